@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gflydev/core"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"github.com/valyala/fasthttp"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+const (
+	// sessionTokenCookie is the cookie holding the session token issued by the login endpoint.
+	sessionTokenCookie = "ws_token"
+
+	// bearerProtocol is the subprotocol announcing a session token in Sec-WebSocket-Protocol.
+	// Browsers cannot set headers on websocket requests, so clients offer the protocols
+	// `bearer, <token>` and the server selects the bearer protocol.
+	bearerProtocol = "bearer"
+)
+
+// Errors of session token verification
+var (
+	errInvalidToken = errors.New("invalid session token")
+	errTokenExpired = errors.New("session token expired")
+	errTokenRevoked = errors.New("session token revoked")
+)
+
+// sessionClaims is the payload of a session token
+type sessionClaims struct {
+	ID        string `json:"jti"`
+	Username  string `json:"sub"`
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// TokenIssuer issues and verifies session tokens. A token is the base64url encoded JSON claims
+// and their HMAC-SHA256 signature, separated by a dot. Revoked tokens are remembered until they
+// expire, in a file if the issuer has one.
+type TokenIssuer struct {
+	secret []byte
+	ttl    time.Duration
+	path   string // The file of the revoked tokens, empty to keep them in memory.
+
+	mu      sync.Mutex
+	revoked map[string]time.Time // map[token ID]expiry
+}
+
+// revokedToken is a revoked token as saved in the file of the revoked tokens
+type revokedToken struct {
+	ID        string `json:"jti"`
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// NewTokenIssuer creates a token issuer.
+//
+// Parameters:
+// - secret ([]byte): The HMAC key signing the tokens.
+// - ttl (time.Duration): The lifetime of issued tokens.
+//
+// Returns:
+// - *TokenIssuer: The token issuer.
+func NewTokenIssuer(secret []byte, ttl time.Duration) *TokenIssuer {
+	return &TokenIssuer{
+		secret:  secret,
+		ttl:     ttl,
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// NewFileTokenIssuer creates a token issuer that saves the revoked tokens to path, loading the
+// tokens revoked before that have not expired.
+//
+// Parameters:
+// - secret ([]byte): The HMAC key signing the tokens.
+// - ttl (time.Duration): The lifetime of issued tokens.
+// - path (string): The file of the revoked tokens.
+//
+// Returns:
+// - *TokenIssuer: The token issuer.
+// - error: The error reading the file; a missing file is no error.
+func NewFileTokenIssuer(secret []byte, ttl time.Duration, path string) (*TokenIssuer, error) {
+	t := NewTokenIssuer(secret, ttl)
+	t.path = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revoked []revokedToken
+	if err := json.Unmarshal(b, &revoked); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, token := range revoked {
+		if expiresAt := time.Unix(token.ExpiresAt, 0); now.Before(expiresAt) {
+			t.revoked[token.ID] = expiresAt
+		}
+	}
+	return t, nil
+}
+
+// Issue creates a session token for a user.
+//
+// Parameters:
+// - username (string): The authenticated user.
+//
+// Returns:
+// - string: The signed token.
+// - time.Time: The time the token expires.
+// - error: An error if no token ID can be generated.
+func (t *TokenIssuer) Issue(username string) (string, time.Time, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(t.ttl).Truncate(time.Second)
+	payload, err := json.Marshal(sessionClaims{
+		ID:        hex.EncodeToString(id),
+		Username:  username,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(t.sign(encoded)), expiresAt, nil
+}
+
+// Verify checks the signature, expiry and revocation of a token and returns its claims
+func (t *TokenIssuer) Verify(token string) (sessionClaims, error) {
+	return t.verify(token, time.Now())
+}
+
+// verify checks a token at the given time
+func (t *TokenIssuer) verify(token string, now time.Time) (sessionClaims, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return sessionClaims{}, errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, t.sign(encoded)) {
+		return sessionClaims{}, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return sessionClaims{}, errInvalidToken
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" || claims.Username == "" {
+		return sessionClaims{}, errInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return sessionClaims{}, errTokenExpired
+	}
+	if t.isRevoked(claims.ID) {
+		return sessionClaims{}, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// isRevoked reports whether the token with the given ID was revoked
+func (t *TokenIssuer) isRevoked(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, revoked := t.revoked[id]
+	return revoked
+}
+
+// Revoke verifies a token and rejects it from now on. The caller closes the connections opened
+// with the token (see closeTokenSessions).
+//
+// Parameters:
+// - token (string): The session token.
+//
+// Returns:
+// - sessionClaims: The claims of the revoked token.
+// - error: The verification error, or the error saving the revoked tokens; the token is not
+// revoked then.
+func (t *TokenIssuer) Revoke(token string) (sessionClaims, error) {
+	claims, err := t.Verify(token)
+	if err != nil {
+		return sessionClaims{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Forget the revoked tokens that expired in the meantime
+	now := time.Now()
+	for id, expiresAt := range t.revoked {
+		if !now.Before(expiresAt) {
+			delete(t.revoked, id)
+		}
+	}
+	t.revoked[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	if err := t.write(); err != nil {
+		delete(t.revoked, claims.ID)
+		return sessionClaims{}, err
+	}
+	return claims, nil
+}
+
+// write saves the revoked tokens to the file of the issuer, if any, replacing it atomically.
+// The caller must hold t.mu.
+func (t *TokenIssuer) write() error {
+	if t.path == "" {
+		return nil
+	}
+	revoked := make([]revokedToken, 0, len(t.revoked))
+	for id, expiresAt := range t.revoked {
+		revoked = append(revoked, revokedToken{ID: id, ExpiresAt: expiresAt.Unix()})
+	}
+	b, err := json.Marshal(revoked)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(t.path), 0o755); err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// sign returns the HMAC-SHA256 signature of the encoded claims
+func (t *TokenIssuer) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// newTokenIssuer creates the token issuer configured by the environment.
+//
+// Logic:
+// 1. Tokens are signed with `WS_TOKEN_SECRET`. Without a secret, a random one is generated and
+// the tokens are invalid once the server restarts.
+// 2. Tokens expire after `WS_TOKEN_TTL` seconds.
+// 3. With a secret, the revoked tokens are saved to `WS_REVOKED_TOKEN_FILE` so that they stay
+// revoked after a restart. Falls back to memory if the file cannot be read.
+func newTokenIssuer() *TokenIssuer {
+	ttl := time.Duration(utils.Getenv[int]("WS_TOKEN_TTL", 86400)) * time.Second
+	secret := []byte(utils.Getenv[string]("WS_TOKEN_SECRET", ""))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Error generating session token secret: %v", err)
+		}
+		log.Warn("WS_TOKEN_SECRET is not set, session tokens are invalid after a restart")
+		return NewTokenIssuer(secret, ttl)
+	}
+
+	path := utils.Getenv[string]("WS_REVOKED_TOKEN_FILE", "storage/revoked_tokens.json")
+	issuer, err := NewFileTokenIssuer(secret, ttl, path)
+	if err != nil {
+		log.Errorf("Error loading revoked tokens from %s, keeping them in memory: %v", path, err)
+		return NewTokenIssuer(secret, ttl)
+	}
+	return issuer
+}
+
+// Global instance of the token issuer
+var tokens = newTokenIssuer()
+
+// Whether upgrades need a session token or a client certificate, rejecting guests
+var authRequired = utils.Getenv[bool]("WS_AUTH_REQUIRED", true)
+
+// sessionToken returns the session token of an upgrade request: the token query parameter, the
+// token following the bearer protocol in Sec-WebSocket-Protocol, or the session cookie. The query
+// parameter is removed from the request (see redactQueryToken).
+//
+// Returns:
+// - string: The token, empty if the request has none.
+// - bool: Whether the token was sent in Sec-WebSocket-Protocol.
+func sessionToken(ctx *fasthttp.RequestCtx) (string, bool) {
+	if token := redactQueryToken(ctx); token != "" {
+		return token, false
+	}
+
+	protocols := strings.Split(string(ctx.Request.Header.Peek("Sec-WebSocket-Protocol")), ",")
+	for i := 0; i+1 < len(protocols); i++ {
+		if strings.TrimSpace(protocols[i]) == bearerProtocol {
+			return strings.TrimSpace(protocols[i+1]), true
+		}
+	}
+
+	return string(ctx.Request.Header.Cookie(sessionTokenCookie)), false
+}
+
+// redactQueryToken removes the token query parameter from the URI of a request and returns it,
+// so that the error and access logs printing the request URI never show the token.
+func redactQueryToken(ctx *fasthttp.RequestCtx) string {
+	args := ctx.QueryArgs()
+	token := string(args.Peek("token"))
+	if !args.Has("token") {
+		return ""
+	}
+	args.Del("token")
+	ctx.Request.Header.SetRequestURIBytes(ctx.URI().RequestURI())
+	return token
+}
+
+// upgradeUser authenticates an upgrade request.
+//
+// Parameters:
+// - ctx: The `fasthttp.RequestCtx` of the upgrade request.
+//
+// Logic:
+// 1. A session token must be valid and belong to a known user. A token sent in
+// Sec-WebSocket-Protocol selects the bearer protocol for the response.
+// 2. Without a token, the user of the client certificate is used (see tlsUsername).
+// 3. Without either, the client connects as a guest only if WS_AUTH_REQUIRED is false.
+//
+// Returns:
+// - string: The authenticated user, empty for guests.
+// - string: The ID of the session token that authenticated the user, empty otherwise.
+// - bool: Whether the upgrade is allowed; false means 401 Unauthorized.
+func upgradeUser(ctx *fasthttp.RequestCtx) (string, string, bool) {
+	token, inProtocol := sessionToken(ctx)
+	if token != "" {
+		claims, err := tokens.Verify(token)
+		if err == nil {
+			if _, ok := GlobalUserStore.GetUser(claims.Username); !ok {
+				err = errInvalidToken
+			}
+		}
+		if err != nil {
+			log.Infof("Rejected upgrade from %s: %v", ctx.RemoteAddr(), err)
+			return "", "", false
+		}
+		if inProtocol {
+			ctx.Response.Header.Set("Sec-WebSocket-Protocol", bearerProtocol)
+		}
+		return claims.Username, claims.ID, true
+	}
+
+	certUser := tlsUsername(ctx.TLSConnectionState())
+	return certUser, "", certUser != "" || !authRequired
+}
+
+// loginWithToken authenticates the client as the user of its session token.
+//
+// Parameters:
+// - username (string): The user of the session token.
+// - tokenID (string): The ID of the session token.
+//
+// Logic:
+// 1. Logs the client in, applying the rate limit of the user's role.
+// 2. Records the token, so that revoking it closes the connection. A token revoked since it was
+// verified closes the connection right away.
+// 3. Queues a successful `user_auth` response so the client knows it is authenticated.
+//
+// Note: The method must be called before readPump starts, from the goroutine that runs it.
+func (c *Client) loginWithToken(username, tokenID string) {
+	c.login(username)
+	c.identityMu.Lock()
+	c.tokenID = tokenID
+	c.identityMu.Unlock()
+	log.Infof("Client %s authenticated as %s by session token", c.id, username)
+	c.sendAuthenticated(username, "Authenticated by session token")
+	if tokens.isRevoked(tokenID) {
+		c.closeAfterSend(CloseAuthFailed, revokedTokenReason)
+	}
+}
+
+// The reason of the close message of connections whose session token is revoked
+var revokedTokenReason = websocket.CloseReason{
+	Reason:  "token_revoked",
+	Message: "the session token was revoked",
+}
+
+// closeTokenSessions closes the connections opened with a revoked session token, with the
+// CloseAuthFailed code.
+//
+// Parameters:
+// - claims (sessionClaims): The claims of the revoked token.
+//
+// Returns:
+// - int: The number of connections closed.
+func (m *Manager) closeTokenSessions(claims sessionClaims) int {
+	var clients []*Client
+	m.sessionsMu.Lock()
+	for client := range m.sessions[claims.Username] {
+		client.identityMu.RLock()
+		if client.tokenID == claims.ID {
+			clients = append(clients, client)
+		}
+		client.identityMu.RUnlock()
+	}
+	m.sessionsMu.Unlock()
+
+	for _, client := range clients {
+		client.closeAfterSend(CloseAuthFailed, revokedTokenReason)
+	}
+	return len(clients)
+}
+
+// sendAuthenticated queues a successful user_auth response for a login at upgrade time
+func (c *Client) sendAuthenticated(username, message string) {
+	response, err := json.Marshal(data.ActionMessage{
+		Metadata: data.Metadata{
+			Version:   "1.0",
+			Timestamp: time.Now(),
+		},
+		Action: data.Action{
+			Type: data.ActionUserAuth,
+			Data: data.UserAuthResponseData{
+				Success:  true,
+				Message:  message,
+				Username: username,
+			},
+		},
+	})
+	if err != nil {
+		log.Errorf("Error marshaling auth response to JSON: %v", err)
+		return
+	}
+	c.send <- response
+}
+
+// ====================================================================
+// ========================== Login endpoints =========================
+// ====================================================================
+
+// serveLogin issues a session token for valid credentials.
+//
+// Parameters:
+// - ctx: The `fasthttp.RequestCtx` of a POST request with a JSON data.UserAuthData body.
+//
+// Logic:
+// 1. Responds 400 Bad Request to a malformed body.
+// 2. Responds 429 Too Many Requests, with Retry-After, once the client IP has used its login
+// attempts for the username or for all usernames (see loginThrottle).
+// 3. Responds 401 Unauthorized to invalid credentials.
+// 4. Responds data.SessionToken and sets the session cookie, so browsers send the token when
+// they open the websocket.
+func serveLogin(ctx *fasthttp.RequestCtx) {
+	var credentials data.UserAuthData
+	if err := json.Unmarshal(ctx.PostBody(), &credentials); err != nil {
+		writeJSONError(ctx, fasthttp.StatusBadRequest, "invalid login request")
+		return
+	}
+	if wait := loginLimits.allow(ctx.RemoteIP().String(), credentials.Username); wait > 0 {
+		log.Infof("Throttled login of %q from %s", credentials.Username, ctx.RemoteAddr())
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeJSONError(ctx, fasthttp.StatusTooManyRequests, "too many login attempts")
+		return
+	}
+	if !GlobalUserStore.Authenticate(credentials.Username, credentials.Password) {
+		log.Infof("Failed login of %q from %s", credentials.Username, ctx.RemoteAddr())
+		writeJSONError(ctx, fasthttp.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	token, expiresAt, err := tokens.Issue(credentials.Username)
+	if err != nil {
+		log.Errorf("Error issuing session token: %v", err)
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, "could not issue session token")
+		return
+	}
+	log.Infof("Issued session token for %s", credentials.Username)
+
+	cookie := fasthttp.AcquireCookie()
+	defer fasthttp.ReleaseCookie(cookie)
+	cookie.SetKey(sessionTokenCookie)
+	cookie.SetValue(token)
+	cookie.SetPath("/")
+	cookie.SetExpire(expiresAt)
+	cookie.SetHTTPOnly(true)
+	cookie.SetSecure(ctx.IsTLS())
+	cookie.SetSameSite(fasthttp.CookieSameSiteStrictMode)
+	ctx.Response.Header.SetCookie(cookie)
+
+	writeJSON(ctx, fasthttp.StatusOK, data.SessionToken{
+		Token:     token,
+		Username:  credentials.Username,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// serveLogout revokes the session token of the `Authorization: Bearer` header or the session
+// cookie and closes the connections opened with it. It responds 204 No Content, 401
+// Unauthorized if the token is invalid, or 500 Internal Server Error if the revocation cannot be
+// saved.
+func serveLogout(ctx *fasthttp.RequestCtx) {
+	token := string(ctx.Request.Header.Cookie(sessionTokenCookie))
+	if bearer, ok := bytes.CutPrefix(ctx.Request.Header.Peek("Authorization"), []byte("Bearer ")); ok {
+		token = string(bearer)
+	}
+	claims, err := tokens.Revoke(token)
+	switch {
+	case errors.Is(err, errInvalidToken), errors.Is(err, errTokenExpired), errors.Is(err, errTokenRevoked):
+		writeJSONError(ctx, fasthttp.StatusUnauthorized, err.Error())
+		return
+	case err != nil:
+		log.Errorf("Error saving revoked session token: %v", err)
+		writeJSONError(ctx, fasthttp.StatusInternalServerError, "could not revoke session token")
+		return
+	}
+	if n := manager.closeTokenSessions(claims); n > 0 {
+		log.Infof("Closing %d connections of %s opened with a revoked session token", n, claims.Username)
+	}
+
+	ctx.Response.Header.DelClientCookie(sessionTokenCookie)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// writeJSON sends a JSON response
+func writeJSON(ctx *fasthttp.RequestCtx, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Error marshaling response to JSON: %v", err)
+		ctx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// writeJSONError sends an error message as a JSON response
+func writeJSONError(ctx *fasthttp.RequestCtx, status int, message string) {
+	writeJSON(ctx, status, map[string]string{"error": message})
+}
+
+// NewLoginHandler As a constructor to create the login handler.
+func NewLoginHandler() *LoginHandler {
+	return &LoginHandler{}
+}
+
+type LoginHandler struct {
+	core.Api
+}
+
+func (h *LoginHandler) Handle(c *core.Ctx) error {
+	serveLogin(c.Root())
+
+	return nil
+}
+
+// NewLogoutHandler As a constructor to create the logout handler.
+func NewLogoutHandler() *LogoutHandler {
+	return &LogoutHandler{}
+}
+
+type LogoutHandler struct {
+	core.Api
+}
+
+func (h *LogoutHandler) Handle(c *core.Ctx) error {
+	serveLogout(c.Root())
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestTokenIssuer(t *testing.T) {
+	issuer := NewTokenIssuer([]byte("secret"), time.Hour)
+	token, expiresAt, err := issuer.Issue("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := issuer.Verify(token)
+	if err != nil || claims.Username != "alice" || claims.ExpiresAt != expiresAt.Unix() {
+		t.Fatalf("Verify = %+v, %v", claims, err)
+	}
+
+	// Tokens of another secret, altered tokens and garbage are invalid.
+	other, _, _ := NewTokenIssuer([]byte("other"), time.Hour).Issue("alice")
+	forged, _, _ := issuer.Issue("bob")
+	forged = strings.SplitN(forged, ".", 2)[0] + "." + strings.SplitN(token, ".", 2)[1]
+	for _, invalid := range []string{other, forged, token + "x", "", "garbage"} {
+		if _, err := issuer.Verify(invalid); err != errInvalidToken {
+			t.Errorf("Verify(%q) = %v, want %v", invalid, err, errInvalidToken)
+		}
+	}
+	if _, err := issuer.verify(token, expiresAt); err != errTokenExpired {
+		t.Errorf("verify at expiry = %v, want %v", err, errTokenExpired)
+	}
+
+	// A revoked token is rejected; other tokens of the user are not.
+	second, _, _ := issuer.Issue("alice")
+	if revoked, err := issuer.Revoke(token); err != nil || revoked != claims {
+		t.Fatalf("Revoke = %+v, %v", revoked, err)
+	}
+	if _, err := issuer.Verify(token); err != errTokenRevoked {
+		t.Errorf("Verify revoked token = %v, want %v", err, errTokenRevoked)
+	}
+	if _, err := issuer.Revoke(token); err != errTokenRevoked {
+		t.Errorf("Revoke revoked token = %v, want %v", err, errTokenRevoked)
+	}
+	if _, err := issuer.Verify(second); err != nil {
+		t.Errorf("Verify other token = %v", err)
+	}
+}
+
+func TestFileTokenIssuer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	issuer, err := NewFileTokenIssuer([]byte("secret"), time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, _ := issuer.Issue("alice")
+	other, _, _ := issuer.Issue("alice")
+	if _, err := issuer.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// The revocation survives a restart.
+	restarted, err := NewFileTokenIssuer([]byte("secret"), time.Hour, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Verify(token); err != errTokenRevoked {
+		t.Errorf("Verify revoked token after restart = %v, want %v", err, errTokenRevoked)
+	}
+	if _, err := restarted.Verify(other); err != nil {
+		t.Errorf("Verify other token after restart = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("revoked tokens file: %v, %v", info, err)
+	}
+
+	// A token whose revocation cannot be saved stays valid.
+	os.Remove(path)
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.Revoke(other); err == nil {
+		t.Errorf("Revoke saved to a directory")
+	}
+	if _, err := restarted.Verify(other); err != nil {
+		t.Errorf("Verify token after a failed revocation = %v", err)
+	}
+}
+
+func TestTokenUpgrade(t *testing.T) {
+	addr := startTestServer(t)
+	t.Cleanup(http.DefaultClient.CloseIdleConnections) // lets the server shut down
+	base := "http://" + addr
+	wsURL := "ws://" + addr + "/ws"
+
+	login := func(username, password string) *http.Response {
+		t.Helper()
+		body, _ := json.Marshal(data.UserAuthData{Username: username, Password: password})
+		resp, err := http.Post(base+"/auth/login", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := login("user1", "wrong")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status %d", resp.StatusCode)
+	}
+
+	resp = login("user1", "password1")
+	var session data.SessionToken
+	err := json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || session.Username != "user1" || session.Token == "" {
+		t.Fatalf("login: status %d, %+v, %v", resp.StatusCode, session, err)
+	}
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionTokenCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != session.Token || !cookie.HttpOnly {
+		t.Fatalf("session cookie = %+v", cookie)
+	}
+
+	// The token authenticates the upgrade from the query, the subprotocols or the cookie.
+	var conns []*websocket.Conn
+	for name, tt := range map[string]struct {
+		url       string
+		header    http.Header
+		protocols []string
+	}{
+		"query":    {url: wsURL + "?token=" + session.Token, header: http.Header{}},
+		"protocol": {url: wsURL, header: http.Header{}, protocols: []string{bearerProtocol, session.Token}},
+		"cookie":   {url: wsURL, header: http.Header{"Cookie": {cookie.String()}}},
+	} {
+		c, resp, err := dialTestServer(t, tt.url, tt.header, tt.protocols...)
+		if err != nil {
+			t.Errorf("%s: Dial: %v", name, err)
+			continue
+		}
+		if tt.protocols != nil && resp.Header.Get("Sec-WebSocket-Protocol") != bearerProtocol {
+			t.Errorf("%s: selected protocol %q", name, resp.Header.Get("Sec-WebSocket-Protocol"))
+		}
+		if auth, ok := readAuthResponse(t, c, 5*time.Second); !ok || !auth.Success || auth.Username != "user1" {
+			t.Errorf("%s: auth response = %+v, %v", name, auth, ok)
+		}
+		conns = append(conns, c)
+	}
+
+	// Invalid and revoked tokens are rejected before the upgrade.
+	if _, resp, err := dialTestServer(t, wsURL, nil, bearerProtocol, "garbage"); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Dial with an invalid token: %v, want status 401", err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, base+"/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+session.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("logout: status %d", resp.StatusCode)
+	}
+	for _, c := range conns {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err = c.ReadMessage(); err != nil {
+				break
+			}
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != CloseAuthFailed {
+			t.Errorf("read error after logout = %v, want close %d", err, CloseAuthFailed)
+		}
+	}
+	if _, resp, err := dialTestServer(t, wsURL, nil, bearerProtocol, session.Token); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Dial with a revoked token: %v, want status 401", err)
+	}
+}
+
+func TestSessionTokenRedacted(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.SetRequestURI("/ws?token=secret-token&channel=general")
+	if token, inProtocol := sessionToken(&ctx); token != "secret-token" || inProtocol {
+		t.Errorf("sessionToken = %q, %v", token, inProtocol)
+	}
+
+	// The token is gone from everything that prints the request; other parameters are kept.
+	for name, s := range map[string]string{
+		"URI":        string(ctx.URI().FullURI()),
+		"RequestURI": string(ctx.RequestURI()),
+		"String":     ctx.String(),
+	} {
+		if strings.Contains(s, "secret-token") || !strings.Contains(s, "channel=general") {
+			t.Errorf("%s = %q", name, s)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	l := newLoginThrottle(60, 2, 60, 3)
+	if l.allow("10.0.0.1", "alice") != 0 || l.allow("10.0.0.1", "alice") != 0 {
+		t.Fatal("attempts within the burst throttled")
+	}
+	if wait := l.allow("10.0.0.1", "alice"); wait <= 0 || wait > time.Second {
+		t.Errorf("third attempt for a user from an IP: wait %v, want up to 1s", wait)
+	}
+
+	// Attempts for a user from other IPs do not lock the user out.
+	l.allow("10.0.0.2", "alice")
+	l.allow("10.0.0.2", "alice")
+	if wait := l.allow("10.0.0.3", "alice"); wait != 0 {
+		t.Errorf("attempt for a user from another IP: wait %v", wait)
+	}
+
+	// The IP limit applies across usernames. Refused attempts take nothing from either bucket:
+	// the third attempt for alice left an attempt for bob.
+	if l.allow("10.0.0.1", "bob") != 0 {
+		t.Fatal("attempt for another user throttled")
+	}
+	if wait := l.allow("10.0.0.1", "carol"); wait <= 0 {
+		t.Error("fourth attempt from an IP: not throttled")
+	}
+	l = newLoginThrottle(60, 2, 60, 1)
+	l.allow("10.0.0.1", "alice")
+	if wait := l.allow("10.0.0.1", "alice"); wait <= 0 {
+		t.Error("second attempt from an IP: not throttled")
+	}
+	if l.buckets["user:10.0.0.1/alice"].Wait(time.Now()) != 0 {
+		t.Error("attempt refused by the IP limit counted against the user")
+	}
+
+	if newLoginThrottle(0, 0, 0, 0).allow("10.0.0.1", "alice") != 0 {
+		t.Errorf("disabled throttle throttled")
+	}
+}
+
+func TestLoginThrottled(t *testing.T) {
+	limits := loginLimits
+	loginLimits = newLoginThrottle(1, 1, 0, 0)
+	t.Cleanup(func() { loginLimits = limits })
+	base := "http://" + startTestServer(t)
+	t.Cleanup(http.DefaultClient.CloseIdleConnections)
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		resp, err := http.Post(base+"/auth/login", "application/json", strings.NewReader(`{"username":"user1","password":"wrong"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("attempt %d: status %d, want %d", i, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Errorf("attempt %d: no Retry-After", i)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"ws/data"
+	"ws/websocket"
+)
+
+// redactedPassword replaces the password of user_auth requests in captures.
+const redactedPassword = "[redacted]"
+
+// startCapture records the messages of a connection to a capture file when `WS_CAPTURE_DIR` is set.
+//
+// Parameters:
+// - conn (*websocket.Conn): The websocket connection.
+// - clientID (string): The client ID, used to name the capture file.
+//
+// Logic:
+// 1. Returns a no-op function if `WS_CAPTURE_DIR` is empty.
+// 2. Creates `<WS_CAPTURE_DIR>/<clientID>.wscap`, replacing characters unsafe in file names.
+//   - Captures hold message content, so the file is only readable by the server's user.
+//
+// 3. Enables the capture on the connection, redacting passwords (see redactCapture). Captures
+// hold messages only, not the upgrade request and its session token. Replay the file with
+// `go run ./cmd/wsreplay`.
+//
+// Returns:
+// - func(): Stops the capture and closes the file. Call it after the connection is done.
+func startCapture(conn *websocket.Conn, clientID string) func() {
+	dir := utils.Getenv[string]("WS_CAPTURE_DIR", "")
+	if dir == "" {
+		return func() {}
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Errorf("Error creating capture directory %s: %v", dir, err)
+		return func() {}
+	}
+
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, clientID)
+	path := filepath.Join(dir, name+".wscap")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		log.Errorf("Error creating capture file %s: %v", path, err)
+		return func() {}
+	}
+
+	w := websocket.NewCaptureWriter(f)
+	w.Redact = redactCapture
+	conn.SetCapture(w)
+	log.Infof("Capturing client %s to %s", clientID, path)
+
+	return func() {
+		conn.SetCapture(nil)
+		if err := w.Flush(); err != nil {
+			log.Errorf("Error writing capture file %s: %v", path, err)
+		}
+		_ = f.Close()
+	}
+}
+
+// redactCapture replaces the password of captured user_auth requests with redactedPassword.
+//
+// Parameters:
+// - rec (websocket.CaptureRecord): The captured message.
+//
+// Logic:
+// 1. Inspects inbound messages; binary messages are decompressed with the dictionary of browser
+// clients first (see writeMessage).
+// 2. Rewrites user_auth requests as text messages with the password redacted.
+// 3. Skips messages that mention user_auth but cannot be parsed, as they may hold a password.
+//
+// Returns:
+// - websocket.CaptureRecord: The record to write.
+// - bool: false if the record is skipped.
+func redactCapture(rec websocket.CaptureRecord) (websocket.CaptureRecord, bool) {
+	if rec.Direction != websocket.CaptureInbound {
+		return rec, true
+	}
+	text := rec.Data
+	if rec.MessageType == websocket.BinaryMessage && compressionDictionary != nil {
+		decompressed, err := compressionDictionary.Decompress(rec.Data, maxMessageSize)
+		if err != nil {
+			return rec, true
+		}
+		text = decompressed
+	}
+	if !bytes.Contains(text, []byte(data.ActionUserAuth)) {
+		return rec, true
+	}
+
+	var actionMsg data.ActionMessage
+	if err := json.Unmarshal(text, &actionMsg); err != nil {
+		return rec, false
+	}
+	if actionMsg.Action.Type != data.ActionUserAuth {
+		return rec, true
+	}
+	authData, _ := actionMsg.Action.Data.(map[string]interface{})
+	actionMsg.Action.Data = map[string]interface{}{
+		"username": authData["username"],
+		"password": redactedPassword,
+	}
+	redacted, err := json.Marshal(actionMsg)
+	if err != nil {
+		return rec, false
+	}
+	rec.MessageType = websocket.TextMessage
+	rec.Data = redacted
+	return rec, true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+func TestStartCaptureFileMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "captures")
+	t.Setenv("WS_CAPTURE_DIR", dir)
+
+	stop := startCapture(nil, "127.0.0.1:1234-now")
+	stop()
+	info, err := os.Stat(filepath.Join(dir, "127.0.0.1_1234-now.wscap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("capture file mode = %v, want 0600", mode)
+	}
+}
+
+func TestRedactCapture(t *testing.T) {
+	auth, _ := json.Marshal(data.ActionMessage{Action: data.Action{
+		Type: data.ActionUserAuth,
+		Data: data.UserAuthData{Username: "alice", Password: "hunter2"},
+	}})
+	record := func(direction websocket.CaptureDirection, messageType int, p []byte) websocket.CaptureRecord {
+		return websocket.CaptureRecord{Time: time.Now(), Direction: direction, MessageType: messageType, Data: p}
+	}
+
+	rec, ok := redactCapture(record(websocket.CaptureInbound, websocket.TextMessage, auth))
+	if !ok || bytes.Contains(rec.Data, []byte("hunter2")) || !bytes.Contains(rec.Data, []byte(redactedPassword)) || !bytes.Contains(rec.Data, []byte("alice")) {
+		t.Errorf("redacted user_auth = %s, %v", rec.Data, ok)
+	}
+	if _, ok := redactCapture(record(websocket.CaptureInbound, websocket.TextMessage, []byte(`{"action":{"type":"user_auth","data":{"password":"hunter2"`))); ok {
+		t.Errorf("malformed user_auth was not skipped")
+	}
+	for _, rec := range []websocket.CaptureRecord{
+		record(websocket.CaptureInbound, websocket.TextMessage, []byte("hello")),
+		record(websocket.CaptureOutbound, websocket.TextMessage, []byte(`{"action":{"type":"user_auth"`)),
+	} {
+		if got, ok := redactCapture(rec); !ok || !bytes.Equal(got.Data, rec.Data) {
+			t.Errorf("redactCapture(%s) = %s, %v, want unchanged", rec.Data, got.Data, ok)
+		}
+	}
+
+	// Requests of browser clients compressed with the dictionary are redacted too.
+	compressionDictionary = websocket.NewCompressionDictionary([]byte(`{"action":{"type":"user_auth"}}`))
+	defer func() { compressionDictionary = nil }()
+	compressed, err := compressionDictionary.Compress(auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, ok = redactCapture(record(websocket.CaptureInbound, websocket.BinaryMessage, compressed))
+	if !ok || rec.MessageType != websocket.TextMessage || bytes.Contains(rec.Data, []byte("hunter2")) {
+		t.Errorf("redacted compressed user_auth = %d %s, %v", rec.MessageType, rec.Data, ok)
+	}
+}
@@ -4,4 +4,19 @@ echo "creating server.key"
 openssl genrsa -out server.key 2048
 openssl ecparam -genkey -name secp384r1 -out server.key
 echo "creating server.crt"
-openssl req -new -x509 -sha256 -key server.key -out server.crt -batch -days 3650
\ No newline at end of file
+openssl req -new -x509 -sha256 -key server.key -out server.crt -batch -days 3650
+
+# Client certificates for mutual TLS (WS_TLS_CLIENT_CA=certs/ca.crt). The common name of a
+# client certificate is the username it authenticates as, e.g. `./certgen.sh user1`.
+if [ -n "$1" ]; then
+  if [ ! -f ca.key ]; then
+    echo "creating ca.key and ca.crt"
+    openssl ecparam -genkey -name secp384r1 -out ca.key
+    openssl req -new -x509 -sha256 -key ca.key -out ca.crt -subj "/CN=ws client CA" -days 3650
+  fi
+  echo "creating client-$1.key and client-$1.crt"
+  openssl ecparam -genkey -name secp384r1 -out "client-$1.key"
+  openssl req -new -sha256 -key "client-$1.key" -subj "/CN=$1" -out "client-$1.csr"
+  openssl x509 -req -sha256 -in "client-$1.csr" -CA ca.crt -CAkey ca.key -CAcreateserial -out "client-$1.crt" -days 365
+  rm "client-$1.csr"
+fi
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"ws/data"
+)
+
+// Error code of a channel creation with the ID of an existing channel.
+const errCodeConflict = "conflict"
+
+// The number of channels a user other than an admin may own, from WS_CHANNELS_PER_USER; 0
+// allows any number.
+var channelQuota = utils.Getenv[int]("WS_CHANNELS_PER_USER", 10)
+
+// canSeeChannel reports whether a group channel is listed to the client: public channels are
+// listed to everybody, private channels to admins and to their authenticated owner and
+// participants. Direct channels are listed separately.
+func (c *Client) canSeeChannel(channel data.Channel) bool {
+	if channel.Type == data.ChannelTypeDirect {
+		return false
+	}
+	if channel.Visibility != data.VisibilityPrivate || c.isAdmin() {
+		return true
+	}
+	username, authenticated := c.identity()
+	return authenticated && (channel.OwnerID == username || isParticipant(channel, username))
+}
+
+// handleListChannels sends the channels visible to the client.
+//
+// Logic:
+// 1. Lists the default channel and the channels of the channel store, oldest first.
+// 2. Leaves out the private channels the client does not own or participate in, unless the
+// client is an admin.
+// 3. Lists the direct channels of an authenticated client separately.
+func (c *Client) handleListChannels() {
+	channels := make([]data.Channel, 0)
+	for _, channel := range manager.Channels() {
+		if c.canSeeChannel(channel) {
+			channels = append(channels, channel)
+		}
+	}
+
+	direct := make([]data.Channel, 0)
+	if c.authenticated {
+		direct = manager.directChannels(c.username)
+	}
+
+	c.sendAction(data.Action{
+		Type: data.ActionListChannels,
+		Data: data.ChannelListData{
+			Channels:       channels,
+			DirectChannels: direct,
+		},
+	})
+}
+
+// handleCreateChannel creates a channel owned by the client.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The create_channel action.
+//
+// Logic:
+// 1. Rejects guests: channels are owned by the username of an authenticated client.
+// 2. Decodes data.ChannelCreateData and rejects channels without ID or with the prefix of direct
+// channels, with an unknown type or visibility, or with the ID of a saved channel or running hub.
+// 3. Saves the channel with the client as owner, unless the client owns channelQuota channels
+// and is not an admin.
+// 4. Sends the saved channel to the client.
+func (c *Client) handleCreateChannel(actionMsg data.ActionMessage) {
+	var createData data.ChannelCreateData
+	if err := decodeActionData(actionMsg.Action.Data, &createData); err != nil || createData.Channel.ID == "" {
+		c.sendError(data.ActionCreateChannel, errCodeInvalidRequest, "channel.id is required")
+		return
+	}
+	username, authenticated := c.identity()
+	if !authenticated {
+		c.sendError(data.ActionCreateChannel, errCodeForbidden, "authentication required")
+		return
+	}
+	channel := createData.Channel
+	if isDirectChannel(channel.ID) {
+		c.sendError(data.ActionCreateChannel, errCodeInvalidRequest, "channel.id must not start with "+directChannelPrefix)
+		return
+	}
+	if channel.Type != "" && channel.Type != data.ChannelTypeGroup {
+		c.sendError(data.ActionCreateChannel, errCodeInvalidRequest, "type must be group")
+		return
+	}
+	if channel.Visibility != "" && channel.Visibility != data.VisibilityPublic && channel.Visibility != data.VisibilityPrivate {
+		c.sendError(data.ActionCreateChannel, errCodeInvalidRequest, "visibility must be public or private")
+		return
+	}
+
+	quota := channelQuota
+	if c.isAdmin() {
+		quota = 0
+	}
+	channel.OwnerID = username
+	_, err := manager.CreateChannel(channel, quota)
+	switch {
+	case errors.Is(err, ErrChannelExists):
+		c.sendError(data.ActionCreateChannel, errCodeConflict, "channel "+channel.ID+" already exists")
+		return
+	case errors.Is(err, ErrChannelQuota):
+		c.sendError(data.ActionCreateChannel, errCodeForbidden, fmt.Sprintf("a user may own at most %d channels", quota))
+		return
+	case err != nil:
+		log.Errorf("Error saving channel %s: %v", channel.ID, err)
+		c.sendError(data.ActionCreateChannel, errCodeInternal, "the channel could not be saved")
+		return
+	}
+	log.Infof("Client %s created channel %s", c.id, channel.ID)
+
+	saved, _ := manager.Channel(channel.ID)
+	c.sendAction(data.Action{
+		Type: data.ActionCreateChannel,
+		Data: data.ChannelCreateData{
+			Channel: saved,
+		},
+	})
+}
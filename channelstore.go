@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"ws/data"
+)
+
+// ErrChannelNotFound is returned by ChannelStore.Delete for an unknown channel
+var ErrChannelNotFound = errors.New("channel not found")
+
+// ChannelStore defines the interface for channel definition storage
+type ChannelStore interface {
+	// Save adds a channel or replaces the channel with the same ID
+	Save(channel data.Channel) error
+
+	// Get retrieves a channel by ID
+	Get(id string) (data.Channel, bool)
+
+	// Delete removes a channel
+	Delete(id string) error
+
+	// List returns all channels sorted by creation time
+	List() []data.Channel
+}
+
+// InMemoryChannelStore implements ChannelStore with an in-memory map
+type InMemoryChannelStore struct {
+	channels map[string]data.Channel // map[id]channel
+	mu       sync.RWMutex
+}
+
+// NewInMemoryChannelStore creates a new in-memory channel store
+func NewInMemoryChannelStore() *InMemoryChannelStore {
+	return &InMemoryChannelStore{
+		channels: make(map[string]data.Channel),
+	}
+}
+
+// Save adds a channel or replaces the channel with the same ID
+func (s *InMemoryChannelStore) Save(channel data.Channel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels[channel.ID] = channel
+	return nil
+}
+
+// Get retrieves a channel by ID
+func (s *InMemoryChannelStore) Get(id string) (data.Channel, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	channel, ok := s.channels[id]
+	return channel, ok
+}
+
+// Delete removes a channel
+func (s *InMemoryChannelStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.channels[id]; !ok {
+		return ErrChannelNotFound
+	}
+	delete(s.channels, id)
+	return nil
+}
+
+// List returns all channels sorted by creation time
+func (s *InMemoryChannelStore) List() []data.Channel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	channels := make([]data.Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if !channels[i].CreatedAt.Equal(channels[j].CreatedAt) {
+			return channels[i].CreatedAt.Before(channels[j].CreatedAt)
+		}
+		return channels[i].ID < channels[j].ID
+	})
+	return channels
+}
+
+// FileChannelStore implements ChannelStore with a JSON file. The channels are kept in memory
+// and the file is rewritten on every change.
+type FileChannelStore struct {
+	InMemoryChannelStore
+	path string
+	fmu  sync.Mutex // serializes writes of the file
+}
+
+// NewFileChannelStore creates a channel store saved to path, loading the channels saved before
+func NewFileChannelStore(path string) (*FileChannelStore, error) {
+	store := &FileChannelStore{
+		InMemoryChannelStore: *NewInMemoryChannelStore(),
+		path:                 path,
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var channels []data.Channel
+	if err := json.Unmarshal(b, &channels); err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		store.channels[channel.ID] = channel
+	}
+	return store, nil
+}
+
+// Save adds a channel or replaces the channel with the same ID
+func (s *FileChannelStore) Save(channel data.Channel) error {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+
+	previous, existed := s.InMemoryChannelStore.Get(channel.ID)
+	_ = s.InMemoryChannelStore.Save(channel)
+	if err := s.write(); err != nil {
+		if existed {
+			_ = s.InMemoryChannelStore.Save(previous)
+		} else {
+			_ = s.InMemoryChannelStore.Delete(channel.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a channel
+func (s *FileChannelStore) Delete(id string) error {
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+
+	previous, existed := s.InMemoryChannelStore.Get(id)
+	if !existed {
+		return ErrChannelNotFound
+	}
+	_ = s.InMemoryChannelStore.Delete(id)
+	if err := s.write(); err != nil {
+		_ = s.InMemoryChannelStore.Save(previous)
+		return err
+	}
+	return nil
+}
+
+// write saves the channels to the file. The file is replaced atomically so that a crash
+// never leaves a partial file. The caller must hold s.fmu.
+func (s *FileChannelStore) write() error {
+	b, err := json.MarshalIndent(s.List(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// newChannelStore creates the channel store configured by the environment.
+//
+// Logic:
+// 1. `WS_CHANNEL_STORE=file` (default) saves the channels to `WS_CHANNEL_FILE`.
+// 2. `WS_CHANNEL_STORE=memory` forgets the channels when the server stops.
+//
+// Returns:
+// - ChannelStore: The channel store. Falls back to memory if the file cannot be read.
+func newChannelStore() ChannelStore {
+	if utils.Getenv[string]("WS_CHANNEL_STORE", "file") == "file" {
+		path := utils.Getenv[string]("WS_CHANNEL_FILE", "storage/channels.json")
+		store, err := NewFileChannelStore(path)
+		if err == nil {
+			return store
+		}
+		log.Errorf("Error loading channels from %s, keeping channels in memory: %v", path, err)
+	}
+	return NewInMemoryChannelStore()
+}
+
+// Global instance of the channel store
+var GlobalChannelStore = newChannelStore()
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ws/data"
+)
+
+func TestFileChannelStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "channels.json")
+	store, err := NewFileChannelStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels := store.List(); len(channels) != 0 {
+		t.Fatalf("new store lists %+v", channels)
+	}
+
+	created := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"random", "go"} {
+		err := store.Save(data.Channel{
+			ID:         id,
+			Name:       "#" + id,
+			Type:       data.ChannelTypeGroup,
+			OwnerID:    "alice",
+			Topic:      "all about " + id,
+			Visibility: data.VisibilityPublic,
+			CreatedAt:  created.Add(time.Duration(i) * time.Hour),
+			UpdatedAt:  created.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("save %s: %v", id, err)
+		}
+	}
+	channel, _ := store.Get("go")
+	channel.Topic = "gophers"
+	if err := store.Save(channel); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("unknown"); !errors.Is(err, ErrChannelNotFound) {
+		t.Errorf("delete of unknown channel: %v, want %v", err, ErrChannelNotFound)
+	}
+
+	reloaded, err := NewFileChannelStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels := reloaded.List()
+	if len(channels) != 2 || channels[0].ID != "random" || channels[1].ID != "go" {
+		t.Fatalf("reloaded channels = %+v, want random and go in creation order", channels)
+	}
+	if c := channels[1]; c.Topic != "gophers" || c.Name != "#go" || c.OwnerID != "alice" || !c.CreatedAt.Equal(created.Add(time.Hour)) {
+		t.Errorf("reloaded go = %+v", c)
+	}
+
+	if err := reloaded.Delete("random"); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = NewFileChannelStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Get("random"); ok {
+		t.Errorf("deleted channel was reloaded")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileChannelStore(path); err == nil {
+		t.Errorf("corrupt file loaded without error")
+	}
+}
+
+func TestHandleCreateAndListChannels(t *testing.T) {
+	channels := manager.channels
+	manager.channels = NewInMemoryChannelStore()
+	defer func() { manager.channels = channels }()
+
+	alice := newTestClient(newTestHub("test"), "alice", data.RoleUser)
+	bob := newTestClient(newTestHub("test"), "bob", data.RoleUser)
+	action := func(c *Client, actionType data.ActionType, actionData any) {
+		c.handleAction(data.ActionMessage{Action: data.Action{Type: actionType, Data: actionData}})
+	}
+
+	action(alice, data.ActionCreateChannel, map[string]interface{}{"channel": map[string]interface{}{
+		"id": "test-secret", "topic": "plans", "visibility": data.VisibilityPrivate, "owner_id": "mallory",
+	}})
+	var created data.ChannelCreateData
+	if typ := decodeAction(t, <-alice.send, &created); typ != data.ActionCreateChannel {
+		t.Fatalf("response type = %s", typ)
+	}
+	if c := created.Channel; c.ID != "test-secret" || c.Name != "test-secret" || c.OwnerID != "alice" ||
+		c.Type != data.ChannelTypeGroup || c.Topic != "plans" || c.CreatedAt.IsZero() {
+		t.Errorf("created channel = %+v", c)
+	}
+	defer manager.DeleteHub("test-secret")
+
+	var errData data.ErrorData
+	action(bob, data.ActionCreateChannel, map[string]interface{}{"channel": map[string]interface{}{"id": "test-secret"}})
+	if typ := decodeAction(t, <-bob.send, &errData); typ != data.ActionError || errData.Code != errCodeConflict {
+		t.Fatalf("response = %s %+v, want conflict error", typ, errData)
+	}
+	action(bob, data.ActionCreateChannel, map[string]interface{}{"channel": map[string]interface{}{"id": "x", "visibility": "hidden"}})
+	if typ := decodeAction(t, <-bob.send, &errData); typ != data.ActionError || errData.Code != errCodeInvalidRequest {
+		t.Fatalf("response = %s %+v, want invalid_request error", typ, errData)
+	}
+
+	// Guests cannot own channels, nor see private channels owned by their connection ID.
+	guest := newTestClient(newTestHub("test"), "guest", data.RoleGuest)
+	guest.authenticated = false
+	action(guest, data.ActionCreateChannel, map[string]interface{}{"channel": map[string]interface{}{"id": "test-guest"}})
+	if typ := decodeAction(t, <-guest.send, &errData); typ != data.ActionError || errData.Code != errCodeForbidden {
+		t.Fatalf("response = %s %+v, want forbidden error", typ, errData)
+	}
+	if guest.canSeeChannel(data.Channel{ID: "test-guest", OwnerID: guest.senderID(), Visibility: data.VisibilityPrivate}) {
+		t.Error("guest sees a private channel owned by its connection ID")
+	}
+
+	// The private channel is only listed to its owner.
+	for _, tt := range []struct {
+		client *Client
+		want   bool
+	}{{alice, true}, {bob, false}} {
+		action(tt.client, data.ActionListChannels, nil)
+		var list data.ChannelListData
+		if typ := decodeAction(t, <-tt.client.send, &list); typ != data.ActionListChannels || len(list.Channels) == 0 {
+			t.Fatalf("%s: list = %s %+v", tt.client.username, typ, list.Channels)
+		}
+		if list.Channels[0].ID != DefaultHubID {
+			t.Errorf("%s: first channel = %+v, want the default channel", tt.client.username, list.Channels[0])
+		}
+		listed := false
+		for _, channel := range list.Channels {
+			listed = listed || channel.ID == "test-secret"
+		}
+		if listed != tt.want {
+			t.Errorf("%s: private channel listed = %v, want %v", tt.client.username, listed, tt.want)
+		}
+	}
+}
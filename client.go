@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/gflydev/core/log"
+	"sync"
 	"time"
 	"ws/data"
 	"ws/websocket"
@@ -32,14 +33,39 @@ var (
 
 // Client is an intermediary between the websocket connection and the hub.
 type Client struct {
+	// The active channel, where actions without channel go.
 	hub *Hub
 
+	// The channels the client is subscribed to, by channel ID, the active channel included.
+	hubs map[string]*Hub
+
+	// The user whose sessions the client is recorded in, empty if none; see addSession.
+	session string
+
+	// Guards hub, hubs and session; other clients subscribe the client to the direct channels they open
+	// and remove it from the channels it is kicked from.
+	mu sync.Mutex
+
 	// The websocket connection.
 	conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
 	send chan []byte
 
+	// Closed when a hub drops the client because its send buffer is full.
+	slow     chan struct{}
+	slowOnce sync.Once
+
+	// Closed when readPump returns, to stop writePump.
+	closed chan struct{}
+
+	// Receives the close message writePump sends after the queued messages; see closeAfterSend.
+	closing chan closeMessage
+
+	// The dictionary a browser client compresses its messages with above the websocket layer,
+	// or nil; see writeMessage.
+	dictionary *websocket.CompressionDictionary
+
 	// Client ID for tracking across channel switches
 	id string
 
@@ -48,6 +74,17 @@ type Client struct {
 
 	// Authentication status
 	authenticated bool
+
+	// Role of the authenticated user (see data.RoleUser, data.RoleAdmin)
+	role string
+
+	// ID of the session token the client authenticated with, empty if it logged in otherwise.
+	tokenID string
+
+	// Guards username, authenticated, role and tokenID. readPump writes them on login; other goroutines,
+	// hubs included, read them through identity and senderID. It is not mu: subscribe holds mu
+	// while the hub registers the client.
+	identityMu sync.RWMutex
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -63,11 +100,14 @@ type Client struct {
 //
 // Logic:
 // 1. A deferred function is executed at the end of the method:
-//   - Sends the client instance to the hub's unregister channel to remove it from the active client list.
-//   - Closes the websocket connection.
+//   - Stops tracking the presence of the connection, which may turn the user offline.
+//   - Forgets the session of an authenticated client so direct channels are no longer delivered to it.
+//   - Unsubscribes the client from all its channels, which broadcasts the leave to each channel.
+//   - Closes the websocket connection and stops writePump.
 //
 // 2. Sets the read limit for the websocket connection using `maxMessageSize`.
 //   - Ensures that incoming messages do not exceed this size.
+//   - Applies the guest rate limit until the client authenticates.
 //
 // 3. Updates the read deadline based on the `pongWait` duration to detect timeouts on the websocket.
 //
@@ -92,14 +132,19 @@ type Client struct {
 //   - Sends the sanitized message to the hub's broadcast channel for distribution to other clients.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
-		err := c.conn.Close()
-		if err != nil {
-			return
+		presence.Disconnect(c)
+		if c.authenticated {
+			manager.removeSession(c)
 		}
+		c.unsubscribeAll()
+		_ = c.conn.Close()
+		close(c.closed)
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
+	if !c.authenticated {
+		c.applyRateLimit(data.RoleGuest)
+	}
 
 	// Set pong handler to update read deadline on pong message.
 	if err := c.pongHandler(""); err != nil {
@@ -108,14 +153,23 @@ func (c *Client) readPump() {
 	c.conn.SetPongHandler(c.pongHandler)
 
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if err == websocket.ErrRateLimited {
+				log.Infof("Client %s disconnected: %v", c.conn.RemoteAddr(), err)
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Errorf("Error: %v", err)
 			}
 			break
 		}
+		if messageType == websocket.BinaryMessage && c.dictionary != nil {
+			if message, err = c.dictionary.Decompress(message, maxMessageSize); err != nil {
+				log.Infof("Client %s disconnected: invalid compressed message: %v", c.conn.RemoteAddr(), err)
+				break
+			}
+		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+		presence.Touch(c)
 
 		// Process the message based on its format and content
 		msgStr := string(message)
@@ -125,14 +179,9 @@ func (c *Client) readPump() {
 			channelID := msgStr[8:]
 			log.Infof("Client %s requesting channel switch to %s (legacy format)", c.conn.RemoteAddr(), channelID)
 
-			// Get the hub for the specified channel or create a new one if it doesn't exist
-			hub := manager.GetHub(channelID)
-			if hub == nil {
-				hub = manager.CreateChannelHub(channelID, channelID)
-			}
-
-			// Switch the client to the new channel without closing the WebSocket connection
-			c.SwitchChannel(hub)
+			// Switch the client to the channel, created if it doesn't exist, without closing
+			// the WebSocket connection
+			c.SwitchChannel(channelID)
 		} else {
 			// Try to parse the message as an ActionMessage first
 			var actionMsg data.ActionMessage
@@ -163,14 +212,14 @@ func (c *Client) readPump() {
 					}
 				}
 
-				// Add channel information if available
-				if c.hub.name != "" {
-					// Add channel name to the message content for display purposes
-					if textContent, ok := msgSend.Message.Content.(data.ContentText); ok {
-						textContent.Text = "[" + c.hub.name + "] " + textContent.Text
-						msgSend.Message.Content = textContent
-					}
+				// Track the message for edits and deletions and tag it with the active channel
+				hub := c.activeHub()
+				stored, ok := c.storeMessage(hub, msgSend.Message)
+				if !ok {
+					continue
 				}
+				msgSend.Message = stored
+				msgSend.Channel = hub.channelTag()
 
 				// Convert the message to JSON
 				jsonMessage, err := json.Marshal(msgSend)
@@ -179,7 +228,7 @@ func (c *Client) readPump() {
 					return
 				}
 
-				c.hub.broadcast <- jsonMessage
+				hub.publish(jsonMessage)
 			}
 		}
 	}
@@ -209,20 +258,19 @@ func (c *Client) readPump() {
 //
 //   - The write deadline for the websocket is updated based on `writeWait`.
 //
-//   - If the `send` channel is closed (`ok == false`), the connection is terminated
-//     using a websocket `CloseMessage`, and the loop exits.
+//   - Any queued messages in the `send` channel are appended to the received message in order and separated by newlines.
 //
-//   - Otherwise:
+//   - The batch is written as a single `TextMessage`. The connection's compression policy decides whether it is compressed.
 //
-//   - A new `TextMessage` writer is created for the websocket connection.
+//   - Failure to write the message will terminate the loop.
 //
-//   - The received message is written to the writer.
+//   - Case 2: readPump closed the connection (`closed` is closed); the loop exits.
 //
-//   - Any queued messages in the `send` channel are added to the same writer in order and separated by newlines.
+//   - Case 3: A hub dropped the client (`slow` is closed).
 //
-//   - The writer is closed to finalize the message. Failure to close the writer will terminate the loop.
+//   - The connection is terminated using a `CloseSlowConsumer` close message, and the loop exits.
 //
-//   - Case 2: The ticker signals a timer event.
+//   - Case 4: The ticker signals a timer event.
 //
 //   - The write deadline for the websocket is updated based on `writeWait`.
 //
@@ -240,30 +288,45 @@ func (c *Client) writePump() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			var err error
-
+		case <-c.closed:
+			// The connection was closed by readPump.
+			return
+		case <-c.slow:
+			// A hub dropped the client because it could not keep up.
+			_ = c.conn.WriteCloseReason(CloseSlowConsumer, websocket.CloseReason{
+				Reason:  "slow_consumer",
+				Message: "send buffer overflow",
+			}, time.Now().Add(writeWait))
+			return
+		case msg := <-c.closing:
+			// Write the messages queued before the close message.
 			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+			for n := len(c.send); n > 0; n-- {
+				if err := c.writeMessage(<-c.send); err != nil {
+					return
+				}
 			}
+			_ = c.conn.WriteCloseReason(msg.code, msg.reason, time.Now().Add(writeWait))
+			return
+		case message := <-c.send:
+			var err error
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			_, _ = w.Write(message)
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				_, _ = w.Write(newline)
-				_, _ = w.Write(<-c.send)
+			// Add queued chat messages to the current websocket message. The message slice is
+			// shared with other clients, so the batch is built in a new buffer.
+			if n := len(c.send); n > 0 {
+				var batch bytes.Buffer
+				batch.Write(message)
+				for i := 0; i < n; i++ {
+					batch.Write(newline)
+					batch.Write(<-c.send)
+				}
+				message = batch.Bytes()
 			}
 
-			if err := w.Close(); err != nil {
+			// Write the complete message so that the compression policy can inspect it.
+			if err = c.writeMessage(message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -279,6 +342,40 @@ func (c *Client) writePump() {
 	}
 }
 
+// writeMessage writes a text message. For a client that compresses with the dictionary, messages
+// that the compression policy compresses are sent as binary messages holding the compressed text.
+func (c *Client) writeMessage(message []byte) error {
+	if c.dictionary != nil && compressionPolicy(websocket.TextMessage, message) {
+		compressed, err := c.dictionary.Compress(message)
+		if err == nil {
+			return c.conn.WriteMessage(websocket.BinaryMessage, compressed)
+		}
+		log.Errorf("Error compressing message with the dictionary: %v", err)
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// closeMessage is a close message queued by closeAfterSend.
+type closeMessage struct {
+	code   int
+	reason websocket.CloseReason
+}
+
+// closeAfterSend makes writePump close the connection with the given code and reason once the
+// messages queued before are written. It does not block; only the first close is sent.
+func (c *Client) closeAfterSend(code int, reason websocket.CloseReason) {
+	select {
+	case c.closing <- closeMessage{code: code, reason: reason}:
+	default:
+	}
+}
+
+// dropSlow closes the connection of a client that cannot keep up with its messages.
+// It is called by the hubs and may be called more than once.
+func (c *Client) dropSlow() {
+	c.slowOnce.Do(func() { close(c.slow) })
+}
+
 func (c *Client) pongHandler(string) error {
 	// NOTE: Will get the error inside c.conn.RemoteAddr() for everytime the client disconnects
 	// error detail `panic: runtime error: invalid memory address or nil pointer dereference`
@@ -305,6 +402,51 @@ func generateID() string {
 	return hex.EncodeToString(bytes)
 }
 
+// login marks the client as authenticated as the given user.
+//
+// Parameters:
+// - username (string): The authenticated username.
+//
+// Logic:
+// 1. If the client was authenticated as another user, unsubscribes it from that user's direct
+// channels.
+// 2. Sets the username and authentication status of the client and forgets its session token.
+// 3. Records the user's role, the regular user role if the user has none, and applies its rate limit.
+// 4. Moves the client to the new user in the participants of its channels, and subscribes it to
+// the user's direct channels.
+// 5. Moves the presence of the connection from the previous user or guest to the new user.
+//
+// Note: The method must be called from the readPump goroutine.
+func (c *Client) login(username string) {
+	// The presence of the connection moves to the new user.
+	tracked := presence.Disconnect(c)
+	if c.authenticated {
+		manager.removeSession(c)
+		if c.username != username {
+			c.leaveDirectChannels()
+		}
+	}
+	role := data.RoleUser
+	if user, ok := GlobalUserStore.GetUser(username); ok && user.Role != "" {
+		role = user.Role
+	}
+	c.identityMu.Lock()
+	c.username = username
+	c.authenticated = true
+	c.role = role
+	c.tokenID = ""
+	c.identityMu.Unlock()
+
+	c.applyRateLimit(role)
+	for _, hub := range c.subscriptions() {
+		hub.identifyClient(c)
+	}
+	manager.addSession(c)
+	if tracked {
+		presence.Connect(c)
+	}
+}
+
 // handleAction processes an ActionMessage based on its action type.
 // It handles various action types like switching channels, listing channels, sending messages, etc.
 //
@@ -318,56 +460,44 @@ func (c *Client) handleAction(actionMsg data.ActionMessage) {
 			if channelID, ok := switchData["channel_id"].(string); ok && channelID != "" {
 				log.Infof("Client %s requesting channel switch to %s", c.conn.RemoteAddr(), channelID)
 
-				// Get the hub for the specified channel or create a new one if it doesn't exist
-				hub := manager.GetHub(channelID)
-				if hub == nil {
-					hub = manager.CreateChannelHub(channelID, channelID)
-				}
-
-				// Switch the client to the new channel
-				c.SwitchChannel(hub)
+				// Switch the client to the channel, created if it doesn't exist
+				c.SwitchChannel(channelID)
 				return
 			}
 		}
 		log.Errorf("Invalid channel switch data: %v", actionMsg.Action.Data)
 
-	case data.ActionListChannels:
-		// Handle channel listing
-		channels := make([]data.Channel, 0)
-
-		// Collect all available channels
-		for id, _ := range manager.poolHub {
-			channels = append(channels, data.Channel{
-				ID:           id,
-				Type:         "group",
-				Participants: []data.Participant{},
-				CreatedAt:    time.Now(),
-				UpdatedAt:    time.Now(),
-			})
-		}
+	case data.ActionJoinChannel:
+		// Handle channel subscription
+		c.handleJoinChannel(actionMsg)
 
-		// Create a response message
-		response := data.ActionMessage{
-			Metadata: data.Metadata{
-				Version:   "1.0",
-				Timestamp: time.Now(),
-			},
-			Action: data.Action{
-				Type: data.ActionListChannels,
-				Data: data.ChannelListData{
-					Channels: channels,
-				},
-			},
-		}
+	case data.ActionLeaveChannel:
+		// Handle channel unsubscription
+		c.handleLeaveChannel(actionMsg)
 
-		// Send the response only to the requesting client
-		jsonResponse, err := json.Marshal(response)
-		if err != nil {
-			log.Errorf("Error marshaling channel list to JSON: %v", err)
-			return
-		}
+	case data.ActionOpenDirect:
+		// Handle direct channel opening
+		c.handleOpenDirect(actionMsg)
+
+	case data.ActionInviteMember, data.ActionKickMember, data.ActionBanMember:
+		// Handle channel membership changes
+		c.handleMemberAction(actionMsg)
+
+	case data.ActionGetParticipants:
+		// Handle participant list requests
+		c.handleGetParticipants(actionMsg)
 
-		c.send <- jsonResponse
+	case data.ActionUserPresence:
+		// Handle presence changes
+		c.handleUserPresence(actionMsg)
+
+	case data.ActionUserTyping:
+		// Handle typing indicators
+		c.handleUserTyping(actionMsg)
+
+	case data.ActionListChannels:
+		// Handle channel listing
+		c.handleListChannels()
 
 	case data.ActionSendMessage:
 		// Handle message sending
@@ -386,20 +516,23 @@ func (c *Client) handleAction(actionMsg data.ActionMessage) {
 				return
 			}
 
-			// Create a MessageSend structure
-			msgSend := data.MessageSend{
-				Metadata: actionMsg.Metadata,
-				Channel:  actionMsg.Channel,
-				Message:  messageData.Message,
+			// The message goes to the channel of the action message, the active channel by default
+			hub, ok := c.channelHub(actionMsg.Channel.ID)
+			if !ok {
+				c.sendNotSubscribed(data.ActionSendMessage, actionMsg.Channel.ID)
+				return
 			}
 
-			// Add channel information if available
-			if c.hub.name != "" && msgSend.Message.Type == "text" {
-				if textContent, ok := msgSend.Message.Content.(map[string]interface{}); ok {
-					if text, ok := textContent["text"].(string); ok {
-						textContent["text"] = "[" + c.hub.name + "] " + text
-					}
-				}
+			// Track the message for edits and deletions and create a MessageSend structure
+			// tagged with the channel
+			message, ok := c.storeMessage(hub, messageData.Message)
+			if !ok {
+				return
+			}
+			msgSend := data.MessageSend{
+				Metadata: actionMsg.Metadata,
+				Channel:  hub.channelTag(),
+				Message:  message,
 			}
 
 			// Convert the message to JSON
@@ -409,111 +542,36 @@ func (c *Client) handleAction(actionMsg data.ActionMessage) {
 				return
 			}
 
-			// Broadcast the message to all clients in the hub
-			c.hub.broadcast <- jsonMessage
+			// Broadcast the message to all clients in the hub; the sender stopped typing
+			hub.publish(jsonMessage)
+			presence.Typing(c, hub.id, false)
 		}
 
-	case data.ActionCreateChannel:
-		// Handle channel creation
-		if createData, ok := actionMsg.Action.Data.(map[string]interface{}); ok {
-			if channelData, ok := createData["channel"].(map[string]interface{}); ok {
-				if channelID, ok := channelData["id"].(string); ok && channelID != "" {
-					// Create a new hub for the channel
-					_ = manager.CreateChannelHub(channelID, channelID)
-
-					// Send a confirmation message
-					response := data.ActionMessage{
-						Metadata: data.Metadata{
-							Version:   "1.0",
-							Timestamp: time.Now(),
-						},
-						Action: data.Action{
-							Type: data.ActionCreateChannel,
-							Data: data.ChannelCreateData{
-								Channel: data.Channel{
-									ID:           channelID,
-									Type:         "group",
-									Participants: []data.Participant{},
-									CreatedAt:    time.Now(),
-									UpdatedAt:    time.Now(),
-								},
-							},
-						},
-					}
+	case data.ActionEditMessage:
+		// Handle message editing
+		c.handleEditMessage(actionMsg)
 
-					jsonResponse, err := json.Marshal(response)
-					if err != nil {
-						log.Errorf("Error marshaling channel creation response to JSON: %v", err)
-						return
-					}
+	case data.ActionDeleteMessage:
+		// Handle message deletion
+		c.handleDeleteMessage(actionMsg)
 
-					c.send <- jsonResponse
-					return
-				}
-			}
-		}
-		log.Errorf("Invalid channel creation data: %v", actionMsg.Action.Data)
+	case data.ActionReactMessage:
+		// Handle message reactions
+		c.handleReactMessage(actionMsg)
 
-	case data.ActionUserAuth:
-		// Handle user authentication
-		log.Infof("Client %s requesting authentication", c.conn.RemoteAddr())
+	case data.ActionFetchHistory:
+		// Handle message history requests
+		c.handleFetchHistory(actionMsg)
 
-		// Extract authentication data
-		authBytes, err := json.Marshal(actionMsg.Action.Data)
-		if err != nil {
-			log.Errorf("Error marshaling auth data: %v", err)
-			return
-		}
-
-		var authData data.UserAuthData
-		err = json.Unmarshal(authBytes, &authData)
-		if err != nil {
-			log.Errorf("Error unmarshaling auth data: %v", err)
-			return
-		}
-
-		// Authenticate the user
-		success := GlobalUserStore.Authenticate(authData.Username, authData.Password)
-
-		// Prepare response
-		responseData := data.UserAuthResponseData{
-			Success: success,
-		}
-
-		if success {
-			// Set authentication status on the client
-			c.username = authData.Username
-			c.authenticated = true
-
-			responseData.Message = "Authentication successful"
-			responseData.Username = authData.Username
-
-			log.Infof("Client %s authenticated as %s", c.conn.RemoteAddr(), authData.Username)
-		} else {
-			responseData.Message = "Invalid username or password"
-			log.Infof("Client %s failed authentication attempt", c.conn.RemoteAddr())
-		}
-
-		// Create response message
-		response := data.ActionMessage{
-			Metadata: data.Metadata{
-				Version:   "1.0",
-				Timestamp: time.Now(),
-			},
-			Action: data.Action{
-				Type: data.ActionUserAuth,
-				Data: responseData,
-			},
-		}
-
-		// Send the response
-		jsonResponse, err := json.Marshal(response)
-		if err != nil {
-			log.Errorf("Error marshaling auth response to JSON: %v", err)
-			return
-		}
+	case data.ActionCreateChannel:
+		// Handle channel creation
+		c.handleCreateChannel(actionMsg)
 
-		c.send <- jsonResponse
+	case data.ActionUserAuth:
+		// Passwords are not accepted over the websocket, where they would escape the login
+		// throttle: clients log in with POST /auth/login and connect with the session token.
+		log.Infof("Client %s sent a password over the websocket", c.conn.RemoteAddr())
+		c.sendError(data.ActionUserAuth, errCodeInvalidRequest, "log in with POST /auth/login and connect with the session token")
 
 	default:
 		// For unhandled action types, just log a message
@@ -529,25 +587,32 @@ func (c *Client) handleAction(actionMsg data.ActionMessage) {
 // existing connection while changing the hub that the client is associated with.
 //
 // Parameters:
-// - newHub (*Hub): The new hub to register the client with.
+// - channelID (string): The ID of the channel to switch to.
 //
 // Logic:
-// 1. Unregister the client from its current hub.
-// 2. Update the client's hub reference to the new hub.
-// 3. Register the client with the new hub.
-func (c *Client) SwitchChannel(newHub *Hub) {
-	if c.hub.name == newHub.name {
+// 1. Send an error response if the client may not access the channel (see canAccessChannel).
+// 2. Subscribe the client to the channel, created if it doesn't exist, and make it the active channel.
+// 3. Unsubscribe the client from the previous active channel.
+// 4. Send a switch notification and the recent messages of the new channel.
+//
+// Subscriptions added with join_channel are kept.
+func (c *Client) SwitchChannel(channelID string) {
+	previous := c.activeHub()
+	if previous.id == channelID {
 		return // Already in this hub
 	}
+	if !c.canAccessChannel(channelID) {
+		c.sendError(data.ActionSwitchChannel, errCodeForbidden, "not allowed to join channel "+channelID)
+		return
+	}
 
-	// Unregister from the current hub
-	c.hub.unregister <- c
-
-	// Update hub reference
-	c.hub = newHub
-
-	// Register with a new hub
-	c.hub.register <- c
+	hub := c.subscribe(channelID)
+	c.setActiveHub(hub)
+	if _, ok := c.subscription(previous.id); ok {
+		c.unsubscribe(previous)
+	} else {
+		previous.leave(c)
+	}
 
 	// Send a JSON notification to the client about the channel switch
 	switchMsg := data.MessageSend{
@@ -557,7 +622,7 @@ func (c *Client) SwitchChannel(newHub *Hub) {
 			Timestamp: time.Now(),
 			Type:      "text",
 			Content: data.ContentText{
-				Text: "Switched to channel: " + c.hub.name,
+				Text: "Switched to channel: " + hub.name,
 			},
 			Status:    "sent",
 			Reactions: []data.Reaction{},
@@ -571,4 +636,7 @@ func (c *Client) SwitchChannel(newHub *Hub) {
 	}
 
 	c.send <- jsonMessage
+
+	// Catch the client up with the recent messages of the channel
+	c.sendRecentHistory(hub)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+	"ws/websocket/faultnet"
+)
+
+// sendChatMessage sends a text message to a channel from the peer of a client.
+func sendChatMessage(t *testing.T, conn *websocket.Conn, channelID, id, text string) {
+	t.Helper()
+	err := conn.WriteJSON(data.ActionMessage{
+		Channel: data.Channel{ID: channelID},
+		Action: data.Action{Type: data.ActionSendMessage, Data: map[string]interface{}{
+			"message": map[string]interface{}{"id": id, "type": "text", "content": map[string]interface{}{"text": text}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readChatMessage reads the messages written to the peer of a client, which may hold several
+// messages separated by newlines, until the chat message with the given ID.
+func readChatMessage(t *testing.T, conn *websocket.Conn, id string) data.MessageSend {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("no message %s: %v", id, err)
+		}
+		for _, line := range bytes.Split(p, newline) {
+			var msgSend data.MessageSend
+			if json.Unmarshal(line, &msgSend) == nil && msgSend.Message.ID == id {
+				return msgSend
+			}
+		}
+	}
+}
+
+func TestClientPumpsOverPipe(t *testing.T) {
+	server, peer := websocket.Pipe(nil)
+	defer manager.DeleteHub("test-pipe")
+
+	c := &Client{
+		conn:    server,
+		send:    make(chan []byte, 256),
+		slow:    make(chan struct{}),
+		closed:  make(chan struct{}),
+		closing: make(chan closeMessage, 1),
+		id:      "pipe",
+	}
+	c.login("user1")
+	c.setActiveHub(c.subscribe("test-pipe"))
+	writeDone := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(writeDone)
+	}()
+	go c.readPump()
+
+	// The message read by readPump is broadcast to the channel and written back by writePump.
+	id := generateID()
+	sendChatMessage(t, peer, "test-pipe", id, "hello")
+	if msgSend := readChatMessage(t, peer, id); msgSend.Channel.ID != "test-pipe" || msgSend.Message.SenderID != "user1" {
+		t.Errorf("message = %+v", msgSend)
+	}
+
+	// Closing the peer stops both pumps and unsubscribes the client.
+	_ = peer.Close()
+	select {
+	case <-writeDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writePump did not return after the peer closed")
+	}
+	<-c.closed
+	if _, ok := c.subscription("test-pipe"); ok {
+		t.Error("client still subscribed after readPump returned")
+	}
+}
+
+func TestChatOverFaultyNetwork(t *testing.T) {
+	token, _, err := tokens.Issue("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split the frames in small chunks with delays in both directions.
+	faults := faultnet.Faults{Latency: time.Millisecond, Jitter: time.Millisecond, MaxReadChunk: 7, MaxWriteChunk: 5, Seed: 1}
+	d := websocket.Dialer{
+		NetDialContext:   faultnet.DialContext(nil, faults),
+		Subprotocols:     []string{bearerProtocol, token},
+		HandshakeTimeout: 5 * time.Second,
+	}
+	conn, _, err := d.Dial("ws://"+startTestServer(t)+"/ws?channel=test-faulty", http.Header{"Origin": {os.Getenv("APP_URL")}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	defer manager.DeleteHub("test-faulty")
+
+	for _, id := range []string{generateID(), generateID()} {
+		sendChatMessage(t, conn, "test-faulty", id, "hello over a slow network")
+		if msgSend := readChatMessage(t, conn, id); msgSend.Message.SenderID != "user1" {
+			t.Errorf("message = %+v", msgSend)
+		}
+	}
+}
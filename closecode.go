@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/gflydev/core/log"
+	"ws/websocket"
+)
+
+// Application close codes sent by the chat server. Clients use the class of the code to decide
+// whether to reconnect (see websocket.CloseError.IsRetryable and IsAuthFailure).
+const (
+	// CloseAuthFailed is sent when the session token that authenticated a client is revoked.
+	CloseAuthFailed = 4001
+
+	// CloseSlowConsumer is sent when a client does not read its messages fast enough and its send
+	// buffer overflows.
+	CloseSlowConsumer = 4002
+)
+
+// appCloseCodes lists the application close codes to register with the websocket package.
+var appCloseCodes = []websocket.CloseCodeInfo{
+	{Code: CloseAuthFailed, Name: "authentication failed", Class: websocket.CloseClassAuthFailure},
+	{Code: CloseSlowConsumer, Name: "slow consumer", Class: websocket.CloseClassRetryable},
+}
+
+func init() {
+	// Register the application close codes so that close errors are named and classified
+	for _, info := range appCloseCodes {
+		if err := websocket.RegisterCloseCode(info.Code, info.Name, info.Class); err != nil {
+			log.Errorf("Error registering close code %d: %v", info.Code, err)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Command wsbench load tests the chat server.
+//
+// Usage:
+//
+//	go run ./cmd/wsbench -users user1:password1 [-url ws://localhost:7789/ws] [-conns 100] [-channels 4] [-rate 1] [-duration 30s]
+//
+// wsbench logs in the users of -users, or of WS_SEED_USERS if -users is not
+// set, with POST /auth/login. It then opens -conns connections spread over
+// -channels channels, authenticated by the session token of a user in the
+// bearer subprotocol, and sends send_message actions at -rate messages per
+// second per connection for -duration. Every connection reads the
+// broadcasts of its channel; the end-to-end latency of a message is the time
+// from the send to the receipt by a member of the channel, the sender
+// included. Messages sent but not received by a member of the channel are
+// reported as dropped.
+//
+// The server only accepts connections with an Origin matching its APP_URL; set
+// -origin if APP_URL differs from the host of -url.
+//
+// Regular users are rate limited by the server (10 messages per second per
+// connection); use an admin account with -users to measure the server without
+// the limit.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+// user is a benchmark user and its session token.
+type user struct {
+	name  string
+	token string
+}
+
+// stats collects the results of all connections.
+type stats struct {
+	mu              sync.Mutex
+	connectLatency  []time.Duration
+	messageLatency  []time.Duration
+	connectErrors   int
+	authFailures    int
+	disconnects     map[string]int
+	expectedReceipt int64
+}
+
+func (s *stats) addConnect(d time.Duration) {
+	s.mu.Lock()
+	s.connectLatency = append(s.connectLatency, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addMessage(d time.Duration) {
+	s.mu.Lock()
+	s.messageLatency = append(s.messageLatency, d)
+	s.mu.Unlock()
+}
+
+func (s *stats) addDisconnect(err error) {
+	reason := err.Error()
+	if e, ok := err.(*websocket.CloseError); ok {
+		reason = fmt.Sprintf("close %d", e.Code)
+		if r, ok := e.Reason(); ok {
+			reason += " " + r.Reason
+		}
+	}
+	s.mu.Lock()
+	s.disconnects[reason]++
+	s.mu.Unlock()
+}
+
+// bench holds the configuration and the shared state of a run.
+type bench struct {
+	url      string
+	channels int
+	rate     float64
+	duration time.Duration
+	size     int
+	users    []user
+	dialer   websocket.Dialer
+	header   http.Header
+
+	members []int64  // connected and authenticated connections per channel
+	sent    sync.Map // send time by message ID
+	stats   stats
+
+	messagesSent int64
+}
+
+func main() {
+	serverURL := flag.String("url", "ws://localhost:7789/ws", "websocket URL of the chat server")
+	conns := flag.Int("conns", 100, "number of connections")
+	channels := flag.Int("channels", 4, "number of channels")
+	rate := flag.Float64("rate", 1, "messages per second sent by each connection")
+	duration := flag.Duration("duration", 30*time.Second, "duration of the send phase")
+	size := flag.Int("size", 64, "size of the message text in bytes")
+	users := flag.String("users", os.Getenv("WS_SEED_USERS"), "comma separated username:password pairs, assigned round robin (default $WS_SEED_USERS)")
+	loginURL := flag.String("login", "", "login URL of the chat server (default: the /auth/login http URL of -url)")
+	concurrency := flag.Int("connect-concurrency", 50, "number of connections opened in parallel")
+	compress := flag.Bool("compress", false, "negotiate permessage-deflate")
+	origin := flag.String("origin", "", "Origin header, must match APP_URL of the server (default: the http URL of -url)")
+	flag.Parse()
+
+	if *conns <= 0 || *channels <= 0 || *rate <= 0 {
+		log.Fatal("-conns, -channels and -rate must be positive")
+	}
+	if strings.TrimSpace(*users) == "" {
+		log.Fatal("-users is required when WS_SEED_USERS is not set")
+	}
+
+	b := &bench{
+		url:      *serverURL,
+		channels: *channels,
+		rate:     *rate,
+		duration: *duration,
+		size:     *size,
+		members:  make([]int64, *channels),
+		dialer: websocket.Dialer{
+			HandshakeTimeout:  10 * time.Second,
+			EnableCompression: *compress,
+		},
+	}
+	b.stats.disconnects = make(map[string]int)
+	u, err := url.Parse(b.url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme := "http"
+	if u.Scheme == "wss" {
+		scheme = "https"
+	}
+	if *origin == "" {
+		*origin = scheme + "://" + u.Host
+	}
+	if *loginURL == "" {
+		*loginURL = scheme + "://" + u.Host + "/auth/login"
+	}
+	b.header = http.Header{"Origin": {*origin}}
+
+	// Log in every user once: the server throttles login attempts.
+	for _, entry := range strings.Split(*users, ",") {
+		// Entries of WS_SEED_USERS may end with the role of the user.
+		fields := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+		if fields[0] == "" {
+			continue
+		}
+		if len(fields) < 2 {
+			log.Fatalf("invalid -users entry %q", entry)
+		}
+		token, err := login(*loginURL, fields[0], fields[1])
+		if err != nil {
+			log.Fatalf("login of %s: %v", fields[0], err)
+		}
+		b.users = append(b.users, user{name: fields[0], token: token})
+	}
+
+	// Connect and authenticate all connections before sending.
+	log.Printf("opening %d connections to %s", *conns, b.url)
+	var (
+		ready   sync.WaitGroup
+		done    sync.WaitGroup
+		start   = make(chan struct{})
+		limiter = make(chan struct{}, *concurrency)
+	)
+	for i := 0; i < *conns; i++ {
+		ready.Add(1)
+		done.Add(1)
+		limiter <- struct{}{}
+		go func(i int) {
+			defer done.Done()
+			b.run(i, &ready, start, limiter)
+		}(i)
+	}
+	ready.Wait()
+
+	log.Printf("sending for %v", b.duration)
+	begin := time.Now()
+	close(start)
+	done.Wait()
+	b.report(os.Stdout, time.Since(begin))
+}
+
+// run opens connection i as one of the users, waits for start and sends messages
+// for the duration of the benchmark while reading the broadcasts.
+func (b *bench) run(i int, ready *sync.WaitGroup, start chan struct{}, limiter chan struct{}) {
+	channel := i % b.channels
+	readyDone := false
+	setReady := func() {
+		if !readyDone {
+			readyDone = true
+			<-limiter
+			ready.Done()
+		}
+	}
+	defer setReady()
+
+	u, err := url.Parse(b.url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("channel", fmt.Sprintf("bench-%d", channel))
+	u.RawQuery = q.Encode()
+
+	// The server authenticates the upgrade by the token following the bearer protocol.
+	user := b.users[i%len(b.users)]
+	dialer := b.dialer
+	dialer.Subprotocols = []string{"bearer", user.token}
+
+	t := time.Now()
+	c, resp, err := dialer.Dial(u.String(), b.header)
+	if err != nil {
+		b.stats.mu.Lock()
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			b.stats.authFailures++
+		} else {
+			b.stats.connectErrors++
+		}
+		b.stats.mu.Unlock()
+		return
+	}
+	defer c.Close()
+	b.stats.addConnect(time.Since(t))
+	atomic.AddInt64(&b.members[channel], 1)
+	setReady()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		b.read(c)
+	}()
+
+	<-start
+	b.send(c, i, channel, user.name, readDone)
+
+	// Wait for the broadcasts of the last messages, then close.
+	select {
+	case <-readDone:
+		return
+	case <-time.After(2 * time.Second):
+	}
+	_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+	}
+}
+
+// login logs in a user with the login endpoint and returns its session token.
+func login(loginURL, username, password string) (string, error) {
+	body, err := json.Marshal(data.UserAuthData{Username: username, Password: password})
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Post(loginURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("login failed: %s", resp.Status)
+	}
+	var session data.SessionToken
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", err
+	}
+	return session.Token, nil
+}
+
+// send sends messages at the configured rate until the duration elapses or
+// the connection fails.
+func (b *bench) send(c *websocket.Conn, i, channel int, username string, readDone chan struct{}) {
+	interval := time.Duration(float64(time.Second) / b.rate)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	end := time.After(b.duration)
+	text := strings.Repeat("x", b.size)
+
+	for seq := 0; ; seq++ {
+		select {
+		case <-end:
+			return
+		case <-readDone:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		id := fmt.Sprintf("bench-%d-%d", i, seq)
+		b.sent.Store(id, now)
+		err := c.WriteJSON(data.ActionMessage{
+			Metadata: data.Metadata{Version: "1.0", Timestamp: now},
+			Action: data.Action{Type: data.ActionSendMessage, Data: data.MessageSendData{Message: data.Message{
+				ID:        id,
+				SenderID:  username,
+				Timestamp: now,
+				Type:      "text",
+				Content:   data.ContentText{Text: text},
+				Status:    "sent",
+				Reactions: []data.Reaction{},
+			}}},
+		})
+		if err != nil {
+			b.sent.Delete(id)
+			return
+		}
+		atomic.AddInt64(&b.messagesSent, 1)
+		atomic.AddInt64(&b.stats.expectedReceipt, atomic.LoadInt64(&b.members[channel]))
+	}
+}
+
+// read records the latency of the broadcasts received on c until the
+// connection fails.
+func (b *bench) read(c *websocket.Conn) {
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				b.stats.addDisconnect(err)
+			}
+			return
+		}
+		now := time.Now()
+		// The server batches queued messages in one websocket message.
+		for _, line := range strings.Split(string(p), "\n") {
+			var msg struct {
+				Message struct {
+					ID string `json:"id"`
+				} `json:"message"`
+			}
+			if json.Unmarshal([]byte(line), &msg) != nil || msg.Message.ID == "" {
+				continue
+			}
+			if v, ok := b.sent.Load(msg.Message.ID); ok {
+				b.stats.addMessage(now.Sub(v.(time.Time)))
+			}
+		}
+	}
+}
+
+// report prints the results of the run.
+func (b *bench) report(w *os.File, elapsed time.Duration) {
+	s := &b.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sentCount := atomic.LoadInt64(&b.messagesSent)
+	received := int64(len(s.messageLatency))
+	dropped := atomic.LoadInt64(&s.expectedReceipt) - received
+	if dropped < 0 {
+		dropped = 0
+	}
+
+	fmt.Fprintf(w, "connections:   %d ok, %d connect errors, %d auth failures\n", len(s.connectLatency), s.connectErrors, s.authFailures)
+	fmt.Fprintf(w, "connect:       %s\n", percentiles(s.connectLatency))
+	fmt.Fprintf(w, "messages:      %d sent (%.1f/s), %d received, %d dropped\n", sentCount, float64(sentCount)/elapsed.Seconds(), received, dropped)
+	fmt.Fprintf(w, "latency:       %s\n", percentiles(s.messageLatency))
+	if len(s.disconnects) > 0 {
+		reasons := make([]string, 0, len(s.disconnects))
+		for reason := range s.disconnects {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "disconnects:   %d %s\n", s.disconnects[reason], reason)
+		}
+	}
+}
+
+// percentiles formats the median, 90th and 99th percentile and the maximum of
+// durations.
+func percentiles(durations []time.Duration) string {
+	if len(durations) == 0 {
+		return "n/a"
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	at := func(p float64) time.Duration {
+		return durations[int(p*float64(len(durations)-1))].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50 %v  p90 %v  p99 %v  max %v", at(0.5), at(0.9), at(0.99), at(1))
+}
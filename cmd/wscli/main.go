@@ -0,0 +1,337 @@
+// Command wscli is an interactive websocket client.
+//
+// Usage:
+//
+//	go run ./cmd/wscli [flags] ws://localhost:7789/ws
+//
+// wscli prints the messages received from the server and sends every line read
+// from standard input as a text message. Lines starting with a slash are
+// commands:
+//
+//	/ping [data]          send a ping and print the round trip time of the pong
+//	/close [code [text]]  send a close message, 1000 by default, and wait for the reply
+//	/compress on|off      enable or disable compression of sent messages
+//	/binary text          send text as a binary message
+//	/help                 list the commands
+//
+// Start a line with two slashes to send a text message starting with a slash.
+// The Origin header defaults to the http URL of the server, which matches the
+// APP_URL check of the chat server when both use the same host.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ws/websocket"
+)
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+func main() {
+	var headers headerFlags
+	flag.Var(&headers, "H", `request header "Name: value", may be repeated`)
+	subprotocols := flag.String("subprotocol", "", "comma separated subprotocols to offer")
+	origin := flag.String("origin", "", "Origin header (default: the http URL of the server)")
+	proxy := flag.String("proxy", "", "proxy URL (default: the HTTP_PROXY and HTTPS_PROXY environment)")
+	insecure := flag.Bool("insecure", false, "skip verification of the server certificate")
+	caFile := flag.String("ca", "", "PEM file with the CA certificates used to verify the server")
+	certFile := flag.String("cert", "", "PEM client certificate file for mutual TLS")
+	keyFile := flag.String("key", "", "PEM client key file for mutual TLS")
+	compress := flag.Bool("compress", true, "negotiate compression")
+	pretty := flag.Bool("pretty", false, "pretty print JSON messages")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: wscli [flags] url")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	target := flag.Arg(0)
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  10 * time.Second,
+		EnableCompression: *compress,
+	}
+	if *subprotocols != "" {
+		for _, p := range strings.Split(*subprotocols, ",") {
+			dialer.Subprotocols = append(dialer.Subprotocols, strings.TrimSpace(p))
+		}
+	}
+	if *proxy != "" {
+		proxyURL, err := url.Parse(*proxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+	if dialer.TLSClientConfig, err = tlsConfig(*insecure, *caFile, *certFile, *keyFile); err != nil {
+		log.Fatal(err)
+	}
+
+	header := http.Header{}
+	for _, h := range headers {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			log.Fatalf("invalid header %q", h)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if *origin == "" && header.Get("Origin") == "" {
+		scheme := "http"
+		if u.Scheme == "wss" {
+			scheme = "https"
+		}
+		*origin = scheme + "://" + u.Host
+	}
+	if *origin != "" {
+		header.Set("Origin", *origin)
+	}
+
+	c, resp, err := dialer.Dial(target, header)
+	if err != nil {
+		if resp != nil {
+			log.Fatalf("%v (%s)", err, resp.Status)
+		}
+		log.Fatal(err)
+	}
+	defer c.Close()
+
+	info := "connected to " + target
+	if p := c.Subprotocol(); p != "" {
+		info += ", subprotocol " + p
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		info += ", extensions " + ext
+	}
+	printf("%s (/help for commands)\n", info)
+
+	cli := &client{conn: c, pretty: *pretty, pings: make(map[string]time.Time)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cli.read()
+	}()
+
+	lines := make(chan string)
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case line, ok := <-lines:
+			if !ok {
+				// End of input: close the connection normally.
+				cli.command("/close")
+				<-done
+				return
+			}
+			if err := cli.handle(line); err != nil {
+				printf("error: %v\n", err)
+			}
+		}
+	}
+}
+
+// tlsConfig returns the TLS configuration for the flags, or nil if no TLS
+// option is set.
+func tlsConfig(insecure bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	if !insecure && caFile == "" && certFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	if certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// outputMu serializes the output of the read and input goroutines.
+var outputMu sync.Mutex
+
+func printf(format string, args ...interface{}) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	fmt.Printf(format, args...)
+}
+
+// client holds the state of the interactive session.
+type client struct {
+	conn   *websocket.Conn
+	pretty bool
+
+	mu    sync.Mutex
+	pings map[string]time.Time // send time of pending pings by payload
+	seq   int
+}
+
+// read prints the messages received from the server until the connection
+// fails.
+func (cli *client) read() {
+	c := cli.conn
+	c.SetPingHandler(func(appData string) error {
+		printf("< ping %q\n", appData)
+		return c.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+	})
+	c.SetPongHandler(func(appData string) error {
+		cli.mu.Lock()
+		sent, ok := cli.pings[appData]
+		delete(cli.pings, appData)
+		cli.mu.Unlock()
+		if ok {
+			printf("< pong %q (%v)\n", appData, time.Since(sent).Round(time.Microsecond))
+		} else {
+			printf("< pong %q\n", appData)
+		}
+		return nil
+	})
+
+	for {
+		messageType, p, err := c.ReadMessage()
+		if err != nil {
+			if e, ok := err.(*websocket.CloseError); ok {
+				printf("closed: %v\n", e)
+			} else {
+				printf("disconnected: %v\n", err)
+			}
+			return
+		}
+		if messageType == websocket.BinaryMessage {
+			printf("< binary %d bytes\n", len(p))
+			continue
+		}
+		printf("< %s\n", cli.format(p))
+	}
+}
+
+// format returns a text message for printing. With pretty printing, JSON
+// documents are indented. The chat server sends queued messages as one
+// message with a JSON document per line.
+func (cli *client) format(p []byte) string {
+	if !cli.pretty {
+		return string(p)
+	}
+	lines := bytes.Split(p, []byte("\n"))
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		var b bytes.Buffer
+		if json.Indent(&b, line, "  ", "  ") == nil {
+			out = append(out, b.String())
+		} else {
+			out = append(out, string(line))
+		}
+	}
+	return strings.Join(out, "\n  ")
+}
+
+// handle sends an input line or runs a command.
+func (cli *client) handle(line string) error {
+	if strings.HasPrefix(line, "//") {
+		line = line[1:]
+	} else if strings.HasPrefix(line, "/") {
+		return cli.command(line)
+	}
+	return cli.conn.WriteMessage(websocket.TextMessage, []byte(line))
+}
+
+// command runs a slash command.
+func (cli *client) command(line string) error {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	c := cli.conn
+	deadline := time.Now().Add(5 * time.Second)
+
+	switch name {
+	case "/ping":
+		cli.mu.Lock()
+		if arg == "" {
+			cli.seq++
+			arg = strconv.Itoa(cli.seq)
+		}
+		cli.pings[arg] = time.Now()
+		cli.mu.Unlock()
+		return c.WriteControl(websocket.PingMessage, []byte(arg), deadline)
+
+	case "/close":
+		code := websocket.CloseNormalClosure
+		codeText, text, _ := strings.Cut(arg, " ")
+		if codeText != "" {
+			n, err := strconv.Atoi(codeText)
+			if err != nil {
+				return fmt.Errorf("invalid close code %q", codeText)
+			}
+			code = n
+		}
+		return c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+
+	case "/compress":
+		switch arg {
+		case "on":
+			c.EnableWriteCompression(true)
+		case "off":
+			c.EnableWriteCompression(false)
+		default:
+			return fmt.Errorf("usage: /compress on|off")
+		}
+		printf("compression %s\n", arg)
+		return nil
+
+	case "/binary":
+		return c.WriteMessage(websocket.BinaryMessage, []byte(arg))
+
+	case "/help":
+		printf("/ping [data]          send a ping\n" +
+			"/close [code [text]]  close the connection\n" +
+			"/compress on|off      toggle compression of sent messages\n" +
+			"/binary text          send a binary message\n" +
+			"//text                send a text message starting with a slash\n")
+		return nil
+	}
+	return fmt.Errorf("unknown command %s, try /help", name)
+}
@@ -0,0 +1,161 @@
+// Command wsdict builds a preset DEFLATE dictionary for the x-deflate-dictionary
+// websocket extension from sample chat payloads.
+//
+// Usage:
+//
+//	go run ./cmd/wsdict [-o dictionary.bin] [-size 16384] [-synthetic 500] [samples.jsonl ...]
+//
+// Sample files hold one data.ActionMessage JSON payload per line, for example
+// messages captured from a running server. Lines that are not action messages
+// are skipped. With -synthetic, generated messages for the common action types
+// are added to the samples. Point WS_COMPRESSION_DICTIONARY at the output file
+// to enable the dictionary on the server.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+func main() {
+	output := flag.String("o", "dictionary.bin", "output file")
+	size := flag.Int("size", 16*1024, "maximum dictionary size in bytes (at most 32768)")
+	synthetic := flag.Int("synthetic", 0, "number of generated sample messages to add")
+	flag.Parse()
+
+	var samples [][]byte
+	for _, name := range flag.Args() {
+		s, skipped, err := readSamples(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if skipped > 0 {
+			log.Printf("%s: skipped %d lines that are not action messages", name, skipped)
+		}
+		samples = append(samples, s...)
+	}
+	samples = append(samples, syntheticSamples(*synthetic)...)
+	if len(samples) == 0 {
+		log.Fatal("no samples: pass sample files or -synthetic N")
+	}
+
+	dict := websocket.BuildCompressionDictionary(samples, *size)
+	if err := os.WriteFile(*output, dict, 0o644); err != nil {
+		log.Fatal(err)
+	}
+
+	d := websocket.NewCompressionDictionary(dict)
+	fmt.Printf("wrote %s: %d bytes from %d samples, dict_id=%s\n", *output, len(dict), len(samples), d.ID())
+}
+
+// readSamples reads the action messages in the file name, one JSON payload per
+// line. It returns the number of lines that are not action messages.
+func readSamples(name string) ([][]byte, int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var samples [][]byte
+	skipped := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			if isActionMessage(line) {
+				samples = append(samples, line)
+			} else {
+				skipped++
+			}
+		}
+		if err == io.EOF {
+			return samples, skipped, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// isActionMessage reports whether p is a JSON encoded data.ActionMessage.
+func isActionMessage(p []byte) bool {
+	var msg data.ActionMessage
+	return json.Unmarshal(p, &msg) == nil && msg.Action.Type != ""
+}
+
+// syntheticSamples generates n action messages in the format the server and
+// the browser client exchange.
+func syntheticSamples(n int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"hello", "channel", "meeting", "thanks", "ok", "see you", "lunch", "deploy", "review", "done"}
+	text := func() string {
+		s := words[rnd.Intn(len(words))]
+		for i := rnd.Intn(6); i > 0; i-- {
+			s += " " + words[rnd.Intn(len(words))]
+		}
+		return s
+	}
+	channelID := func() string {
+		return []string{"default", "general", "random", "dev"}[rnd.Intn(4)]
+	}
+	user := func() string {
+		return fmt.Sprintf("user%d", rnd.Intn(50))
+	}
+
+	samples := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(rnd.Intn(1e6)) * time.Second)
+		message := data.Message{
+			ID:        fmt.Sprintf("msg-%d", rnd.Int63()),
+			SenderID:  user(),
+			Timestamp: now,
+			Type:      "text",
+			Content:   data.ContentText{Text: text()},
+			Status:    "sent",
+			Reactions: []data.Reaction{},
+		}
+
+		var action data.Action
+		switch i % 8 {
+		case 0, 1, 2, 3:
+			action = data.Action{Type: data.ActionSendMessage, Data: data.MessageSendData{Message: message}}
+		case 4:
+			action = data.Action{Type: data.ActionSwitchChannel, Data: data.ChannelSwitchData{ChannelID: channelID()}}
+		case 5:
+			action = data.Action{Type: data.ActionReactMessage, Data: data.MessageReactData{
+				MessageID: message.ID,
+				Reaction:  data.Reaction{Emoji: "👍", Count: 1, Users: []string{user()}},
+			}}
+		case 6:
+			action = data.Action{Type: data.ActionEditMessage, Data: data.MessageEditData{
+				MessageID:  message.ID,
+				NewContent: data.ContentText{Text: text()},
+			}}
+		default:
+			action = data.Action{Type: data.ActionUserPresence, Data: data.UserPresenceData{UserID: user(), Status: "online"}}
+		}
+
+		p, err := json.Marshal(data.ActionMessage{
+			Metadata: data.Metadata{Version: "1.0", Timestamp: now},
+			Channel:  data.Channel{ID: channelID(), Type: "public", CreatedAt: now, UpdatedAt: now},
+			Action:   action,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		samples = append(samples, p)
+	}
+	return samples
+}
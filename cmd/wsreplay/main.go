@@ -0,0 +1,241 @@
+// Command wsreplay replays a websocket capture recorded with
+// websocket.Conn.SetCapture (for example by the chat server with
+// WS_CAPTURE_DIR set).
+//
+// Usage:
+//
+//	go run ./cmd/wsreplay -dump capture.wscap
+//	go run ./cmd/wsreplay -connect ws://localhost:7789/ws [-speed 10] [-check] capture.wscap
+//	go run ./cmd/wsreplay -listen :9000 [-speed 0] capture.wscap
+//
+// With -connect, wsreplay dials the server and sends the messages the server
+// received in the capture. With -listen, wsreplay acts as a fake server and
+// sends the messages the server sent to every client that connects. Use -send
+// to choose the direction explicitly, e.g. for captures recorded by a client.
+//
+// With -check, the data messages received during the replay are compared with
+// the data messages of the other direction in the capture. JSON keys listed in
+// -ignore (timestamps and generated IDs by default) are removed before the
+// comparison. wsreplay exits with status 1 if the messages differ.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+	"ws/websocket"
+)
+
+func main() {
+	connect := flag.String("connect", "", "replay as a client against this websocket URL")
+	listen := flag.String("listen", "", "replay as a fake server listening on this address")
+	send := flag.String("send", "", `direction of the records to send: "in" or "out" (default "in" with -connect, "out" with -listen)`)
+	speed := flag.Float64("speed", 1, "timing multiplier: 1 original timing, 10 ten times faster, 0 no delays")
+	wait := flag.Duration("wait", time.Second, "time to wait for messages after the last record")
+	check := flag.Bool("check", false, "compare received data messages with the capture")
+	ignore := flag.String("ignore", "timestamp,id,created_at,updated_at,joined_at", "comma separated JSON keys ignored by -check")
+	dump := flag.Bool("dump", false, "print the capture and exit")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	records, err := readCapture(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *dump {
+		for _, rec := range records {
+			printRecord(rec.Time.Sub(records[0].Time), rec)
+		}
+		return
+	}
+
+	opts := websocket.ReplayOptions{Speed: *speed, Wait: *wait}
+	switch {
+	case *connect != "" && *listen == "":
+		opts.Direction = websocket.CaptureInbound
+	case *listen != "" && *connect == "":
+		opts.Direction = websocket.CaptureOutbound
+	default:
+		log.Fatal("exactly one of -connect and -listen is required")
+	}
+	switch *send {
+	case "":
+	case "in":
+		opts.Direction = websocket.CaptureInbound
+	case "out":
+		opts.Direction = websocket.CaptureOutbound
+	default:
+		log.Fatalf("invalid -send %q", *send)
+	}
+
+	ignored := make(map[string]bool)
+	for _, key := range strings.Split(*ignore, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			ignored[key] = true
+		}
+	}
+
+	replay := func(c *websocket.Conn) bool {
+		start := time.Now()
+		received, err := websocket.Replay(c, records, opts)
+		if err != nil {
+			log.Printf("replay: %v", err)
+		}
+		for _, rec := range received {
+			printRecord(rec.Time.Sub(start), rec)
+		}
+		if !*check {
+			return true
+		}
+		return compare(expected(records, opts.Direction), received, ignored)
+	}
+
+	if *connect != "" {
+		c, _, err := websocket.DefaultDialer.Dial(*connect, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !replay(c) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		log.Printf("%s connected", c.RemoteAddr())
+		replay(c)
+		log.Printf("%s replay finished", c.RemoteAddr())
+	})
+	log.Printf("replaying %d records to clients of %s", len(records), *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
+
+// readCapture reads all records of the capture file name.
+func readCapture(name string) ([]websocket.CaptureRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := websocket.NewCaptureReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s: capture is empty", name)
+	}
+	return records, nil
+}
+
+var messageTypes = map[int]string{
+	websocket.TextMessage:   "text",
+	websocket.BinaryMessage: "binary",
+	websocket.CloseMessage:  "close",
+	websocket.PingMessage:   "ping",
+	websocket.PongMessage:   "pong",
+}
+
+// printRecord prints a record with its offset from the start of the capture.
+func printRecord(offset time.Duration, rec websocket.CaptureRecord) {
+	payload := string(rec.Data)
+	switch {
+	case rec.MessageType == websocket.CloseMessage:
+		code, text := rec.CloseCode()
+		payload = fmt.Sprintf("%d %s", code, text)
+	case rec.MessageType == websocket.BinaryMessage || !utf8.Valid(rec.Data):
+		payload = fmt.Sprintf("<%d bytes>", len(rec.Data))
+	}
+	fmt.Printf("%10.3fs %-3s %-6s %s\n", offset.Seconds(), rec.Direction, messageTypes[rec.MessageType], payload)
+}
+
+// expected returns the data messages of the capture that the peer is expected
+// to send when the records in direction sent are replayed.
+func expected(records []websocket.CaptureRecord, sent websocket.CaptureDirection) []websocket.CaptureRecord {
+	var result []websocket.CaptureRecord
+	for _, rec := range records {
+		if rec.Direction != sent && isData(rec.MessageType) {
+			result = append(result, rec)
+		}
+	}
+	return result
+}
+
+func isData(messageType int) bool {
+	return messageType == websocket.TextMessage || messageType == websocket.BinaryMessage
+}
+
+// compare reports whether the received data messages match the expected
+// messages, printing the differences.
+func compare(want, received []websocket.CaptureRecord, ignored map[string]bool) bool {
+	var got []websocket.CaptureRecord
+	for _, rec := range received {
+		if isData(rec.MessageType) {
+			got = append(got, rec)
+		}
+	}
+
+	ok := true
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			fmt.Printf("missing message %d: %s\n", i, want[i].Data)
+			ok = false
+		case i >= len(want):
+			fmt.Printf("unexpected message %d: %s\n", i, got[i].Data)
+			ok = false
+		case !equalPayload(want[i].Data, got[i].Data, ignored):
+			fmt.Printf("message %d differs:\n  want %s\n  got  %s\n", i, want[i].Data, got[i].Data)
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Printf("check passed: %d messages match\n", len(want))
+	}
+	return ok
+}
+
+// equalPayload compares two payloads, as JSON without the ignored keys if both
+// are JSON documents.
+func equalPayload(a, b []byte, ignored map[string]bool) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(stripKeys(va, ignored), stripKeys(vb, ignored))
+}
+
+// stripKeys removes the ignored keys from a decoded JSON value at any depth.
+func stripKeys(v interface{}, ignored map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if ignored[k] {
+				delete(v, k)
+			} else {
+				v[k] = stripKeys(e, ignored)
+			}
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = stripKeys(e, ignored)
+		}
+	}
+	return v
+}
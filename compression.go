@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gflydev/core"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"github.com/valyala/fasthttp"
+	"os"
+	"ws/websocket"
+)
+
+const (
+	// Messages smaller than this are sent uncompressed; the deflate overhead outweighs the gain.
+	minCompressSize = 256
+)
+
+// compressedFileTypes lists MIME type prefixes of file attachments (data.ContentFile) that are
+// already compressed. The base64 encoded data of such files barely shrinks with deflate.
+var compressedFileTypes = [][]byte{
+	[]byte("image/jpeg"),
+	[]byte("image/png"),
+	[]byte("image/gif"),
+	[]byte("image/webp"),
+	[]byte("video/"),
+	[]byte("audio/"),
+	[]byte("application/zip"),
+	[]byte("application/gzip"),
+	[]byte("application/x-7z-compressed"),
+}
+
+// fileTypeField is the JSON key of the MIME type in data.ContentFile.
+var fileTypeField = []byte(`"file_type":"`)
+
+// compressionPolicy decides whether an outbound message is compressed.
+//
+// Parameters:
+// - messageType (int): The websocket message type.
+// - payload ([]byte): The complete message, or nil when the message is streamed.
+//
+// Logic:
+// 1. Compresses streamed messages, as their content is unknown.
+// 2. Skips binary messages, which hold text compressed with the dictionary (see writeMessage).
+// 3. Skips messages smaller than `minCompressSize`.
+// 4. Skips messages carrying a file attachment with an already compressed file type.
+//
+// Returns:
+// - bool: true if the message should be compressed.
+func compressionPolicy(messageType int, payload []byte) bool {
+	if payload == nil {
+		return true
+	}
+	if messageType == websocket.BinaryMessage || len(payload) < minCompressSize {
+		return false
+	}
+
+	// A batch may hold several messages; skip compression if any carries a compressed file.
+	rest := payload
+	for {
+		i := bytes.Index(rest, fileTypeField)
+		if i < 0 {
+			return true
+		}
+		rest = rest[i+len(fileTypeField):]
+		for _, fileType := range compressedFileTypes {
+			if bytes.HasPrefix(rest, fileType) {
+				return false
+			}
+		}
+	}
+}
+
+// configureCompression applies the compression policy and adaptive compression to a connection.
+//
+// Parameters:
+// - conn (*websocket.Conn): The websocket connection. Compression only applies if negotiated with the client.
+func configureCompression(conn *websocket.Conn) {
+	conn.SetCompressionPolicy(compressionPolicy)
+	conn.SetAdaptiveCompression(&websocket.AdaptiveCompression{})
+}
+
+// compressionDictionary is the preset dictionary loaded from `WS_COMPRESSION_DICTIONARY`, or nil.
+var compressionDictionary *websocket.CompressionDictionary
+
+// loadCompressionDictionary enables the x-deflate-dictionary extension on the upgrader.
+//
+// Logic:
+// 1. Reads the dictionary file named by `WS_COMPRESSION_DICTIONARY` (built with `go run ./cmd/wsdict`).
+// 2. Adds the dictionary to the upgrader. Go clients offering the same dictionary compress with it.
+//   - Browsers cannot offer custom extensions. They download the dictionary from /ws/dictionary
+//     and compress above the websocket layer (see public/compression.js and writeMessage).
+//
+// 3. Logs and continues without the dictionary if the file cannot be read.
+func loadCompressionDictionary() {
+	path := utils.Getenv[string]("WS_COMPRESSION_DICTIONARY", "")
+	if path == "" {
+		return
+	}
+
+	dict, err := os.ReadFile(path)
+	if err != nil {
+		log.Errorf("Error reading compression dictionary %s: %v", path, err)
+		return
+	}
+
+	d := websocket.NewCompressionDictionary(dict)
+	upgrader.CompressionDictionaries = append(upgrader.CompressionDictionaries, d)
+	compressionDictionary = d
+	log.Infof("Compression dictionary %s loaded (%d bytes, id %s)", path, len(dict), d.ID())
+}
+
+// requestedDictionary returns the dictionary a browser client asks for with the `dict` query
+// parameter, or nil if the parameter does not name the loaded dictionary.
+func requestedDictionary(ctx *fasthttp.RequestCtx) *websocket.CompressionDictionary {
+	id := string(ctx.QueryArgs().Peek("dict"))
+	if id == "" || compressionDictionary == nil || id != compressionDictionary.ID() {
+		return nil
+	}
+	return compressionDictionary
+}
+
+// serveCompressionDictionary sends the preset dictionary to browser clients, with its ID in the
+// X-Dictionary-Id header. It responds 404 Not Found if no dictionary is loaded.
+func serveCompressionDictionary(ctx *fasthttp.RequestCtx) {
+	if compressionDictionary == nil {
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.Response.Header.Set("X-Dictionary-Id", compressionDictionary.ID())
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetBody(compressionDictionary.Bytes())
+}
+
+// NewDictionaryHandler As a constructor to create the compression dictionary handler.
+func NewDictionaryHandler() *DictionaryHandler {
+	return &DictionaryHandler{}
+}
+
+type DictionaryHandler struct {
+	core.Api
+}
+
+func (h *DictionaryHandler) Handle(c *core.Ctx) error {
+	serveCompressionDictionary(c.Root())
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+func TestBrowserDictionaryCompression(t *testing.T) {
+	dict := websocket.NewCompressionDictionary([]byte(`{"metadata":{"version":"1.0"},"action":{"type":"list_channels","data":{"channels":[{"id":"general","name":"General"}]}}}`))
+	compressionDictionary = dict
+	defer func() { compressionDictionary = nil }()
+	addr := startTestServer(t)
+
+	// Browsers download the dictionary with its ID.
+	resp, err := http.Get("http://" + addr + "/ws/dictionary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, dict.Bytes()) || resp.Header.Get("X-Dictionary-Id") != dict.ID() {
+		t.Fatalf("dictionary response: %q, id %q", body, resp.Header.Get("X-Dictionary-Id"))
+	}
+
+	c, _, err := dialTestServer(t, "ws://"+addr+"/ws?dict="+dict.ID(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// Compressed requests are read and large responses are compressed.
+	request, _ := json.Marshal(data.ActionMessage{Action: data.Action{Type: data.ActionListChannels}})
+	compressed, err := dict.Compress(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WriteMessage(websocket.BinaryMessage, compressed); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, p, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("no compressed channel list: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			if len(p) >= minCompressSize {
+				t.Errorf("uncompressed message of %d bytes", len(p))
+			}
+			continue
+		}
+		if p, err = dict.Decompress(p, maxMessageSize*10); err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if bytes.Contains(p, []byte(`"type":"list_channels"`)) {
+			break
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 // ActionType defines the type of action being performed in the WebSocket communication
 type ActionType string
 
@@ -11,12 +13,17 @@ const (
 	ActionCreateChannel ActionType = "create_channel"
 	ActionJoinChannel   ActionType = "join_channel"
 	ActionLeaveChannel  ActionType = "leave_channel"
+	ActionOpenDirect    ActionType = "open_direct"
+	ActionInviteMember  ActionType = "invite_member"
+	ActionKickMember    ActionType = "kick_member"
+	ActionBanMember     ActionType = "ban_member"
 
 	// Message-related actions
 	ActionSendMessage   ActionType = "send_message"
 	ActionEditMessage   ActionType = "edit_message"
 	ActionDeleteMessage ActionType = "delete_message"
 	ActionReactMessage  ActionType = "react_message"
+	ActionFetchHistory  ActionType = "fetch_history"
 
 	// User-related actions
 	ActionUserJoin     ActionType = "user_join"
@@ -24,6 +31,12 @@ const (
 	ActionUserTyping   ActionType = "user_typing"
 	ActionUserPresence ActionType = "user_presence"
 	ActionUserAuth     ActionType = "user_auth"
+
+	// Participant-related actions
+	ActionGetParticipants ActionType = "get_participants"
+
+	// Error response to a rejected action
+	ActionError ActionType = "error"
 )
 
 // Action represents the action being performed in a WebSocket message
@@ -42,10 +55,23 @@ type ChannelSwitchData struct {
 	ChannelID string `json:"channel_id"`
 }
 
+// ChannelMembershipData contains data for joining or leaving a channel. The server broadcasts
+// it with the user who joined or left to the channel's participants.
+type ChannelMembershipData struct {
+	// ChannelID is the ID of the channel to join or leave
+	ChannelID string `json:"channel_id"`
+
+	// UserID is the user who joined or left (set by the server)
+	UserID string `json:"user_id,omitempty"`
+}
+
 // ChannelListData contains data for listing channels
 type ChannelListData struct {
 	// Channels is the list of available channels
 	Channels []Channel `json:"channels"`
+
+	// DirectChannels is the list of the client's direct channels
+	DirectChannels []Channel `json:"direct_channels"`
 }
 
 // ChannelCreateData contains data for creating a new channel
@@ -54,6 +80,29 @@ type ChannelCreateData struct {
 	Channel Channel `json:"channel"`
 }
 
+// ChannelMemberData contains data for inviting, kicking or banning a user. The server broadcasts
+// it with the acting user to the channel and sends it to the user's connections.
+type ChannelMemberData struct {
+	// ChannelID is the ID of the channel
+	ChannelID string `json:"channel_id"`
+
+	// Username is the invited, kicked or banned user
+	Username string `json:"username"`
+
+	// Role is the role of an invited user (member by default, or admin)
+	Role string `json:"role,omitempty"`
+
+	// ActorID is the user who invited, kicked or banned (set by the server)
+	ActorID string `json:"actor_id,omitempty"`
+}
+
+// DirectOpenData contains data for opening the direct channel with another user. The server
+// responds with a ChannelCreateData holding the channel.
+type DirectOpenData struct {
+	// Username is the other user of the direct channel
+	Username string `json:"username"`
+}
+
 // MessageSendData contains data for sending a message
 type MessageSendData struct {
 	// Message contains the message to send
@@ -67,12 +116,24 @@ type MessageEditData struct {
 
 	// NewContent contains the updated content
 	NewContent interface{} `json:"new_content"`
+
+	// EditorID is the user who edited the message (set by the server)
+	EditorID string `json:"editor_id,omitempty"`
+
+	// EditedAt is the time of the edit (set by the server)
+	EditedAt *time.Time `json:"edited_at,omitempty"`
 }
 
 // MessageDeleteData contains data for deleting a message
 type MessageDeleteData struct {
 	// MessageID is the ID of the message to delete
 	MessageID string `json:"message_id"`
+
+	// DeletedBy is the user who deleted the message (set by the server)
+	DeletedBy string `json:"deleted_by,omitempty"`
+
+	// DeletedAt is the time of the deletion (set by the server)
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // MessageReactData contains data for reacting to a message
@@ -80,19 +141,121 @@ type MessageReactData struct {
 	// MessageID is the ID of the message to react to
 	MessageID string `json:"message_id"`
 
-	// Reaction contains the reaction details
+	// Reaction contains the reaction details; only Emoji is used in requests
 	Reaction Reaction `json:"reaction"`
+
+	// Op is ReactionAdd, ReactionRemove or empty to toggle the user's reaction
+	Op string `json:"op,omitempty"`
 }
 
-// UserPresenceData contains data for user presence updates
+// Operations of a react_message request
+const (
+	ReactionAdd    = "add"
+	ReactionRemove = "remove"
+)
+
+// MessageReactionDeltaData describes a change of the reactions of a message, broadcast
+// instead of the whole message
+type MessageReactionDeltaData struct {
+	// MessageID is the ID of the message
+	MessageID string `json:"message_id"`
+
+	// Emoji is the reaction that changed
+	Emoji string `json:"emoji"`
+
+	// UserID is the user who added or removed the reaction
+	UserID string `json:"user_id"`
+
+	// Added is true if the reaction was added, false if it was removed
+	Added bool `json:"added"`
+
+	// Count is the number of users reacting with the emoji after the change
+	Count int `json:"count"`
+}
+
+// HistoryRequestData contains data for fetching a page of a channel's message history
+type HistoryRequestData struct {
+	// ChannelID is the channel of the history, the client's current channel if empty
+	ChannelID string `json:"channel_id,omitempty"`
+
+	// Before is a message ID; the page holds the messages sent before it
+	Before string `json:"before,omitempty"`
+
+	// After is a message ID; the page holds the messages sent after it
+	After string `json:"after,omitempty"`
+
+	// Limit is the maximum number of messages in the page
+	Limit int `json:"limit,omitempty"`
+}
+
+// HistoryData contains a page of a channel's message history
+type HistoryData struct {
+	// ChannelID is the channel of the history
+	ChannelID string `json:"channel_id"`
+
+	// Messages are the messages of the page, oldest first
+	Messages []Message `json:"messages"`
+
+	// HasMore is true if older messages (or newer messages for an "after" request) exist
+	HasMore bool `json:"has_more"`
+}
+
+// UserPresenceData contains data for user presence updates. Clients send it to set their
+// connection away or online; the server broadcasts the status changes of users to their channels.
 type UserPresenceData struct {
-	// UserID is the ID of the user
+	// UserID is the ID of the user (set by the server)
 	UserID string `json:"user_id"`
 
-	// Status is the new status of the user
+	// Status is the new status of the user (online, away or offline)
 	Status string `json:"status"`
 }
 
+// ParticipantEventData contains the participant of a user_join or user_leave event. The server
+// broadcasts it to a channel when the first connection of a user joins it, or the last one leaves.
+type ParticipantEventData struct {
+	// ChannelID is the channel the user joined or left
+	ChannelID string `json:"channel_id"`
+
+	// Participant is the user who joined or left
+	Participant Participant `json:"participant"`
+}
+
+// ParticipantsRequestData contains data for fetching a page of a channel's participants
+type ParticipantsRequestData struct {
+	// ChannelID is the channel, the client's current channel if empty
+	ChannelID string `json:"channel_id,omitempty"`
+
+	// After is a user ID; the page holds the participants after it in user ID order
+	After string `json:"after,omitempty"`
+
+	// Limit is the maximum number of participants in the page
+	Limit int `json:"limit,omitempty"`
+}
+
+// ParticipantsData contains a page of a channel's participants. The server also sends the first
+// page to a client joining a channel.
+type ParticipantsData struct {
+	// ChannelID is the channel of the participants
+	ChannelID string `json:"channel_id"`
+
+	// Participants are the participants of the page, sorted by user ID
+	Participants []Participant `json:"participants"`
+
+	// HasMore is true if more participants follow the page
+	HasMore bool `json:"has_more"`
+}
+
+// UserTypingData contains data for typing indicators. Clients send it while the user types;
+// the server broadcasts it with the typing user to the channel, and a stop when the indicator
+// expires.
+type UserTypingData struct {
+	// UserID is the typing user (set by the server)
+	UserID string `json:"user_id,omitempty"`
+
+	// Typing is true while the user types and false once they stopped
+	Typing bool `json:"typing"`
+}
+
 // UserAuthData contains data for user authentication
 type UserAuthData struct {
 	// Username is the user's username
@@ -126,3 +289,15 @@ type ActionMessage struct {
 	// Action contains the action being performed
 	Action Action `json:"action"`
 }
+
+// ErrorData contains the details of an error response
+type ErrorData struct {
+	// Action is the type of the rejected action
+	Action ActionType `json:"action"`
+
+	// Code is a machine readable error code (e.g. not_found, forbidden, invalid_request)
+	Code string `json:"code"`
+
+	// Message is a human readable description of the error
+	Message string `json:"message"`
+}
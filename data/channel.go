@@ -12,16 +12,70 @@ type Participant struct {
 	Status string `json:"status"`
 	// JoinedAt records when the participant joined the channel
 	JoinedAt time.Time `json:"joined_at"`
+	// Role is the participant's role in the channel (owner, admin or member)
+	Role string `json:"role,omitempty"`
 }
 
+// Participant statuses
+const (
+	// StatusOnline is the status of a user with an active connection
+	StatusOnline = "online"
+
+	// StatusAway is the status of a user whose connections are idle or set away
+	StatusAway = "away"
+
+	// StatusOffline is the status of a user without connections
+	StatusOffline = "offline"
+)
+
+// Participant roles in a channel
+const (
+	// ChannelRoleOwner is the creator of the channel; the owner cannot be kicked or banned
+	ChannelRoleOwner = "owner"
+
+	// ChannelRoleAdmin may invite, kick and ban members
+	ChannelRoleAdmin = "admin"
+
+	// ChannelRoleMember may read and post in the channel
+	ChannelRoleMember = "member"
+)
+
+// Channel types
+const (
+	// ChannelTypeGroup is a channel for any number of participants
+	ChannelTypeGroup = "group"
+
+	// ChannelTypeDirect is a conversation between two users
+	ChannelTypeDirect = "direct"
+)
+
+// Channel visibilities
+const (
+	// VisibilityPublic channels are listed to every client
+	VisibilityPublic = "public"
+
+	// VisibilityPrivate channels are only listed to and joined by their participants
+	VisibilityPrivate = "private"
+)
+
 // Channel represents a messaging channel that participants can interact in
 type Channel struct {
 	// ID uniquely identifies the channel
 	ID string `json:"id"`
+	// Name is the display name of the channel
+	Name string `json:"name,omitempty"`
 	// Type indicates the kind of channel (e.g. direct, group)
 	Type string `json:"type"`
 	// Participants contains the list of users in this channel
 	Participants []Participant `json:"participants"`
+	// OwnerID is the user who created the channel
+	OwnerID string `json:"owner_id,omitempty"`
+	// Topic describes what the channel is about
+	Topic string `json:"topic,omitempty"`
+	// Visibility is public or private
+	Visibility string `json:"visibility,omitempty"`
+	// Banned lists the usernames banned from the channel
+	Banned []string `json:"banned,omitempty"`
 	// CreatedAt records when the channel was created
 	CreatedAt time.Time `json:"created_at"`
 	// UpdatedAt records when the channel was last modified
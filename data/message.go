@@ -50,4 +50,20 @@ type Message struct {
 	Status string `json:"status"`
 	// Reactions tracks emoji responses from users to this message
 	Reactions []Reaction `json:"reactions"`
+	// EditedAt records when the message was last edited (nil if never edited)
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// Edits keeps the previous versions of an edited message, oldest first
+	Edits []MessageEdit `json:"edits,omitempty"`
+	// Deleted marks a message removed by its sender or an admin; its content is cleared
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// MessageEdit records a previous version of an edited message
+type MessageEdit struct {
+	// Content is the content of the message before the edit
+	Content any `json:"content"`
+	// EditedAt records when the content was replaced
+	EditedAt time.Time `json:"edited_at"`
+	// EditorID identifies the user who made the edit
+	EditorID string `json:"editor_id"`
 }
@@ -1,10 +1,39 @@
 package data
 
+import "time"
+
+// User roles
+const (
+	// RoleGuest is the role of a client that has not authenticated
+	RoleGuest = "guest"
+
+	// RoleUser is the role of a regular authenticated user
+	RoleUser = "user"
+
+	// RoleAdmin is the role of an administrator
+	RoleAdmin = "admin"
+)
+
 // User represents a user in the system
 type User struct {
 	// Username is the unique identifier for the user
 	Username string `json:"username"`
 
-	// Password is the user's password (in a real system, this would be hashed)
-	Password string `json:"password"`
+	// PasswordHash is the bcrypt hash of the user's password
+	PasswordHash string `json:"password_hash"`
+
+	// Role is the user's role (user or admin)
+	Role string `json:"role"`
+}
+
+// SessionToken is the response of the login endpoint
+type SessionToken struct {
+	// Token is the signed session token
+	Token string `json:"token"`
+
+	// Username is the authenticated username
+	Username string `json:"username"`
+
+	// ExpiresAt is the time the token expires
+	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"github.com/gflydev/core/log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"ws/data"
+)
+
+// Prefix of the IDs of direct channels. Group channels cannot be created with it.
+const directChannelPrefix = "dm:"
+
+// directChannelID returns the ID of the direct channel between two users. The ID does not
+// depend on the order of the usernames, so both users open the same channel.
+func directChannelID(a, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return directChannelPrefix + url.QueryEscape(a) + ":" + url.QueryEscape(b)
+}
+
+// isDirectChannel reports whether a channel ID is the ID of a direct channel.
+func isDirectChannel(id string) bool {
+	return strings.HasPrefix(id, directChannelPrefix)
+}
+
+// isParticipant reports whether a user is a participant of a channel.
+func isParticipant(channel data.Channel, username string) bool {
+	for _, participant := range channel.Participants {
+		if participant.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// addSession records a connection of an authenticated user and subscribes it to the user's
+// direct channels, so that direct messages reach every connection of the user.
+//
+// The client records the user in c.session, so that openDirect, which subscribes the sessions
+// after releasing sessionsMu, skips clients that closed or logged in as another user since.
+//
+// Parameters:
+// - c (*Client): The authenticated client.
+func (m *Manager) addSession(c *Client) {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+
+	if m.sessions[c.username] == nil {
+		m.sessions[c.username] = make(map[*Client]bool)
+	}
+	m.sessions[c.username][c] = true
+	c.mu.Lock()
+	c.session = c.username
+	c.mu.Unlock()
+	for _, channel := range m.directChannels(c.username) {
+		c.subscribe(channel.ID)
+	}
+}
+
+// removeSession forgets a connection of a user. Once it returns, opening a direct channel no
+// longer subscribes the client.
+//
+// Parameters:
+// - c (*Client): The client.
+func (m *Manager) removeSession(c *Client) {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+
+	delete(m.sessions[c.username], c)
+	if len(m.sessions[c.username]) == 0 {
+		delete(m.sessions, c.username)
+	}
+	c.mu.Lock()
+	c.session = ""
+	c.mu.Unlock()
+}
+
+// directChannels returns the direct channels of a user, oldest first.
+func (m *Manager) directChannels(username string) []data.Channel {
+	channels := make([]data.Channel, 0)
+	for _, channel := range m.channels.List() {
+		if channel.Type == data.ChannelTypeDirect && isParticipant(channel, username) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// OpenDirectChannel returns the direct channel between two users, creating it if it does not
+// exist.
+//
+// Parameters:
+// - a (string): The username of the first user.
+// - b (string): The username of the second user.
+//
+// Logic:
+// 1. Returns the saved channel with the ID of directChannelID.
+// 2. Otherwise saves a private direct channel with both users as participants and starts its
+// persistent hub.
+//
+// Returns:
+// - data.Channel: The channel definition.
+// - error: The error of the channel store.
+func (m *Manager) OpenDirectChannel(a, b string) (data.Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := directChannelID(a, b)
+	if channel, ok := m.channels.Get(id); ok {
+		return channel, nil
+	}
+
+	usernames := []string{a, b}
+	sort.Strings(usernames)
+	now := time.Now()
+	channel := data.Channel{
+		ID:         id,
+		Name:       usernames[0] + ", " + usernames[1],
+		Type:       data.ChannelTypeDirect,
+		Visibility: data.VisibilityPrivate,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	for _, username := range usernames {
+		channel.Participants = append(channel.Participants, data.Participant{
+			UserID:   username,
+			Username: username,
+			JoinedAt: now,
+		})
+	}
+	if err := m.channels.Save(channel); err != nil {
+		return data.Channel{}, err
+	}
+
+	if hub, ok := m.poolHub[id]; ok {
+		hub.persistent = true
+	} else {
+		m.startHub(id, true)
+	}
+	return channel, nil
+}
+
+// openDirect subscribes every connection of the participants to a direct channel and sends
+// them the channel.
+//
+// Parameters:
+// - channel (data.Channel): The direct channel.
+//
+// Logic:
+// 1. Reads the connections of the participants under sessionsMu.
+// 2. After releasing it, subscribes the connections that are still sessions of their user and
+// sends them the channel. Subscribing does not hold sessionsMu while registering with the hub.
+func (m *Manager) openDirect(channel data.Channel) {
+	sessions := make(map[*Client]string)
+	m.sessionsMu.Lock()
+	for _, participant := range channel.Participants {
+		for client := range m.sessions[participant.Username] {
+			sessions[client] = participant.Username
+		}
+	}
+	m.sessionsMu.Unlock()
+
+	for client, username := range sessions {
+		if !client.subscribeSession(username, channel.ID) {
+			continue
+		}
+		client.notifyAction(data.Action{
+			Type: data.ActionOpenDirect,
+			Data: data.ChannelCreateData{
+				Channel: channel,
+			},
+		})
+	}
+}
+
+// handleOpenDirect opens the direct channel between the client and another user.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The open_direct action.
+//
+// Logic:
+// 1. Rejects guests, requests without username or for the client's own username, and unknown
+// users.
+// 2. Opens the direct channel, created on first use.
+// 3. Subscribes all connections of both users to the channel and sends them the channel.
+func (c *Client) handleOpenDirect(actionMsg data.ActionMessage) {
+	if !c.authenticated {
+		c.sendError(data.ActionOpenDirect, errCodeForbidden, "authentication required")
+		return
+	}
+	var openData data.DirectOpenData
+	if err := decodeActionData(actionMsg.Action.Data, &openData); err != nil || openData.Username == "" {
+		c.sendError(data.ActionOpenDirect, errCodeInvalidRequest, "username is required")
+		return
+	}
+	if openData.Username == c.username {
+		c.sendError(data.ActionOpenDirect, errCodeInvalidRequest, "cannot open a direct channel with yourself")
+		return
+	}
+	if _, ok := GlobalUserStore.GetUser(openData.Username); !ok {
+		c.sendError(data.ActionOpenDirect, errCodeNotFound, "unknown user "+openData.Username)
+		return
+	}
+
+	channel, err := manager.OpenDirectChannel(c.username, openData.Username)
+	if err != nil {
+		log.Errorf("Error saving direct channel with %s: %v", openData.Username, err)
+		c.sendError(data.ActionOpenDirect, errCodeInternal, "the channel could not be saved")
+		return
+	}
+	log.Infof("Client %s opened direct channel %s", c.id, channel.ID)
+
+	manager.openDirect(channel)
+}
+
+// leaveDirectChannels unsubscribes the client from its direct channels when it logs in as
+// another user. If the active channel was one of them, the client falls back to another
+// channel, the default channel if it has none left.
+func (c *Client) leaveDirectChannels() {
+	for _, hub := range c.subscriptions() {
+		if isDirectChannel(hub.id) {
+			c.unsubscribe(hub)
+		}
+	}
+	c.resetActiveHub()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"ws/data"
+)
+
+// receiveMessage waits for a chat message sent to a client, skipping actions.
+func receiveMessage(t *testing.T, c *Client) data.MessageSend {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case p := <-c.send:
+			var msgSend data.MessageSend
+			if err := json.Unmarshal(p, &msgSend); err == nil && msgSend.Message.ID != "" {
+				return msgSend
+			}
+		case <-timeout:
+			t.Fatalf("%s: no message", c.username)
+		}
+	}
+}
+
+func TestDirectChannels(t *testing.T) {
+	channels := manager.channels
+	manager.channels = NewInMemoryChannelStore()
+	defer func() { manager.channels = channels }()
+	defer manager.DeleteHub("dm:user1:user2")
+
+	if a, b := directChannelID("user2", "user1"), directChannelID("user1", "user2"); a != b || a != "dm:user1:user2" {
+		t.Fatalf("direct channel IDs = %q and %q", a, b)
+	}
+
+	// user1 has two connections, user2 one; admin is not a participant.
+	var sessions []*Client
+	for _, username := range []string{"user1", "user1", "user2", "admin"} {
+		c := newTestClient(nil, username, data.RoleUser)
+		c.hub = c.subscribe(DefaultHubID)
+		manager.addSession(c)
+		sessions = append(sessions, c)
+		defer func() {
+			manager.removeSession(c)
+			c.unsubscribeAll()
+		}()
+	}
+	user1, user1Again, user2, admin := sessions[0], sessions[1], sessions[2], sessions[3]
+	action := func(c *Client, actionType data.ActionType, channelID string, actionData any) {
+		c.handleAction(data.ActionMessage{
+			Channel: data.Channel{ID: channelID},
+			Action:  data.Action{Type: actionType, Data: actionData},
+		})
+	}
+
+	var errData data.ErrorData
+	for _, username := range []string{"", "user1", "nobody"} {
+		action(user1, data.ActionOpenDirect, "", map[string]interface{}{"username": username})
+		if receiveAction(t, user1, data.ActionError, &errData); errData.Code == "" {
+			t.Errorf("open_direct with %q: %+v, want error", username, errData)
+		}
+	}
+
+	action(user1, data.ActionOpenDirect, "", map[string]interface{}{"username": "user2"})
+	for _, c := range []*Client{user1, user1Again, user2} {
+		var opened data.ChannelCreateData
+		receiveAction(t, c, data.ActionOpenDirect, &opened)
+		if ch := opened.Channel; ch.ID != "dm:user1:user2" || ch.Type != data.ChannelTypeDirect || len(ch.Participants) != 2 {
+			t.Fatalf("opened channel = %+v", ch)
+		}
+		if _, ok := c.subscription("dm:user1:user2"); !ok {
+			t.Errorf("%s is not subscribed to the direct channel", c.username)
+		}
+	}
+	if _, ok := admin.subscription("dm:user1:user2"); ok {
+		t.Errorf("admin is subscribed to the direct channel")
+	}
+
+	// Messages reach every connection of both users.
+	action(user2, data.ActionSendMessage, "dm:user1:user2", map[string]interface{}{
+		"message": map[string]interface{}{"type": "text", "content": map[string]interface{}{"text": "hi"}},
+	})
+	for _, c := range []*Client{user1, user1Again, user2} {
+		if msgSend := receiveMessage(t, c); msgSend.Message.SenderID != "user2" || msgSend.Channel.ID != "dm:user1:user2" {
+			t.Errorf("%s: message = %+v", c.username, msgSend)
+		}
+	}
+
+	// Other users can neither join nor read the direct channel.
+	action(admin, data.ActionJoinChannel, "", map[string]interface{}{"channel_id": "dm:user1:user2"})
+	if receiveAction(t, admin, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("join by a non-participant: %+v, want forbidden error", errData)
+	}
+	action(admin, data.ActionFetchHistory, "", map[string]interface{}{"channel_id": "dm:user1:user2"})
+	if receiveAction(t, admin, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("history of a non-participant: %+v, want forbidden error", errData)
+	}
+	action(admin, data.ActionCreateChannel, "", map[string]interface{}{"channel": map[string]interface{}{"id": "dm:admin:user1"}})
+	if receiveAction(t, admin, data.ActionError, &errData); errData.Code != errCodeInvalidRequest {
+		t.Errorf("create_channel with a direct channel ID: %+v, want invalid_request error", errData)
+	}
+
+	// Direct channels are listed separately, to their participants only.
+	for _, tt := range []struct {
+		client *Client
+		want   int
+	}{{user2, 1}, {admin, 0}} {
+		action(tt.client, data.ActionListChannels, "", nil)
+		var list data.ChannelListData
+		receiveAction(t, tt.client, data.ActionListChannels, &list)
+		if len(list.DirectChannels) != tt.want {
+			t.Errorf("%s: direct channels = %+v, want %d", tt.client.username, list.DirectChannels, tt.want)
+		}
+		for _, channel := range list.Channels {
+			if channel.Type == data.ChannelTypeDirect {
+				t.Errorf("%s: direct channel %s listed with the group channels", tt.client.username, channel.ID)
+			}
+		}
+	}
+
+	// A new connection of a participant is subscribed on login.
+	late := newTestClient(nil, "user2", data.RoleUser)
+	late.hub = late.subscribe(DefaultHubID)
+	manager.addSession(late)
+	defer func() {
+		manager.removeSession(late)
+		late.unsubscribeAll()
+	}()
+	if _, ok := late.subscription("dm:user1:user2"); !ok {
+		t.Errorf("new connection is not subscribed to the direct channel")
+	}
+
+	// A connection that closed after openDirect read the sessions is not subscribed.
+	manager.removeSession(late)
+	late.unsubscribeAll()
+	if late.subscribeSession("user2", "dm:user1:user2") {
+		t.Errorf("closed connection subscribed to the direct channel")
+	}
+	if _, ok := late.subscription("dm:user1:user2"); ok {
+		t.Errorf("closed connection is subscribed to the direct channel")
+	}
+}
@@ -7,11 +7,11 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/klauspost/compress v1.18.0
 	github.com/valyala/fasthttp v1.60.0
+	golang.org/x/crypto v0.37.0
 	golang.org/x/net v0.39.0
 )
 
 require (
 	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
 )
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"ws/data"
+)
+
+// Number of recent messages sent to a client when it switches channel (0 to disable).
+var historyOnSwitch = utils.Getenv[int]("WS_HISTORY_ON_SWITCH", defaultHistoryLimit)
+
+// handleFetchHistory sends a page of a channel's message history to the client.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The fetch_history action.
+//
+// Logic:
+// 1. Decodes data.HistoryRequestData; the channel defaults to the client's current channel.
+// 2. Rejects requests with both `before` and `after` cursors or a negative limit.
+// 3. Without cursor, the page holds the latest messages. With `before`, the messages sent before
+// that message; with `after`, the messages sent after it. Pages hold at most maxHistoryLimit
+// messages and are sorted oldest first.
+// 4. Sends a not_found error if the cursor is not in the channel's history.
+func (c *Client) handleFetchHistory(actionMsg data.ActionMessage) {
+	var request data.HistoryRequestData
+	if err := decodeActionData(actionMsg.Action.Data, &request); err != nil {
+		c.sendError(data.ActionFetchHistory, errCodeInvalidRequest, "invalid history request")
+		return
+	}
+	if request.Before != "" && request.After != "" {
+		c.sendError(data.ActionFetchHistory, errCodeInvalidRequest, "before and after cannot be combined")
+		return
+	}
+	if request.Limit < 0 {
+		c.sendError(data.ActionFetchHistory, errCodeInvalidRequest, "limit must not be negative")
+		return
+	}
+
+	active := c.activeHub()
+	messages := active.messages
+	if request.ChannelID != "" && request.ChannelID != active.id {
+		if hub, ok := c.subscription(request.ChannelID); ok {
+			messages = hub.messages
+		} else if !c.canAccessChannel(request.ChannelID) {
+			c.sendError(data.ActionFetchHistory, errCodeForbidden, "not allowed to read channel "+request.ChannelID)
+			return
+		} else if hub := manager.GetHub(request.ChannelID); hub != nil {
+			messages = hub.messages
+		} else {
+			messages = newMessageLog(GlobalMessageStore, request.ChannelID)
+		}
+	}
+
+	page, err := messages.history(HistoryQuery{
+		Before: request.Before,
+		After:  request.After,
+		Limit:  request.Limit,
+	})
+	switch {
+	case errors.Is(err, ErrCursorNotFound):
+		c.sendError(data.ActionFetchHistory, errCodeNotFound, err.Error())
+		return
+	case err != nil:
+		log.Errorf("Error reading history of channel %s: %v", messages.channelID, err)
+		c.sendError(data.ActionFetchHistory, errCodeInternal, "history is not available")
+		return
+	}
+
+	c.sendAction(data.Action{
+		Type: data.ActionFetchHistory,
+		Data: data.HistoryData{
+			ChannelID: messages.channelID,
+			Messages:  page.Messages,
+			HasMore:   page.HasMore,
+		},
+	})
+}
+
+// sendRecentHistory sends the latest messages of a channel, as a fetch_history response, after
+// the client switched to or joined the channel.
+func (c *Client) sendRecentHistory(hub *Hub) {
+	if historyOnSwitch <= 0 {
+		return
+	}
+	page, err := hub.messages.history(HistoryQuery{Limit: historyOnSwitch})
+	if err != nil {
+		log.Errorf("Error reading history of channel %s: %v", hub.id, err)
+		return
+	}
+	c.sendAction(data.Action{
+		Type: data.ActionFetchHistory,
+		Data: data.HistoryData{
+			ChannelID: hub.id,
+			Messages:  page.Messages,
+			HasMore:   page.HasMore,
+		},
+	})
+}
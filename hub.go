@@ -1,9 +1,15 @@
 package main
 
-func newHub(name string) *Hub {
+import (
+	"sync"
+	"time"
+)
+
+func newHub(id, name string) *Hub {
 	// Creates and returns a new Hub instance.
 	//
 	// Parameters:
+	// - id (string): The ID of the channel/room.
 	// - name (string): The name of the channel/room.
 	//
 	// Logic:
@@ -13,19 +19,41 @@ func newHub(name string) *Hub {
 	//	- register: A channel for handling client registration requests.
 	//	- unregister: A channel for handling client unregistration requests.
 	//	- clients: A map to manage and store the active clients.
-	//	- name: The name of the channel/room.
+	//	- id, name: The ID and name of the channel/room.
+	//	- messages: The messages of the channel in the global message store.
+	//	- identify: A channel for identity changes of registered clients that logged in.
+	//	- participants: The users of the registered clients, by user ID.
+	//	- quit: A channel for stop requests; done is closed when the hub stops.
 	//
 	// Returns:
 	// - *Hub: A pointer to a newly created Hub instance.
 	return &Hub{
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		name:       name,
+		broadcast:    make(chan []byte),
+		register:     make(chan *Client),
+		unregister:   make(chan *Client),
+		identify:     make(chan *Client),
+		clients:      make(map[*Client]bool),
+		clientUsers:  make(map[*Client]string),
+		participants: make(map[string]*hubParticipant),
+		id:           id,
+		name:         name,
+		messages:     newMessageLog(GlobalMessageStore, id),
+		quit:         make(chan quitRequest),
+		done:         make(chan struct{}),
+		createdAt:    time.Now(),
+		emptySince:   time.Now(),
 	}
 }
 
+// quitRequest asks a hub to stop if it has been empty for a while.
+type quitRequest struct {
+	// Minimum time the hub must have been without clients
+	idle time.Duration
+
+	// Receives whether the hub stopped
+	reply chan bool
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -41,8 +69,78 @@ type Hub struct {
 	// Unregister requests from clients.
 	unregister chan *Client
 
+	// Identity changes of registered clients that logged in, see identifyClient.
+	identify chan *Client
+
+	// The user ID each registered client was registered as, owned by the run goroutine.
+	clientUsers map[*Client]string
+
+	// The users of the registered clients, by user ID. Written by the run goroutine and
+	// guarded by participantsMu.
+	participants   map[string]*hubParticipant
+	participantsMu sync.RWMutex
+
+	// ID of the channel/room
+	id string
+
 	// Name of the channel/room
 	name string
+
+	// Messages of the channel, for history, edits and deletions
+	messages *messageLog
+
+	// Stop requests, see stopIfIdle.
+	quit chan quitRequest
+
+	// Closed when the run goroutine has stopped.
+	done chan struct{}
+
+	// Time the hub was created.
+	createdAt time.Time
+
+	// Time the last client left, owned by the run goroutine.
+	emptySince time.Time
+
+	// Whether the channel is saved in the channel store. Hubs of saved channels are never
+	// reaped. Guarded by the manager's lock.
+	persistent bool
+}
+
+// stopIfIdle stops the hub if it has had no clients for at least idle.
+//
+// Parameters:
+// - idle (time.Duration): The minimum time without clients; 0 stops any empty hub.
+//
+// Logic:
+// 1. Sends the request to the run goroutine, which checks the clients. Registrations received
+// before the request keep the hub running.
+//
+// Returns:
+// - bool: Whether the hub is stopped.
+func (h *Hub) stopIfIdle(idle time.Duration) bool {
+	reply := make(chan bool)
+	select {
+	case h.quit <- quitRequest{idle: idle, reply: reply}:
+		return <-reply
+	case <-h.done:
+		return true
+	}
+}
+
+// leave unregisters a client. It does not block if the hub has stopped.
+func (h *Hub) leave(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// publish sends a message to all clients of the hub. It does not block if the hub has stopped.
+func (h *Hub) publish(message []byte) {
+	select {
+	case h.broadcast <- message:
+	case <-h.done:
+	}
 }
 
 // IsEmpty Check if the hub's client map is empty.
@@ -52,6 +150,8 @@ type Hub struct {
 //
 // Logic:
 // 1. Returns true if the clients map is empty, otherwise false.
+//
+// It must only be called by the run goroutine, which owns the clients map.
 func (h *Hub) IsEmpty() bool {
 	return len(h.clients) == 0
 }
@@ -60,13 +160,21 @@ func (h *Hub) run() {
 	// Logic:
 	// 1. Continuously listen for incoming events on one of the hub's channels using a select statement.
 	// 2. Handle the specific event type and update hub's state.
+	// 3. Return when a quit request finds the hub idle; done is closed on return.
+	defer close(h.done)
 
 	for {
 		select {
 		case client := <-h.register: // Parameter: client (*Client) - A new client attempting to connect to the hub.
 			// Logic:
 			// - Mark the client as registered by adding it to the hub's client map.
-			h.clients[client] = true
+			// - Add the client's user to the participants and send the client the roster.
+			if _, ok := h.clients[client]; !ok {
+				h.clients[client] = true
+				h.addParticipant(client)
+				h.sendRoster(client)
+			}
+			h.emptySince = time.Time{}
 		case client := <-h.unregister: // Parameter: client (*Client) - A client attempting to disconnect from the hub.
 			// Logic:
 			// - Check if the client exists in the client map.
@@ -78,23 +186,74 @@ func (h *Hub) run() {
 			// - The send channel will be closed in the client's readPump when the connection is actually closed
 			//   (i.e., when the client disconnects from the server, not just when switching channels).
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
+				h.removeClient(client)
 				// Don't close the send channel here to support channel switching
 				// close(client.send) - This would break channel switching
 			}
+			h.markIfEmpty()
+		case client := <-h.identify: // Parameter: client (*Client) - A registered client that logged in.
+			// Logic:
+			// - Move the client from the participant it was registered as to its new user.
+			if _, ok := h.clients[client]; ok {
+				h.removeParticipant(client)
+				h.addParticipant(client)
+			}
 		case message := <-h.broadcast: // Parameter: message ([]byte) - A message received from a client to be broadcast to all clients.
 			// Logic:
 			// - Loop through all currently registered clients.
 			// - Attempt to send the message through each client's send channel.
-			// - If a client's send channel is full (default case), close the client's channel and unregister the client by removing it from the hub.
-			for client := range h.clients {
-				select {
-				case client.send <- message: // Successfully send the message.
-				default: // Failed to send a message (channel full or disconnected).
-					close(client.send)
-					delete(h.clients, client)
-				}
+			// - If a client's send channel is full (default case), drop the slow client and unregister it by removing it from the hub.
+			//   The send channel is not closed: the client may still be registered with other hubs.
+			h.deliver(message)
+			h.markIfEmpty()
+		case req := <-h.quit: // Parameter: req (quitRequest) - A request to stop the hub if it is idle.
+			// Logic:
+			// - Stop if there are no clients and the last client left at least req.idle ago.
+			stop := h.IsEmpty() && time.Since(h.emptySince) >= req.idle
+			req.reply <- stop
+			if stop {
+				return
 			}
 		}
 	}
 }
+
+// deliver sends a message to all registered clients and removes the clients whose send buffer
+// is full. It is called by the run goroutine.
+func (h *Hub) deliver(message []byte) {
+	var dropped []*Client
+	for client := range h.clients {
+		select {
+		case client.send <- message: // Successfully send the message.
+		default: // Failed to send a message (channel full or disconnected).
+			client.dropSlow()
+			dropped = append(dropped, client)
+		}
+	}
+	for _, client := range dropped {
+		h.removeClient(client)
+	}
+}
+
+// removeClient unregisters a client and removes its user from the participants if it was
+// their last client. It is called by the run goroutine.
+func (h *Hub) removeClient(client *Client) {
+	delete(h.clients, client)
+	h.removeParticipant(client)
+}
+
+// identifyClient tells the hub that a registered client logged in. It does not block if the
+// hub has stopped.
+func (h *Hub) identifyClient(client *Client) {
+	select {
+	case h.identify <- client:
+	case <-h.done:
+	}
+}
+
+// markIfEmpty records the time the last client left. It is called by the run goroutine.
+func (h *Hub) markIfEmpty() {
+	if h.IsEmpty() && h.emptySince.IsZero() {
+		h.emptySince = time.Now()
+	}
+}
@@ -11,6 +11,9 @@ func main() {
 	// Register router
 	app.RegisterRouter(func(g core.IFly) {
 		g.GET("/ws", NewWSHandler())
+		g.GET("/ws/dictionary", NewDictionaryHandler())
+		g.POST("/auth/login", NewLoginHandler())
+		g.POST("/auth/logout", NewLogoutHandler())
 	})
 
 	/*// Create a new instance of MessageSend
@@ -94,5 +97,8 @@ func main() {
 
 	litter.Dump(item)*/
 
+	// Serve wss:// on a separate port if a certificate is configured
+	startTLSServer()
+
 	app.Run()
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"github.com/gflydev/core/log"
+	"time"
+	"ws/data"
+)
+
+var (
+	// errNotModerator is returned when a user who is neither owner nor admin of a channel
+	// invites, kicks or bans.
+	errNotModerator = errors.New("only the owner and admins of the channel can manage its members")
+
+	// errNotOwner is returned when a channel admin invites another admin, or kicks or bans one.
+	errNotOwner = errors.New("only the owner of the channel can manage its admins")
+
+	// errNotMember is returned when kicking a user who is not a participant of the channel.
+	errNotMember = errors.New("user is not a member of the channel")
+
+	// errInvalidMember is returned when a user targets themselves or the owner of the channel.
+	errInvalidMember = errors.New("cannot change the membership of yourself or of the channel owner")
+
+	// errInvalidRole is returned when inviting with a role other than member or admin.
+	errInvalidRole = errors.New("role must be member or admin")
+)
+
+// channelAllows reports whether a user may subscribe to a channel.
+//
+// Parameters:
+// - id (string): The channel ID.
+// - username (string): The authenticated username, empty for guests.
+// - admin (bool): Whether the user is a server admin.
+//
+// Logic:
+// 1. Direct channels are restricted to their two participants.
+// 2. Unsaved channels are open to everybody, and saved channels to server admins.
+// 3. Banned users are refused. Private channels are restricted to their participants.
+func channelAllows(id, username string, admin bool) bool {
+	channel, ok := manager.Channel(id)
+	if isDirectChannel(id) {
+		return ok && username != "" && isParticipant(channel, username)
+	}
+	if !ok || admin {
+		return true
+	}
+	if username != "" && isBanned(channel, username) {
+		return false
+	}
+	return channel.Visibility != data.VisibilityPrivate || (username != "" && isParticipant(channel, username))
+}
+
+// canAccessChannel reports whether the client may subscribe to a channel (see channelAllows).
+func (c *Client) canAccessChannel(id string) bool {
+	username := ""
+	if c.authenticated {
+		username = c.username
+	}
+	return channelAllows(id, username, c.isAdmin())
+}
+
+// participantRole returns the role of a user in a channel, empty if the user is not a participant.
+// Participants saved without role are members.
+func participantRole(channel data.Channel, username string) string {
+	for _, participant := range channel.Participants {
+		if participant.Username != username {
+			continue
+		}
+		if participant.Role == "" {
+			return data.ChannelRoleMember
+		}
+		return participant.Role
+	}
+	return ""
+}
+
+// isBanned reports whether a user is banned from a channel.
+func isBanned(channel data.Channel, username string) bool {
+	for _, banned := range channel.Banned {
+		if banned == username {
+			return true
+		}
+	}
+	return false
+}
+
+// changeMember applies an invitation, kick or ban to a channel definition.
+//
+// Parameters:
+// - channel (*data.Channel): The channel definition, updated with new slices.
+// - actionType (data.ActionType): data.ActionInviteMember, data.ActionKickMember or data.ActionBanMember.
+// - actor (string): The acting user.
+// - admin (bool): Whether the acting user is a server admin; server admins act as owners.
+// - member (*data.ChannelMemberData): The target user. The role of an invitation defaults to member.
+//
+// Logic:
+// 1. Only owners and admins of the channel may act, and only on other users than themselves and
+// the owner. Only owners may invite admins, change an admin's role, or kick or ban admins.
+// 2. An invitation lifts a ban and adds the user as participant, or changes their role.
+// 3. A kick removes the participant; a ban also records the user in the banned list.
+//
+// Returns:
+// - error: errNotModerator, errNotOwner, errNotMember, errInvalidMember or errInvalidRole.
+func changeMember(channel *data.Channel, actionType data.ActionType, actor string, admin bool, member *data.ChannelMemberData) error {
+	actorRole := participantRole(*channel, actor)
+	if admin {
+		actorRole = data.ChannelRoleOwner
+	}
+	if actorRole != data.ChannelRoleOwner && actorRole != data.ChannelRoleAdmin {
+		return errNotModerator
+	}
+	targetRole := participantRole(*channel, member.Username)
+	if member.Username == actor || targetRole == data.ChannelRoleOwner {
+		return errInvalidMember
+	}
+	if targetRole == data.ChannelRoleAdmin && actorRole != data.ChannelRoleOwner {
+		return errNotOwner
+	}
+
+	// Copy the participants, the stored definition shares its slices with channel.
+	participants := make([]data.Participant, 0, len(channel.Participants)+1)
+	for _, participant := range channel.Participants {
+		if participant.Username != member.Username {
+			participants = append(participants, participant)
+		}
+	}
+	banned := make([]string, 0, len(channel.Banned)+1)
+	for _, username := range channel.Banned {
+		if username != member.Username {
+			banned = append(banned, username)
+		}
+	}
+
+	switch actionType {
+	case data.ActionInviteMember:
+		if member.Role == "" {
+			member.Role = data.ChannelRoleMember
+		}
+		if member.Role != data.ChannelRoleMember && member.Role != data.ChannelRoleAdmin {
+			return errInvalidRole
+		}
+		if member.Role == data.ChannelRoleAdmin && actorRole != data.ChannelRoleOwner {
+			return errNotOwner
+		}
+		joinedAt := time.Now()
+		for _, participant := range channel.Participants {
+			if participant.Username == member.Username {
+				joinedAt = participant.JoinedAt
+			}
+		}
+		participants = append(participants, data.Participant{
+			UserID:   member.Username,
+			Username: member.Username,
+			JoinedAt: joinedAt,
+			Role:     member.Role,
+		})
+	case data.ActionKickMember:
+		if targetRole == "" {
+			return errNotMember
+		}
+		member.Role = ""
+	case data.ActionBanMember:
+		banned = append(banned, member.Username)
+		member.Role = ""
+	}
+
+	channel.Participants = participants
+	channel.Banned = banned
+	return nil
+}
+
+// handleMemberAction invites a user to a channel, or kicks or bans a user from it.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The invite_member, kick_member or ban_member action.
+//
+// Logic:
+// 1. Decodes data.ChannelMemberData and rejects guests, requests without channel ID or username,
+// direct channels and unknown users.
+// 2. Applies the change to the saved channel (see changeMember) and sends an error response if
+// the client may not make it or the channel is not saved.
+// 3. Removes a kicked or banned user's connections from the channel, broadcasts the change to the
+// channel and sends it to the target user's and the client's connections outside the channel.
+func (c *Client) handleMemberAction(actionMsg data.ActionMessage) {
+	actionType := actionMsg.Action.Type
+	var memberData data.ChannelMemberData
+	if err := decodeActionData(actionMsg.Action.Data, &memberData); err != nil || memberData.ChannelID == "" || memberData.Username == "" {
+		c.sendError(actionType, errCodeInvalidRequest, "channel_id and username are required")
+		return
+	}
+	if !c.authenticated {
+		c.sendError(actionType, errCodeForbidden, "authentication required")
+		return
+	}
+	if isDirectChannel(memberData.ChannelID) {
+		c.sendError(actionType, errCodeInvalidRequest, "the members of direct channels cannot change")
+		return
+	}
+	if _, ok := GlobalUserStore.GetUser(memberData.Username); !ok {
+		c.sendError(actionType, errCodeNotFound, "unknown user "+memberData.Username)
+		return
+	}
+
+	_, err := manager.UpdateChannel(memberData.ChannelID, func(channel *data.Channel) error {
+		return changeMember(channel, actionType, c.username, c.isAdmin(), &memberData)
+	})
+	switch {
+	case errors.Is(err, ErrChannelNotFound):
+		c.sendError(actionType, errCodeNotFound, "channel "+memberData.ChannelID+" is not saved")
+		return
+	case errors.Is(err, errNotModerator), errors.Is(err, errNotOwner):
+		c.sendError(actionType, errCodeForbidden, err.Error())
+		return
+	case errors.Is(err, errNotMember):
+		c.sendError(actionType, errCodeNotFound, err.Error())
+		return
+	case errors.Is(err, errInvalidMember), errors.Is(err, errInvalidRole):
+		c.sendError(actionType, errCodeInvalidRequest, err.Error())
+		return
+	case err != nil:
+		log.Errorf("Error saving channel %s: %v", memberData.ChannelID, err)
+		c.sendError(actionType, errCodeInternal, "the channel could not be saved")
+		return
+	}
+	memberData.ActorID = c.username
+	log.Infof("Client %s %s: %s in channel %s", c.id, actionType, memberData.Username, memberData.ChannelID)
+
+	action := data.Action{Type: actionType, Data: memberData}
+	manager.announceMember(action, memberData)
+	if _, ok := c.subscription(memberData.ChannelID); !ok {
+		c.sendAction(action)
+	}
+}
+
+// announceMember delivers a membership change to the channel and the target user.
+//
+// Parameters:
+// - action (data.Action): The invite_member, kick_member or ban_member action to deliver.
+// - member (data.ChannelMemberData): The change.
+//
+// Logic:
+// 1. Unsubscribes the connections of a kicked or banned user from the channel.
+// 2. Broadcasts the action to the channel.
+// 3. Sends the action to the user's connections that are not subscribed to the channel.
+func (m *Manager) announceMember(action data.Action, member data.ChannelMemberData) {
+	m.sessionsMu.Lock()
+	defer m.sessionsMu.Unlock()
+
+	hub := m.GetHub(member.ChannelID)
+	if hub != nil && action.Type != data.ActionInviteMember {
+		for client := range m.sessions[member.Username] {
+			if _, ok := client.subscription(member.ChannelID); ok {
+				client.expel(hub)
+			}
+		}
+	}
+	if hub != nil {
+		hub.broadcastAction(action)
+	}
+	for client := range m.sessions[member.Username] {
+		if _, ok := client.subscription(member.ChannelID); !ok {
+			client.notifyAction(action)
+		}
+	}
+}
+
+// expel unsubscribes the client from a channel it was kicked or banned from. If it was the
+// active channel, the client falls back to another channel.
+func (c *Client) expel(hub *Hub) {
+	c.unsubscribe(hub)
+	c.resetActiveHub()
+}
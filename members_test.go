@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"ws/data"
+)
+
+func TestChangeMember(t *testing.T) {
+	channel := data.Channel{
+		ID: "team",
+		Participants: []data.Participant{
+			{Username: "olivia", Role: data.ChannelRoleOwner},
+			{Username: "adam", Role: data.ChannelRoleAdmin},
+			{Username: "mia"},
+		},
+	}
+	tests := []struct {
+		actionType data.ActionType
+		actor      string
+		admin      bool
+		target     string
+		role       string
+		want       error
+	}{
+		{data.ActionInviteMember, "mia", false, "nina", "", errNotModerator},
+		{data.ActionInviteMember, "adam", false, "nina", data.ChannelRoleAdmin, errNotOwner},
+		{data.ActionInviteMember, "adam", false, "nina", "guest", errInvalidRole},
+		{data.ActionInviteMember, "adam", false, "nina", "", nil},
+		{data.ActionInviteMember, "olivia", false, "nina", data.ChannelRoleAdmin, nil},
+		{data.ActionKickMember, "adam", false, "olivia", "", errInvalidMember},
+		{data.ActionKickMember, "adam", false, "adam", "", errInvalidMember},
+		{data.ActionKickMember, "adam", false, "nina", "", errNotMember},
+		{data.ActionKickMember, "adam", false, "mia", "", nil},
+		{data.ActionBanMember, "mia", true, "adam", "", nil},
+	}
+	for _, tt := range tests {
+		changed := channel
+		member := data.ChannelMemberData{Username: tt.target, Role: tt.role}
+		if err := changeMember(&changed, tt.actionType, tt.actor, tt.admin, &member); !errors.Is(err, tt.want) {
+			t.Errorf("%s of %s by %s: %v, want %v", tt.actionType, tt.target, tt.actor, err, tt.want)
+		}
+	}
+	if len(channel.Participants) != 3 || channel.Participants[2].Username != "mia" || channel.Banned != nil {
+		t.Errorf("changes modified the original definition: %+v", channel)
+	}
+
+	changed := channel
+	_ = changeMember(&changed, data.ActionBanMember, "olivia", false, &data.ChannelMemberData{Username: "mia"})
+	if participantRole(changed, "mia") != "" || !isBanned(changed, "mia") {
+		t.Errorf("banned definition = %+v", changed)
+	}
+	_ = changeMember(&changed, data.ActionInviteMember, "olivia", false, &data.ChannelMemberData{Username: "mia"})
+	if participantRole(changed, "mia") != data.ChannelRoleMember || isBanned(changed, "mia") {
+		t.Errorf("definition after invitation of a banned user = %+v", changed)
+	}
+}
+
+func TestPrivateChannelMembers(t *testing.T) {
+	channels := manager.channels
+	manager.channels = NewInMemoryChannelStore()
+	defer func() { manager.channels = channels }()
+
+	if _, err := manager.CreateChannel(data.Channel{ID: "test-private", OwnerID: "user1", Visibility: data.VisibilityPrivate}, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.DeleteHub("test-private")
+
+	var sessions []*Client
+	for _, username := range []string{"user1", "user2"} {
+		c := newTestClient(nil, username, data.RoleUser)
+		c.hub = c.subscribe(DefaultHubID)
+		manager.addSession(c)
+		sessions = append(sessions, c)
+		defer func() {
+			manager.removeSession(c)
+			c.unsubscribeAll()
+		}()
+	}
+	owner, user := sessions[0], sessions[1]
+	action := func(c *Client, actionType data.ActionType, actionData any) {
+		c.handleAction(data.ActionMessage{Action: data.Action{Type: actionType, Data: actionData}})
+	}
+	join := map[string]interface{}{"channel_id": "test-private"}
+	member := func(username string) map[string]interface{} {
+		return map[string]interface{}{"channel_id": "test-private", "username": username}
+	}
+
+	var errData data.ErrorData
+	action(user, data.ActionJoinChannel, join)
+	if receiveAction(t, user, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Fatalf("join of an uninvited user: %+v, want forbidden error", errData)
+	}
+	action(user, data.ActionInviteMember, member("user2"))
+	if receiveAction(t, user, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("invitation by a non-member: %+v, want forbidden error", errData)
+	}
+	action(user, data.ActionKickMember, member("user1"))
+	if receiveAction(t, user, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("kick by a non-member: %+v, want forbidden error", errData)
+	}
+
+	// The owner invites the user, who can then join.
+	action(owner, data.ActionInviteMember, member("user2"))
+	var memberData data.ChannelMemberData
+	for _, c := range []*Client{owner, user} {
+		if receiveAction(t, c, data.ActionInviteMember, &memberData); memberData.ActorID != "user1" || memberData.Role != data.ChannelRoleMember {
+			t.Errorf("%s: invitation = %+v", c.username, memberData)
+		}
+	}
+	action(user, data.ActionJoinChannel, join)
+	var history data.HistoryData
+	receiveAction(t, user, data.ActionFetchHistory, &history)
+	if _, ok := user.subscription("test-private"); !ok {
+		t.Fatalf("invited user is not subscribed")
+	}
+	action(user, data.ActionListChannels, nil)
+	var list data.ChannelListData
+	receiveAction(t, user, data.ActionListChannels, &list)
+	listed := false
+	for _, channel := range list.Channels {
+		listed = listed || channel.ID == "test-private"
+	}
+	if !listed {
+		t.Errorf("private channel is not listed to its member")
+	}
+
+	// A ban removes the user from the channel and keeps them out.
+	user.setActiveHub(manager.GetHub("test-private"))
+	action(owner, data.ActionBanMember, member("user2"))
+	if receiveAction(t, user, data.ActionBanMember, &memberData); memberData.Username != "user2" {
+		t.Errorf("ban = %+v", memberData)
+	}
+	if _, ok := user.subscription("test-private"); ok {
+		t.Errorf("banned user is still subscribed")
+	}
+	if hub := user.activeHub(); hub.id != DefaultHubID {
+		t.Errorf("banned user's active channel = %s, want the default channel", hub.id)
+	}
+	action(user, data.ActionJoinChannel, join)
+	if receiveAction(t, user, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("join of a banned user: %+v, want forbidden error", errData)
+	}
+	action(owner, data.ActionKickMember, member("user2"))
+	if receiveAction(t, owner, data.ActionError, &errData); errData.Code != errCodeNotFound {
+		t.Errorf("kick of a non-member: %+v, want not_found error", errData)
+	}
+}
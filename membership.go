@@ -0,0 +1,275 @@
+package main
+
+import (
+	"github.com/gflydev/core/log"
+	"sort"
+	"ws/data"
+)
+
+// subscribe registers the client with the hub of a channel and announces it to the channel.
+//
+// Parameters:
+// - channelID (string): The channel ID. The channel is created if it doesn't exist.
+//
+// Logic:
+// 1. Returns the hub if the client is already subscribed.
+// 2. Otherwise registers the client with the hub, records the subscription and broadcasts a
+// join_channel event to the channel, the client included. Joins of direct channels are not
+// broadcast.
+//
+// Returns:
+// - *Hub: The hub of the channel.
+//
+// Note: Other goroutines may subscribe the client to direct channels (see openDirect).
+func (c *Client) subscribe(channelID string) *Hub {
+	c.mu.Lock()
+	hub, joined := c.join(channelID)
+	c.mu.Unlock()
+
+	if joined {
+		c.announceJoin(hub)
+	}
+	return hub
+}
+
+// subscribeSession subscribes the client to a channel, like subscribe, if it is still a session
+// of the user.
+//
+// Parameters:
+// - username (string): The user whose sessions were read from the manager.
+// - channelID (string): The channel ID.
+//
+// Returns:
+// - bool: False if the client closed or logged in as another user since, see addSession.
+func (c *Client) subscribeSession(username, channelID string) bool {
+	c.mu.Lock()
+	if c.session != username {
+		c.mu.Unlock()
+		return false
+	}
+	hub, joined := c.join(channelID)
+	c.mu.Unlock()
+
+	if joined {
+		c.announceJoin(hub)
+	}
+	return true
+}
+
+// join registers the client with the hub of a channel and records the subscription, unless the
+// client is already subscribed. It is called with c.mu held.
+//
+// Returns:
+// - *Hub: The hub of the channel.
+// - bool: Whether the client was not subscribed before.
+func (c *Client) join(channelID string) (*Hub, bool) {
+	if hub, ok := c.hubs[channelID]; ok {
+		return hub, false
+	}
+	hub := manager.Join(channelID, c)
+	if c.hubs == nil {
+		c.hubs = make(map[string]*Hub)
+	}
+	c.hubs[channelID] = hub
+	return hub, true
+}
+
+// announceJoin broadcasts a join_channel event for a new subscription. Joins of direct
+// channels are not broadcast.
+func (c *Client) announceJoin(hub *Hub) {
+	log.Infof("Client %s joined channel %s", c.id, hub.id)
+	if !isDirectChannel(hub.id) {
+		hub.broadcastAction(data.Action{
+			Type: data.ActionJoinChannel,
+			Data: data.ChannelMembershipData{ChannelID: hub.id, UserID: c.senderID()},
+		})
+	}
+}
+
+// unsubscribe announces to a channel that the client leaves and unregisters it from the hub.
+//
+// Parameters:
+// - hub (*Hub): The hub of the channel.
+//
+// Logic:
+// 1. Broadcasts a leave_channel event to the channel, the client included, while the client is
+// still registered so that the hub cannot be reaped in between. Leaves of direct channels are
+// not broadcast.
+// 2. Unregisters the client and forgets the subscription.
+func (c *Client) unsubscribe(hub *Hub) {
+	if !isDirectChannel(hub.id) {
+		hub.broadcastAction(data.Action{
+			Type: data.ActionLeaveChannel,
+			Data: data.ChannelMembershipData{ChannelID: hub.id, UserID: c.senderID()},
+		})
+	}
+	hub.leave(c)
+
+	c.mu.Lock()
+	delete(c.hubs, hub.id)
+	c.mu.Unlock()
+	log.Infof("Client %s left channel %s", c.id, hub.id)
+}
+
+// subscriptions returns the hubs the client is subscribed to.
+func (c *Client) subscriptions() []*Hub {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hubs := make([]*Hub, 0, len(c.hubs))
+	for _, hub := range c.hubs {
+		hubs = append(hubs, hub)
+	}
+	return hubs
+}
+
+// subscription returns the hub of a channel the client is subscribed to.
+func (c *Client) subscription(channelID string) (*Hub, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hub, ok := c.hubs[channelID]
+	return hub, ok
+}
+
+// unsubscribeAll leaves every channel when the connection closes.
+func (c *Client) unsubscribeAll() {
+	for _, hub := range c.subscriptions() {
+		c.unsubscribe(hub)
+	}
+	if hub := c.activeHub(); hub != nil {
+		if _, ok := c.subscription(hub.id); !ok {
+			// The active hub is not a subscription when the client was set up directly.
+			hub.leave(c)
+		}
+	}
+}
+
+// channelHub returns the hub an action is addressed to.
+//
+// Parameters:
+// - channelID (string): The channel of the action, from the action message.
+//
+// Returns:
+// - *Hub: The active channel's hub if channelID is empty, the subscribed channel's hub otherwise.
+// - bool: False if the client is not subscribed to the channel.
+func (c *Client) channelHub(channelID string) (*Hub, bool) {
+	if hub := c.activeHub(); channelID == "" || channelID == hub.id {
+		return hub, true
+	}
+	return c.subscription(channelID)
+}
+
+// sendNotSubscribed queues the error response for an action addressed to a channel the client
+// is not subscribed to.
+func (c *Client) sendNotSubscribed(actionType data.ActionType, channelID string) {
+	c.sendError(actionType, errCodeForbidden, "not subscribed to channel "+channelID)
+}
+
+// handleJoinChannel subscribes the client to a channel in addition to its current channels.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The join_channel action.
+//
+// Logic:
+// 1. Decodes data.ChannelMembershipData and rejects requests without channel ID, or for a
+// direct channel of other users.
+// 2. Subscribes the client, which broadcasts the join to the channel. Joining a subscribed
+// channel does nothing.
+// 3. Sends the recent messages of the channel to the client.
+func (c *Client) handleJoinChannel(actionMsg data.ActionMessage) {
+	var joinData data.ChannelMembershipData
+	if err := decodeActionData(actionMsg.Action.Data, &joinData); err != nil || joinData.ChannelID == "" {
+		c.sendError(data.ActionJoinChannel, errCodeInvalidRequest, "channel_id is required")
+		return
+	}
+	if !c.canAccessChannel(joinData.ChannelID) {
+		c.sendError(data.ActionJoinChannel, errCodeForbidden, "not allowed to join channel "+joinData.ChannelID)
+		return
+	}
+	if _, ok := c.subscription(joinData.ChannelID); ok {
+		return
+	}
+
+	hub := c.subscribe(joinData.ChannelID)
+	c.sendRecentHistory(hub)
+}
+
+// handleLeaveChannel unsubscribes the client from a channel.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The leave_channel action.
+//
+// Logic:
+// 1. Decodes data.ChannelMembershipData and rejects requests without channel ID, for a channel
+// the client is not subscribed to, or for the client's last channel.
+// 2. Unsubscribes the client, which broadcasts the leave to the channel.
+// 3. If the client left its active channel, the default channel or else the first subscribed
+// channel by ID becomes active.
+func (c *Client) handleLeaveChannel(actionMsg data.ActionMessage) {
+	var leaveData data.ChannelMembershipData
+	if err := decodeActionData(actionMsg.Action.Data, &leaveData); err != nil || leaveData.ChannelID == "" {
+		c.sendError(data.ActionLeaveChannel, errCodeInvalidRequest, "channel_id is required")
+		return
+	}
+	hub, ok := c.subscription(leaveData.ChannelID)
+	if !ok {
+		c.sendError(data.ActionLeaveChannel, errCodeNotFound, "not subscribed to channel "+leaveData.ChannelID)
+		return
+	}
+	if len(c.subscriptions()) == 1 {
+		c.sendError(data.ActionLeaveChannel, errCodeInvalidRequest, "cannot leave the last channel")
+		return
+	}
+
+	c.unsubscribe(hub)
+	c.resetActiveHub()
+}
+
+// activeHub returns the hub of the client's active channel.
+func (c *Client) activeHub() *Hub {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hub
+}
+
+// setActiveHub makes a channel the client is subscribed to its active channel.
+func (c *Client) setActiveHub(hub *Hub) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hub = hub
+}
+
+// resetActiveHub picks a new active channel once the client is no longer subscribed to its
+// active channel: the default channel if subscribed, the first subscribed channel by ID
+// otherwise. A client left without subscriptions is subscribed to the default channel.
+func (c *Client) resetActiveHub() {
+	if hub := c.activeHub(); hub == nil {
+		return
+	} else if _, ok := c.subscription(hub.id); ok {
+		return
+	}
+	if len(c.subscriptions()) == 0 {
+		c.subscribe(DefaultHubID)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hub = c.fallbackHub()
+}
+
+// fallbackHub returns the hub that becomes active when the client leaves its active channel.
+// The caller must hold c.mu.
+func (c *Client) fallbackHub() *Hub {
+	if hub, ok := c.hubs[DefaultHubID]; ok {
+		return hub
+	}
+	ids := make([]string, 0, len(c.hubs))
+	for id := range c.hubs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return c.hubs[ids[0]]
+}
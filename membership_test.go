@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"ws/data"
+)
+
+// receiveAction waits for an action of the given type sent to a client, skipping other messages,
+// and decodes its data. It returns the channel the action was tagged with.
+func receiveAction(t *testing.T, c *Client, typ data.ActionType, v any) data.Channel {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case p := <-c.send:
+			var msg struct {
+				Channel data.Channel `json:"channel"`
+			}
+			_ = json.Unmarshal(p, &msg)
+			if decodeAction(t, p, nil) == typ {
+				decodeAction(t, p, v)
+				return msg.Channel
+			}
+		case <-timeout:
+			t.Fatalf("%s: no %s action", c.username, typ)
+		}
+	}
+}
+
+func TestJoinAndLeaveChannels(t *testing.T) {
+	alice := newTestClient(nil, "alice", data.RoleUser)
+	bob := newTestClient(nil, "bob", data.RoleUser)
+	alice.hub = alice.subscribe("test-lobby")
+	bob.hub = bob.subscribe("test-team")
+	defer alice.unsubscribeAll()
+	defer bob.unsubscribeAll()
+	var membership data.ChannelMembershipData
+	receiveAction(t, alice, data.ActionJoinChannel, &membership)
+	receiveAction(t, bob, data.ActionJoinChannel, &membership)
+
+	action := func(c *Client, actionType data.ActionType, channelID string, actionData any) {
+		c.handleAction(data.ActionMessage{
+			Channel: data.Channel{ID: channelID},
+			Action:  data.Action{Type: actionType, Data: actionData},
+		})
+	}
+
+	// Alice joins the team channel; bob sees the join.
+	action(alice, data.ActionJoinChannel, "", map[string]interface{}{"channel_id": "test-team"})
+	if channel := receiveAction(t, bob, data.ActionJoinChannel, &membership); channel.ID != "test-team" ||
+		membership != (data.ChannelMembershipData{ChannelID: "test-team", UserID: "alice"}) {
+		t.Fatalf("join event = %+v in %+v", membership, channel)
+	}
+	var history data.HistoryData
+	if receiveAction(t, alice, data.ActionFetchHistory, &history); history.ChannelID != "test-team" {
+		t.Errorf("history after join = %+v", history)
+	}
+	if alice.hub.id != "test-lobby" || len(alice.hubs) != 2 {
+		t.Errorf("alice active channel %s, subscriptions %v", alice.hub.id, alice.hubs)
+	}
+
+	// Messages addressed to a subscribed channel are tagged with it, without text prefix.
+	action(alice, data.ActionSendMessage, "test-team", map[string]interface{}{
+		"message": map[string]interface{}{"id": "m1", "type": "text", "content": map[string]interface{}{"text": "hi"}},
+	})
+	var msgSend data.MessageSend
+	p := <-bob.send
+	if err := json.Unmarshal(p, &msgSend); err != nil || msgSend.Channel.ID != "test-team" || msgSend.Message.SenderID != "alice" {
+		t.Fatalf("message = %s", p)
+	}
+	if content, _ := msgSend.Message.Content.(map[string]interface{}); content["text"] != "hi" {
+		t.Errorf("message content = %v, want the original text", msgSend.Message.Content)
+	}
+
+	var errData data.ErrorData
+	action(alice, data.ActionSendMessage, "test-elsewhere", map[string]interface{}{"message": map[string]interface{}{"type": "text"}})
+	if receiveAction(t, alice, data.ActionError, &errData); errData.Code != errCodeForbidden {
+		t.Errorf("message to an unsubscribed channel: %+v, want forbidden error", errData)
+	}
+
+	// Alice leaves her active channel; the team channel becomes active.
+	action(alice, data.ActionLeaveChannel, "", map[string]interface{}{"channel_id": "test-lobby"})
+	if receiveAction(t, alice, data.ActionLeaveChannel, &membership); membership.ChannelID != "test-lobby" {
+		t.Errorf("leave event = %+v", membership)
+	}
+	if alice.hub.id != "test-team" || len(alice.hubs) != 1 {
+		t.Errorf("alice active channel %s, subscriptions %v", alice.hub.id, alice.hubs)
+	}
+
+	action(alice, data.ActionLeaveChannel, "", map[string]interface{}{"channel_id": "test-team"})
+	if receiveAction(t, alice, data.ActionError, &errData); errData.Code != errCodeInvalidRequest {
+		t.Errorf("leave of the last channel: %+v, want invalid_request error", errData)
+	}
+	action(alice, data.ActionLeaveChannel, "", map[string]interface{}{"channel_id": "test-lobby"})
+	if receiveAction(t, alice, data.ActionError, &errData); errData.Code != errCodeNotFound {
+		t.Errorf("leave of an unsubscribed channel: %+v, want not_found error", errData)
+	}
+}
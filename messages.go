@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gflydev/core/log"
+	"sync"
+	"time"
+	"ws/data"
+)
+
+const (
+	// Error codes of error responses.
+	errCodeInvalidRequest = "invalid_request"
+	errCodeNotFound       = "not_found"
+	errCodeForbidden      = "forbidden"
+	errCodeInternal       = "internal_error"
+)
+
+var (
+	// errMessageNotFound is returned for unknown or deleted messages.
+	errMessageNotFound = errors.New("message not found")
+
+	// errNotMessageSender is returned when a user changes a message sent by somebody else.
+	errNotMessageSender = errors.New("only the sender or an admin can change this message")
+)
+
+// messageLog gives a hub access to the messages of its channel in the message store so that
+// they can be edited and deleted. It is safe for concurrent use by the readPump goroutines of
+// the hub's clients.
+type messageLog struct {
+	mu        sync.Mutex // serializes read-modify-write changes of messages
+	store     MessageStore
+	channelID string
+}
+
+// newMessageLog creates the message log of a channel.
+//
+// Parameters:
+// - store (MessageStore): The store holding the messages.
+// - channelID (string): The channel ID.
+//
+// Returns:
+// - *messageLog: The message log.
+func newMessageLog(store MessageStore, channelID string) *messageLog {
+	return &messageLog{
+		store:     store,
+		channelID: channelID,
+	}
+}
+
+// add records a message sent to the hub.
+//
+// Parameters:
+// - message (data.Message): The message. Its ID must not be stored yet.
+//
+// Logic:
+// 1. Appends the message to the channel's history.
+// 2. Appends it with a new ID if a message with its ID was stored after prepareMessage checked it.
+//
+// Returns:
+// - data.Message: The message as stored.
+// - error: A storage error; the message must not be broadcast.
+func (l *messageLog) add(message data.Message) (data.Message, error) {
+	err := l.store.Append(l.channelID, message)
+	if errors.Is(err, ErrMessageExists) {
+		message.ID = generateID()
+		err = l.store.Append(l.channelID, message)
+	}
+	return message, err
+}
+
+// contains reports whether a message ID is stored, including deleted messages.
+func (l *messageLog) contains(id string) bool {
+	_, ok := l.store.Get(l.channelID, id)
+	return ok
+}
+
+// history returns a page of the channel's history.
+func (l *messageLog) history(query HistoryQuery) (HistoryPage, error) {
+	return l.store.History(l.channelID, query)
+}
+
+// evict releases what the store holds for the channel once the hub has stopped.
+func (l *messageLog) evict() {
+	if store, ok := l.store.(ChannelEvicter); ok {
+		if err := store.Evict(l.channelID); err != nil {
+			log.Errorf("Error closing the messages of channel %s: %v", l.channelID, err)
+		}
+	}
+}
+
+// change looks up a message that the user may change.
+// The caller must hold l.mu.
+func (l *messageLog) change(id, userID string, isAdmin bool) (data.Message, error) {
+	message, ok := l.store.Get(l.channelID, id)
+	if !ok || message.Deleted {
+		return data.Message{}, errMessageNotFound
+	}
+	if message.SenderID != userID && !isAdmin {
+		return data.Message{}, errNotMessageSender
+	}
+	return message, nil
+}
+
+// edit replaces the content of a message and records the previous content in its edit history.
+//
+// Parameters:
+// - id (string): The message ID.
+// - editorID (string): The user editing the message.
+// - isAdmin (bool): Whether the user is an admin; admins may edit any message.
+// - content (any): The new content.
+// - at (time.Time): The time of the edit.
+//
+// Returns:
+// - data.Message: The edited message.
+// - error: errMessageNotFound, errNotMessageSender or a storage error.
+func (l *messageLog) edit(id, editorID string, isAdmin bool, content any, at time.Time) (data.Message, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	message, err := l.change(id, editorID, isAdmin)
+	if err != nil {
+		return data.Message{}, err
+	}
+	// The full slice expression makes append copy the edits instead of writing to the
+	// backing array shared with the stored message.
+	message.Edits = append(message.Edits[:len(message.Edits):len(message.Edits)], data.MessageEdit{
+		Content:  message.Content,
+		EditedAt: at,
+		EditorID: editorID,
+	})
+	message.Content = content
+	message.EditedAt = &at
+	if err := l.store.Update(l.channelID, message); err != nil {
+		return data.Message{}, err
+	}
+	return message, nil
+}
+
+// remove deletes a message. The message stays in the store as a tombstone without content.
+//
+// Parameters:
+// - id (string): The message ID.
+// - userID (string): The user deleting the message.
+// - isAdmin (bool): Whether the user is an admin; admins may delete any message.
+//
+// Returns:
+// - error: errMessageNotFound, errNotMessageSender or a storage error.
+func (l *messageLog) remove(id, userID string, isAdmin bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	message, err := l.change(id, userID, isAdmin)
+	if err != nil {
+		return err
+	}
+	message.Deleted = true
+	message.Content = nil
+	message.Edits = nil
+	return l.store.Update(l.channelID, message)
+}
+
+// senderID returns the ID recorded as the sender of the client's messages: the username of
+// an authenticated client, the connection ID of a guest.
+func (c *Client) senderID() string {
+	if username, ok := c.identity(); ok {
+		return username
+	}
+	return c.id
+}
+
+// identity returns the username of the client and whether it is authenticated. Unlike the
+// fields, it may be called from any goroutine.
+func (c *Client) identity() (string, bool) {
+	c.identityMu.RLock()
+	defer c.identityMu.RUnlock()
+	return c.username, c.authenticated
+}
+
+// isAdmin reports whether the client is authenticated as an admin.
+func (c *Client) isAdmin() bool {
+	c.identityMu.RLock()
+	defer c.identityMu.RUnlock()
+	return c.authenticated && c.role == data.RoleAdmin
+}
+
+// prepareMessage stamps a message received from the client before it is tracked and broadcast.
+//
+// Parameters:
+// - hub (*Hub): The hub the message is sent to.
+// - message (data.Message): The message as sent by the client.
+//
+// Logic:
+// 1. Sets the sender to the client's identity, ignoring the sender sent by the client.
+// 2. Generates an ID if the message has none or reuses the ID of a message of the hub.
+// 3. Sets the timestamp to the current time if it is missing.
+// 4. Clears server-managed fields (reactions, edit history, deletion mark).
+//
+// Returns:
+// - data.Message: The stamped message.
+func (c *Client) prepareMessage(hub *Hub, message data.Message) data.Message {
+	message.SenderID = c.senderID()
+	if message.ID == "" || hub.messages.contains(message.ID) {
+		message.ID = generateID()
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	message.Reactions = []data.Reaction{}
+	message.EditedAt = nil
+	message.Edits = nil
+	message.Deleted = false
+	return message
+}
+
+// storeMessage stamps a message received from the client and records it in the history of the
+// hub it is sent to. If the message cannot be stored, the client receives an internal error.
+//
+// Returns:
+// - data.Message: The stored message.
+// - bool: Whether the message was stored and may be broadcast.
+func (c *Client) storeMessage(hub *Hub, message data.Message) (data.Message, bool) {
+	message, err := hub.messages.add(c.prepareMessage(hub, message))
+	if err != nil {
+		log.Errorf("Error storing message %s of channel %s: %v", message.ID, hub.id, err)
+		c.sendError(data.ActionSendMessage, errCodeInternal, "the message could not be saved")
+		return data.Message{}, false
+	}
+	return message, true
+}
+
+// sendAction queues an action message for the client only.
+//
+// Parameters:
+// - action (data.Action): The action to send.
+func (c *Client) sendAction(action data.Action) {
+	jsonResponse, err := marshalAction(action)
+	if err != nil {
+		log.Errorf("Error marshaling %s response to JSON: %v", action.Type, err)
+		return
+	}
+	c.send <- jsonResponse
+}
+
+// notifyAction queues an action for the client from the goroutine of another client. Like a hub
+// broadcast it does not block: a client whose send buffer is full is dropped.
+//
+// Parameters:
+// - action (data.Action): The action to send.
+func (c *Client) notifyAction(action data.Action) {
+	jsonResponse, err := marshalAction(action)
+	if err != nil {
+		log.Errorf("Error marshaling %s notification to JSON: %v", action.Type, err)
+		return
+	}
+	select {
+	case c.send <- jsonResponse:
+	default:
+		c.dropSlow()
+	}
+}
+
+// marshalAction encodes an action message holding the action.
+func marshalAction(action data.Action) ([]byte, error) {
+	return json.Marshal(data.ActionMessage{
+		Metadata: data.Metadata{
+			Version:   "1.0",
+			Timestamp: time.Now(),
+		},
+		Action: action,
+	})
+}
+
+// sendError queues an error response for a rejected action.
+//
+// Parameters:
+// - actionType (data.ActionType): The type of the rejected action.
+// - code (string): The error code (errCodeInvalidRequest, errCodeNotFound, errCodeForbidden).
+// - message (string): A description of the error.
+func (c *Client) sendError(actionType data.ActionType, code, message string) {
+	c.sendAction(data.Action{
+		Type: data.ActionError,
+		Data: data.ErrorData{
+			Action:  actionType,
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// sendChangeError queues the error response for a failed edit or deletion. Storage errors are
+// logged and reported without their details.
+func (c *Client) sendChangeError(actionType data.ActionType, id string, err error) {
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		c.sendError(actionType, errCodeNotFound, err.Error())
+	case errors.Is(err, errNotMessageSender):
+		c.sendError(actionType, errCodeForbidden, err.Error())
+	default:
+		log.Errorf("Error saving %s of message %s: %v", actionType, id, err)
+		c.sendError(actionType, errCodeInternal, "the change could not be saved")
+	}
+}
+
+// broadcastAction sends an action message, tagged with the channel, to all clients of the hub.
+//
+// Parameters:
+// - action (data.Action): The action to broadcast.
+func (h *Hub) broadcastAction(action data.Action) {
+	jsonMessage, err := h.marshalAction(action)
+	if err != nil {
+		log.Errorf("Error marshaling %s event to JSON: %v", action.Type, err)
+		return
+	}
+	h.publish(jsonMessage)
+}
+
+// marshalAction encodes an action message holding the action, tagged with the channel.
+func (h *Hub) marshalAction(action data.Action) ([]byte, error) {
+	return json.Marshal(data.ActionMessage{
+		Metadata: data.Metadata{
+			Version:   "1.0",
+			Timestamp: time.Now(),
+		},
+		Channel: h.channelTag(),
+		Action:  action,
+	})
+}
+
+// channelTag returns the channel information added to the messages of the hub.
+func (h *Hub) channelTag() data.Channel {
+	return data.Channel{ID: h.id, Name: h.name}
+}
+
+// decodeActionData decodes the data of an action into the given struct.
+//
+// Parameters:
+// - actionData (interface{}): The action data as decoded from JSON.
+// - v (any): A pointer to the struct to decode into.
+//
+// Returns:
+// - error: An error if the data does not match the struct.
+func decodeActionData(actionData interface{}, v any) error {
+	raw, err := json.Marshal(actionData)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// handleEditMessage edits a message of a channel and broadcasts the edit.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The edit_message action.
+//
+// Logic:
+// 1. Decodes data.MessageEditData and rejects requests without a message ID or content, or for a
+// channel the client is not subscribed to. The channel defaults to the active channel.
+// 2. Edits the message if the client sent it or is an admin; otherwise sends an error response.
+// 3. Broadcasts the edit, with the editor and time of the edit, to the channel.
+func (c *Client) handleEditMessage(actionMsg data.ActionMessage) {
+	var editData data.MessageEditData
+	if err := decodeActionData(actionMsg.Action.Data, &editData); err != nil || editData.MessageID == "" || editData.NewContent == nil {
+		c.sendError(data.ActionEditMessage, errCodeInvalidRequest, "message_id and new_content are required")
+		return
+	}
+	hub, ok := c.channelHub(actionMsg.Channel.ID)
+	if !ok {
+		c.sendNotSubscribed(data.ActionEditMessage, actionMsg.Channel.ID)
+		return
+	}
+
+	now := time.Now()
+	if _, err := hub.messages.edit(editData.MessageID, c.senderID(), c.isAdmin(), editData.NewContent, now); err != nil {
+		c.sendChangeError(data.ActionEditMessage, editData.MessageID, err)
+		return
+	}
+	log.Infof("Client %s edited message %s in channel %s", c.id, editData.MessageID, hub.id)
+
+	hub.broadcastAction(data.Action{
+		Type: data.ActionEditMessage,
+		Data: data.MessageEditData{
+			MessageID:  editData.MessageID,
+			NewContent: editData.NewContent,
+			EditorID:   c.senderID(),
+			EditedAt:   &now,
+		},
+	})
+}
+
+// handleDeleteMessage deletes a message of a channel and broadcasts the deletion.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The delete_message action.
+//
+// Logic:
+// 1. Decodes data.MessageDeleteData and rejects requests without a message ID, or for a channel
+// the client is not subscribed to. The channel defaults to the active channel.
+// 2. Deletes the message if the client sent it or is an admin; otherwise sends an error response.
+// 3. Broadcasts the deletion to the channel.
+func (c *Client) handleDeleteMessage(actionMsg data.ActionMessage) {
+	var deleteData data.MessageDeleteData
+	if err := decodeActionData(actionMsg.Action.Data, &deleteData); err != nil || deleteData.MessageID == "" {
+		c.sendError(data.ActionDeleteMessage, errCodeInvalidRequest, "message_id is required")
+		return
+	}
+	hub, ok := c.channelHub(actionMsg.Channel.ID)
+	if !ok {
+		c.sendNotSubscribed(data.ActionDeleteMessage, actionMsg.Channel.ID)
+		return
+	}
+
+	if err := hub.messages.remove(deleteData.MessageID, c.senderID(), c.isAdmin()); err != nil {
+		c.sendChangeError(data.ActionDeleteMessage, deleteData.MessageID, err)
+		return
+	}
+	log.Infof("Client %s deleted message %s in channel %s", c.id, deleteData.MessageID, hub.id)
+
+	now := time.Now()
+	hub.broadcastAction(data.Action{
+		Type: data.ActionDeleteMessage,
+		Data: data.MessageDeleteData{
+			MessageID: deleteData.MessageID,
+			DeletedBy: c.senderID(),
+			DeletedAt: &now,
+		},
+	})
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"ws/data"
+)
+
+func TestMessageLogEditAndRemove(t *testing.T) {
+	l := newMessageLog(NewInMemoryMessageStore(10), "test")
+	l.add(data.Message{ID: "m1", SenderID: "alice", Content: "first"})
+
+	if _, err := l.edit("m1", "bob", false, "hijacked", time.Now()); !errors.Is(err, errNotMessageSender) {
+		t.Fatalf("edit by another user: %v, want %v", err, errNotMessageSender)
+	}
+	if _, err := l.edit("m2", "alice", false, "x", time.Now()); !errors.Is(err, errMessageNotFound) {
+		t.Fatalf("edit of unknown message: %v, want %v", err, errMessageNotFound)
+	}
+
+	at := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := l.edit("m1", "alice", false, "second", at); err != nil {
+		t.Fatalf("edit by sender: %v", err)
+	}
+	m, err := l.edit("m1", "admin", true, "third", at.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("edit by admin: %v", err)
+	}
+	if m.Content != "third" || m.EditedAt == nil || !m.EditedAt.Equal(at.Add(time.Minute)) {
+		t.Errorf("edited message = %+v", m)
+	}
+	if len(m.Edits) != 2 || m.Edits[0].Content != "first" || m.Edits[1].Content != "second" ||
+		m.Edits[0].EditorID != "alice" || m.Edits[1].EditorID != "admin" || !m.Edits[0].EditedAt.Equal(at) {
+		t.Errorf("edit history = %+v", m.Edits)
+	}
+
+	if err := l.remove("m1", "bob", false); !errors.Is(err, errNotMessageSender) {
+		t.Fatalf("remove by another user: %v, want %v", err, errNotMessageSender)
+	}
+	if err := l.remove("m1", "alice", false); err != nil {
+		t.Fatalf("remove by sender: %v", err)
+	}
+	if err := l.remove("m1", "alice", false); !errors.Is(err, errMessageNotFound) {
+		t.Fatalf("second remove: %v, want %v", err, errMessageNotFound)
+	}
+	if _, err := l.edit("m1", "alice", false, "again", time.Now()); !errors.Is(err, errMessageNotFound) {
+		t.Fatalf("edit of deleted message: %v, want %v", err, errMessageNotFound)
+	}
+	if !l.contains("m1") {
+		t.Errorf("deleted message is no longer tracked")
+	}
+}
+
+func TestMessageLogLimit(t *testing.T) {
+	l := newMessageLog(NewInMemoryMessageStore(2), "test")
+	for _, id := range []string{"m1", "m2", "m3"} {
+		l.add(data.Message{ID: id, SenderID: "alice"})
+	}
+	if l.contains("m1") || !l.contains("m2") || !l.contains("m3") {
+		t.Errorf("log holds m1=%v m2=%v m3=%v, want only the last two", l.contains("m1"), l.contains("m2"), l.contains("m3"))
+	}
+}
+
+// newTestHub returns a hub, not running, with its own in-memory message store.
+func newTestHub(name string) *Hub {
+	hub := newHub(name, name)
+	hub.messages = newMessageLog(NewInMemoryMessageStore(0), name)
+	return hub
+}
+
+// newTestClient returns an authenticated client whose hub is not running. Broadcasts can be
+// read from hub.broadcast and responses from client.send.
+func newTestClient(hub *Hub, username, role string) *Client {
+	return &Client{
+		hub:           hub,
+		send:          make(chan []byte, 16),
+		slow:          make(chan struct{}),
+		id:            username + "-conn",
+		username:      username,
+		authenticated: true,
+		role:          role,
+	}
+}
+
+// decodeAction decodes an action message and its data.
+func decodeAction(t *testing.T, p []byte, v any) data.ActionType {
+	t.Helper()
+	var msg struct {
+		Action struct {
+			Type data.ActionType `json:"type"`
+			Data json.RawMessage `json:"data"`
+		} `json:"action"`
+	}
+	if err := json.Unmarshal(p, &msg); err != nil {
+		t.Fatalf("invalid message %s: %v", p, err)
+	}
+	if v != nil {
+		if err := json.Unmarshal(msg.Action.Data, v); err != nil {
+			t.Fatalf("invalid action data %s: %v", msg.Action.Data, err)
+		}
+	}
+	return msg.Action.Type
+}
+
+func TestHandleEditAndDeleteMessage(t *testing.T) {
+	hub := newTestHub("test")
+	alice := newTestClient(hub, "alice", data.RoleUser)
+	bob := newTestClient(hub, "bob", data.RoleUser)
+	admin := newTestClient(hub, "admin", data.RoleAdmin)
+	hub.messages.add(alice.prepareMessage(hub, data.Message{ID: "m1", SenderID: "spoofed", Content: "hello"}))
+
+	action := func(c *Client, actionType data.ActionType, actionData any) {
+		go c.handleAction(data.ActionMessage{Action: data.Action{Type: actionType, Data: actionData}})
+	}
+
+	// Edits of another user's message are rejected.
+	action(bob, data.ActionEditMessage, map[string]interface{}{"message_id": "m1", "new_content": "bob was here"})
+	var errData data.ErrorData
+	if typ := decodeAction(t, <-bob.send, &errData); typ != data.ActionError || errData.Code != errCodeForbidden {
+		t.Fatalf("response = %s %+v, want forbidden error", typ, errData)
+	}
+
+	// The sender's edit is broadcast with the editor and time.
+	action(alice, data.ActionEditMessage, map[string]interface{}{"message_id": "m1", "new_content": "hello, world"})
+	var edit data.MessageEditData
+	if typ := decodeAction(t, <-hub.broadcast, &edit); typ != data.ActionEditMessage || edit.EditorID != "alice" || edit.NewContent != "hello, world" || edit.EditedAt == nil {
+		t.Fatalf("broadcast = %s %+v", typ, edit)
+	}
+
+	// Admins may delete any message.
+	action(admin, data.ActionDeleteMessage, map[string]interface{}{"message_id": "m1"})
+	var deletion data.MessageDeleteData
+	if typ := decodeAction(t, <-hub.broadcast, &deletion); typ != data.ActionDeleteMessage || deletion.MessageID != "m1" || deletion.DeletedBy != "admin" {
+		t.Fatalf("broadcast = %s %+v", typ, deletion)
+	}
+
+	action(alice, data.ActionDeleteMessage, map[string]interface{}{"message_id": "m1"})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeNotFound {
+		t.Fatalf("response = %s %+v, want not_found error", typ, errData)
+	}
+	action(alice, data.ActionDeleteMessage, map[string]interface{}{})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInvalidRequest {
+		t.Fatalf("response = %s %+v, want invalid_request error", typ, errData)
+	}
+
+	// Storage failures are internal errors.
+	store := &failingMessageStore{InMemoryMessageStore: NewInMemoryMessageStore(0)}
+	hub.messages = newMessageLog(store, hub.id)
+	hub.messages.add(alice.prepareMessage(hub, data.Message{ID: "m2"}))
+	store.err = errors.New("disk full")
+	action(alice, data.ActionEditMessage, map[string]interface{}{"message_id": "m2", "new_content": "hi"})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInternal || strings.Contains(errData.Message, "disk") {
+		t.Fatalf("response = %s %+v, want internal error", typ, errData)
+	}
+}
+
+func TestSendMessageIDs(t *testing.T) {
+	hub := newTestHub("test")
+	other := newTestHub("test-other")
+	alice := newTestClient(hub, "alice", data.RoleUser)
+	other.messages.add(alice.prepareMessage(other, data.Message{ID: "m1"}))
+
+	// IDs are checked against the channel the message is sent to, not the active channel.
+	if message := alice.prepareMessage(hub, data.Message{ID: "m1"}); message.ID != "m1" {
+		t.Errorf("message ID = %s, want m1 kept in another channel", message.ID)
+	}
+	if message := alice.prepareMessage(other, data.Message{ID: "m1"}); message.ID == "m1" {
+		t.Error("message ID m1 of the channel was reused")
+	}
+
+	// A message stored after the check gets a new ID.
+	message := alice.prepareMessage(hub, data.Message{ID: "m2"})
+	hub.messages.add(message)
+	if stored, err := hub.messages.add(message); err != nil || stored.ID == "m2" {
+		t.Errorf("add of a stored ID = %s, %v, want a new ID", stored.ID, err)
+	}
+
+	// Messages that cannot be stored are rejected instead of broadcast.
+	store := &failingMessageStore{InMemoryMessageStore: NewInMemoryMessageStore(0), err: errors.New("disk full")}
+	hub.messages = newMessageLog(store, hub.id)
+	alice.handleAction(data.ActionMessage{Action: data.Action{Type: data.ActionSendMessage, Data: map[string]interface{}{
+		"message": map[string]interface{}{"type": "text", "content": "hello"},
+	}}})
+	var errData data.ErrorData
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInternal || strings.Contains(errData.Message, "disk") {
+		t.Fatalf("response = %s %+v, want internal error", typ, errData)
+	}
+	if len(hub.broadcast) != 0 {
+		t.Error("unsaved message was broadcast")
+	}
+}
+
+func TestBroadcastToStoppedHub(t *testing.T) {
+	hub := newTestHub("test")
+	alice := newTestClient(hub, "alice", data.RoleUser)
+	close(hub.done)
+
+	// Messages and events for a stopped hub are dropped instead of blocking the sender.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		alice.handleAction(data.ActionMessage{Action: data.Action{Type: data.ActionSendMessage, Data: map[string]interface{}{
+			"message": map[string]interface{}{"type": "text", "content": "hello"},
+		}}})
+		hub.broadcastAction(data.Action{Type: data.ActionDeleteMessage, Data: data.MessageDeleteData{MessageID: "m1"}})
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("broadcasting to a stopped hub blocked")
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"ws/data"
+)
+
+const (
+	// Default number of messages returned by a history query.
+	defaultHistoryLimit = 50
+
+	// Maximum number of messages returned by a history query.
+	maxHistoryLimit = 200
+
+	// Default number of messages an in-memory store keeps per channel.
+	defaultMessagesPerChannel = 10000
+)
+
+// ErrCursorNotFound is returned by MessageStore.History when the Before or After message is unknown
+var ErrCursorNotFound = errors.New("history cursor not found")
+
+// ErrMessageExists is returned by MessageStore.Append for a message ID already stored in the channel
+var ErrMessageExists = errors.New("message already exists")
+
+// HistoryQuery selects a page of a channel's history
+type HistoryQuery struct {
+	// Before selects the messages older than this message ID
+	Before string
+
+	// After selects the messages newer than this message ID (ignored if Before is set)
+	After string
+
+	// Limit is the maximum number of messages, defaultHistoryLimit if zero
+	Limit int
+}
+
+// HistoryPage is a page of a channel's history
+type HistoryPage struct {
+	// Messages in the order they were sent, oldest first
+	Messages []data.Message
+
+	// HasMore is true if there are more messages in the direction of the query
+	HasMore bool
+}
+
+// MessageStore defines the interface for message history storage
+type MessageStore interface {
+	// Append adds a new message at the end of a channel's history
+	Append(channelID string, message data.Message) error
+
+	// Update replaces a stored message with the same ID
+	Update(channelID string, message data.Message) error
+
+	// Get retrieves a message by ID
+	Get(channelID, messageID string) (data.Message, bool)
+
+	// History returns a page of a channel's history
+	History(channelID string, query HistoryQuery) (HistoryPage, error)
+}
+
+// channelHistory holds the messages of one channel in the order they were sent
+type channelHistory struct {
+	messages []data.Message
+	index    map[string]int // message ID to sequence number
+	offset   int            // sequence number of messages[0]
+}
+
+func newChannelHistory() *channelHistory {
+	return &channelHistory{index: make(map[string]int)}
+}
+
+func (h *channelHistory) append(message data.Message) {
+	h.index[message.ID] = h.offset + len(h.messages)
+	h.messages = append(h.messages, message)
+}
+
+func (h *channelHistory) get(messageID string) (int, bool) {
+	seq, ok := h.index[messageID]
+	return seq - h.offset, ok
+}
+
+// trim forgets the oldest messages so that at most limit messages are kept
+func (h *channelHistory) trim(limit int) {
+	for limit > 0 && len(h.messages) > limit {
+		delete(h.index, h.messages[0].ID)
+		h.messages = h.messages[1:]
+		h.offset++
+	}
+}
+
+// page selects the messages of a query
+func (h *channelHistory) page(query HistoryQuery) (HistoryPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	var start, end int
+	switch {
+	case query.Before != "":
+		pos, ok := h.get(query.Before)
+		if !ok {
+			return HistoryPage{}, ErrCursorNotFound
+		}
+		end = pos
+		start = max(end-limit, 0)
+	case query.After != "":
+		pos, ok := h.get(query.After)
+		if !ok {
+			return HistoryPage{}, ErrCursorNotFound
+		}
+		start = pos + 1
+		end = min(start+limit, len(h.messages))
+	default:
+		end = len(h.messages)
+		start = max(end-limit, 0)
+	}
+
+	page := HistoryPage{Messages: make([]data.Message, end-start)}
+	copy(page.Messages, h.messages[start:end])
+	if query.Before == "" && query.After != "" {
+		page.HasMore = end < len(h.messages)
+	} else {
+		page.HasMore = start > 0
+	}
+	return page, nil
+}
+
+// InMemoryMessageStore implements MessageStore with a bounded history per channel in memory
+type InMemoryMessageStore struct {
+	channels map[string]*channelHistory
+	limit    int
+	mu       sync.RWMutex
+}
+
+// NewInMemoryMessageStore creates a new in-memory message store keeping the last limit messages per channel
+func NewInMemoryMessageStore(limit int) *InMemoryMessageStore {
+	if limit <= 0 {
+		limit = defaultMessagesPerChannel
+	}
+	return &InMemoryMessageStore{
+		channels: make(map[string]*channelHistory),
+		limit:    limit,
+	}
+}
+
+// Append adds a new message at the end of a channel's history
+func (s *InMemoryMessageStore) Append(channelID string, message data.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.channels[channelID]
+	if !ok {
+		h = newChannelHistory()
+		s.channels[channelID] = h
+	}
+	if _, ok := h.index[message.ID]; ok {
+		return ErrMessageExists
+	}
+	h.append(message)
+	h.trim(s.limit)
+	return nil
+}
+
+// Update replaces a stored message with the same ID
+func (s *InMemoryMessageStore) Update(channelID string, message data.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if h, ok := s.channels[channelID]; ok {
+		if pos, ok := h.get(message.ID); ok {
+			h.messages[pos] = message
+			return nil
+		}
+	}
+	return errMessageNotFound
+}
+
+// Get retrieves a message by ID
+func (s *InMemoryMessageStore) Get(channelID, messageID string) (data.Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if h, ok := s.channels[channelID]; ok {
+		if pos, ok := h.get(messageID); ok {
+			return h.messages[pos], true
+		}
+	}
+	return data.Message{}, false
+}
+
+// History returns a page of a channel's history
+func (s *InMemoryMessageStore) History(channelID string, query HistoryQuery) (HistoryPage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, ok := s.channels[channelID]
+	if !ok {
+		h = newChannelHistory()
+	}
+	return h.page(query)
+}
+
+// fileRecord is a line of a channel's log file
+type fileRecord struct {
+	// Op is "append" for a new message or "update" for a changed message
+	Op      string       `json:"op"`
+	Message data.Message `json:"message"`
+}
+
+// FileMessageStore implements MessageStore with an append-only log file per channel.
+// The last messages of a channel are loaded into memory on first access; the log is compacted
+// when it is loaded if it contains updates. Evict releases a channel when its hub stops.
+type FileMessageStore struct {
+	dir      string
+	limit    int
+	channels map[string]*channelHistory
+	files    map[string]*os.File
+	mu       sync.Mutex
+}
+
+// ChannelEvicter is implemented by message stores that hold resources per channel, which are
+// released by Evict when the hub of the channel stops.
+type ChannelEvicter interface {
+	Evict(channelID string) error
+}
+
+// NewFileMessageStore creates a message store writing the channel logs to dir and keeping the
+// last limit messages per channel in memory
+func NewFileMessageStore(dir string, limit int) (*FileMessageStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultMessagesPerChannel
+	}
+	return &FileMessageStore{
+		dir:      dir,
+		limit:    limit,
+		channels: make(map[string]*channelHistory),
+		files:    make(map[string]*os.File),
+	}, nil
+}
+
+// path returns the log file of a channel. Channel IDs are escaped to be safe file names.
+func (s *FileMessageStore) path(channelID string) string {
+	return filepath.Join(s.dir, url.PathEscape(channelID)+".jsonl")
+}
+
+// channel returns the history of a channel, loading its log file on first access. Reads of a
+// channel without a log file get an empty history that is not kept; writes open the log file,
+// creating it. The caller must hold s.mu for writing.
+func (s *FileMessageStore) channel(channelID string, write bool) (*channelHistory, error) {
+	h, ok := s.channels[channelID]
+	if !ok {
+		var exists bool
+		var err error
+		if h, exists, err = s.load(channelID); err != nil {
+			return nil, err
+		}
+		if !exists && !write {
+			return h, nil
+		}
+		s.channels[channelID] = h
+	}
+
+	if write && s.files[channelID] == nil {
+		f, err := os.OpenFile(s.path(channelID), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		s.files[channelID] = f
+	}
+	return h, nil
+}
+
+// load reads the log file of a channel, compacts it if it contains updates and returns the
+// last s.limit messages, and whether the file exists.
+func (s *FileMessageStore) load(channelID string) (*channelHistory, bool, error) {
+	h := newChannelHistory()
+	name := s.path(channelID)
+	updates := 0
+	if f, err := os.Open(name); err == nil {
+		r := bufio.NewReader(f)
+		for line := 1; ; line++ {
+			b, err := r.ReadBytes('\n')
+			if len(b) > 0 {
+				var rec fileRecord
+				if jsonErr := json.Unmarshal(b, &rec); jsonErr != nil {
+					// A torn last line after a crash is skipped.
+					log.Errorf("Error reading %s line %d: %v", name, line, jsonErr)
+				} else if pos, ok := h.get(rec.Message.ID); ok {
+					h.messages[pos] = rec.Message
+					updates++
+				} else if rec.Op == "append" {
+					h.append(rec.Message)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		_ = f.Close()
+	} else if os.IsNotExist(err) {
+		return h, false, nil
+	} else {
+		return nil, false, err
+	}
+
+	// The log is compacted before the history is trimmed, so the file keeps every message.
+	if updates > 0 {
+		if err := s.compact(name, h); err != nil {
+			return nil, false, err
+		}
+	}
+	h.trim(s.limit)
+	return h, true, nil
+}
+
+// compact rewrites a log file with one append record per message
+func (s *FileMessageStore) compact(name string, h *channelHistory) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, message := range h.messages {
+		if err := enc.Encode(fileRecord{Op: "append", Message: message}); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// write appends a record to a channel's log file. The caller must hold s.mu for writing.
+func (s *FileMessageStore) write(channelID string, rec fileRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = s.files[channelID].Write(append(b, '\n'))
+	return err
+}
+
+// Append adds a new message at the end of a channel's history
+func (s *FileMessageStore) Append(channelID string, message data.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.channel(channelID, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := h.index[message.ID]; ok {
+		return ErrMessageExists
+	}
+	if err := s.write(channelID, fileRecord{Op: "append", Message: message}); err != nil {
+		return err
+	}
+	h.append(message)
+	h.trim(s.limit)
+	return nil
+}
+
+// Update replaces a stored message with the same ID
+func (s *FileMessageStore) Update(channelID string, message data.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.channel(channelID, true)
+	if err != nil {
+		return err
+	}
+	pos, ok := h.get(message.ID)
+	if !ok {
+		return errMessageNotFound
+	}
+	if err := s.write(channelID, fileRecord{Op: "update", Message: message}); err != nil {
+		return err
+	}
+	h.messages[pos] = message
+	return nil
+}
+
+// Get retrieves a message by ID
+func (s *FileMessageStore) Get(channelID, messageID string) (data.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.channel(channelID, false)
+	if err != nil {
+		log.Errorf("Error loading messages of channel %s: %v", channelID, err)
+		return data.Message{}, false
+	}
+	if pos, ok := h.get(messageID); ok {
+		return h.messages[pos], true
+	}
+	return data.Message{}, false
+}
+
+// History returns a page of a channel's history
+func (s *FileMessageStore) History(channelID string, query HistoryQuery) (HistoryPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, err := s.channel(channelID, false)
+	if err != nil {
+		return HistoryPage{}, err
+	}
+	return h.page(query)
+}
+
+// Evict closes the log file of a channel and forgets its history until the next access
+func (s *FileMessageStore) Evict(channelID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.channels, channelID)
+	f, ok := s.files[channelID]
+	if !ok {
+		return nil
+	}
+	delete(s.files, channelID)
+	return f.Close()
+}
+
+// Close closes the log files
+func (s *FileMessageStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for channelID, f := range s.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.files, channelID)
+		delete(s.channels, channelID)
+	}
+	return firstErr
+}
+
+// newMessageStore creates the message store configured by the environment.
+//
+// Logic:
+// 1. `WS_MESSAGE_STORE=file` stores the history in append-only logs in `WS_MESSAGE_DIR`.
+// 2. Any other value keeps the history in memory.
+// 3. Both keep the last `WS_MESSAGES_PER_CHANNEL` messages per channel in memory.
+//
+// Returns:
+// - MessageStore: The message store. Falls back to memory if the directory cannot be created.
+func newMessageStore() MessageStore {
+	limit := utils.Getenv[int]("WS_MESSAGES_PER_CHANNEL", defaultMessagesPerChannel)
+	if utils.Getenv[string]("WS_MESSAGE_STORE", "memory") == "file" {
+		dir := utils.Getenv[string]("WS_MESSAGE_DIR", "storage/messages")
+		store, err := NewFileMessageStore(dir, limit)
+		if err == nil {
+			return store
+		}
+		log.Errorf("Error opening message store %s, keeping messages in memory: %v", dir, err)
+	}
+	return NewInMemoryMessageStore(limit)
+}
+
+// Global instance of the message store
+var GlobalMessageStore = newMessageStore()
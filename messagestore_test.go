@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"ws/data"
+)
+
+// messageIDs returns the IDs of messages.
+func messageIDs(messages []data.Message) string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func testMessageStore(t *testing.T, store MessageStore) {
+	for i := 1; i <= 5; i++ {
+		if err := store.Append("c1", data.Message{ID: fmt.Sprintf("m%d", i), SenderID: "alice"}); err != nil {
+			t.Fatalf("append m%d: %v", i, err)
+		}
+	}
+	if err := store.Append("c2", data.Message{ID: "m1", SenderID: "bob"}); err != nil {
+		t.Fatalf("append to c2: %v", err)
+	}
+	if err := store.Append("c1", data.Message{ID: "m1"}); !errors.Is(err, ErrMessageExists) {
+		t.Errorf("duplicate append: %v, want %v", err, ErrMessageExists)
+	}
+
+	tests := []struct {
+		query   HistoryQuery
+		ids     string
+		hasMore bool
+	}{
+		{HistoryQuery{}, "m1,m2,m3,m4,m5", false},
+		{HistoryQuery{Limit: 2}, "m4,m5", true},
+		{HistoryQuery{Before: "m4", Limit: 2}, "m2,m3", true},
+		{HistoryQuery{Before: "m3", Limit: 2}, "m1,m2", false},
+		{HistoryQuery{Before: "m1"}, "", false},
+		{HistoryQuery{After: "m1", Limit: 2}, "m2,m3", true},
+		{HistoryQuery{After: "m3", Limit: 2}, "m4,m5", false},
+		{HistoryQuery{After: "m5"}, "", false},
+	}
+	for _, tt := range tests {
+		page, err := store.History("c1", tt.query)
+		if err != nil {
+			t.Errorf("%+v: %v", tt.query, err)
+			continue
+		}
+		if ids := messageIDs(page.Messages); ids != tt.ids || page.HasMore != tt.hasMore {
+			t.Errorf("%+v = %s, %v; want %s, %v", tt.query, ids, page.HasMore, tt.ids, tt.hasMore)
+		}
+	}
+
+	if _, err := store.History("c1", HistoryQuery{Before: "m9"}); !errors.Is(err, ErrCursorNotFound) {
+		t.Errorf("unknown cursor: %v, want %v", err, ErrCursorNotFound)
+	}
+	if page, err := store.History("unknown", HistoryQuery{}); err != nil || len(page.Messages) != 0 {
+		t.Errorf("unknown channel = %+v, %v", page, err)
+	}
+
+	if err := store.Update("c1", data.Message{ID: "m2", SenderID: "alice", Content: "edited"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if m, ok := store.Get("c1", "m2"); !ok || m.Content != "edited" {
+		t.Errorf("get m2 = %+v, %v", m, ok)
+	}
+	if m, ok := store.Get("c2", "m1"); !ok || m.SenderID != "bob" {
+		t.Errorf("get m1 of c2 = %+v, %v", m, ok)
+	}
+	if err := store.Update("c1", data.Message{ID: "m9"}); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("update of unknown message: %v, want %v", err, errMessageNotFound)
+	}
+}
+
+func TestInMemoryMessageStore(t *testing.T) {
+	testMessageStore(t, NewInMemoryMessageStore(0))
+}
+
+func TestInMemoryMessageStoreLimit(t *testing.T) {
+	store := NewInMemoryMessageStore(3)
+	for i := 1; i <= 5; i++ {
+		_ = store.Append("c1", data.Message{ID: fmt.Sprintf("m%d", i)})
+	}
+	page, err := store.History("c1", HistoryQuery{})
+	if err != nil || messageIDs(page.Messages) != "m3,m4,m5" || page.HasMore {
+		t.Errorf("history = %s, %v, %v; want m3,m4,m5", messageIDs(page.Messages), page.HasMore, err)
+	}
+	if _, err := store.History("c1", HistoryQuery{Before: "m2"}); !errors.Is(err, ErrCursorNotFound) {
+		t.Errorf("forgotten cursor: %v, want %v", err, ErrCursorNotFound)
+	}
+	if page, _ := store.History("c1", HistoryQuery{Before: "m4"}); messageIDs(page.Messages) != "m3" {
+		t.Errorf("before m4 = %s, want m3", messageIDs(page.Messages))
+	}
+}
+
+func TestFileMessageStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileMessageStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageStore(t, store)
+	if err := store.Append("a/../b", data.Message{ID: "x"}); err != nil {
+		t.Fatalf("append to channel with slashes: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn line at the end of a log is skipped.
+	name := filepath.Join(dir, "c1.jsonl")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"op":"append","message":{"id":"m6"`)
+	_ = f.Close()
+
+	reopened, err := NewFileMessageStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	page, err := reopened.History("c1", HistoryQuery{})
+	if err != nil || messageIDs(page.Messages) != "m1,m2,m3,m4,m5" {
+		t.Fatalf("reloaded history = %s, %v", messageIDs(page.Messages), err)
+	}
+	if page.Messages[1].Content != "edited" {
+		t.Errorf("reloaded m2 = %+v, want the update", page.Messages[1])
+	}
+	if m, ok := reopened.Get("a/../b", "x"); !ok || m.ID != "x" {
+		t.Errorf("reloaded channel with slashes = %+v, %v", m, ok)
+	}
+
+	// The log with updates was compacted to one line per message.
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 5 || strings.Contains(string(b), `"update"`) {
+		t.Errorf("compacted log has %d lines:\n%s", lines, b)
+	}
+}
+
+func TestFileMessageStoreLimits(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileMessageStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// Reads of a channel without messages do not create its log.
+	if page, err := store.History("c1", HistoryQuery{}); err != nil || len(page.Messages) != 0 {
+		t.Fatalf("history of an empty channel = %+v, %v", page, err)
+	}
+	if _, ok := store.Get("c1", "m1"); ok {
+		t.Fatal("found a message in an empty channel")
+	}
+	name := filepath.Join(dir, "c1.jsonl")
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("read created the log: %v", err)
+	}
+
+	// Only the last messages are kept in memory; the log keeps all of them and is private.
+	for _, id := range []string{"m1", "m2", "m3"} {
+		if err := store.Append("c1", data.Message{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if page, _ := store.History("c1", HistoryQuery{}); messageIDs(page.Messages) != "m2,m3" {
+		t.Errorf("history = %s, want m2,m3", messageIDs(page.Messages))
+	}
+	if fi, err := os.Stat(name); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0o600 {
+		t.Errorf("log mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	// An evicted channel is closed and reloaded on the next access.
+	if err := store.Evict("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.files) != 0 || len(store.channels) != 0 {
+		t.Fatalf("evicted channel still open: %v", store.files)
+	}
+	if err := store.Append("c1", data.Message{ID: "m4"}); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := store.History("c1", HistoryQuery{}); messageIDs(page.Messages) != "m3,m4" {
+		t.Errorf("reloaded history = %s, want m3,m4", messageIDs(page.Messages))
+	}
+	b, err := os.ReadFile(name)
+	if err != nil || strings.Count(string(b), "\n") != 4 {
+		t.Errorf("log has %d lines, want 4: %v", strings.Count(string(b), "\n"), err)
+	}
+}
+
+func TestHandleFetchHistory(t *testing.T) {
+	hub := newTestHub("test")
+	alice := newTestClient(hub, "alice", data.RoleUser)
+	for i := 1; i <= 3; i++ {
+		hub.messages.add(alice.prepareMessage(hub, data.Message{ID: fmt.Sprintf("m%d", i)}))
+	}
+
+	fetch := func(actionData any) {
+		alice.handleAction(data.ActionMessage{Action: data.Action{Type: data.ActionFetchHistory, Data: actionData}})
+	}
+
+	fetch(map[string]interface{}{"before": "m3", "limit": 1})
+	var history data.HistoryData
+	if typ := decodeAction(t, <-alice.send, &history); typ != data.ActionFetchHistory ||
+		history.ChannelID != "test" || messageIDs(history.Messages) != "m2" || !history.HasMore {
+		t.Fatalf("response = %s %+v", typ, history)
+	}
+
+	var errData data.ErrorData
+	fetch(map[string]interface{}{"before": "unknown"})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeNotFound {
+		t.Fatalf("response = %s %+v, want not_found error", typ, errData)
+	}
+	fetch(map[string]interface{}{"before": "m3", "after": "m1"})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInvalidRequest {
+		t.Fatalf("response = %s %+v, want invalid_request error", typ, errData)
+	}
+}
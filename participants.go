@@ -0,0 +1,208 @@
+package main
+
+import (
+	"github.com/gflydev/core/log"
+	"sort"
+	"time"
+	"ws/data"
+)
+
+const (
+	// Default number of participants in a page of get_participants, and in the roster sent to a
+	// client that joins a channel.
+	defaultParticipantsLimit = 100
+
+	// Maximum number of participants in a page of get_participants.
+	maxParticipantsLimit = 500
+)
+
+// hubParticipant is a user with registered clients in a hub.
+type hubParticipant struct {
+	participant data.Participant
+	clients     int // The number of registered clients of the user.
+}
+
+// addParticipant records the user of a registered client. The first client of a user adds the
+// user to the participants and broadcasts a user_join event. Guests have no username. It is
+// called by the run goroutine.
+func (h *Hub) addParticipant(client *Client) {
+	username, authenticated := client.identity()
+	userID := client.id
+	if authenticated {
+		userID = username
+	} else {
+		username = ""
+	}
+	h.clientUsers[client] = userID
+
+	h.participantsMu.Lock()
+	entry, ok := h.participants[userID]
+	if !ok {
+		entry = &hubParticipant{participant: data.Participant{
+			UserID:   userID,
+			Username: username,
+			JoinedAt: time.Now(),
+		}}
+		h.participants[userID] = entry
+	}
+	entry.clients++
+	h.participantsMu.Unlock()
+
+	if !ok {
+		h.deliverParticipant(data.ActionUserJoin, entry.participant)
+	}
+}
+
+// removeParticipant forgets the user of an unregistered client. The last client of a user
+// removes the user from the participants and broadcasts a user_leave event. It is called by the
+// run goroutine.
+func (h *Hub) removeParticipant(client *Client) {
+	userID, ok := h.clientUsers[client]
+	if !ok {
+		return
+	}
+	delete(h.clientUsers, client)
+
+	h.participantsMu.Lock()
+	entry := h.participants[userID]
+	entry.clients--
+	left := entry.clients == 0
+	if left {
+		delete(h.participants, userID)
+	}
+	h.participantsMu.Unlock()
+
+	if left {
+		h.deliverParticipant(data.ActionUserLeave, entry.participant)
+	}
+}
+
+// deliverParticipant sends a user_join or user_leave event to the registered clients. It is
+// called by the run goroutine.
+func (h *Hub) deliverParticipant(actionType data.ActionType, participant data.Participant) {
+	jsonMessage, err := h.marshalAction(data.Action{
+		Type: actionType,
+		Data: data.ParticipantEventData{
+			ChannelID:   h.id,
+			Participant: withStatus([]data.Participant{participant})[0],
+		},
+	})
+	if err != nil {
+		log.Errorf("Error marshaling %s event to JSON: %v", actionType, err)
+		return
+	}
+	h.deliver(jsonMessage)
+}
+
+// sendRoster sends the first page of participants to a client that registered. It does not
+// block; a client whose send buffer is full is dropped. It is called by the run goroutine.
+func (h *Hub) sendRoster(client *Client) {
+	participants, hasMore := h.participantsPage("", defaultParticipantsLimit)
+	jsonMessage, err := h.marshalAction(data.Action{
+		Type: data.ActionGetParticipants,
+		Data: data.ParticipantsData{
+			ChannelID:    h.id,
+			Participants: participants,
+			HasMore:      hasMore,
+		},
+	})
+	if err != nil {
+		log.Errorf("Error marshaling roster to JSON: %v", err)
+		return
+	}
+	select {
+	case client.send <- jsonMessage:
+	default:
+		client.dropSlow()
+		h.removeClient(client)
+	}
+}
+
+// participantsPage returns a page of the participants, sorted by user ID.
+//
+// Parameters:
+// - after (string): A user ID; the page holds the participants after it. Empty for the first page.
+// - limit (int): The maximum number of participants.
+//
+// Returns:
+// - []data.Participant: The participants with their current status.
+// - bool: Whether more participants follow the page.
+func (h *Hub) participantsPage(after string, limit int) ([]data.Participant, bool) {
+	h.participantsMu.RLock()
+	ids := make([]string, 0, len(h.participants))
+	for id := range h.participants {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	hasMore := len(ids) > limit
+	if hasMore {
+		ids = ids[:limit]
+	}
+	participants := make([]data.Participant, 0, len(ids))
+	for _, id := range ids {
+		participants = append(participants, h.participants[id].participant)
+	}
+	h.participantsMu.RUnlock()
+
+	return withStatus(participants), hasMore
+}
+
+// withStatus sets the presence status of participants.
+func withStatus(participants []data.Participant) []data.Participant {
+	for i := range participants {
+		participants[i].Status = presence.Status(participants[i].UserID)
+	}
+	return participants
+}
+
+// handleGetParticipants sends a page of the participants of a channel to the client.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The get_participants action.
+//
+// Logic:
+// 1. Decodes data.ParticipantsRequestData; the channel defaults to the active channel and must be
+// subscribed.
+// 2. Rejects negative limits. The limit defaults to defaultParticipantsLimit and is capped at
+// maxParticipantsLimit.
+// 3. Sends the participants after the `after` user ID, sorted by user ID, with their role in a
+// saved channel.
+func (c *Client) handleGetParticipants(actionMsg data.ActionMessage) {
+	var request data.ParticipantsRequestData
+	if err := decodeActionData(actionMsg.Action.Data, &request); err != nil {
+		c.sendError(data.ActionGetParticipants, errCodeInvalidRequest, "invalid participants request")
+		return
+	}
+	if request.Limit < 0 {
+		c.sendError(data.ActionGetParticipants, errCodeInvalidRequest, "limit must not be negative")
+		return
+	}
+	hub, ok := c.channelHub(request.ChannelID)
+	if !ok {
+		c.sendNotSubscribed(data.ActionGetParticipants, request.ChannelID)
+		return
+	}
+
+	limit := request.Limit
+	if limit == 0 {
+		limit = defaultParticipantsLimit
+	}
+	limit = min(limit, maxParticipantsLimit)
+	participants, hasMore := hub.participantsPage(request.After, limit)
+	if channel, ok := manager.Channel(hub.id); ok {
+		for i := range participants {
+			participants[i].Role = participantRole(channel, participants[i].Username)
+		}
+	}
+
+	c.sendAction(data.Action{
+		Type: data.ActionGetParticipants,
+		Data: data.ParticipantsData{
+			ChannelID:    hub.id,
+			Participants: participants,
+			HasMore:      hasMore,
+		},
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ws/data"
+)
+
+func TestChannelParticipants(t *testing.T) {
+	alice := newTestClient(nil, "alice", data.RoleUser)
+	aliceAgain := newTestClient(nil, "alice", data.RoleUser)
+	bob := newTestClient(nil, "bob", data.RoleUser)
+	for _, c := range []*Client{alice, aliceAgain, bob} {
+		c.hub = c.subscribe("test-roster")
+		defer c.unsubscribeAll()
+	}
+	action := func(c *Client, actionData any) {
+		c.handleAction(data.ActionMessage{Action: data.Action{Type: data.ActionGetParticipants, Data: actionData}})
+	}
+	userIDs := func(participants []data.Participant) []string {
+		ids := make([]string, 0, len(participants))
+		for _, participant := range participants {
+			ids = append(ids, participant.UserID)
+		}
+		return ids
+	}
+
+	// Each client receives the roster on join; the second connection of a user is no new participant.
+	var roster data.ParticipantsData
+	receiveAction(t, alice, data.ActionGetParticipants, &roster)
+	if ids := userIDs(roster.Participants); len(ids) != 1 || ids[0] != "alice" {
+		t.Errorf("first roster = %v", ids)
+	}
+	receiveAction(t, bob, data.ActionGetParticipants, &roster)
+	if ids := userIDs(roster.Participants); len(ids) != 2 || ids[0] != "alice" || ids[1] != "bob" || roster.HasMore {
+		t.Errorf("roster = %v, has_more=%v", ids, roster.HasMore)
+	}
+	var event data.ParticipantEventData
+	if receiveAction(t, alice, data.ActionUserJoin, &event); event.Participant.UserID != "bob" || event.ChannelID != "test-roster" {
+		t.Errorf("join event = %+v", event)
+	}
+
+	// Pages follow the user IDs.
+	var page data.ParticipantsData
+	action(bob, map[string]interface{}{"limit": 1})
+	if receiveAction(t, bob, data.ActionGetParticipants, &page); len(page.Participants) != 1 || page.Participants[0].UserID != "alice" || !page.HasMore {
+		t.Errorf("first page = %+v", page)
+	}
+	action(bob, map[string]interface{}{"after": "alice", "limit": 1})
+	if receiveAction(t, bob, data.ActionGetParticipants, &page); len(page.Participants) != 1 || page.Participants[0].UserID != "bob" || page.HasMore {
+		t.Errorf("second page = %+v", page)
+	}
+	var errData data.ErrorData
+	action(bob, map[string]interface{}{"limit": -1})
+	if receiveAction(t, bob, data.ActionError, &errData); errData.Code != errCodeInvalidRequest {
+		t.Errorf("negative limit: %+v, want invalid_request error", errData)
+	}
+
+	// A user leaves with their last connection.
+	aliceAgain.unsubscribeAll()
+	bob.unsubscribeAll()
+	if receiveAction(t, alice, data.ActionUserLeave, &event); event.Participant.UserID != "bob" {
+		t.Errorf("leave event = %+v, want bob", event)
+	}
+
+	// A guest that logs in becomes a participant under its username.
+	guest := newTestClient(nil, "carol", data.RoleUser)
+	guest.authenticated = false
+	guest.hub = guest.subscribe("test-roster")
+	defer guest.unsubscribeAll()
+	if receiveAction(t, alice, data.ActionUserJoin, &event); event.Participant.UserID != guest.id {
+		t.Errorf("guest join event = %+v", event)
+	}
+	guest.authenticated = true
+	guest.hub.identifyClient(guest)
+	if receiveAction(t, alice, data.ActionUserLeave, &event); event.Participant.UserID != guest.id {
+		t.Errorf("guest leave event = %+v", event)
+	}
+	if receiveAction(t, alice, data.ActionUserJoin, &event); event.Participant.UserID != "carol" || event.Participant.Username != "carol" {
+		t.Errorf("user join event = %+v", event)
+	}
+	action(alice, nil)
+	if receiveAction(t, alice, data.ActionGetParticipants, &page); len(page.Participants) != 2 {
+		t.Errorf("participants = %v, want alice and carol", userIDs(page.Participants))
+	}
+}
+
+func TestParticipantsLoginWhileSubscribing(t *testing.T) {
+	guest := newTestClient(nil, "", data.RoleGuest)
+	guest.authenticated = false
+	guest.hub = guest.subscribe("test-login")
+	defer func() {
+		manager.removeSession(guest)
+		guest.unsubscribeAll()
+	}()
+
+	// Another goroutine subscribes the client, as openDirect does, while it logs in.
+	subscribed := make(chan *Hub)
+	go func() { subscribed <- guest.subscribe("test-login-other") }()
+	time.Sleep(10 * time.Millisecond) // the hub usually registers the client as a guest first
+	guest.login("alice")
+	other := <-subscribed
+
+	for _, hub := range []*Hub{guest.hub, other} {
+		hub.stopIfIdle(time.Hour) // waits for the hub to handle the registration and login
+		if participants, _ := hub.participantsPage("", maxParticipantsLimit); len(participants) != 1 || participants[0].UserID != "alice" {
+			t.Errorf("%s: participants = %+v, want alice", hub.id, participants)
+		}
+	}
+}
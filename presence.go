@@ -0,0 +1,364 @@
+package main
+
+import (
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"sync"
+	"time"
+	"ws/data"
+)
+
+const (
+	// Minimum time between two typing broadcasts of a user in a channel.
+	typingThrottle = 2 * time.Second
+
+	// Time after which a typing indicator expires without a new typing action.
+	typingTimeout = 5 * time.Second
+)
+
+// connectionPresence is the presence of one connection of a user.
+type connectionPresence struct {
+	lastActive time.Time // The time of the last message received from the connection.
+	away       bool      // Set by the client with a user_presence action.
+}
+
+// typingState is the typing indicator of a user in a channel.
+type typingState struct {
+	sentAt    time.Time // The time of the last typing broadcast.
+	expiresAt time.Time // The time the indicator expires.
+}
+
+// userPresence aggregates the connections of a user.
+type userPresence struct {
+	connections map[*Client]*connectionPresence
+	status      string
+	typing      map[string]typingState // by channel ID
+}
+
+// presenceEvent is a presence or typing change to broadcast once the tracker is unlocked.
+type presenceEvent struct {
+	action  data.Action
+	channel string    // The channel of a typing change.
+	clients []*Client // The connections whose channels receive a presence change.
+}
+
+// PresenceTracker tracks the presence of the users across all their connections and the typing
+// indicators, and broadcasts their changes. Users are identified by their sender ID. It is safe
+// for concurrent use.
+//
+// A user is online while one of their connections is active, away when all connections are idle
+// for awayAfter or set away by the client, and offline without connections.
+type PresenceTracker struct {
+	mu        sync.Mutex
+	users     map[string]*userPresence
+	userIDs   map[*Client]string // The user of each connection, as it was connected.
+	awayAfter time.Duration
+}
+
+// NewPresenceTracker creates a presence tracker.
+//
+// Parameters:
+// - awayAfter (time.Duration): The idle time after which a connection counts as away, 0 to
+// never count idle connections as away.
+//
+// Returns:
+// - *PresenceTracker: The tracker.
+func NewPresenceTracker(awayAfter time.Duration) *PresenceTracker {
+	return &PresenceTracker{
+		users:     make(map[string]*userPresence),
+		userIDs:   make(map[*Client]string),
+		awayAfter: awayAfter,
+	}
+}
+
+// presence is the global PresenceTracker instance.
+var presence = NewPresenceTracker(time.Duration(utils.Getenv[int]("WS_PRESENCE_AWAY_AFTER", 300)) * time.Second)
+
+// Status returns the presence status of a user: data.StatusOnline, data.StatusAway or data.StatusOffline.
+func (p *PresenceTracker) Status(userID string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if user, ok := p.users[userID]; ok {
+		return user.status
+	}
+	return data.StatusOffline
+}
+
+// Connect starts tracking a connection of the client's sender ID, as an active one.
+//
+// Parameters:
+// - c (*Client): The client, subscribed to its channels. It must not be tracked already.
+func (p *PresenceTracker) Connect(c *Client) {
+	p.mu.Lock()
+	userID := c.senderID()
+	user, ok := p.users[userID]
+	if !ok {
+		user = &userPresence{
+			connections: make(map[*Client]*connectionPresence),
+			status:      data.StatusOffline,
+			typing:      make(map[string]typingState),
+		}
+		p.users[userID] = user
+	}
+	user.connections[c] = &connectionPresence{lastActive: time.Now()}
+	p.userIDs[c] = userID
+	events := p.update(userID, user, time.Now())
+	p.mu.Unlock()
+
+	p.broadcast(events)
+}
+
+// Disconnect stops tracking a connection. The user becomes offline with their last connection.
+//
+// Parameters:
+// - c (*Client): The client, still subscribed to its channels.
+//
+// Returns:
+// - bool: Whether the connection was tracked.
+func (p *PresenceTracker) Disconnect(c *Client) bool {
+	p.mu.Lock()
+	userID, user := p.find(c)
+	if user == nil {
+		p.mu.Unlock()
+		return false
+	}
+	delete(p.userIDs, c)
+	var events []presenceEvent
+	if len(user.connections) == 1 {
+		// The typing indicators of an offline user stop, and the leaving connection's channels
+		// receive the change.
+		for channelID := range user.typing {
+			events = append(events, typingEvent(userID, channelID, false))
+		}
+		events = append(events, presenceEvent{
+			action: data.Action{
+				Type: data.ActionUserPresence,
+				Data: data.UserPresenceData{UserID: userID, Status: data.StatusOffline},
+			},
+			clients: []*Client{c},
+		})
+		delete(p.users, userID)
+	} else {
+		delete(user.connections, c)
+		events = p.update(userID, user, time.Now())
+	}
+	p.mu.Unlock()
+
+	p.broadcast(events)
+	return true
+}
+
+// Touch records activity on a connection. An idle connection becomes active again.
+func (p *PresenceTracker) Touch(c *Client) {
+	p.mu.Lock()
+	userID, user := p.find(c)
+	if user == nil {
+		p.mu.Unlock()
+		return
+	}
+	user.connections[c].lastActive = time.Now()
+	events := p.update(userID, user, time.Now())
+	p.mu.Unlock()
+
+	p.broadcast(events)
+}
+
+// SetAway sets or clears the away status a client requested for its connection.
+func (p *PresenceTracker) SetAway(c *Client, away bool) {
+	p.mu.Lock()
+	userID, user := p.find(c)
+	if user == nil {
+		p.mu.Unlock()
+		return
+	}
+	user.connections[c].away = away
+	events := p.update(userID, user, time.Now())
+	p.mu.Unlock()
+
+	p.broadcast(events)
+}
+
+// Typing records that a user is typing in a channel, or has stopped.
+//
+// Parameters:
+// - c (*Client): The typing client.
+// - channelID (string): The channel.
+// - typing (bool): Whether the user is typing.
+//
+// Logic:
+// 1. Broadcasts a start at most once per typingThrottle and extends the indicator by typingTimeout.
+// 2. Broadcasts a stop if the user was typing in the channel.
+func (p *PresenceTracker) Typing(c *Client, channelID string, typing bool) {
+	p.mu.Lock()
+	userID, user := p.find(c)
+	if user == nil {
+		p.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	state, wasTyping := user.typing[channelID]
+	var events []presenceEvent
+	switch {
+	case typing:
+		if !wasTyping || now.Sub(state.sentAt) >= typingThrottle {
+			state.sentAt = now
+			events = append(events, typingEvent(userID, channelID, true))
+		}
+		state.expiresAt = now.Add(typingTimeout)
+		user.typing[channelID] = state
+	case wasTyping:
+		delete(user.typing, channelID)
+		events = append(events, typingEvent(userID, channelID, false))
+	}
+	p.mu.Unlock()
+
+	p.broadcast(events)
+}
+
+// sweep turns idle users away and expires the typing indicators.
+//
+// Parameters:
+// - now (time.Time): The current time.
+func (p *PresenceTracker) sweep(now time.Time) {
+	p.mu.Lock()
+	var events []presenceEvent
+	for userID, user := range p.users {
+		for channelID, state := range user.typing {
+			if !now.Before(state.expiresAt) {
+				delete(user.typing, channelID)
+				events = append(events, typingEvent(userID, channelID, false))
+			}
+		}
+		events = append(events, p.update(userID, user, now)...)
+	}
+	p.mu.Unlock()
+
+	p.broadcast(events)
+}
+
+// start runs sweep periodically in a goroutine.
+func (p *PresenceTracker) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			p.sweep(now)
+		}
+	}()
+}
+
+// find returns the user of a tracked connection. The caller must hold p.mu.
+func (p *PresenceTracker) find(c *Client) (string, *userPresence) {
+	userID, ok := p.userIDs[c]
+	if !ok {
+		return "", nil
+	}
+	return userID, p.users[userID]
+}
+
+// update recomputes the status of a user and returns the event of a change. The caller must
+// hold p.mu.
+func (p *PresenceTracker) update(userID string, user *userPresence, now time.Time) []presenceEvent {
+	status := data.StatusOffline
+	for _, connection := range user.connections {
+		idle := p.awayAfter > 0 && now.Sub(connection.lastActive) >= p.awayAfter
+		if !connection.away && !idle {
+			status = data.StatusOnline
+			break
+		}
+		status = data.StatusAway
+	}
+	if status == user.status {
+		return nil
+	}
+	user.status = status
+
+	clients := make([]*Client, 0, len(user.connections))
+	for client := range user.connections {
+		clients = append(clients, client)
+	}
+	return []presenceEvent{{
+		action: data.Action{
+			Type: data.ActionUserPresence,
+			Data: data.UserPresenceData{UserID: userID, Status: status},
+		},
+		clients: clients,
+	}}
+}
+
+// typingEvent returns the event of a typing change.
+func typingEvent(userID, channelID string, typing bool) presenceEvent {
+	return presenceEvent{
+		action: data.Action{
+			Type: data.ActionUserTyping,
+			Data: data.UserTypingData{UserID: userID, Typing: typing},
+		},
+		channel: channelID,
+	}
+}
+
+// broadcast delivers events: typing changes to their channel, presence changes to every
+// channel of the user's connections.
+// A hub may stop after it is looked up; broadcastAction then drops the event instead of
+// blocking the sweep.
+func (p *PresenceTracker) broadcast(events []presenceEvent) {
+	for _, event := range events {
+		if event.channel != "" {
+			if hub := manager.GetHub(event.channel); hub != nil {
+				hub.broadcastAction(event.action)
+			}
+			continue
+		}
+		hubs := make(map[*Hub]bool)
+		for _, client := range event.clients {
+			for _, hub := range client.subscriptions() {
+				hubs[hub] = true
+			}
+		}
+		for hub := range hubs {
+			hub.broadcastAction(event.action)
+		}
+	}
+}
+
+// handleUserPresence sets the away status of the client's connection.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The user_presence action.
+//
+// Logic:
+// 1. Decodes data.UserPresenceData and rejects statuses other than online and away.
+// 2. Updates the connection; the change is broadcast if the user's status changes.
+func (c *Client) handleUserPresence(actionMsg data.ActionMessage) {
+	var presenceData data.UserPresenceData
+	if err := decodeActionData(actionMsg.Action.Data, &presenceData); err != nil ||
+		(presenceData.Status != data.StatusOnline && presenceData.Status != data.StatusAway) {
+		c.sendError(data.ActionUserPresence, errCodeInvalidRequest, "status must be online or away")
+		return
+	}
+	presence.SetAway(c, presenceData.Status == data.StatusAway)
+}
+
+// handleUserTyping records that the client's user is typing in a channel, or has stopped.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The user_typing action.
+//
+// Logic:
+// 1. Decodes data.UserTypingData. The channel defaults to the active channel.
+// 2. Updates the typing indicator, which is broadcast to the channel (see PresenceTracker.Typing).
+func (c *Client) handleUserTyping(actionMsg data.ActionMessage) {
+	var typingData data.UserTypingData
+	if err := decodeActionData(actionMsg.Action.Data, &typingData); err != nil {
+		c.sendError(data.ActionUserTyping, errCodeInvalidRequest, "invalid typing data")
+		return
+	}
+	hub, ok := c.channelHub(actionMsg.Channel.ID)
+	if !ok {
+		c.sendNotSubscribed(data.ActionUserTyping, actionMsg.Channel.ID)
+		return
+	}
+	log.Debugf("Client %s typing=%v in channel %s", c.id, typingData.Typing, hub.id)
+	presence.Typing(c, hub.id, typingData.Typing)
+}
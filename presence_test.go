@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"ws/data"
+)
+
+func TestPresenceTracker(t *testing.T) {
+	p := NewPresenceTracker(time.Minute)
+	alice := newTestClient(nil, "alice", data.RoleUser)
+	aliceAgain := newTestClient(nil, "alice", data.RoleUser)
+	bob := newTestClient(nil, "bob", data.RoleUser)
+	for _, c := range []*Client{alice, aliceAgain, bob} {
+		c.hub = c.subscribe("test-presence")
+		defer c.unsubscribeAll()
+	}
+	hub := alice.hub
+
+	// expect waits for the next presence change of alice seen by bob.
+	expect := func(status string) {
+		t.Helper()
+		var presenceData data.UserPresenceData
+		receiveAction(t, bob, data.ActionUserPresence, &presenceData)
+		if presenceData != (data.UserPresenceData{UserID: "alice", Status: status}) {
+			t.Fatalf("presence = %+v, want alice %s", presenceData, status)
+		}
+	}
+	expectTyping := func(typing bool) {
+		t.Helper()
+		var typingData data.UserTypingData
+		receiveAction(t, bob, data.ActionUserTyping, &typingData)
+		if typingData != (data.UserTypingData{UserID: "alice", Typing: typing}) {
+			t.Fatalf("typing = %+v, want alice typing=%v", typingData, typing)
+		}
+	}
+
+	// The user is online with the first connection and away once all connections are away.
+	p.Connect(alice)
+	expect(data.StatusOnline)
+	p.Connect(aliceAgain)
+	p.SetAway(alice, true)
+	if status := p.Status("alice"); status != data.StatusOnline {
+		t.Errorf("status with an active connection = %s", status)
+	}
+	p.SetAway(aliceAgain, true)
+	expect(data.StatusAway)
+	p.SetAway(aliceAgain, false)
+	expect(data.StatusOnline)
+
+	// Idle connections turn away until they are active again.
+	p.sweep(time.Now().Add(2 * time.Minute))
+	expect(data.StatusAway)
+	p.Touch(aliceAgain)
+	expect(data.StatusOnline)
+
+	// Repeated typing is throttled and the indicator expires.
+	p.Typing(alice, hub.id, true)
+	expectTyping(true)
+	p.Typing(aliceAgain, hub.id, true)
+	p.Typing(alice, hub.id, false)
+	expectTyping(false)
+	p.Typing(alice, hub.id, true)
+	expectTyping(true)
+	p.sweep(time.Now().Add(typingTimeout))
+	expectTyping(false)
+
+	// The user is offline once the last connection is gone.
+	p.Typing(alice, hub.id, true)
+	expectTyping(true)
+	if !p.Disconnect(alice) {
+		t.Fatal("tracked connection not disconnected")
+	}
+	p.Disconnect(aliceAgain)
+	expectTyping(false)
+	expect(data.StatusOffline)
+	if status := p.Status("alice"); status != data.StatusOffline {
+		t.Errorf("status without connections = %s", status)
+	}
+	if p.Disconnect(alice) {
+		t.Errorf("untracked connection disconnected")
+	}
+}
+
+func TestPresenceTypingInStoppedHub(t *testing.T) {
+	p := NewPresenceTracker(time.Minute)
+	alice := newTestClient(nil, "alice", data.RoleUser)
+	alice.hub = alice.subscribe("test-typing")
+	hub := alice.hub
+	defer manager.DeleteHub(hub.id)
+
+	p.Connect(alice)
+	p.Typing(alice, hub.id, true)
+
+	// The hub stops while it is still in the pool, as when it is reaped during a sweep.
+	alice.unsubscribeAll()
+	if !hub.stopIfIdle(0) {
+		t.Fatal("hub without clients not stopped")
+	}
+	swept := make(chan struct{})
+	go func() {
+		defer close(swept)
+		p.sweep(time.Now().Add(typingTimeout))
+	}()
+	select {
+	case <-swept:
+	case <-time.After(time.Second):
+		t.Fatal("sweep blocked on a stopped hub")
+	}
+}
@@ -1,6 +1,6 @@
 // auth.js - Handles user authentication
 
-// Global WebSocket connection that will be used for both authentication and chat
+// Global WebSocket connection used for chat, opened once the user has logged in
 window.globalConn = null;
 
 // Store the current user and authentication state
@@ -18,39 +18,61 @@ function getCurrentUsername() {
   return currentUser;
 }
 
-// Initialize the global WebSocket connection
+// Initialize the global WebSocket connection. The browser sends the session cookie set by
+// POST /auth/login with the upgrade request.
 function initializeGlobalWebSocket() {
   if (window.globalConn === null) {
     const wsUrl = "ws://" + document.location.host + "/ws";
-    window.globalConn = new ReconnectingWebSocket(wsUrl);
+    window.globalConn = new ReconnectingWebSocket(wsUrl, null, { automaticOpen: false });
+
+    // Compress with the server's preset dictionary if it has one (see compression.js)
+    const conn = window.globalConn;
+    DictionaryCompression.load().then(function(dictionary) {
+      if (dictionary) {
+        conn.url = DictionaryCompression.url(wsUrl, dictionary);
+        DictionaryCompression.wrap(conn, dictionary);
+      }
+    }).finally(function() {
+      conn.open(false);
+    });
 
     console.log("Global WebSocket connection initialized");
 
-    // Set up a message handler that will route messages to the appropriate handler
+    // Set up a message handler that will route messages to the appropriate handler. The server
+    // batches queued messages in one WebSocket message, separated by newlines.
     window.globalConn.onmessage = function(evt) {
-      try {
-        const response = JSON.parse(evt.data);
-
-        // If we have an auth message handler and this is an auth response, route to it
-        if (authMessageHandler && response.action && response.action.type === "user_auth") {
-          authMessageHandler(evt);
-        } 
-        // Otherwise, if we have a chat message handler, route to it
-        else if (window.chatMessageHandler) {
-          window.chatMessageHandler(evt);
+      const chatMessages = [];
+      evt.data.split("\n").forEach(function(data) {
+        try {
+          const response = JSON.parse(data);
+
+          // If we have an auth message handler and this is an auth response, route to it
+          if (authMessageHandler && response.action && response.action.type === "user_auth") {
+            authMessageHandler({ data: data });
+            return;
+          }
+        } catch (e) {
+          console.error("Error parsing WebSocket message:", e);
         }
-      } catch (e) {
-        console.error("Error parsing WebSocket message:", e);
+        chatMessages.push(data);
+      });
+
+      // Otherwise, if we have a chat message handler, route to it
+      if (chatMessages.length > 0 && window.chatMessageHandler) {
+        window.chatMessageHandler({ data: chatMessages.join("\n") });
       }
     };
 
     window.globalConn.onerror = function(evt) {
       console.error("WebSocket error:", evt);
 
-      // If we have an auth callback and we're not logged in yet, report the error
+      // If we have an auth callback and we're not logged in yet, report the error and stop
+      // reconnecting
       if (authCallback && !isLoggedIn()) {
         authCallback(false, "Connection error");
         authCallback = null;
+        window.globalConn.close();
+        window.globalConn = null;
       }
     };
   }
@@ -58,52 +80,70 @@ function initializeGlobalWebSocket() {
   return window.globalConn;
 }
 
-// Initialize the global WebSocket connection when the page loads
-document.addEventListener('DOMContentLoaded', function() {
-  initializeGlobalWebSocket();
-});
-
-// Login function - uses the global WebSocket connection for authentication
+// Login function - logs in with POST /auth/login, which sets the session cookie, then opens the
+// global WebSocket connection. The server authenticates the connection by the cookie and confirms
+// it with a user_auth message; passwords are never sent over the WebSocket.
 function login(username, password, callback) {
-  // Store the callback to be called when we get a response
+  // Store the callback to be called when the connection is authenticated
   authCallback = callback;
 
-  // Make sure we have a global connection
-  if (!window.globalConn) {
-    initializeGlobalWebSocket();
-  }
+  fetch("/auth/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    credentials: "same-origin",
+    body: JSON.stringify({ username: username, password: password })
+  }).then(function(response) {
+    return response.json().catch(function() {
+      return {};
+    }).then(function(body) {
+      if (response.ok) {
+        connectWithSession();
+        return;
+      }
+
+      // Report the error of the login endpoint
+      let message = body.error || "Authentication failed";
+      if (response.status === 429 && response.headers.get("Retry-After")) {
+        message = "Too many login attempts, try again in " + response.headers.get("Retry-After") + " seconds";
+      }
+      if (authCallback) {
+        authCallback(false, message);
+        authCallback = null;
+      }
+    });
+  }).catch(function(e) {
+    console.error("Error logging in:", e);
+    if (authCallback) {
+      authCallback(false, "Connection error");
+      authCallback = null;
+    }
+  });
+
+  // Return false as the actual result will come asynchronously
+  return false;
+}
 
+// Helper function to open the WebSocket connection with the session cookie and wait for the
+// server to confirm the user
+function connectWithSession() {
   // Set up the auth message handler
   authMessageHandler = function(evt) {
     try {
       const response = JSON.parse(evt.data);
+      const authData = response.action.data;
 
-      // Check if this is an authentication response
-      if (response.action && response.action.type === "user_auth") {
-        const authData = response.action.data;
+      if (authData.success) {
+        // Authentication successful
+        currentUser = authData.username;
 
-        if (authData.success) {
-          // Authentication successful
-          currentUser = authData.username;
-
-          // Call the callback with success
-          if (authCallback) {
-            authCallback(true, authData.message);
-            authCallback = null;
-          }
-
-          // We no longer need the auth message handler
-          authMessageHandler = null;
-        } else {
-          // Authentication failed
-          currentUser = null;
-
-          // Call the callback with failure
-          if (authCallback) {
-            authCallback(false, authData.message);
-            authCallback = null;
-          }
+        // Call the callback with success
+        if (authCallback) {
+          authCallback(true, authData.message);
+          authCallback = null;
         }
+
+        // We no longer need the auth message handler
+        authMessageHandler = null;
       }
     } catch (e) {
       console.error("Error parsing auth response:", e);
@@ -116,59 +156,18 @@ function login(username, password, callback) {
     }
   };
 
-  // Wait for the connection to be open before sending the auth request
-  if (window.globalConn.readyState === WebSocket.OPEN) {
-    sendAuthRequest(username, password);
-  } else {
-    window.globalConn.addEventListener('open', function() {
-      sendAuthRequest(username, password);
-    });
-  }
-
-  // Return false as the actual result will come asynchronously
-  return false;
-}
-
-// Helper function to send the authentication request
-function sendAuthRequest(username, password) {
-  console.log("Sending authentication request");
-
-  // Create authentication request
-  const authRequest = {
-    metadata: {
-      version: "1.0",
-      timestamp: new Date().toISOString(),
-      server_node: {
-        id: "browser-client",
-        region: "local",
-        load: 0.0
-      }
-    },
-    channel: {
-      id: "auth",
-      type: "system",
-      participants: [],
-      created_at: new Date().toISOString(),
-      updated_at: new Date().toISOString()
-    },
-    action: {
-      type: "user_auth",
-      data: {
-        username: username,
-        password: password
-      }
-    }
-  };
-
-  // Send authentication request
-  window.globalConn.send(JSON.stringify(authRequest));
+  initializeGlobalWebSocket();
 }
 
-// Logout function
+// Logout function - revokes the session token and forgets the user
 function logout() {
   currentUser = null;
   authMessageHandler = null;
 
+  fetch("/auth/logout", { method: "POST", credentials: "same-origin" }).catch(function(e) {
+    console.error("Error logging out:", e);
+  });
+
   // Note: We don't close the global WebSocket connection here
   // It will be closed by the closeWebSocketConnection function in chat.js if needed
 }
@@ -4,6 +4,13 @@ window.onload = function () {
   const channelSelect = document.getElementById("channel");
   const currentChannel = document.getElementById("currentChannel");
 
+  // Escape text sent by users, such as channel names and messages, before writing it into innerHTML
+  function escapeHTML(text) {
+    const span = document.createElement("span");
+    span.textContent = text;
+    return span.innerHTML;
+  }
+
   // The global WebSocket connection is initialized in auth.js
   // We'll use that connection for chat as well
 
@@ -120,7 +127,7 @@ window.onload = function () {
 
             default:
               // For other action types, just display the action type
-              item.innerHTML = `<b>Received action: ${jsonData.action.type}</b>`;
+              item.innerHTML = `<b>Received action: ${escapeHTML(jsonData.action.type)}</b>`;
               item.className += " bg-gray-50 text-gray-700";
               appendLog(item);
           }
@@ -133,6 +140,9 @@ window.onload = function () {
           // Get the sender ID
           const sender = jsonData.message.sender_id;
 
+          // Get the channel the message was sent to
+          const channelName = jsonData.channel ? (jsonData.channel.name || jsonData.channel.id || "") : "";
+
           // Get the message text
           let messageText = "";
           if (jsonData.message.type === "text" && jsonData.message.content) {
@@ -158,7 +168,7 @@ window.onload = function () {
                     <span class="text-xs font-medium text-gray-500 mr-2">${timeStr}</span>
                     <span class="text-sm font-semibold text-gray-700">System</span>
                   </div>
-                  <div class="text-sm text-gray-600 italic">${messageText}</div>
+                  <div class="text-sm text-gray-600 italic">${escapeHTML(messageText)}</div>
                 </div>
               </div>
             `;
@@ -174,15 +184,16 @@ window.onload = function () {
               <div class="flex items-start">
                 <div class="flex-shrink-0">
                   <span class="inline-flex items-center justify-center h-8 w-8 rounded-full bg-${color}-100 text-${color}-700">
-                    ${sender.charAt(0).toUpperCase()}
+                    ${escapeHTML(sender.charAt(0).toUpperCase())}
                   </span>
                 </div>
                 <div class="ms-3 flex-1">
                   <div class="flex items-center mb-1">
                     <span class="text-xs font-medium text-gray-500 mr-2">${timeStr}</span>
-                    <span class="text-sm font-semibold text-gray-800">${sender}</span>
+                    <span class="text-sm font-semibold text-gray-800">${escapeHTML(sender)}</span>
+                    ${channelName ? `<span class="ms-2 text-xs text-gray-500">#${escapeHTML(channelName)}</span>` : ""}
                   </div>
-                  <div class="text-sm text-gray-700">${messageText}</div>
+                  <div class="text-sm text-gray-700">${escapeHTML(messageText)}</div>
                 </div>
               </div>
             `;
@@ -321,7 +332,7 @@ window.onload = function () {
             </svg>
             <span class="sr-only">Success</span>
             <div>
-              <span class="font-medium">Connected to channel: ${channel || "General"}</span>
+              <span class="font-medium">Connected to channel: ${escapeHTML(channel || "General")}</span>
             </div>
           `;
           appendLog(connectedItem);
@@ -375,7 +386,7 @@ window.onload = function () {
       </svg>
       <span class="sr-only">Info</span>
       <div>
-        <span class="font-medium">Switching to channel: ${channel || "General"}</span>
+        <span class="font-medium">Switching to channel: ${escapeHTML(channel || "General")}</span>
       </div>
     `;
     appendLog(item);
@@ -461,7 +472,7 @@ window.onload = function () {
             </svg>
             <span class="sr-only">Success</span>
             <div>
-              <span class="font-medium">Creating new channel: ${channelName}</span>
+              <span class="font-medium">Creating new channel: ${escapeHTML(channelName)}</span>
             </div>
           `;
           appendLog(item);
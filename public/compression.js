@@ -0,0 +1,106 @@
+// compression.js - Compresses chat messages with the server's preset dictionary
+
+/**
+ * Browsers do not let pages offer the x-deflate-dictionary websocket extension that Go clients
+ * negotiate, so browser clients compress with the dictionary above the websocket layer:
+ *
+ *  - The dictionary is downloaded from /ws/dictionary, which sends its ID in the
+ *    X-Dictionary-Id header (404 if the server has no dictionary).
+ *  - The websocket URL asks for the dictionary with the `dict` query parameter.
+ *  - The server then sends large messages as binary messages holding the raw DEFLATE stream of
+ *    the JSON text, primed with the dictionary. Small messages stay text.
+ *  - The client may send binary messages compressed the same way.
+ *
+ * DEFLATE with a preset dictionary needs pako (https://github.com/nodeca/pako); without it the
+ * client does not ask for the dictionary and uses plain text messages.
+ *
+ * Usage:
+ *   const socket = new ReconnectingWebSocket(url, null, { automaticOpen: false });
+ *   DictionaryCompression.load().then(function(dictionary) {
+ *     if (dictionary) {
+ *       socket.url = DictionaryCompression.url(url, dictionary);
+ *       DictionaryCompression.wrap(socket, dictionary);
+ *     }
+ *   }).finally(function() { socket.open(false); });
+ */
+const DictionaryCompression = (function() {
+
+  // Messages smaller than this are sent as text; see minCompressSize in compression.go
+  const minCompressSize = 256;
+
+  /**
+   * Downloads the server's dictionary.
+   *
+   * @returns Promise resolving to { id, bytes }, or null if the server has no dictionary or
+   * pako is not loaded.
+   */
+  function load() {
+    if (typeof pako === 'undefined') {
+      return Promise.resolve(null);
+    }
+    return fetch('/ws/dictionary').then(function(response) {
+      const id = response.headers.get('X-Dictionary-Id');
+      if (!response.ok || !id) {
+        return null;
+      }
+      return response.arrayBuffer().then(function(buffer) {
+        return { id: id, bytes: new Uint8Array(buffer) };
+      });
+    }).catch(function(e) {
+      console.error("Error loading compression dictionary:", e);
+      return null;
+    });
+  }
+
+  /**
+   * Returns the websocket URL asking for the dictionary.
+   */
+  function url(wsUrl, dictionary) {
+    return wsUrl + (wsUrl.indexOf('?') < 0 ? '?' : '&') + 'dict=' + encodeURIComponent(dictionary.id);
+  }
+
+  /**
+   * Makes a ReconnectingWebSocket compress the messages it sends and decompress the binary
+   * messages it receives. The onmessage handler, set before or after, receives the decompressed
+   * text in event.data. Native WebSocket objects call their own onmessage and cannot be wrapped.
+   */
+  function wrap(socket, dictionary) {
+    socket.binaryType = 'arraybuffer';
+
+    const send = socket.send.bind(socket);
+    socket.send = function(data) {
+      if (typeof data === 'string' && data.length >= minCompressSize) {
+        return send(pako.deflateRaw(data, { dictionary: dictionary.bytes }));
+      }
+      return send(data);
+    };
+
+    let handler = socket.onmessage;
+    Object.defineProperty(socket, 'onmessage', {
+      configurable: true,
+      get: function() {
+        return function(event) {
+          if (event.data instanceof ArrayBuffer) {
+            let text;
+            try {
+              text = pako.inflateRaw(new Uint8Array(event.data), { dictionary: dictionary.bytes, to: 'string' });
+            } catch (e) {
+              console.error("Error decompressing message:", e);
+              return;
+            }
+            event = { data: text, original: event };
+          }
+          if (handler) {
+            handler.call(socket, event);
+          }
+        };
+      },
+      set: function(value) {
+        handler = value;
+      }
+    });
+    return socket;
+  }
+
+  return { load: load, url: url, wrap: wrap };
+})();
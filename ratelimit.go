@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/gflydev/core/utils"
+	"sync"
+	"time"
+	"ws/data"
+	"ws/websocket"
+)
+
+// roleRateLimits maps a user role to the inbound rate limit applied to its connections.
+//
+// Guests may only authenticate and browse, so they get a small budget and are disconnected
+// when they exceed it. Regular users are slowed down instead of losing messages. Admins are
+// not limited (a nil limit).
+var roleRateLimits = map[string]*websocket.RateLimit{
+	data.RoleGuest: {
+		MessagesPerSecond: 2,
+		MessageBurst:      5,
+		BytesPerSecond:    4096,
+		ByteBurst:         maxMessageSize,
+		Policy:            websocket.RateLimitClose,
+	},
+	data.RoleUser: {
+		MessagesPerSecond: 10,
+		MessageBurst:      20,
+		BytesPerSecond:    64 * 1024,
+		ByteBurst:         4 * maxMessageSize,
+		Policy:            websocket.RateLimitDelay,
+	},
+	data.RoleAdmin: nil,
+}
+
+// applyRateLimit configures the rate limit of the client's connection for the given role.
+//
+// Parameters:
+// - role (string): The role of the user owning the connection (see data.RoleGuest, data.RoleUser, data.RoleAdmin).
+//
+// Logic:
+// 1. Looks up the limit for the role, falling back to the regular user limit for unknown roles.
+// 2. Replaces the connection's rate limit. The token buckets start full.
+//
+// Note: The method must be called from the readPump goroutine.
+func (c *Client) applyRateLimit(role string) {
+	limit, ok := roleRateLimits[role]
+	if !ok {
+		limit = roleRateLimits[data.RoleUser]
+	}
+	c.conn.SetRateLimit(limit)
+}
+
+// loginThrottle limits the login attempts with a token bucket per client IP and username, so
+// that passwords cannot be guessed at the rate of the password hashing, and a token bucket per
+// client IP, so that a client cannot try many usernames. Attempts from other IPs do not count
+// against a username, so that a client cannot lock a user out.
+type loginThrottle struct {
+	rate    float64 // Attempts per IP and username added per second
+	burst   int     // Attempts per IP and username allowed in a burst
+	ipRate  float64 // Attempts per IP added per second
+	ipBurst int     // Attempts per IP allowed in a burst
+
+	mu      sync.Mutex
+	buckets map[string]*websocket.TokenBucket // map[ip:<ip> or user:<ip>/<username>]bucket
+	swept   time.Time
+}
+
+// newLoginThrottle creates a login throttle. A limit with a sustained rate of 0 is disabled.
+//
+// Parameters:
+// - perMinute (float64): The sustained number of attempts per IP and username allowed per minute.
+// - burst (int): The number of attempts per IP and username allowed in a burst.
+// - ipPerMinute (float64): The sustained number of attempts per IP allowed per minute.
+// - ipBurst (int): The number of attempts per IP allowed in a burst.
+func newLoginThrottle(perMinute float64, burst int, ipPerMinute float64, ipBurst int) *loginThrottle {
+	return &loginThrottle{
+		rate:    perMinute / 60,
+		burst:   burst,
+		ipRate:  ipPerMinute / 60,
+		ipBurst: ipBurst,
+		buckets: make(map[string]*websocket.TokenBucket),
+	}
+}
+
+// allow takes an attempt from the bucket of the client IP and username and from the bucket of
+// the client IP.
+//
+// Parameters:
+// - ip (string): The client IP.
+// - username (string): The username of the attempt.
+//
+// Logic:
+// 1. Gets the buckets of the enabled limits, creating them full.
+// 2. If a bucket is empty, takes nothing from either bucket, so that a refused attempt is not
+// counted.
+// 3. Otherwise takes an attempt from both.
+//
+// Returns:
+// - time.Duration: Zero if the attempt is allowed, otherwise the time until the next attempt.
+func (l *loginThrottle) allow(ip, username string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	var buckets []*websocket.TokenBucket
+	if l.rate > 0 {
+		buckets = append(buckets, l.bucket("user:"+ip+"/"+username, l.rate, l.burst, now))
+	}
+	if l.ipRate > 0 {
+		buckets = append(buckets, l.bucket("ip:"+ip, l.ipRate, l.ipBurst, now))
+	}
+
+	var wait time.Duration
+	for _, bucket := range buckets {
+		wait = max(wait, bucket.Wait(now))
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, bucket := range buckets {
+		bucket.Take(now)
+	}
+	return 0
+}
+
+// bucket returns the bucket of a key, creating a full one if there is none. The caller must
+// hold l.mu.
+func (l *loginThrottle) bucket(key string, rate float64, burst int, now time.Time) *websocket.TokenBucket {
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = websocket.NewTokenBucket(rate, burst, now)
+		l.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// sweep forgets the full buckets once a minute, so that the throttle only holds the buckets of
+// recent attempts. The caller must hold l.mu.
+func (l *loginThrottle) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, bucket := range l.buckets {
+		if bucket.Full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Global instance of the login throttle
+var loginLimits = newLoginThrottle(
+	utils.Getenv[float64]("WS_LOGIN_ATTEMPTS_PER_MINUTE", 5),
+	utils.Getenv[int]("WS_LOGIN_BURST", 10),
+	utils.Getenv[float64]("WS_LOGIN_IP_ATTEMPTS_PER_MINUTE", 30),
+	utils.Getenv[int]("WS_LOGIN_IP_BURST", 60),
+)
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"github.com/gflydev/core/log"
+	"unicode/utf8"
+	"ws/data"
+)
+
+const (
+	// Maximum size in bytes of a reaction emoji.
+	maxEmojiSize = 32
+
+	// Maximum number of distinct emojis on a message.
+	maxReactionsPerMessage = 50
+)
+
+var (
+	// errInvalidEmoji is returned for empty or oversized emojis.
+	errInvalidEmoji = errors.New("invalid emoji")
+
+	// errTooManyReactions is returned when a new emoji would exceed maxReactionsPerMessage.
+	errTooManyReactions = errors.New("too many different reactions on this message")
+)
+
+// react adds or removes the reaction of a user on a message.
+//
+// Parameters:
+// - id (string): The message ID.
+// - userID (string): The reacting user.
+// - emoji (string): The reaction emoji.
+// - op (string): data.ReactionAdd, data.ReactionRemove, or "" to toggle the user's reaction.
+//
+// Logic:
+// 1. Adding a reaction the user already has, or removing one they do not have, changes nothing,
+// so repeated requests are idempotent.
+// 2. Recomputes `Count` from `Users` and drops reactions without users.
+//
+// Returns:
+// - data.MessageReactionDeltaData: The change, valid if changed is true.
+// - bool: Whether the reactions changed.
+// - error: errMessageNotFound, errInvalidEmoji, errTooManyReactions or a storage error.
+func (l *messageLog) react(id, userID, emoji, op string) (data.MessageReactionDeltaData, bool, error) {
+	if emoji == "" || len(emoji) > maxEmojiSize || !utf8.ValidString(emoji) {
+		return data.MessageReactionDeltaData{}, false, errInvalidEmoji
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	message, ok := l.store.Get(l.channelID, id)
+	if !ok || message.Deleted {
+		return data.MessageReactionDeltaData{}, false, errMessageNotFound
+	}
+	// Work on copies, the stored message shares its slices with the returned one.
+	message.Reactions = append([]data.Reaction(nil), message.Reactions...)
+
+	// Find the reaction and the user's position in it.
+	reaction, user := -1, -1
+	for i, r := range message.Reactions {
+		if r.Emoji != emoji {
+			continue
+		}
+		reaction = i
+		for j, u := range r.Users {
+			if u == userID {
+				user = j
+				break
+			}
+		}
+		break
+	}
+
+	add := user < 0
+	switch op {
+	case data.ReactionAdd:
+		if !add {
+			return data.MessageReactionDeltaData{}, false, nil
+		}
+	case data.ReactionRemove:
+		if add {
+			return data.MessageReactionDeltaData{}, false, nil
+		}
+	}
+
+	delta := data.MessageReactionDeltaData{MessageID: id, Emoji: emoji, UserID: userID, Added: add}
+	switch {
+	case add && reaction < 0:
+		if len(message.Reactions) >= maxReactionsPerMessage {
+			return data.MessageReactionDeltaData{}, false, errTooManyReactions
+		}
+		message.Reactions = append(message.Reactions, data.Reaction{Emoji: emoji, Count: 1, Users: []string{userID}})
+		delta.Count = 1
+	case add:
+		r := &message.Reactions[reaction]
+		r.Users = append(r.Users[:len(r.Users):len(r.Users)], userID)
+		r.Count = len(r.Users)
+		delta.Count = r.Count
+	default:
+		r := &message.Reactions[reaction]
+		r.Users = append(r.Users[:user:user], r.Users[user+1:]...)
+		r.Count = len(r.Users)
+		delta.Count = r.Count
+		if r.Count == 0 {
+			message.Reactions = append(message.Reactions[:reaction:reaction], message.Reactions[reaction+1:]...)
+		}
+	}
+	if err := l.store.Update(l.channelID, message); err != nil {
+		return data.MessageReactionDeltaData{}, false, err
+	}
+	return delta, true, nil
+}
+
+// handleReactMessage adds or removes the client's reaction on a message and broadcasts the change.
+//
+// Parameters:
+// - actionMsg (data.ActionMessage): The react_message action.
+//
+// Logic:
+// 1. Decodes data.MessageReactData; only the emoji of the reaction is used, counts and users
+// sent by the client are ignored. The channel defaults to the active channel.
+// 2. Applies the reaction and sends an error response if the message or emoji is invalid.
+// 3. Broadcasts a data.MessageReactionDeltaData to the channel if the reactions changed.
+func (c *Client) handleReactMessage(actionMsg data.ActionMessage) {
+	var reactData data.MessageReactData
+	if err := decodeActionData(actionMsg.Action.Data, &reactData); err != nil || reactData.MessageID == "" {
+		c.sendError(data.ActionReactMessage, errCodeInvalidRequest, "message_id and reaction.emoji are required")
+		return
+	}
+	if reactData.Op != "" && reactData.Op != data.ReactionAdd && reactData.Op != data.ReactionRemove {
+		c.sendError(data.ActionReactMessage, errCodeInvalidRequest, "op must be add, remove or empty")
+		return
+	}
+	hub, ok := c.channelHub(actionMsg.Channel.ID)
+	if !ok {
+		c.sendNotSubscribed(data.ActionReactMessage, actionMsg.Channel.ID)
+		return
+	}
+
+	delta, changed, err := hub.messages.react(reactData.MessageID, c.senderID(), reactData.Reaction.Emoji, reactData.Op)
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		c.sendError(data.ActionReactMessage, errCodeNotFound, err.Error())
+		return
+	case errors.Is(err, errInvalidEmoji), errors.Is(err, errTooManyReactions):
+		c.sendError(data.ActionReactMessage, errCodeInvalidRequest, err.Error())
+		return
+	case err != nil:
+		log.Errorf("Error saving reaction on message %s: %v", reactData.MessageID, err)
+		c.sendError(data.ActionReactMessage, errCodeInternal, "the reaction could not be saved")
+		return
+	case !changed:
+		return
+	}
+	log.Debugf("Client %s reaction %s on message %s: added=%v", c.id, delta.Emoji, delta.MessageID, delta.Added)
+
+	hub.broadcastAction(data.Action{
+		Type: data.ActionReactMessage,
+		Data: delta,
+	})
+}
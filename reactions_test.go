@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"ws/data"
+)
+
+func TestMessageLogReact(t *testing.T) {
+	l := newMessageLog(NewInMemoryMessageStore(10), "test")
+	l.add(data.Message{ID: "m1", SenderID: "alice", Reactions: []data.Reaction{}})
+
+	steps := []struct {
+		user, emoji, op string
+		changed         bool
+		added           bool
+		count           int
+	}{
+		{"alice", "👍", "", true, true, 1},
+		{"bob", "👍", data.ReactionAdd, true, true, 2},
+		{"bob", "👍", data.ReactionAdd, false, false, 0},
+		{"bob", "🎉", "", true, true, 1},
+		{"alice", "👍", "", true, false, 1},
+		{"alice", "👍", data.ReactionRemove, false, false, 0},
+		{"bob", "🎉", data.ReactionRemove, true, false, 0},
+	}
+	for i, s := range steps {
+		delta, changed, err := l.react("m1", s.user, s.emoji, s.op)
+		if err != nil {
+			t.Fatalf("%d: react: %v", i, err)
+		}
+		if changed != s.changed || (changed && (delta.Added != s.added || delta.Count != s.count || delta.UserID != s.user || delta.Emoji != s.emoji)) {
+			t.Fatalf("%d: react(%s, %s, %q) = %+v, %v", i, s.user, s.emoji, s.op, delta, changed)
+		}
+	}
+
+	m, _ := l.store.Get("test", "m1")
+	reactions := m.Reactions
+	want := []data.Reaction{{Emoji: "👍", Count: 1, Users: []string{"bob"}}}
+	if !reflect.DeepEqual(reactions, want) {
+		t.Errorf("reactions = %+v, want %+v", reactions, want)
+	}
+}
+
+func TestMessageLogReactErrors(t *testing.T) {
+	l := newMessageLog(NewInMemoryMessageStore(10), "test")
+	l.add(data.Message{ID: "m1", SenderID: "alice"})
+
+	if _, _, err := l.react("m2", "alice", "👍", ""); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("unknown message: %v, want %v", err, errMessageNotFound)
+	}
+	for _, emoji := range []string{"", strings.Repeat("x", maxEmojiSize+1), "\xff"} {
+		if _, _, err := l.react("m1", "alice", emoji, ""); !errors.Is(err, errInvalidEmoji) {
+			t.Errorf("emoji %q: %v, want %v", emoji, err, errInvalidEmoji)
+		}
+	}
+	for i := 0; i < maxReactionsPerMessage; i++ {
+		if _, _, err := l.react("m1", "alice", string(rune('a'+i)), ""); err != nil {
+			t.Fatalf("reaction %d: %v", i, err)
+		}
+	}
+	if _, _, err := l.react("m1", "alice", "👍", ""); !errors.Is(err, errTooManyReactions) {
+		t.Errorf("reaction over the limit: %v, want %v", err, errTooManyReactions)
+	}
+
+	_ = l.remove("m1", "alice", false)
+	if _, _, err := l.react("m1", "alice", "a", ""); !errors.Is(err, errMessageNotFound) {
+		t.Errorf("deleted message: %v, want %v", err, errMessageNotFound)
+	}
+}
+
+func TestHandleReactMessage(t *testing.T) {
+	hub := newTestHub("test")
+	alice := newTestClient(hub, "alice", data.RoleUser)
+	hub.messages.add(alice.prepareMessage(hub, data.Message{ID: "m1", Reactions: []data.Reaction{{Emoji: "💯", Count: 99}}}))
+
+	react := func(actionData any) {
+		go alice.handleAction(data.ActionMessage{Action: data.Action{Type: data.ActionReactMessage, Data: actionData}})
+	}
+
+	react(map[string]interface{}{"message_id": "m1", "reaction": map[string]interface{}{"emoji": "👍", "count": 10}})
+	var delta data.MessageReactionDeltaData
+	if typ := decodeAction(t, <-hub.broadcast, &delta); typ != data.ActionReactMessage ||
+		delta != (data.MessageReactionDeltaData{MessageID: "m1", Emoji: "👍", UserID: "alice", Added: true, Count: 1}) {
+		t.Fatalf("broadcast = %s %+v", typ, delta)
+	}
+
+	react(map[string]interface{}{"message_id": "m1", "reaction": map[string]interface{}{"emoji": "👍"}, "op": "flip"})
+	var errData data.ErrorData
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInvalidRequest {
+		t.Fatalf("response = %s %+v, want invalid_request error", typ, errData)
+	}
+
+	// Storage failures are internal errors.
+	store := &failingMessageStore{InMemoryMessageStore: NewInMemoryMessageStore(10)}
+	hub.messages = newMessageLog(store, hub.id)
+	hub.messages.add(alice.prepareMessage(hub, data.Message{ID: "m2"}))
+	store.err = errors.New("disk full")
+	react(map[string]interface{}{"message_id": "m2", "reaction": map[string]interface{}{"emoji": "👍"}})
+	if typ := decodeAction(t, <-alice.send, &errData); typ != data.ActionError || errData.Code != errCodeInternal || strings.Contains(errData.Message, "disk") {
+		t.Fatalf("response = %s %+v, want internal error", typ, errData)
+	}
+}
+
+// failingMessageStore fails to store messages once err is set.
+type failingMessageStore struct {
+	*InMemoryMessageStore
+	err error
+}
+
+func (s *failingMessageStore) Append(channelID string, message data.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.InMemoryMessageStore.Append(channelID, message)
+}
+
+func (s *failingMessageStore) Update(channelID string, message data.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.InMemoryMessageStore.Update(channelID, message)
+}
@@ -1,15 +1,40 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"ws/data"
 )
 
+// ErrInvalidUser is returned when adding a user without username or password
+var ErrInvalidUser = errors.New("username and password are required")
+
+// bcrypt cost of new password hashes
+var passwordCost = utils.Getenv[int]("WS_PASSWORD_COST", bcrypt.DefaultCost)
+
+// dummyPasswordHash is compared with the password of unknown users, so that authenticating an
+// unknown user takes as long as authenticating a known one
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy password"), passwordCost)
+	return hash
+})
+
 // UserStore defines the interface for user storage
 type UserStore interface {
-	// AddUser adds a new user to the store
+	// AddUser adds a new user with the regular user role to the store
 	AddUser(username, password string) error
 
+	// AddUserWithRole adds a new user with the given role to the store
+	AddUserWithRole(username, password, role string) error
+
 	// GetUser retrieves a user by username
 	GetUser(username string) (*data.User, bool)
 
@@ -20,33 +45,67 @@ type UserStore interface {
 	ListUsers() []string
 }
 
-// InMemoryUserStore implements UserStore with an in-memory map
+// hashPassword returns the bcrypt hash of a password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// InMemoryUserStore implements UserStore with an in-memory map. Passwords are stored as
+// bcrypt hashes.
 type InMemoryUserStore struct {
-	users map[string]string // map[username]password
+	users map[string]data.User // map[username]user
 	mu    sync.RWMutex
 }
 
-// NewInMemoryUserStore creates a new in-memory user store
+// NewInMemoryUserStore creates a new, empty in-memory user store
 func NewInMemoryUserStore() *InMemoryUserStore {
-	store := &InMemoryUserStore{
-		users: make(map[string]string),
+	return &InMemoryUserStore{
+		users: make(map[string]data.User),
 	}
+}
 
-	// Add some default users
-	_ = store.AddUser("admin", "admin123")
-	_ = store.AddUser("user1", "password1")
-	_ = store.AddUser("user2", "password2")
+// AddUser adds a new user with the regular user role to the store
+func (s *InMemoryUserStore) AddUser(username, password string) error {
+	return s.AddUserWithRole(username, password, data.RoleUser)
+}
 
-	return store
+// AddUserWithRole adds a new user with the given role to the store, or replaces the user
+// with the same username
+func (s *InMemoryUserStore) AddUserWithRole(username, password, role string) error {
+	user, err := newUser(username, password, role)
+	if err != nil {
+		return err
+	}
+	s.put(user)
+	return nil
 }
 
-// AddUser adds a new user to the store
-func (s *InMemoryUserStore) AddUser(username, password string) error {
+// newUser creates a user with the hash of the password
+func newUser(username, password, role string) (data.User, error) {
+	if username == "" || password == "" {
+		return data.User{}, ErrInvalidUser
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return data.User{}, err
+	}
+	return data.User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+	}, nil
+}
+
+// put adds or replaces a user
+func (s *InMemoryUserStore) put(user data.User) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.users[username] = password
-	return nil
+	s.users[user.Username] = user
 }
 
 // GetUser retrieves a user by username
@@ -54,28 +113,24 @@ func (s *InMemoryUserStore) GetUser(username string) (*data.User, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	password, exists := s.users[username]
+	user, exists := s.users[username]
 	if !exists {
 		return nil, false
 	}
 
-	return &data.User{
-		Username: username,
-		Password: password,
-	}, true
+	return &user, true
 }
 
-// Authenticate checks if the provided credentials are valid
+// Authenticate checks if the provided credentials are valid. The password is compared with
+// the hash in constant time, and unknown users take as long as known ones.
 func (s *InMemoryUserStore) Authenticate(username, password string) bool {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	storedPassword, exists := s.users[username]
+	user, exists := s.GetUser(username)
 	if !exists {
+		_ = bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
 		return false
 	}
 
-	return storedPassword == password
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
 }
 
 // ListUsers returns a list of all usernames
@@ -91,5 +146,181 @@ func (s *InMemoryUserStore) ListUsers() []string {
 	return usernames
 }
 
+// FileUserStore implements UserStore with a JSON file. The users are kept in memory and the
+// file is rewritten on every change.
+type FileUserStore struct {
+	InMemoryUserStore
+	path string
+	fmu  sync.Mutex // serializes writes of the file
+}
+
+// fileUser is a user as saved in the file. Files written before passwords were hashed hold
+// plaintext passwords.
+type fileUser struct {
+	data.User
+	Password string `json:"password,omitempty"`
+}
+
+// NewFileUserStore creates a user store saved to path, loading the users saved before.
+// Plaintext passwords of older files are hashed and the file is rewritten without them.
+func NewFileUserStore(path string) (*FileUserStore, error) {
+	store := &FileUserStore{
+		InMemoryUserStore: *NewInMemoryUserStore(),
+		path:              path,
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users []fileUser
+	if err := json.Unmarshal(b, &users); err != nil {
+		return nil, err
+	}
+	migrated := 0
+	for _, saved := range users {
+		user := saved.User
+		if user.PasswordHash == "" && saved.Password != "" {
+			if user.PasswordHash, err = hashPassword(saved.Password); err != nil {
+				return nil, err
+			}
+			migrated++
+		}
+		store.users[user.Username] = user
+	}
+	if migrated > 0 {
+		if err := store.write(); err != nil {
+			return nil, err
+		}
+		log.Infof("Hashed %d plaintext passwords in %s", migrated, path)
+	}
+	return store, nil
+}
+
+// AddUser adds a new user with the regular user role to the store
+func (s *FileUserStore) AddUser(username, password string) error {
+	return s.AddUserWithRole(username, password, data.RoleUser)
+}
+
+// AddUserWithRole adds a new user with the given role to the store, or replaces the user
+// with the same username
+func (s *FileUserStore) AddUserWithRole(username, password, role string) error {
+	user, err := newUser(username, password, role)
+	if err != nil {
+		return err
+	}
+
+	s.fmu.Lock()
+	defer s.fmu.Unlock()
+
+	previous, existed := s.GetUser(username)
+	s.put(user)
+	if err := s.write(); err != nil {
+		if existed {
+			s.put(*previous)
+		} else {
+			s.mu.Lock()
+			delete(s.users, username)
+			s.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// write saves the users to the file, sorted by username. The file is replaced atomically so
+// that a crash never leaves a partial file. The caller must hold s.fmu, or own the store.
+func (s *FileUserStore) write() error {
+	s.mu.RLock()
+	users := make([]data.User, 0, len(s.users))
+	for _, user := range s.users {
+		users = append(users, user)
+	}
+	s.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	b, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// seedUsers adds the users of a seed specification that are not in the store yet.
+//
+// Parameters:
+// - store (UserStore): The user store.
+// - seed (string): Comma separated `username:password` or `username:password:role` entries.
+//
+// Returns:
+// - int: The number of users added.
+func seedUsers(store UserStore, seed string) int {
+	added := 0
+	for _, entry := range strings.Split(seed, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, ":", 3)
+		if len(fields) < 2 {
+			log.Errorf("Invalid seed user %q, want username:password[:role]", fields[0])
+			continue
+		}
+		if _, ok := store.GetUser(fields[0]); ok {
+			continue
+		}
+		role := data.RoleUser
+		if len(fields) == 3 && fields[2] != "" {
+			role = fields[2]
+		}
+		if err := store.AddUserWithRole(fields[0], fields[1], role); err != nil {
+			log.Errorf("Error seeding user %s: %v", fields[0], err)
+			continue
+		}
+		added++
+	}
+	return added
+}
+
+// newUserStore creates the user store configured by the environment.
+//
+// Logic:
+// 1. `WS_USER_STORE=file` (default) saves the users to `WS_USER_FILE`.
+// 2. `WS_USER_STORE=memory` forgets the users when the server stops.
+// 3. Adds the users of `WS_SEED_USERS` that do not exist yet (see seedUsers).
+//
+// Returns:
+// - UserStore: The user store. Falls back to memory if the file cannot be read.
+func newUserStore() UserStore {
+	var store UserStore
+	if utils.Getenv[string]("WS_USER_STORE", "file") == "file" {
+		path := utils.Getenv[string]("WS_USER_FILE", "storage/users.json")
+		fileStore, err := NewFileUserStore(path)
+		if err == nil {
+			store = fileStore
+		} else {
+			log.Errorf("Error loading users from %s, keeping users in memory: %v", path, err)
+		}
+	}
+	if store == nil {
+		store = NewInMemoryUserStore()
+	}
+
+	if n := seedUsers(store, utils.Getenv[string]("WS_SEED_USERS", "")); n > 0 {
+		log.Infof("Seeded %d users", n)
+	}
+	return store
+}
+
 // Global instance of the user store
-var GlobalUserStore UserStore = NewInMemoryUserStore()
+var GlobalUserStore = newUserStore()
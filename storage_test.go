@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"ws/data"
+)
+
+func TestInMemoryUserStore(t *testing.T) {
+	store := NewInMemoryUserStore()
+	if users := store.ListUsers(); len(users) != 0 {
+		t.Fatalf("new store lists %v", users)
+	}
+	if err := store.AddUser("alice", ""); err != ErrInvalidUser {
+		t.Errorf("AddUser without password: %v, want %v", err, ErrInvalidUser)
+	}
+	if err := store.AddUser("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, ok := store.GetUser("alice")
+	if !ok || user.Role != data.RoleUser || user.PasswordHash == "" || strings.Contains(user.PasswordHash, "secret") {
+		t.Fatalf("stored user = %+v", user)
+	}
+	for _, tt := range []struct {
+		username, password string
+		want               bool
+	}{{"alice", "secret", true}, {"alice", "Secret", false}, {"bob", "secret", false}} {
+		if got := store.Authenticate(tt.username, tt.password); got != tt.want {
+			t.Errorf("Authenticate(%s, %s) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestFileUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "users.json")
+
+	// Plaintext passwords of an older file are hashed on load.
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `[{"username": "alice", "password": "secret", "role": "admin"}]`
+	if err := os.WriteFile(path, []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Authenticate("alice", "secret") {
+		t.Errorf("migrated user does not authenticate")
+	}
+	if b, _ := os.ReadFile(path); strings.Contains(string(b), "secret") || !strings.Contains(string(b), "password_hash") {
+		t.Errorf("migrated file = %s", b)
+	}
+
+	// Seeding adds missing users only.
+	if n := seedUsers(store, "alice:other:user, bob:hunter2, invalid"); n != 1 {
+		t.Errorf("seeded %d users, want 1", n)
+	}
+	reloaded, err := NewFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, ok := reloaded.GetUser("alice"); !ok || user.Role != data.RoleAdmin || !reloaded.Authenticate("alice", "secret") {
+		t.Errorf("reloaded alice = %+v", user)
+	}
+	if !reloaded.Authenticate("bob", "hunter2") {
+		t.Errorf("seeded user does not authenticate after reload")
+	}
+
+	if err := os.WriteFile(path, []byte("["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileUserStore(path); err == nil {
+		t.Errorf("corrupt file loaded without error")
+	}
+}
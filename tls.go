@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gflydev/core/log"
+	"github.com/gflydev/core/utils"
+	"github.com/valyala/fasthttp"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is the minimum time between two checks of the certificate files for changes.
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a TLS certificate and reloads it when the certificate or key file changes,
+// so renewed certificates are picked up without restarting the server.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	loaded  time.Time // modification time of the loaded files
+	checked time.Time // time of the last check for changes
+}
+
+// newCertReloader loads a certificate and key pair.
+//
+// Parameters:
+// - certFile (string): Path of the PEM encoded certificate chain.
+// - keyFile (string): Path of the PEM encoded private key.
+//
+// Returns:
+// - *certReloader: The reloader serving the certificate.
+// - error: An error if the certificate cannot be loaded.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: certReloadInterval,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// modTime returns the latest modification time of the certificate and key files.
+func (r *certReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate and key files. The caller must hold r.mu or own r.
+func (r *certReloader) load() error {
+	modTime, err := r.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.loaded = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading the files if they changed.
+// It is used as tls.Config.GetCertificate.
+//
+// Logic:
+// 1. Checks the modification time of the files at most once per `interval`.
+// 2. Reloads the pair if a file changed. If the new pair is invalid (e.g. the certificate was
+// replaced but not yet the key), the previous certificate is kept and the load is retried at the
+// next check.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= r.interval {
+		r.checked = time.Now()
+		if modTime, err := r.modTime(); err != nil {
+			log.Errorf("Error checking TLS certificate %s: %v", r.certFile, err)
+		} else if !modTime.Equal(r.loaded) {
+			if err := r.load(); err != nil {
+				log.Errorf("Error reloading TLS certificate %s, keeping the previous one: %v", r.certFile, err)
+			} else {
+				log.Infof("TLS certificate %s reloaded", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+// newTLSConfig creates the TLS configuration of the secure websocket endpoint.
+//
+// Parameters:
+// - certFile, keyFile (string): The server certificate and key, reloaded when they change.
+// - clientCAFile (string): PEM file with the CAs that sign client certificates. Empty to disable client certificates.
+// - clientAuth (string): "optional" to verify client certificates if given, "require" to reject clients
+// without a valid certificate. Defaults to "optional" if clientCAFile is set.
+//
+// Returns:
+// - *tls.Config: The TLS configuration.
+// - error: An error if a file cannot be loaded or the options are invalid.
+func newTLSConfig(certFile, keyFile, clientCAFile, clientAuth string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if clientCAFile == "" {
+		if clientAuth != "" && clientAuth != "none" {
+			return nil, fmt.Errorf("client certificate authentication %q requires a client CA file", clientAuth)
+		}
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+
+	switch clientAuth {
+	case "", "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid client certificate authentication %q", clientAuth)
+	}
+	return cfg, nil
+}
+
+// tlsUsername maps the verified client certificate of a connection to a user.
+//
+// Parameters:
+// - state (*tls.ConnectionState): The TLS state of the connection, nil for plain connections.
+//
+// Logic:
+// 1. Ignores connections without a verified client certificate.
+// 2. Tries the subject common name, then the email addresses of the certificate.
+// 3. Returns the first name that is a user in `GlobalUserStore`.
+//
+// Returns:
+// - string: The username, or "" if the certificate does not map to a user.
+func tlsUsername(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+
+	names := append([]string{cert.Subject.CommonName}, cert.EmailAddresses...)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if _, ok := GlobalUserStore.GetUser(name); ok {
+			return name
+		}
+	}
+	log.Infof("Client certificate %q does not match a user", cert.Subject.String())
+	return ""
+}
+
+// startTLSServer serves the websocket endpoint over `wss://` on a separate port.
+//
+// Logic:
+// 1. Does nothing unless `WS_TLS_CERT` and `WS_TLS_KEY` are set.
+// 2. Builds the TLS configuration; client certificates are verified with `WS_TLS_CLIENT_CA`
+// according to `WS_TLS_CLIENT_AUTH` (optional|require).
+// 3. Listens on `SERVER_HOST`:`WS_TLS_PORT` and serves `/ws` with ServeWS in the background.
+func startTLSServer() {
+	certFile := utils.Getenv[string]("WS_TLS_CERT", "")
+	keyFile := utils.Getenv[string]("WS_TLS_KEY", "")
+	if certFile == "" || keyFile == "" {
+		return
+	}
+
+	cfg, err := newTLSConfig(
+		certFile,
+		keyFile,
+		utils.Getenv[string]("WS_TLS_CLIENT_CA", ""),
+		utils.Getenv[string]("WS_TLS_CLIENT_AUTH", ""),
+	)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+
+	addr := fmt.Sprintf("%s:%v", utils.Getenv("SERVER_HOST", "0.0.0.0"), utils.Getenv("WS_TLS_PORT", 7790))
+	ln, err := tls.Listen("tcp", addr, cfg)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", addr, err)
+	}
+
+	server := &fasthttp.Server{Handler: serveTLSWS}
+	go func() {
+		log.Fatal(server.Serve(ln))
+	}()
+	log.Infof("Serving secure websocket on wss://%s/ws", addr)
+}
+
+// serveTLSWS routes the requests of the TLS server to the websocket and login endpoints.
+func serveTLSWS(ctx *fasthttp.RequestCtx) {
+	switch path := string(ctx.Path()); {
+	case path == "/ws":
+		ServeWS(ctx)
+	case path == "/ws/dictionary":
+		serveCompressionDictionary(ctx)
+	case path == "/auth/login" && ctx.IsPost():
+		serveLogin(ctx)
+	case path == "/auth/logout" && ctx.IsPost():
+		serveLogout(ctx)
+	default:
+		ctx.Error("Not Found", fasthttp.StatusNotFound)
+	}
+}
+
+// loginWithCertificate authenticates the client as the user of its client certificate.
+//
+// Parameters:
+// - username (string): The user mapped from the certificate by tlsUsername.
+//
+// Logic:
+// 1. Logs the client in, applying the rate limit of the user's role.
+// 2. Queues a successful `user_auth` response so the client knows it is authenticated.
+//
+// Note: The method must be called before readPump starts, from the goroutine that runs it.
+func (c *Client) loginWithCertificate(username string) {
+	c.login(username)
+	log.Infof("Client %s authenticated as %s by client certificate", c.id, username)
+	c.sendAuthenticated(username, "Authenticated by client certificate")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+
+	"github.com/valyala/fasthttp"
+)
+
+// testCert is a generated certificate with its key.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert generates a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func newServerCert(t *testing.T, ca *testCert, name string) *testCert {
+	return newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+func newClientCert(t *testing.T, ca *testCert, name string) tls.Certificate {
+	c := newTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeFile writes a test file and sets its modification time.
+func writeFile(t *testing.T, name string, content []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(name, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}})
+
+	first := newServerCert(t, ca, "first")
+	modTime := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, first.certPEM, modTime)
+	writeFile(t, keyFile, first.keyPEM, modTime)
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	r.interval = 0
+	commonName := func() string {
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate: %v", err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Fatalf("certificate = %q, want first", name)
+	}
+
+	// A certificate without the matching key keeps the previous certificate.
+	second := newServerCert(t, ca, "second")
+	modTime = modTime.Add(time.Second)
+	writeFile(t, certFile, second.certPEM, modTime)
+	if name := commonName(); name != "first" {
+		t.Fatalf("certificate after partial update = %q, want first", name)
+	}
+
+	modTime = modTime.Add(time.Second)
+	writeFile(t, keyFile, second.keyPEM, modTime)
+	if name := commonName(); name != "second" {
+		t.Fatalf("certificate after update = %q, want second", name)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}})
+	server := newServerCert(t, ca, "localhost")
+	writeFile(t, certFile, server.certPEM, time.Now())
+	writeFile(t, keyFile, server.keyPEM, time.Now())
+	writeFile(t, caFile, ca.certPEM, time.Now())
+
+	tests := []struct {
+		clientCA, clientAuth string
+		want                 tls.ClientAuthType
+		wantErr              bool
+	}{
+		{"", "", tls.NoClientCert, false},
+		{"", "require", 0, true},
+		{caFile, "", tls.VerifyClientCertIfGiven, false},
+		{caFile, "require", tls.RequireAndVerifyClientCert, false},
+		{caFile, "sometimes", 0, true},
+		{keyFile, "", 0, true},
+	}
+	for _, tt := range tests {
+		cfg, err := newTLSConfig(certFile, keyFile, tt.clientCA, tt.clientAuth)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("newTLSConfig(%q, %q) succeeded, want error", tt.clientCA, tt.clientAuth)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newTLSConfig(%q, %q): %v", tt.clientCA, tt.clientAuth, err)
+			continue
+		}
+		if cfg.ClientAuth != tt.want {
+			t.Errorf("newTLSConfig(%q, %q).ClientAuth = %v, want %v", tt.clientCA, tt.clientAuth, cfg.ClientAuth, tt.want)
+		}
+	}
+}
+
+// startTestTLSServer serves the websocket endpoint over TLS with client certificates signed by ca.
+func startTestTLSServer(t *testing.T, ca *testCert, clientAuth string) string {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	server := newServerCert(t, ca, "localhost")
+	writeFile(t, certFile, server.certPEM, time.Now())
+	writeFile(t, keyFile, server.keyPEM, time.Now())
+	writeFile(t, caFile, ca.certPEM, time.Now())
+
+	cfg, err := newTLSConfig(certFile, keyFile, caFile, clientAuth)
+	if err != nil {
+		t.Fatalf("newTLSConfig: %v", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fasthttp.Server{Handler: serveTLSWS}
+	go s.Serve(ln)
+	t.Cleanup(func() { _ = s.Shutdown() })
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return "wss://localhost:" + port + "/ws"
+}
+
+// dialTLS connects to the TLS server with an optional client certificate.
+func dialTLS(t *testing.T, url string, ca *testCert, cert *tls.Certificate) (*websocket.Conn, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	cfg := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		cfg.Certificates = []tls.Certificate{*cert}
+	}
+	d := websocket.Dialer{TLSClientConfig: cfg, HandshakeTimeout: 5 * time.Second}
+	c, _, err := d.Dial(url, http.Header{"Origin": {os.Getenv("APP_URL")}})
+	if err == nil {
+		t.Cleanup(func() { c.Close() })
+	}
+	return c, err
+}
+
+// readAuthResponse waits for a user_auth response, returning false if none arrives. Other
+// messages, such as channel events, are skipped.
+func readAuthResponse(t *testing.T, c *websocket.Conn, wait time.Duration) (data.UserAuthResponseData, bool) {
+	_ = c.SetReadDeadline(time.Now().Add(wait))
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			return data.UserAuthResponseData{}, false
+		}
+		for _, line := range bytes.Split(p, []byte("\n")) {
+			var msg struct {
+				Action struct {
+					Type data.ActionType           `json:"type"`
+					Data data.UserAuthResponseData `json:"data"`
+				} `json:"action"`
+			}
+			if err := json.Unmarshal(line, &msg); err != nil {
+				t.Fatalf("unexpected message %s", line)
+			}
+			if msg.Action.Type == data.ActionUserAuth {
+				return msg.Action.Data, true
+			}
+		}
+	}
+}
+
+func TestTLSClientCertificateLogin(t *testing.T) {
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}})
+	url := startTestTLSServer(t, ca, "optional")
+
+	// A certificate of a known user authenticates the connection.
+	cert := newClientCert(t, ca, "user1")
+	c, err := dialTLS(t, url, ca, &cert)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	resp, ok := readAuthResponse(t, c, 5*time.Second)
+	if !ok || !resp.Success || resp.Username != "user1" {
+		t.Fatalf("auth response = %+v, %v, want success for user1", resp, ok)
+	}
+
+	// Unknown users, certificates of another CA and clients without a certificate connect as
+	// guests.
+	unknown := newClientCert(t, ca, "mallory")
+	other := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other CA"}})
+	forged := newClientCert(t, other, "admin")
+	for _, cert := range []*tls.Certificate{&unknown, &forged, nil} {
+		c, err := dialTLS(t, url, ca, cert)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		if resp, ok := readAuthResponse(t, c, 200*time.Millisecond); ok {
+			t.Errorf("guest received auth response %+v", resp)
+		}
+	}
+}
+
+func TestTLSRequireClientCertificate(t *testing.T) {
+	ca := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "test CA"}})
+	url := startTestTLSServer(t, ca, "require")
+
+	if _, err := dialTLS(t, url, ca, nil); err == nil {
+		t.Errorf("Dial without a client certificate succeeded")
+	}
+	other := newTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other CA"}})
+	forged := newClientCert(t, other, "admin")
+	if _, err := dialTLS(t, url, ca, &forged); err == nil {
+		t.Errorf("Dial with a certificate of another CA succeeded")
+	}
+	cert := newClientCert(t, ca, "user2")
+	if _, err := dialTLS(t, url, ca, &cert); err != nil {
+		t.Errorf("Dial with a client certificate: %v", err)
+	}
+}
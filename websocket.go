@@ -1,14 +1,18 @@
 package main
 
 import (
+	"errors"
 	"github.com/gflydev/core"
 	"github.com/gflydev/core/log"
 	"github.com/gflydev/core/try"
 	"github.com/gflydev/core/utils"
 	"github.com/valyala/fasthttp"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"ws/data"
 	"ws/websocket"
 )
 
@@ -25,39 +29,161 @@ const (
 // It is used to manage multiple Hub instances within the application.
 type PoolHub map[string]*Hub
 
+// ErrChannelExists is returned by Manager.CreateChannel for the ID of a saved channel or of a
+// running hub.
+var ErrChannelExists = errors.New("channel already exists")
+
+// ErrChannelQuota is returned by Manager.CreateChannel when the owner already owns the number of
+// channels allowed.
+var ErrChannelQuota = errors.New("channel quota reached")
+
 // Manager is responsible for managing multiple Hub instances.
-// It contains a poolHub, which is a map of Hub instances identified by unique string keys.
+// It contains a poolHub, which is a map of Hub instances identified by unique string keys,
+// and the channel store holding the definitions of the channels. It is safe for concurrent use.
+//
+// Hubs of channels saved in the channel store run as long as the server. Other hubs are created
+// on demand when a client opens an unknown channel and are stopped by reapIdleHubs once they
+// have been empty for a while.
 type Manager struct {
-	poolHub PoolHub // A map to store and manage Hub instances.
+	mu       sync.RWMutex // Guards poolHub and the persistent flag of the hubs.
+	poolHub  PoolHub      // A map to store and manage Hub instances.
+	channels ChannelStore // The channel definitions.
+
+	// The connections of the authenticated users, by username, to deliver direct channels to
+	// all of them. Acquired before the clients' and m.mu locks.
+	sessionsMu sync.Mutex
+	sessions   map[string]map[*Client]bool
 }
 
 // NewManager creates and initializes a new Manager instance.
 //
+// Parameters:
+// - channels (ChannelStore): The store of the channel definitions.
+//
 // Returns:
 // - *Manager: A pointer to the newly created Manager instance with an initialized poolHub.
-func NewManager() *Manager {
+func NewManager(channels ChannelStore) *Manager {
 	return &Manager{
-		poolHub: make(PoolHub),
+		poolHub:  make(PoolHub),
+		channels: channels,
+		sessions: make(map[string]map[*Client]bool),
 	}
 }
 
 // createDefaultHub creates and initializes the default hub for the manager.
 //
 // This method performs the following steps:
-// 1. Creates a new Hub instance using the `newHub` function with the name "General".
+// 1. Creates a new Hub instance using the `newHub` function with the ID `DefaultHubID` and the name "General".
 // 2. Adds the newly created Hub to the `poolHub` map with the key `DefaultHubID`.
 // 3. Starts the Hub's `run` method in a separate goroutine to handle client connections and messages.
 //
 // Returns:
 // - *Hub: A pointer to the newly created default Hub instance.
 func (m *Manager) createDefaultHub() *Hub {
-	hub := newHub("General")
-	manager.poolHub[DefaultHubID] = hub
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hub := newHub(DefaultHubID, "General")
+	hub.persistent = true
+	m.poolHub[DefaultHubID] = hub
+	go hub.run()
+
+	return hub
+}
+
+// defaultChannel returns the definition of the default channel. It is built in and not saved
+// to the channel store.
+func defaultChannel() data.Channel {
+	return data.Channel{
+		ID:           DefaultHubID,
+		Name:         "General",
+		Type:         data.ChannelTypeGroup,
+		Participants: []data.Participant{},
+		Visibility:   data.VisibilityPublic,
+		CreatedAt:    startedAt,
+		UpdatedAt:    startedAt,
+	}
+}
+
+// loadChannels creates the hubs of the channels saved in the channel store.
+//
+// Logic:
+// 1. Creates and starts a hub for every saved channel that has no hub yet.
+func (m *Manager) loadChannels() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channels := m.channels.List()
+	for _, channel := range channels {
+		if _, ok := m.poolHub[channel.ID]; !ok {
+			m.startHub(channel.ID, true)
+		}
+	}
+	log.Infof("Loaded %d channels", len(channels))
+}
+
+// startHub creates a hub, adds it to the pool and starts its run goroutine.
+// The caller must hold m.mu for writing.
+func (m *Manager) startHub(id string, persistent bool) *Hub {
+	name := id
+	if channel, ok := m.channels.Get(id); ok {
+		name = channel.Name
+	}
+	hub := newHub(id, name)
+	hub.persistent = persistent
+	m.poolHub[id] = hub
 	go hub.run()
 
 	return hub
 }
 
+// Channel retrieves the definition of a channel.
+//
+// Parameters:
+// - id (string): The channel ID.
+//
+// Returns:
+// - data.Channel: The channel definition.
+// - bool: Whether the channel exists.
+func (m *Manager) Channel(id string) (data.Channel, bool) {
+	if id == DefaultHubID {
+		return defaultChannel(), true
+	}
+	return m.channels.Get(id)
+}
+
+// Channels returns the definitions of the channels, the default channel first and the
+// unsaved channels of running hubs last. The default and unsaved channels, which have no
+// members, list the first page of their connected participants.
+func (m *Manager) Channels() []data.Channel {
+	channels := append([]data.Channel{defaultChannel()}, m.channels.List()...)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if hub, ok := m.poolHub[DefaultHubID]; ok {
+		channels[0].Participants, _ = hub.participantsPage("", defaultParticipantsLimit)
+	}
+	unsaved := make([]data.Channel, 0)
+	for id, hub := range m.poolHub {
+		if !hub.persistent {
+			participants, _ := hub.participantsPage("", defaultParticipantsLimit)
+			unsaved = append(unsaved, data.Channel{
+				ID:           id,
+				Name:         id,
+				Type:         data.ChannelTypeGroup,
+				Participants: participants,
+				Visibility:   data.VisibilityPublic,
+				CreatedAt:    hub.createdAt,
+				UpdatedAt:    hub.createdAt,
+			})
+		}
+	}
+	sort.Slice(unsaved, func(i, j int) bool { return unsaved[i].ID < unsaved[j].ID })
+	channels = append(channels, unsaved...)
+	return channels
+}
+
 // GetHub retrieves a Hub instance by its ID.
 //
 // Parameters:
@@ -66,6 +192,9 @@ func (m *Manager) createDefaultHub() *Hub {
 // Returns:
 // - *Hub: A pointer to the Hub instance if found, or nil if no Hub exists with the given ID.
 func (m *Manager) GetHub(id string) *Hub {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	if hub, ok := m.poolHub[id]; ok {
 		return hub
 	}
@@ -82,51 +211,230 @@ func (m *Manager) GetHub(id string) *Hub {
 // 1. Checks if the given id already exists in the poolHub map.
 // 2. If it does not exist, adds the Hub instance to the map.
 func (m *Manager) SetHub(id string, hub *Hub) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if _, ok := m.poolHub[id]; !ok {
 		m.poolHub[id] = hub
 	}
 }
 
-// CreateChannelHub creates and initializes a new hub for a specific channel.
+// GetOrCreateHub retrieves the hub of a channel, creating it if it does not exist.
 //
 // Parameters:
-// - channelID (string): The unique identifier for the channel.
-// - channelName (string): The name of the channel.
+// - id (string): The channel ID.
 //
 // Logic:
-// 1. Creates a new Hub instance using the `newHub` function with the provided channel name.
-// 2. Adds the newly created Hub to the `poolHub` map with the provided channel ID.
-// 3. Starts the Hub's `run` method in a separate goroutine to handle client connections and messages.
+// 1. Returns the running hub of the channel.
+// 2. Otherwise creates and starts a hub. The hub is persistent if the channel is saved in the
+// channel store, and reaped when idle otherwise.
 //
 // Returns:
-// - *Hub: A pointer to the newly created Hub instance.
-func (m *Manager) CreateChannelHub(channelID string, channelName string) *Hub {
-	hub := newHub(channelName)
-	m.poolHub[channelID] = hub
-	go hub.run()
+// - *Hub: A pointer to the Hub instance.
+func (m *Manager) GetOrCreateHub(id string) *Hub {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getOrCreateHub(id)
+}
 
+// getOrCreateHub implements GetOrCreateHub. The caller must hold m.mu for writing.
+func (m *Manager) getOrCreateHub(id string) *Hub {
+	if hub, ok := m.poolHub[id]; ok {
+		return hub
+	}
+	_, saved := m.channels.Get(id)
+	return m.startHub(id, saved)
+}
+
+// Join registers a client with the hub of a channel, creating the hub if it does not exist.
+//
+// Parameters:
+// - id (string): The channel ID.
+// - client (*Client): The client to register.
+//
+// Logic:
+// 1. Gets or creates the hub and registers the client while holding the lock, so that the hub
+// cannot be reaped between its lookup and the registration.
+//
+// Returns:
+// - *Hub: The hub the client is registered with.
+func (m *Manager) Join(id string, client *Client) *Hub {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hub := m.getOrCreateHub(id)
+	hub.register <- client
 	return hub
 }
 
-// DeleteHub removes a Hub instance from the poolHub map if it is empty.
+// CreateChannel saves a new channel definition and creates its hub.
+//
+// Parameters:
+// - channel (data.Channel): The channel definition. The ID is required.
+// - quota (int): The number of group channels the owner may own, 0 for no limit.
+//
+// Logic:
+// 1. Rejects the IDs of the default channel, of saved channels and of running hubs, whose
+// clients would be taken over by the owner, with ErrChannelExists.
+// 2. Rejects the channel with ErrChannelQuota if the owner already owns quota channels.
+// 3. Defaults the name to the ID, the type to group and the visibility to public.
+// 4. Sets the creation and update times to the current time and makes the owner, if any, the
+// only participant with the owner role.
+// 5. Saves the definition to the channel store and starts a persistent hub.
+//
+// Returns:
+// - *Hub: A pointer to the hub of the channel.
+// - error: ErrChannelExists, ErrChannelQuota or the error of the channel store.
+func (m *Manager) CreateChannel(channel data.Channel, quota int) (*Hub, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.Channel(channel.ID); ok {
+		return nil, ErrChannelExists
+	}
+	if _, ok := m.poolHub[channel.ID]; ok {
+		return nil, ErrChannelExists
+	}
+	if quota > 0 && channel.OwnerID != "" {
+		owned := 0
+		for _, saved := range m.channels.List() {
+			if saved.Type == data.ChannelTypeGroup && saved.OwnerID == channel.OwnerID {
+				owned++
+			}
+		}
+		if owned >= quota {
+			return nil, ErrChannelQuota
+		}
+	}
+	if channel.Name == "" {
+		channel.Name = channel.ID
+	}
+	if channel.Type == "" {
+		channel.Type = data.ChannelTypeGroup
+	}
+	if channel.Visibility == "" {
+		channel.Visibility = data.VisibilityPublic
+	}
+	channel.CreatedAt = time.Now()
+	channel.UpdatedAt = channel.CreatedAt
+	channel.Participants = []data.Participant{}
+	if channel.OwnerID != "" {
+		channel.Participants = append(channel.Participants, data.Participant{
+			UserID:   channel.OwnerID,
+			Username: channel.OwnerID,
+			JoinedAt: channel.CreatedAt,
+			Role:     data.ChannelRoleOwner,
+		})
+	}
+	channel.Banned = nil
+	if err := m.channels.Save(channel); err != nil {
+		return nil, err
+	}
+	return m.startHub(channel.ID, true), nil
+}
+
+// UpdateChannel changes a saved channel definition.
+//
+// Parameters:
+// - id (string): The channel ID.
+// - update (func(*data.Channel) error): Changes the definition, or returns an error to leave it
+// unchanged. It must not modify the slices of the definition in place.
+//
+// Logic:
+// 1. Loads the definition and applies the update while holding the lock, so that concurrent
+// updates of a channel do not overwrite each other.
+// 2. Sets the update time and saves the definition to the channel store.
+//
+// Returns:
+// - data.Channel: The saved definition.
+// - error: ErrChannelNotFound for the default channel and unsaved channels, the error of update,
+// or the error of the channel store.
+func (m *Manager) UpdateChannel(id string, update func(*data.Channel) error) (data.Channel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channel, ok := m.channels.Get(id)
+	if !ok {
+		return data.Channel{}, ErrChannelNotFound
+	}
+	if err := update(&channel); err != nil {
+		return data.Channel{}, err
+	}
+	channel.UpdatedAt = time.Now()
+	if err := m.channels.Save(channel); err != nil {
+		return data.Channel{}, err
+	}
+	return channel, nil
+}
+
+// DeleteHub stops an empty Hub instance and removes it from the poolHub map.
 //
 // Parameters:
 // - id (string): The unique identifier for the Hub to be deleted.
 //
 // Logic:
 // 1. Checks if the given id exists in the poolHub map.
-// 2. If the Hub exists and is empty (no active clients), deletes it from the map.
+// 2. If the Hub exists and is empty (no active clients), stops it, deletes it from the map and
+// releases the messages the message store holds for its channel.
 // 3. If the Hub is not empty, logs a warning message and does not delete it.
 func (m *Manager) DeleteHub(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if hub, ok := m.poolHub[id]; ok {
-		if hub.IsEmpty() {
+		if hub.stopIfIdle(0) {
 			delete(m.poolHub, id)
+			hub.messages.evict()
 		} else {
 			log.Warn("Hub is not empty, cannot delete")
 		}
 	}
 }
 
+// reapIdleHubs stops the hubs of unsaved channels that have had no clients for idle and releases
+// the messages the store holds for their channels.
+//
+// Parameters:
+// - idle (time.Duration): The time a hub may stay empty.
+//
+// Returns:
+// - int: The number of hubs stopped.
+func (m *Manager) reapIdleHubs(idle time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reaped := 0
+	for id, hub := range m.poolHub {
+		if !hub.persistent && hub.stopIfIdle(idle) {
+			delete(m.poolHub, id)
+			hub.messages.evict()
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// startReaper periodically reaps the idle hubs of unsaved channels.
+//
+// Parameters:
+// - idle (time.Duration): The time a hub may stay empty; 0 disables reaping.
+func (m *Manager) startReaper(idle time.Duration) {
+	if idle <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(max(idle/2, time.Second))
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if n := m.reapIdleHubs(idle); n > 0 {
+				log.Infof("Stopped %d idle hubs", n)
+			}
+		}
+	}()
+}
+
 // ====================================================================
 // =========================== gFly Handler ===========================
 // ====================================================================
@@ -153,6 +461,10 @@ func (m *WSHandler) Handle(c *core.Ctx) error {
 var upgrader = websocket.FastHTTPUpgrader{
 	ReadBufferSize:  10240,
 	WriteBufferSize: 10240,
+	// Idle clients don't hold a read buffer; buffers are shared through the pool
+	ReadBufferPool: &sync.Pool{},
+	// Negotiate per-message compression; see compressionPolicy for what is compressed
+	EnableCompression: true,
 	// Apply the Origin Checker
 	CheckOrigin: checkOrigin,
 }
@@ -186,11 +498,24 @@ func checkOrigin(r *fasthttp.RequestCtx) bool {
 }
 
 // manager is the global Manager instance that manages all Hub instances.
-var manager = NewManager()
+var manager = NewManager(GlobalChannelStore)
+
+// startedAt is the start time of the server, the creation time of the default channel.
+var startedAt = time.Now()
 
 func init() {
-	// Initialize the default hub
+	// Initialize the default hub and the hubs of the saved channels
 	manager.createDefaultHub()
+	manager.loadChannels()
+
+	// Stop the hubs of unsaved channels after WS_HUB_IDLE_TIMEOUT seconds without clients
+	manager.startReaper(time.Duration(utils.Getenv[int]("WS_HUB_IDLE_TIMEOUT", 300)) * time.Second)
+
+	// Turn idle users away and expire typing indicators
+	presence.start(time.Second)
+
+	// Enable the preset compression dictionary if configured
+	loadCompressionDictionary()
 }
 
 // ServeWS handles websocket requests from the peer.
@@ -201,21 +526,26 @@ func init() {
 //
 // Logic:
 // 1. Gets the channel parameter from the query string, defaulting to the default hub if not provided.
-// 2. If the channel doesn't exist, creates a new hub for that channel.
-// 3. Attempts to upgrade an incoming HTTP request to a websocket connection using the `upgrader.Upgrade` method.
+//   - Authenticates the request by its session token or client certificate (see upgradeUser) and
+//     responds 401 Unauthorized if that fails, or 403 Forbidden if the user may not access the channel.
+//   - Gets the compression dictionary a browser client asks for with the `dict` parameter (see
+//     requestedDictionary).
+//
+// 2. Attempts to upgrade an incoming HTTP request to a websocket connection using the `upgrader.Upgrade` method.
 //   - If the upgrade fails, logs the error and exits the function.
 //
-// 4. On successful connection upgrade:
+// 3. On successful connection upgrade:
 //
 //   - A new `Client` instance is created:
 //
-//   - `hub` is set to the `Hub` instance for managing this client.
-//
 //   - `conn` is set to the newly established websocket connection.
 //
 //   - `send` is initialized as a buffered channel for sending messages to the client.
 //
-//   - The new `Client` is registered with the `Hub` by sending it to the `register` channel.
+//   - The authenticated user is logged in before the client subscribes to a channel.
+//
+//   - The new `Client` subscribes to the channel, which becomes its active channel. The hub is
+//     created if the channel doesn't exist.
 //
 //   - Two goroutines are started to handle the client's websocket connection:
 //
@@ -223,7 +553,9 @@ func init() {
 //
 //   - `readPump`: Responsible for reading messages from the client.
 //
-// 5. If an error occurs during the websocket upgrade, it is logged using the `log.Println` function.
+//   - The handler returns once both have stopped.
+//
+// 4. If an error occurs during the websocket upgrade, it is logged using the `log.Println` function.
 func ServeWS(ctx *fasthttp.RequestCtx) {
 	// Get the channel parameter from the query string
 	channelID := string(ctx.QueryArgs().Peek("channel"))
@@ -231,29 +563,62 @@ func ServeWS(ctx *fasthttp.RequestCtx) {
 		channelID = DefaultHubID
 	}
 
-	// Get the hub for the specified channel, or create a new one if it doesn't exist
-	hub := manager.GetHub(channelID)
-	if hub == nil {
-		hub = manager.CreateChannelHub(channelID, channelID)
+	// The request context must not be used in the upgrade handler, so authenticate the
+	// request by its session token or client certificate before the upgrade.
+	username, tokenID, ok := upgradeUser(ctx)
+	if !ok {
+		ctx.Error("Unauthorized", fasthttp.StatusUnauthorized)
+		return
+	}
+	admin := false
+	if user, ok := GlobalUserStore.GetUser(username); ok && username != "" {
+		admin = user.Role == data.RoleAdmin
+	}
+	if !channelAllows(channelID, username, admin) {
+		ctx.Error("Forbidden", fasthttp.StatusForbidden)
+		return
 	}
 
+	dictionary := requestedDictionary(ctx)
+
 	try.Perform(func() {
 		err := upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
 			// Generate a unique client ID using the remote address and current time
 			clientID := conn.RemoteAddr().String() + "-" + time.Now().Format(time.RFC3339Nano)
 
+			configureCompression(conn)
+			stopCapture := startCapture(conn, clientID)
+			defer stopCapture()
+
 			client := &Client{
-				hub:  hub,
-				conn: conn,
-				send: make(chan []byte, 256),
-				id:   clientID,
+				conn:       conn,
+				send:       make(chan []byte, 256),
+				slow:       make(chan struct{}),
+				closed:     make(chan struct{}),
+				closing:    make(chan closeMessage, 1),
+				dictionary: dictionary,
+				id:         clientID,
 			}
 
 			log.Infof("New client connected: %s to channel: %s", clientID, channelID)
-			client.hub.register <- client
-
-			go client.writePump()
+			switch {
+			case tokenID != "":
+				client.loginWithToken(username, tokenID)
+			case username != "":
+				client.loginWithCertificate(username)
+			}
+			client.setActiveHub(client.subscribe(channelID))
+			presence.Connect(client)
+
+			writeDone := make(chan struct{})
+			go func() {
+				client.writePump()
+				close(writeDone)
+			}()
 			client.readPump()
+
+			// The connection must not be used once the handler returns
+			<-writeDone
 		})
 
 		if err != nil {
@@ -0,0 +1,419 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture file. The last byte is the format
+// version.
+const captureMagic = "WSCAP\x01"
+
+// maxCaptureRecordSize bounds the payload size accepted by CaptureReader.
+const maxCaptureRecordSize = 1 << 30
+
+// ErrBadCapture is returned when reading a capture that is not in the capture
+// format.
+var ErrBadCapture = errors.New("websocket: bad capture format")
+
+// CaptureDirection is the direction of a captured message relative to the
+// connection that recorded it.
+type CaptureDirection byte
+
+const (
+	// CaptureInbound marks a message received from the peer.
+	CaptureInbound CaptureDirection = 1
+
+	// CaptureOutbound marks a message sent to the peer.
+	CaptureOutbound CaptureDirection = 2
+)
+
+// String returns "in" or "out".
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureInbound:
+		return "in"
+	case CaptureOutbound:
+		return "out"
+	}
+	return "unknown"
+}
+
+// CaptureRecord is a message recorded by a capture.
+type CaptureRecord struct {
+	// Time is the time the message was read or written.
+	Time time.Time
+
+	// Direction is the direction of the message.
+	Direction CaptureDirection
+
+	// MessageType is TextMessage, BinaryMessage, CloseMessage, PingMessage or
+	// PongMessage.
+	MessageType int
+
+	// Data is the message payload. Data messages are recorded after
+	// decompression. Close messages hold the close payload as formatted by
+	// FormatCloseMessage.
+	Data []byte
+}
+
+// CloseCode returns the code and text of a captured close message. The code
+// is CloseNoStatusReceived for a close message without payload and for other
+// message types.
+func (r CaptureRecord) CloseCode() (int, string) {
+	if r.MessageType != CloseMessage || len(r.Data) < 2 {
+		return CloseNoStatusReceived, ""
+	}
+	return int(binary.BigEndian.Uint16(r.Data)), string(r.Data[2:])
+}
+
+// CaptureWriter writes records to a capture. The capture format is a magic
+// header followed by one record per message. A record holds the time since the
+// previous record in nanoseconds, the direction and message type, and the
+// payload length and bytes. Integers are unsigned varints.
+//
+// The methods of CaptureWriter are safe for concurrent use.
+type CaptureWriter struct {
+	// Redact, if set, is called with each record before it is written. It
+	// returns the record to write, for example with secrets removed from the
+	// data, or false to skip the record. Set Redact before the first Write.
+	Redact func(rec CaptureRecord) (CaptureRecord, bool)
+
+	mu   sync.Mutex
+	w    *bufio.Writer
+	last time.Time
+	err  error
+	buf  [2*binary.MaxVarintLen64 + 1]byte
+}
+
+// NewCaptureWriter returns a CaptureWriter that writes to w. The header is
+// written with the first record.
+func NewCaptureWriter(w io.Writer) *CaptureWriter {
+	return &CaptureWriter{w: bufio.NewWriter(w)}
+}
+
+// Write appends a record to the capture.
+func (cw *CaptureWriter) Write(rec CaptureRecord) error {
+	if cw.Redact != nil {
+		var ok bool
+		if rec, ok = cw.Redact(rec); !ok {
+			return nil
+		}
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return cw.err
+	}
+
+	if cw.last.IsZero() {
+		// The header holds the time of the first record.
+		var h [len(captureMagic) + 8]byte
+		copy(h[:], captureMagic)
+		binary.BigEndian.PutUint64(h[len(captureMagic):], uint64(rec.Time.UnixNano()))
+		if _, err := cw.w.Write(h[:]); err != nil {
+			cw.err = err
+			return err
+		}
+		cw.last = rec.Time
+	}
+
+	delta := rec.Time.Sub(cw.last)
+	if delta < 0 {
+		delta = 0
+	} else {
+		cw.last = rec.Time
+	}
+
+	n := binary.PutUvarint(cw.buf[:], uint64(delta))
+	cw.buf[n] = byte(rec.Direction)<<4 | byte(rec.MessageType)
+	n++
+	n += binary.PutUvarint(cw.buf[n:], uint64(len(rec.Data)))
+	if _, err := cw.w.Write(cw.buf[:n]); err != nil {
+		cw.err = err
+		return err
+	}
+	if _, err := cw.w.Write(rec.Data); err != nil {
+		cw.err = err
+		return err
+	}
+	return nil
+}
+
+// Flush writes buffered records to the underlying writer.
+func (cw *CaptureWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.err != nil {
+		return cw.err
+	}
+	cw.err = cw.w.Flush()
+	return cw.err
+}
+
+// CaptureReader reads records from a capture.
+type CaptureReader struct {
+	r    *bufio.Reader
+	last time.Time
+}
+
+// NewCaptureReader returns a CaptureReader that reads from r. An empty capture
+// has no records.
+func NewCaptureReader(r io.Reader) *CaptureReader {
+	return &CaptureReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record. Next returns io.EOF at the end of the
+// capture.
+func (cr *CaptureReader) Next() (CaptureRecord, error) {
+	if cr.last.IsZero() {
+		var h [len(captureMagic) + 8]byte
+		if _, err := io.ReadFull(cr.r, h[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = ErrBadCapture
+			}
+			return CaptureRecord{}, err
+		}
+		if string(h[:len(captureMagic)]) != captureMagic {
+			return CaptureRecord{}, ErrBadCapture
+		}
+		cr.last = time.Unix(0, int64(binary.BigEndian.Uint64(h[len(captureMagic):])))
+	}
+
+	delta, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		// A capture ends at a record boundary.
+		return CaptureRecord{}, err
+	}
+	kind, err := cr.r.ReadByte()
+	if err != nil {
+		return CaptureRecord{}, ErrBadCapture
+	}
+	size, err := binary.ReadUvarint(cr.r)
+	if err != nil || size > maxCaptureRecordSize {
+		return CaptureRecord{}, ErrBadCapture
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return CaptureRecord{}, ErrBadCapture
+	}
+
+	cr.last = cr.last.Add(time.Duration(delta))
+	return CaptureRecord{
+		Time:        cr.last,
+		Direction:   CaptureDirection(kind >> 4),
+		MessageType: int(kind & 0x0f),
+		Data:        data,
+	}, nil
+}
+
+// ReadAll returns the remaining records of the capture.
+func (cr *CaptureReader) ReadAll() ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+// SetCapture records the messages read from and written to the connection
+// with w. Data messages are recorded when the application finishes reading or
+// writing them. A nil writer stops the capture. SetCapture may be called
+// concurrently with the read and write methods; a message in progress is
+// recorded with the writer set when it completes, if any.
+func (c *Conn) SetCapture(w *CaptureWriter) {
+	if c == nil {
+		return
+	}
+	c.capture.Store(w)
+}
+
+// captureMessage records a message if the capture is enabled.
+func (c *Conn) captureMessage(direction CaptureDirection, messageType int, data []byte) {
+	cw := c.capture.Load()
+	if cw == nil {
+		return
+	}
+	_ = cw.Write(CaptureRecord{
+		Time:        time.Now(),
+		Direction:   direction,
+		MessageType: messageType,
+		Data:        data,
+	})
+}
+
+// captureReader records an inbound data message when the application reaches
+// the end of the message or abandons it.
+type captureReader struct {
+	r           io.ReadCloser
+	c           *Conn
+	messageType int
+	buf         bytes.Buffer
+	done        bool
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf.Write(p[:n])
+	if err != nil && !r.done {
+		r.done = true
+		r.c.captureMessage(CaptureInbound, r.messageType, r.buf.Bytes())
+	}
+	return n, err
+}
+
+func (r *captureReader) Close() error {
+	if !r.done {
+		r.done = true
+		r.c.captureMessage(CaptureInbound, r.messageType, r.buf.Bytes())
+	}
+	return r.r.Close()
+}
+
+// captureWriter records an outbound data message when the application closes
+// the writer.
+type captureWriter struct {
+	w           io.WriteCloser
+	c           *Conn
+	messageType int
+	buf         bytes.Buffer
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.buf.Write(p[:n])
+	return n, err
+}
+
+func (w *captureWriter) Close() error {
+	err := w.w.Close()
+	if err == nil {
+		w.c.captureMessage(CaptureOutbound, w.messageType, w.buf.Bytes())
+	}
+	return err
+}
+
+// ReplayOptions specifies how Replay sends a capture.
+type ReplayOptions struct {
+	// Direction selects the records to send. The records in the other
+	// direction are the messages expected from the peer. To replay a capture
+	// recorded by a server against a server, send CaptureInbound. To act as
+	// the server of a capture recorded by a server, send CaptureOutbound.
+	Direction CaptureDirection
+
+	// Speed scales the delays between records: 1 replays with the original
+	// timing, 2 twice as fast. If zero, records are sent without delay.
+	Speed float64
+
+	// Wait is the time to wait for messages from the peer after the last
+	// record was sent. If zero, one second is used. Replay returns earlier if
+	// the peer closes the connection.
+	Wait time.Duration
+}
+
+// Replay sends the records of a capture to the peer of c and returns the
+// messages received from the peer as CaptureInbound records. Replay reads from
+// c in a separate goroutine; the application must not read from c during the
+// replay. Replay closes the underlying network connection before it returns.
+func Replay(c *Conn, records []CaptureRecord, opts ReplayOptions) ([]CaptureRecord, error) {
+	if opts.Direction != CaptureInbound && opts.Direction != CaptureOutbound {
+		return nil, errors.New("websocket: invalid replay direction")
+	}
+	wait := opts.Wait
+	if wait <= 0 {
+		wait = time.Second
+	}
+
+	var (
+		mu       sync.Mutex
+		received []CaptureRecord
+		done     = make(chan struct{})
+	)
+	c.SetPingHandler(func(appData string) error {
+		mu.Lock()
+		received = append(received, CaptureRecord{Time: time.Now(), Direction: CaptureInbound, MessageType: PingMessage, Data: []byte(appData)})
+		mu.Unlock()
+		return c.WriteControl(PongMessage, []byte(appData), time.Now().Add(writeWait))
+	})
+	c.SetPongHandler(func(appData string) error {
+		mu.Lock()
+		received = append(received, CaptureRecord{Time: time.Now(), Direction: CaptureInbound, MessageType: PongMessage, Data: []byte(appData)})
+		mu.Unlock()
+		return nil
+	})
+	go func() {
+		defer close(done)
+		for {
+			messageType, p, err := c.ReadMessage()
+			rec := CaptureRecord{Time: time.Now(), Direction: CaptureInbound, MessageType: messageType, Data: p}
+			if e, ok := err.(*CloseError); ok {
+				rec.MessageType = CloseMessage
+				rec.Data = FormatCloseMessage(e.Code, e.Text)
+			} else if err != nil {
+				return
+			}
+			mu.Lock()
+			received = append(received, rec)
+			mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var (
+		err   error
+		start = time.Now()
+		first time.Time
+	)
+	for _, rec := range records {
+		if rec.Direction != opts.Direction {
+			continue
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if opts.Speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / opts.Speed))
+			time.Sleep(time.Until(at))
+		}
+		if isControl(rec.MessageType) {
+			err = c.WriteControl(rec.MessageType, rec.Data, time.Now().Add(writeWait))
+		} else {
+			err = c.WriteMessage(rec.MessageType, rec.Data)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+	c.conn.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err == ErrCloseSent {
+		err = nil
+	}
+	return received, err
+}
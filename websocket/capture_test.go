@@ -0,0 +1,232 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	start := time.Unix(1700000000, 123)
+	records := []CaptureRecord{
+		{Time: start, Direction: CaptureInbound, MessageType: TextMessage, Data: []byte("hello")},
+		{Time: start.Add(time.Millisecond), Direction: CaptureOutbound, MessageType: BinaryMessage, Data: bytes.Repeat([]byte{7}, 300)},
+		{Time: start.Add(time.Second), Direction: CaptureOutbound, MessageType: PingMessage, Data: []byte{}},
+		{Time: start.Add(2 * time.Second), Direction: CaptureInbound, MessageType: CloseMessage, Data: FormatCloseMessage(CloseGoingAway, "bye")},
+	}
+
+	var b bytes.Buffer
+	w := NewCaptureWriter(&b)
+	for _, rec := range records {
+		if err := w.Write(rec); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	got, err := NewCaptureReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d", len(got), len(records))
+	}
+	for i := range records {
+		if !got[i].Time.Equal(records[i].Time) {
+			t.Errorf("%d: time = %v, want %v", i, got[i].Time, records[i].Time)
+		}
+		got[i].Time = records[i].Time
+		if !reflect.DeepEqual(got[i], records[i]) {
+			t.Errorf("%d: record = %+v, want %+v", i, got[i], records[i])
+		}
+	}
+	if code, text := got[3].CloseCode(); code != CloseGoingAway || text != "bye" {
+		t.Errorf("CloseCode() = %d, %q", code, text)
+	}
+}
+
+func TestCaptureRedact(t *testing.T) {
+	var b bytes.Buffer
+	w := NewCaptureWriter(&b)
+	w.Redact = func(rec CaptureRecord) (CaptureRecord, bool) {
+		if string(rec.Data) == "skip" {
+			return rec, false
+		}
+		rec.Data = bytes.ReplaceAll(rec.Data, []byte("secret"), []byte("******"))
+		return rec, true
+	}
+	for _, data := range []string{"skip", "my secret", "plain"} {
+		if err := w.Write(CaptureRecord{Time: time.Now(), Direction: CaptureInbound, MessageType: TextMessage, Data: []byte(data)}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	records, err := NewCaptureReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(records) != 2 || string(records[0].Data) != "my ******" || string(records[1].Data) != "plain" {
+		t.Fatalf("records = %+v", records)
+	}
+}
+
+func TestCaptureBadFormat(t *testing.T) {
+	if _, err := NewCaptureReader(bytes.NewReader(nil)).Next(); err != io.EOF {
+		t.Errorf("empty capture: Next() = %v, want %v", err, io.EOF)
+	}
+	if _, err := NewCaptureReader(bytes.NewReader([]byte("not a capture file"))).Next(); err != ErrBadCapture {
+		t.Errorf("bad magic: Next() = %v, want %v", err, ErrBadCapture)
+	}
+}
+
+// newCaptureEchoServer returns a server that echoes messages until the client
+// closes the connection. The server side messages are captured to b.
+func newCaptureEchoServer(t *testing.T, b *bytes.Buffer) (*httptest.Server, chan struct{}) {
+	done := make(chan struct{})
+	upgrader := Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer close(done)
+		defer ws.Close()
+		if b != nil {
+			cw := NewCaptureWriter(b)
+			defer cw.Flush()
+			ws.SetCapture(cw)
+		}
+		for {
+			mt, r, err := ws.NextReader()
+			if err != nil {
+				return
+			}
+			w, err := ws.NextWriter(mt)
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(w, r)
+			if err := w.Close(); err != nil {
+				return
+			}
+		}
+	}))
+	return s, done
+}
+
+func TestConnCapture(t *testing.T) {
+	var b bytes.Buffer
+	s, done := newCaptureEchoServer(t, &b)
+	defer s.Close()
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	sendRecvMessage(t, ws, "one")
+	if err := ws.WriteControl(PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteControl: %v", err)
+	}
+	sendRecvMessage(t, ws, "two")
+	_ = ws.WriteMessage(CloseMessage, FormatCloseMessage(CloseNormalClosure, "done"))
+	<-done
+
+	records, err := NewCaptureReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	type summary struct {
+		dir  CaptureDirection
+		typ  int
+		data string
+	}
+	var got []summary
+	for _, rec := range records {
+		got = append(got, summary{rec.Direction, rec.MessageType, string(rec.Data)})
+	}
+	want := []summary{
+		{CaptureInbound, TextMessage, "one"},
+		{CaptureOutbound, TextMessage, "one"},
+		{CaptureInbound, PingMessage, "ping"},
+		{CaptureOutbound, PongMessage, "ping"},
+		{CaptureInbound, TextMessage, "two"},
+		{CaptureOutbound, TextMessage, "two"},
+		{CaptureInbound, CloseMessage, string(FormatCloseMessage(CloseNormalClosure, "done"))},
+		{CaptureOutbound, CloseMessage, string(FormatCloseMessage(CloseNormalClosure, ""))},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("records =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s, _ := newCaptureEchoServer(t, nil)
+	defer s.Close()
+
+	// A capture recorded by a client of the echo server.
+	start := time.Now()
+	records := []CaptureRecord{
+		{Time: start, Direction: CaptureOutbound, MessageType: TextMessage, Data: []byte("first")},
+		{Time: start, Direction: CaptureInbound, MessageType: TextMessage, Data: []byte("first")},
+		{Time: start.Add(100 * time.Millisecond), Direction: CaptureOutbound, MessageType: TextMessage, Data: []byte("second")},
+		{Time: start.Add(100 * time.Millisecond), Direction: CaptureInbound, MessageType: TextMessage, Data: []byte("second")},
+		{Time: start.Add(200 * time.Millisecond), Direction: CaptureOutbound, MessageType: CloseMessage, Data: FormatCloseMessage(CloseNormalClosure, "")},
+	}
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	begin := time.Now()
+	received, err := Replay(ws, records, ReplayOptions{Direction: CaptureOutbound, Speed: 2, Wait: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if d := time.Since(begin); d < 90*time.Millisecond {
+		t.Errorf("replay took %v, want at least 100ms at double speed", d)
+	}
+
+	var got []string
+	for _, rec := range received {
+		got = append(got, string(rec.Data))
+	}
+	want := []string{"first", "second", string(FormatCloseMessage(CloseNormalClosure, ""))}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+}
+
+func TestSetCaptureConcurrent(t *testing.T) {
+	c := newTestConn(nil, io.Discard, true)
+	w := NewCaptureWriter(io.Discard)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.SetCapture(w)
+			c.SetCapture(nil)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	<-done
+}
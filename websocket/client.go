@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -23,8 +24,21 @@ import (
 // invalid.
 var ErrBadHandshake = errors.New("websocket: bad handshake")
 
+// ErrCrossOriginRedirect is returned when the server redirects the handshake to
+// another origin and the Dialer's CheckRedirect function is nil.
+var ErrCrossOriginRedirect = errors.New("websocket: redirect to another origin not allowed")
+
 var errInvalidCompression = errors.New("websocket: invalid compression negotiation")
 
+// maxHandshakeRetries limits the number of handshakes retried through
+// Dialer.CheckResponse.
+const maxHandshakeRetries = 10
+
+// AuthFunc returns the value of the Authorization header used to retry a
+// handshake that the server rejected with 401 Unauthorized. The resp argument
+// is the rejected response.
+type AuthFunc func(resp *http.Response) (string, error)
+
 // NewClient creates a new client connection using the given net connection.
 // The URL u specifies the host and request URI. Use requestHeader to specify
 // the origin (Origin), subprotocols (Sec-WebSocket-Protocol) and cookies
@@ -85,6 +99,17 @@ type Dialer struct {
 	// do not limit the size of the messages that can be sent or received.
 	ReadBufferSize, WriteBufferSize int
 
+	// ReadBufferPool is a pool of buffers for read operations. If the value
+	// is set, then a read buffer is taken from the pool when the first byte of
+	// a frame arrives and returned to the pool when the frame has been read,
+	// so idle connections do not hold a read buffer. If the value is not set,
+	// then read buffers are allocated to the connection for the lifetime of
+	// the connection.
+	//
+	// Applications should use a single pool for each unique value of
+	// ReadBufferSize.
+	ReadBufferPool BufferPool
+
 	// WriteBufferPool is a pool of buffers for write operations. If the value
 	// is not set, then write buffers are allocated to the connection for the
 	// lifetime of the connection.
@@ -105,10 +130,41 @@ type Dialer struct {
 	// takeover" modes are supported.
 	EnableCompression bool
 
+	// CompressionDictionary specifies a preset dictionary to offer with the
+	// x-deflate-dictionary extension when EnableCompression is true. The
+	// client falls back to permessage-deflate if the server does not accept
+	// the dictionary.
+	CompressionDictionary *CompressionDictionary
+
 	// Jar specifies the cookie jar.
 	// If Jar is nil, cookies are not sent in requests and ignored
 	// in responses.
 	Jar http.CookieJar
+
+	// MaxRedirects specifies the maximum number of redirects followed during
+	// the handshake. If zero, redirects are not followed and the redirect
+	// response is returned with ErrBadHandshake.
+	MaxRedirects int
+
+	// CheckRedirect specifies the policy for following redirects. If
+	// CheckRedirect is not nil, it is called before following a redirect with
+	// the upcoming request and the requests made so far, oldest first. If
+	// CheckRedirect returns an error, the dial fails with that error. If
+	// CheckRedirect is nil, redirects to another origin are rejected with
+	// ErrCrossOriginRedirect.
+	CheckRedirect func(req *http.Request, via []*http.Request) error
+
+	// Auth supplies credentials when the server rejects the handshake with
+	// 401 Unauthorized. The handshake is retried once with the returned
+	// Authorization header. See BasicAuth and BearerAuth.
+	Auth AuthFunc
+
+	// CheckResponse is called with every failed handshake response that is
+	// not handled by the redirect and authentication logic. The header
+	// argument is the request header of the next attempt and may be modified.
+	// If CheckResponse returns true, the handshake is attempted again. If it
+	// returns an error, the dial fails with that error.
+	CheckResponse func(resp *http.Response, header http.Header) (retry bool, err error)
 }
 
 // Dial creates a new client connection by calling DialContext with a background context.
@@ -221,7 +277,11 @@ func (d *Dialer) createHandshakeRequest(ctx context.Context, u *url.URL, challen
 	}
 
 	if d.EnableCompression {
-		req.Header["Sec-WebSocket-Extensions"] = []string{"permessage-deflate; server_no_context_takeover; client_no_context_takeover"}
+		extensions := "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+		if d.CompressionDictionary != nil {
+			extensions = d.CompressionDictionary.extensionHeader() + ", " + extensions
+		}
+		req.Header["Sec-WebSocket-Extensions"] = []string{extensions}
 	}
 
 	return req, nil
@@ -360,6 +420,14 @@ func (d *Dialer) performHandshake(conn *Conn, req *http.Request, challengeKey st
 
 	// Setup compression if negotiated
 	for _, ext := range parseExtensions(resp.Header) {
+		if ext[""] == dictionaryExtension {
+			dict := d.CompressionDictionary
+			if dict == nil || ext["dict_id"] != dict.ID() {
+				return resp, errInvalidCompression
+			}
+			conn.setupCompression(dict)
+			break
+		}
 		if ext[""] != "permessage-deflate" {
 			continue
 		}
@@ -368,8 +436,7 @@ func (d *Dialer) performHandshake(conn *Conn, req *http.Request, challengeKey st
 		if !snct || !cnct {
 			return resp, errInvalidCompression
 		}
-		conn.newCompressionWriter = compressNoContextTakeover
-		conn.newDecompressionReader = decompressNoContextTakeover
+		conn.setupCompression(nil)
 		break
 	}
 
@@ -386,6 +453,10 @@ func (d *Dialer) performHandshake(conn *Conn, req *http.Request, challengeKey st
 //
 // The context will be used in the request and in the Dialer.
 //
+// Redirects are followed when MaxRedirects is set, 401 Unauthorized responses
+// are retried with credentials when Auth is set, and other failed handshakes
+// are passed to CheckResponse. Every attempt uses a new network connection.
+//
 // If the WebSocket handshake fails, ErrBadHandshake is returned along with a
 // non-nil *http.Response so that callers can handle redirects, authentication,
 // etcetera. The response body may not contain the entire response and does not
@@ -402,24 +473,91 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 		defer cancel()
 	}
 
-	// Generate challenge key for the handshake
-	challengeKey, err := generateChallengeKey()
-	if err != nil {
-		return nil, nil, err
-	}
-
 	// Parse and validate the WebSocket URL
 	u, err := parseWebSocketURL(urlStr)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Create the handshake request
-	req, err := d.createHandshakeRequest(ctx, u, challengeKey, requestHeader)
-	if err != nil {
-		return nil, nil, err
+	header := requestHeader
+	var via []*http.Request
+	var lastResp *http.Response
+	authTried := false
+	retries := 0
+
+	for {
+		// Generate challenge key for the handshake
+		challengeKey, err := generateChallengeKey()
+		if err != nil {
+			return nil, lastResp, err
+		}
+
+		// Create the handshake request
+		req, err := d.createHandshakeRequest(ctx, u, challengeKey, header)
+		if err != nil {
+			return nil, lastResp, err
+		}
+
+		// Apply the redirect policy to the request that follows a redirect
+		if len(via) > 0 {
+			if err := d.checkRedirect(req, via); err != nil {
+				return nil, lastResp, err
+			}
+		}
+
+		conn, resp, err := d.dialHandshake(ctx, u, req, challengeKey)
+		if err == nil {
+			return conn, resp, nil
+		}
+		if err != ErrBadHandshake || resp == nil {
+			return nil, resp, err
+		}
+		lastResp = resp
+
+		switch {
+		case isRedirectStatus(resp.StatusCode) && d.MaxRedirects > 0:
+			if len(via) >= d.MaxRedirects {
+				return nil, resp, fmt.Errorf("websocket: stopped after %d redirects", d.MaxRedirects)
+			}
+			next, err := redirectURL(req.URL, resp.Header.Get("Location"))
+			if err != nil {
+				return nil, resp, err
+			}
+			if !sameOrigin(req.URL, next) {
+				// Don't leak credentials to another origin.
+				header = cloneHeader(header)
+				header.Del("Authorization")
+				header.Del("Cookie")
+			}
+			via = append(via, req)
+			u = next
+		case resp.StatusCode == http.StatusUnauthorized && d.Auth != nil && !authTried:
+			value, err := d.Auth(resp)
+			if err != nil {
+				return nil, resp, err
+			}
+			header = cloneHeader(header)
+			header.Set("Authorization", value)
+			authTried = true
+		case d.CheckResponse != nil && retries < maxHandshakeRetries:
+			header = cloneHeader(header)
+			retry, err := d.CheckResponse(resp, header)
+			if err != nil {
+				return nil, resp, err
+			}
+			if !retry {
+				return nil, resp, ErrBadHandshake
+			}
+			retries++
+		default:
+			return nil, resp, ErrBadHandshake
+		}
 	}
+}
 
+// dialHandshake establishes the network connection for u and performs the
+// WebSocket handshake with req.
+func (d *Dialer) dialHandshake(ctx context.Context, u *url.URL, req *http.Request, challengeKey string) (*Conn, *http.Response, error) {
 	// Setup the network dialer
 	netDial, err := d.setupNetDial(ctx, u, req)
 	if err != nil {
@@ -463,7 +601,12 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 	}
 
 	// Create the WebSocket connection
-	conn := newConn(netConn, false, d.ReadBufferSize, d.WriteBufferSize, d.WriteBufferPool, nil, nil)
+	conn := newConn(netConn, false, d.ReadBufferSize, d.WriteBufferSize, d.ReadBufferPool, d.WriteBufferPool, nil, nil)
+	if conn.br == nil {
+		// The handshake response is read through a pooled buffer that is
+		// released once the response has been consumed.
+		conn.br = conn.newPooledReader(netConn)
+	}
 
 	// Perform the WebSocket handshake
 	resp, err := d.performHandshake(conn, req, challengeKey, trace)
@@ -475,6 +618,7 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 	if err := netConn.SetDeadline(time.Time{}); err != nil {
 		return nil, resp, err
 	}
+	conn.releaseReader()
 
 	// Success! Set netConn to nil to stop the deferred function above from
 	// closing the network connection.
@@ -483,6 +627,110 @@ func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader h
 	return conn, resp, nil
 }
 
+// checkRedirect applies the dialer's redirect policy to req.
+func (d *Dialer) checkRedirect(req *http.Request, via []*http.Request) error {
+	if d.CheckRedirect != nil {
+		return d.CheckRedirect(req, via)
+	}
+	if !sameOrigin(via[0].URL, req.URL) {
+		return ErrCrossOriginRedirect
+	}
+	return nil
+}
+
+// isRedirectStatus reports whether the handshake response redirects the
+// client to another URL.
+func isRedirectStatus(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectURL resolves the Location header of a redirect against the URL of
+// the request. WebSocket schemes are mapped to their HTTP equivalents.
+func redirectURL(base *url.URL, location string) (*url.URL, error) {
+	if location == "" {
+		return nil, errors.New("websocket: redirect without Location header")
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	u := base.ResolveReference(ref)
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, errMalformedURL
+	}
+	if u.User != nil {
+		return nil, errMalformedURL
+	}
+	return u, nil
+}
+
+// sameOrigin reports whether a and b have the same scheme, host and port.
+func sameOrigin(a, b *url.URL) bool {
+	aHostPort, _ := hostPortNoPort(a)
+	bHostPort, _ := hostPortNoPort(b)
+	return equalASCIIFold(a.Scheme, b.Scheme) && equalASCIIFold(aHostPort, bHostPort)
+}
+
+// cloneHeader returns a copy of h that can be modified.
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return make(http.Header)
+	}
+	return h.Clone()
+}
+
+// BasicAuth returns an AuthFunc that answers a Basic challenge with the given
+// credentials.
+func BasicAuth(username, password string) AuthFunc {
+	return func(resp *http.Response) (string, error) {
+		if !offersAuthScheme(resp, "Basic") {
+			return "", errors.New("websocket: server does not accept Basic authentication")
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		return "Basic " + credentials, nil
+	}
+}
+
+// BearerAuth returns an AuthFunc that answers a Bearer challenge with the
+// given token.
+func BearerAuth(token string) AuthFunc {
+	return func(resp *http.Response) (string, error) {
+		if !offersAuthScheme(resp, "Bearer") {
+			return "", errors.New("websocket: server does not accept Bearer authentication")
+		}
+		return "Bearer " + token, nil
+	}
+}
+
+// offersAuthScheme reports whether the WWW-Authenticate challenges in resp
+// include scheme. A response without challenges accepts any scheme.
+func offersAuthScheme(resp *http.Response, scheme string) bool {
+	challenges := resp.Header.Values("Www-Authenticate")
+	if len(challenges) == 0 {
+		return true
+	}
+	for _, challenge := range challenges {
+		for _, part := range strings.Split(challenge, ",") {
+			token, _ := nextToken(skipSpace(part))
+			if equalASCIIFold(token, scheme) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func cloneTLSConfig(cfg *tls.Config) *tls.Config {
 	if cfg == nil {
 		return &tls.Config{}
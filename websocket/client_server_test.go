@@ -144,6 +144,26 @@ func makeWsProto(s string) string {
 	return "ws" + strings.TrimPrefix(s, "http")
 }
 
+func sendRecvMessage(t *testing.T, ws *Conn, message string) {
+	t.Helper()
+	if err := ws.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SetWriteDeadline: %v", err)
+	}
+	if err := ws.WriteMessage(TextMessage, []byte(message)); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if err := ws.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	_, p, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if string(p) != message {
+		t.Fatalf("message=%s, want %s", p, message)
+	}
+}
+
 func sendRecv(t *testing.T, ws *Conn) {
 	const message = "Hello World!"
 	if err := ws.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
@@ -302,6 +322,168 @@ func TestDialCookieJar(t *testing.T) {
 	sendRecv(t, ws)
 }
 
+// newWrappedServer returns a server that passes requests to wrap before they
+// reach the test handler. The wrap function returns false when it has replied
+// to the request.
+func newWrappedServer(t *testing.T, wrap func(w http.ResponseWriter, r *http.Request) bool) *cstServer {
+	var s cstServer
+	h := cstHandler{T: t, s: &s}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wrap(w, r) {
+			h.ServeHTTP(w, r)
+		}
+	}))
+	s.URL = makeWsProto(s.Server.URL)
+	return &s
+}
+
+func TestDialRedirect(t *testing.T) {
+	s := newWrappedServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, cstRequestURI, http.StatusFound)
+			return false
+		}
+		return true
+	})
+	defer s.Close()
+
+	d := cstDialer
+	_, resp, err := d.Dial(s.URL+"/redirect", nil)
+	if err != ErrBadHandshake || resp == nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("Dial without MaxRedirects returned %v, %v; want ErrBadHandshake with 302", resp, err)
+	}
+
+	d.MaxRedirects = 1
+	ws, _, err := d.Dial(s.URL+"/redirect", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+}
+
+func TestDialTooManyRedirects(t *testing.T) {
+	s := newWrappedServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+		return false
+	})
+	defer s.Close()
+
+	d := cstDialer
+	d.MaxRedirects = 3
+	_, resp, err := d.Dial(s.URL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("Dial returned %v, %v; want redirect error", resp, err)
+	}
+}
+
+func TestDialCrossOriginRedirect(t *testing.T) {
+	s := newServer(t)
+	defer s.Close()
+
+	var gotAuth string
+	target := newWrappedServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		gotAuth = r.Header.Get("Authorization")
+		return true
+	})
+	defer target.Close()
+
+	r := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+cstRequestURI, http.StatusFound)
+	}))
+	defer r.Close()
+
+	d := cstDialer
+	d.MaxRedirects = 1
+	header := http.Header{"Authorization": {"Bearer secret"}}
+	if _, _, err := d.Dial(makeWsProto(r.URL), header); err != ErrCrossOriginRedirect {
+		t.Fatalf("Dial returned %v, want %v", err, ErrCrossOriginRedirect)
+	}
+
+	d.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) != 1 {
+			t.Errorf("len(via) = %d, want 1", len(via))
+		}
+		return nil
+	}
+	ws, _, err := d.Dial(makeWsProto(r.URL), header)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+
+	if gotAuth != "" {
+		t.Errorf("Authorization = %q sent to another origin", gotAuth)
+	}
+}
+
+func TestDialAuth(t *testing.T) {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	s := newWrappedServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != want {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chat"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	})
+	defer s.Close()
+
+	d := cstDialer
+	d.Auth = BasicAuth("user", "pass")
+	ws, _, err := d.Dial(s.URL+cstRequestURI, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+
+	d.Auth = BasicAuth("user", "wrong")
+	_, resp, err := d.Dial(s.URL+cstRequestURI, nil)
+	if err != ErrBadHandshake || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Dial with bad credentials returned %v, %v; want ErrBadHandshake with 401", resp, err)
+	}
+
+	d.Auth = BearerAuth("token")
+	if _, _, err := d.Dial(s.URL+cstRequestURI, nil); err == nil || err == ErrBadHandshake {
+		t.Fatalf("Dial with Bearer credentials returned %v, want scheme error", err)
+	}
+}
+
+func TestDialCheckResponse(t *testing.T) {
+	var attempts int32
+	s := newWrappedServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		attempts++
+		if r.Header.Get("X-Retry") == "" {
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+	defer s.Close()
+
+	d := cstDialer
+	d.CheckResponse = func(resp *http.Response, header http.Header) (bool, error) {
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			return false, nil
+		}
+		header.Set("X-Retry", resp.Header.Get("Retry-After"))
+		return true, nil
+	}
+	ws, _, err := d.Dial(s.URL+cstRequestURI, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sendRecv(t, ws)
+
+	if attempts != 2 {
+		t.Errorf("attempts = %d, want 2", attempts)
+	}
+}
+
 func rootCAs(t *testing.T, s *httptest.Server) *x509.CertPool {
 	certs := x509.NewCertPool()
 	for _, c := range s.TLS.Certificates {
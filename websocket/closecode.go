@@ -0,0 +1,225 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// CloseBadGateway is the close code defined by the IANA registry for a
+// gateway or proxy that received an invalid response from the upstream server.
+const CloseBadGateway = 1014
+
+// Application close codes are in the range reserved by RFC 6455, section 7.4.2
+// for private use. Register the codes used by an application with
+// RegisterCloseCode.
+const (
+	MinApplicationCloseCode = 4000
+	MaxApplicationCloseCode = 4999
+)
+
+// maxCloseReasonSize is the maximum size of the text in a close message. The
+// close message payload is limited to 125 bytes, two of which hold the code.
+const maxCloseReasonSize = maxControlFramePayloadSize - 2
+
+// CloseClass classifies close codes by how a peer should react to them.
+type CloseClass int
+
+const (
+	// CloseClassUnknown is the class of unregistered codes.
+	CloseClassUnknown CloseClass = iota
+
+	// CloseClassNormal denotes an intentional close. Clients should not
+	// reconnect.
+	CloseClassNormal
+
+	// CloseClassRetryable denotes a transient condition. Clients may
+	// reconnect, preferably with backoff.
+	CloseClassRetryable
+
+	// CloseClassAuthFailure denotes missing or invalid credentials. Clients
+	// should authenticate again before reconnecting.
+	CloseClassAuthFailure
+
+	// CloseClassFatal denotes an error that will repeat on reconnect, such as
+	// a protocol or policy violation.
+	CloseClassFatal
+)
+
+// String returns the name of the class.
+func (c CloseClass) String() string {
+	switch c {
+	case CloseClassNormal:
+		return "normal"
+	case CloseClassRetryable:
+		return "retryable"
+	case CloseClassAuthFailure:
+		return "auth failure"
+	case CloseClassFatal:
+		return "fatal"
+	}
+	return "unknown"
+}
+
+// CloseCodeInfo describes a registered close code.
+type CloseCodeInfo struct {
+	Code  int
+	Name  string
+	Class CloseClass
+}
+
+var (
+	closeCodesMu sync.RWMutex
+	closeCodes   = map[int]CloseCodeInfo{
+		CloseNormalClosure:           {CloseNormalClosure, "normal", CloseClassNormal},
+		CloseGoingAway:               {CloseGoingAway, "going away", CloseClassRetryable},
+		CloseProtocolError:           {CloseProtocolError, "protocol error", CloseClassFatal},
+		CloseUnsupportedData:         {CloseUnsupportedData, "unsupported data", CloseClassFatal},
+		CloseNoStatusReceived:        {CloseNoStatusReceived, "no status", CloseClassNormal},
+		CloseAbnormalClosure:         {CloseAbnormalClosure, "abnormal closure", CloseClassRetryable},
+		CloseInvalidFramePayloadData: {CloseInvalidFramePayloadData, "invalid payload data", CloseClassFatal},
+		ClosePolicyViolation:         {ClosePolicyViolation, "policy violation", CloseClassFatal},
+		CloseMessageTooBig:           {CloseMessageTooBig, "message too big", CloseClassFatal},
+		CloseMandatoryExtension:      {CloseMandatoryExtension, "mandatory extension missing", CloseClassFatal},
+		CloseInternalServerErr:       {CloseInternalServerErr, "internal server error", CloseClassRetryable},
+		CloseServiceRestart:          {CloseServiceRestart, "service restart", CloseClassRetryable},
+		CloseTryAgainLater:           {CloseTryAgainLater, "try again later", CloseClassRetryable},
+		CloseBadGateway:              {CloseBadGateway, "bad gateway", CloseClassRetryable},
+		CloseTLSHandshake:            {CloseTLSHandshake, "TLS handshake error", CloseClassFatal},
+	}
+)
+
+// unnamedCloseErrorCodes lists the registered codes whose name is not part of
+// the text of CloseError. The text of these codes predates the registry, and
+// callers may match on it.
+var unnamedCloseErrorCodes = map[int]bool{
+	CloseServiceRestart: true,
+	CloseTryAgainLater:  true,
+}
+
+// RegisterCloseCode registers an application close code in the range
+// MinApplicationCloseCode to MaxApplicationCloseCode. The name is used in the
+// text of CloseError and the class is used by the CloseError classification
+// methods. Registering a code again replaces the previous registration.
+func RegisterCloseCode(code int, name string, class CloseClass) error {
+	if code < MinApplicationCloseCode || code > MaxApplicationCloseCode {
+		return errors.New("websocket: close code " + strconv.Itoa(code) + " is not in the application range")
+	}
+	closeCodesMu.Lock()
+	closeCodes[code] = CloseCodeInfo{Code: code, Name: name, Class: class}
+	closeCodesMu.Unlock()
+	return nil
+}
+
+// LookupCloseCode returns the registration of a standard or application close
+// code.
+func LookupCloseCode(code int) (CloseCodeInfo, bool) {
+	closeCodesMu.RLock()
+	info, ok := closeCodes[code]
+	closeCodesMu.RUnlock()
+	return info, ok
+}
+
+// CloseReason is a structured close reason. It is sent as JSON in the text of
+// a close message.
+type CloseReason struct {
+	// Reason is a short machine readable reason such as "rate_limited".
+	Reason string `json:"reason"`
+
+	// Message is an optional human readable description. The message is
+	// truncated to fit the close message size limit.
+	Message string `json:"message,omitempty"`
+
+	// RetryAfter is an optional number of seconds the peer should wait before
+	// reconnecting.
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+// errCloseReasonTooLong is returned when a close reason does not fit in a close
+// message even without its message.
+var errCloseReasonTooLong = errors.New("websocket: close reason too long")
+
+// FormatCloseReason formats closeCode and reason as a WebSocket close message
+// with a JSON encoded text. The Message field is truncated at a UTF-8 boundary
+// if the text exceeds the 123 byte limit of the close message text.
+func FormatCloseReason(closeCode int, reason CloseReason) ([]byte, error) {
+	for {
+		text, err := json.Marshal(reason)
+		if err != nil {
+			return nil, err
+		}
+		if len(text) <= maxCloseReasonSize {
+			return FormatCloseMessage(closeCode, string(text)), nil
+		}
+		if reason.Message == "" {
+			return nil, errCloseReasonTooLong
+		}
+		// Escaping may make the encoded message longer than the message, so
+		// trim by the excess and try again.
+		n := len(reason.Message) - (len(text) - maxCloseReasonSize)
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart(reason.Message[n]) {
+			n--
+		}
+		reason.Message = reason.Message[:n]
+	}
+}
+
+// WriteCloseReason sends a close message with closeCode and the JSON encoded
+// reason. WriteCloseReason is safe to call concurrently with the other write
+// methods as WriteControl is.
+func (c *Conn) WriteCloseReason(closeCode int, reason CloseReason, deadline time.Time) error {
+	data, err := FormatCloseReason(closeCode, reason)
+	if err != nil {
+		return err
+	}
+	return c.WriteControl(CloseMessage, data, deadline)
+}
+
+// Class returns the class of the close code.
+func (e *CloseError) Class() CloseClass {
+	info, ok := LookupCloseCode(e.Code)
+	if !ok {
+		return CloseClassUnknown
+	}
+	return info.Class
+}
+
+// IsNormal returns true if the connection was closed intentionally.
+func (e *CloseError) IsNormal() bool {
+	return e.Class() == CloseClassNormal
+}
+
+// IsRetryable returns true if the peer closed the connection because of a
+// transient condition and a reconnect is likely to succeed.
+func (e *CloseError) IsRetryable() bool {
+	return e.Class() == CloseClassRetryable
+}
+
+// IsAuthFailure returns true if the peer closed the connection because of
+// missing or invalid credentials.
+func (e *CloseError) IsAuthFailure() bool {
+	return e.Class() == CloseClassAuthFailure
+}
+
+// Reason decodes a structured close reason from the close text. It returns
+// false if the text is not a JSON encoded CloseReason.
+func (e *CloseError) Reason() (CloseReason, bool) {
+	var reason CloseReason
+	if e.Text == "" || e.Text[0] != '{' {
+		return reason, false
+	}
+	if err := json.Unmarshal([]byte(e.Text), &reason); err != nil || reason.Reason == "" {
+		return CloseReason{}, false
+	}
+	return reason, true
+}
@@ -0,0 +1,115 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var closeClassTests = []struct {
+	code                           int
+	normal, retryable, authFailure bool
+	class                          CloseClass
+}{
+	{CloseNormalClosure, true, false, false, CloseClassNormal},
+	{CloseGoingAway, false, true, false, CloseClassRetryable},
+	{CloseAbnormalClosure, false, true, false, CloseClassRetryable},
+	{CloseTryAgainLater, false, true, false, CloseClassRetryable},
+	{ClosePolicyViolation, false, false, false, CloseClassFatal},
+	{3000, false, false, false, CloseClassUnknown},
+	{4401, false, false, true, CloseClassAuthFailure},
+}
+
+func TestCloseErrorClass(t *testing.T) {
+	if err := RegisterCloseCode(4401, "unauthorized", CloseClassAuthFailure); err != nil {
+		t.Fatalf("RegisterCloseCode: %v", err)
+	}
+	for _, tt := range closeClassTests {
+		e := &CloseError{Code: tt.code}
+		if e.Class() != tt.class || e.IsNormal() != tt.normal || e.IsRetryable() != tt.retryable || e.IsAuthFailure() != tt.authFailure {
+			t.Errorf("code %d: class=%v normal=%v retryable=%v authFailure=%v, want %v %v %v %v",
+				tt.code, e.Class(), e.IsNormal(), e.IsRetryable(), e.IsAuthFailure(),
+				tt.class, tt.normal, tt.retryable, tt.authFailure)
+		}
+	}
+	for _, tt := range []struct {
+		e    *CloseError
+		want string
+	}{
+		{&CloseError{Code: 4401}, "websocket: close 4401 (unauthorized)"},
+		{&CloseError{Code: CloseGoingAway, Text: "bye"}, "websocket: close 1001 (going away): bye"},
+		{&CloseError{Code: CloseServiceRestart}, "websocket: close 1012"},
+		{&CloseError{Code: CloseTryAgainLater}, "websocket: close 1013"},
+	} {
+		if got := tt.e.Error(); got != tt.want {
+			t.Errorf("Error() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestRegisterCloseCodeRange(t *testing.T) {
+	for _, code := range []int{CloseNormalClosure, 3000, 3999, 5000} {
+		if err := RegisterCloseCode(code, "bad", CloseClassFatal); err == nil {
+			t.Errorf("RegisterCloseCode(%d) returned nil error", code)
+		}
+	}
+	if info, _ := LookupCloseCode(CloseNormalClosure); info.Name != "normal" {
+		t.Errorf("standard code was replaced: %+v", info)
+	}
+}
+
+func TestFormatCloseReason(t *testing.T) {
+	reason := CloseReason{Reason: "slow_consumer", Message: strings.Repeat("é", 100), RetryAfter: 5}
+	data, err := FormatCloseReason(CloseTryAgainLater, reason)
+	if err != nil {
+		t.Fatalf("FormatCloseReason: %v", err)
+	}
+	if len(data) > maxControlFramePayloadSize {
+		t.Fatalf("len(data) = %d, want <= %d", len(data), maxControlFramePayloadSize)
+	}
+	if code := binary.BigEndian.Uint16(data); code != CloseTryAgainLater {
+		t.Fatalf("code = %d, want %d", code, CloseTryAgainLater)
+	}
+	e := &CloseError{Code: CloseTryAgainLater, Text: string(data[2:])}
+	got, ok := e.Reason()
+	if !ok {
+		t.Fatalf("Reason() of %q returned false", e.Text)
+	}
+	if got.Reason != reason.Reason || got.RetryAfter != reason.RetryAfter || !strings.HasPrefix(reason.Message, got.Message) || !utf8.ValidString(got.Message) {
+		t.Fatalf("Reason() = %+v", got)
+	}
+
+	if _, err := FormatCloseReason(CloseTryAgainLater, CloseReason{Reason: strings.Repeat("x", 200)}); err == nil {
+		t.Fatal("FormatCloseReason with long reason returned nil error")
+	}
+	if _, ok := (&CloseError{Code: CloseNormalClosure, Text: "bye"}).Reason(); ok {
+		t.Fatal("Reason() of plain text returned true")
+	}
+}
+
+func TestWriteCloseReason(t *testing.T) {
+	var b bytes.Buffer
+	wc := newTestConn(nil, &b, true)
+	reason := CloseReason{Reason: "maintenance", RetryAfter: 30}
+	if err := wc.WriteCloseReason(CloseServiceRestart, reason, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteCloseReason: %v", err)
+	}
+
+	rc := newTestConn(&b, io.Discard, false)
+	_, _, err := rc.NextReader()
+	e, ok := err.(*CloseError)
+	if !ok || e.Code != CloseServiceRestart || !e.IsRetryable() {
+		t.Fatalf("NextReader() returned %v, want retryable close %d", err, CloseServiceRestart)
+	}
+	if got, ok := e.Reason(); !ok || got != reason {
+		t.Fatalf("Reason() = %+v, %v; want %+v", got, ok, reason)
+	}
+}
@@ -45,6 +45,12 @@ var (
 // The context takeover is disabled, which means that each message is compressed
 // independently without using the compression state from previous messages.
 func decompressNoContextTakeover(r io.Reader) io.ReadCloser {
+	return decompressDictionary(r, nil)
+}
+
+// decompressDictionary creates a no context takeover decompressor that starts
+// with the preset dictionary dict. A nil dict is the empty dictionary.
+func decompressDictionary(r io.Reader, dict []byte) io.ReadCloser {
 	// The tail bytes are necessary for the decompression to work correctly:
 	// - First 4 bytes (\x00\x00\xff\xff) are added as specified in RFC 7692
 	// - Second 5 bytes (\x01\x00\x00\xff\xff) add a final block to prevent
@@ -58,9 +64,9 @@ func decompressNoContextTakeover(r io.Reader) io.ReadCloser {
 	mr := io.MultiReader(r, strings.NewReader(tail))
 
 	// Try to reset the reader to reuse it
-	if err := fr.(flate.Resetter).Reset(mr, nil); err != nil {
+	if err := fr.(flate.Resetter).Reset(mr, dict); err != nil {
 		// Reset never fails, but handle error in case that changes in future versions
-		fr = flate.NewReader(mr)
+		fr = flate.NewReaderDict(mr, dict)
 	}
 
 	// Wrap the reader to handle proper cleanup when closed
@@ -0,0 +1,262 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/flate"
+)
+
+// dictionaryExtension is the name of the custom extension that compresses
+// messages with DEFLATE and a preset dictionary. The extension works like
+// permessage-deflate with no context takeover in both directions, except that
+// the compressor and decompressor of every message start with the dictionary
+// negotiated with the dict_id parameter.
+const dictionaryExtension = "x-deflate-dictionary"
+
+// maxDictionarySize is the size of the DEFLATE window. Bytes of a dictionary
+// beyond the window can not be referenced.
+const maxDictionarySize = 32 * 1024
+
+// CompressionDictionary is a preset DEFLATE dictionary for the
+// x-deflate-dictionary extension. A dictionary holding the byte sequences that
+// are common to the application's messages improves the compression of small
+// messages. Both peers must use the same dictionary; the handshake compares
+// the dictionary IDs.
+//
+// Browsers do not let applications offer custom extensions. Browser clients
+// negotiate permessage-deflate when the server also enables it, or compress
+// above the websocket layer with Compress and Decompress.
+type CompressionDictionary struct {
+	data []byte
+	id   string
+
+	// writerPools contains a pool of writers primed with the dictionary for
+	// each compression level.
+	writerPools [maxCompressionLevel - minCompressionLevel + 1]sync.Pool
+}
+
+// NewCompressionDictionary returns a dictionary with the given content. Only
+// the last 32 KiB of data are used.
+func NewCompressionDictionary(data []byte) *CompressionDictionary {
+	if len(data) > maxDictionarySize {
+		data = data[len(data)-maxDictionarySize:]
+	}
+	sum := sha256.Sum256(data)
+	return &CompressionDictionary{
+		data: append([]byte(nil), data...),
+		id:   hex.EncodeToString(sum[:8]),
+	}
+}
+
+// ID returns the identifier used to negotiate the dictionary. The ID is
+// derived from the dictionary content.
+func (d *CompressionDictionary) ID() string {
+	return d.id
+}
+
+// Bytes returns the content of the dictionary. The application must not
+// modify the returned slice.
+func (d *CompressionDictionary) Bytes() []byte {
+	return d.data
+}
+
+// extensionHeader returns the Sec-WebSocket-Extensions value for the
+// dictionary.
+func (d *CompressionDictionary) extensionHeader() string {
+	return dictionaryExtension + "; dict_id=" + d.id
+}
+
+// compress creates a compressor primed with the dictionary.
+func (d *CompressionDictionary) compress(w io.WriteCloser, level int) io.WriteCloser {
+	p := &d.writerPools[level-minCompressionLevel]
+	tw := &truncWriter{w: w}
+	fw, _ := p.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriterDict(tw, level, d.data)
+	} else {
+		// Reset restores the dictionary of the writer.
+		fw.Reset(tw)
+	}
+	return &flateWriteWrapper{fw: fw, tw: tw, p: p}
+}
+
+// decompress creates a decompressor primed with the dictionary.
+func (d *CompressionDictionary) decompress(r io.Reader) io.ReadCloser {
+	return decompressDictionary(r, d.data)
+}
+
+// Compress returns the raw DEFLATE stream of p primed with the dictionary.
+// Unlike the messages of the x-deflate-dictionary extension, the stream ends
+// with a final block, so that standard inflaters such as the JavaScript pako
+// library decompress it.
+func (d *CompressionDictionary) Compress(p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	pool := &d.writerPools[defaultCompressionLevel-minCompressionLevel]
+	fw, _ := pool.Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriterDict(&b, defaultCompressionLevel, d.data)
+	} else {
+		fw.Reset(&b)
+	}
+	_, err := fw.Write(p)
+	if err == nil {
+		err = fw.Close()
+	}
+	pool.Put(fw)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Decompress decompresses a raw DEFLATE stream primed with the dictionary,
+// as returned by Compress. It returns ErrReadLimit if the decompressed data
+// exceeds limit bytes.
+func (d *CompressionDictionary) Decompress(p []byte, limit int64) ([]byte, error) {
+	fr := flate.NewReaderDict(bytes.NewReader(p), d.data)
+	defer fr.Close()
+
+	b, err := io.ReadAll(io.LimitReader(fr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, ErrReadLimit
+	}
+	return b, nil
+}
+
+// negotiateDictionary returns the first dictionary in dicts offered by the
+// client in the parsed extensions, or nil if there is none.
+func negotiateDictionary(dicts []*CompressionDictionary, extensions []map[string]string) *CompressionDictionary {
+	for _, ext := range extensions {
+		if ext[""] != dictionaryExtension {
+			continue
+		}
+		for _, d := range dicts {
+			if d != nil && ext["dict_id"] == d.id {
+				return d
+			}
+		}
+	}
+	return nil
+}
+
+// setupCompression configures the connection for the negotiated compression
+// extension: the x-deflate-dictionary extension when dict is not nil and
+// permessage-deflate otherwise.
+func (c *Conn) setupCompression(dict *CompressionDictionary) {
+	if dict != nil {
+		c.newCompressionWriter = dict.compress
+		c.newDecompressionReader = dict.decompress
+		return
+	}
+	c.newCompressionWriter = compressNoContextTakeover
+	c.newDecompressionReader = decompressNoContextTakeover
+}
+
+// BuildCompressionDictionary builds a dictionary of at most size bytes from
+// sample messages. Samples should be representative of the messages sent on a
+// connection.
+//
+// The builder repeatedly picks the segment of a sample whose 8 byte sequences
+// occur in the most samples, then discounts the picked sequences. The first,
+// most valuable segments are placed at the end of the dictionary where DEFLATE
+// references are cheapest.
+func BuildCompressionDictionary(samples [][]byte, size int) []byte {
+	const (
+		gram    = 8
+		segment = 64
+	)
+
+	if size <= 0 || size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+
+	// Count the number of samples containing each sequence. Sequences found
+	// in a single sample are not worth a place in the dictionary.
+	freq := make(map[string]int)
+	for _, s := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+gram <= len(s); i++ {
+			g := string(s[i : i+gram])
+			if !seen[g] {
+				seen[g] = true
+				freq[g]++
+			}
+		}
+	}
+	for g, n := range freq {
+		if n < 2 {
+			delete(freq, g)
+		}
+	}
+
+	var picked [][]byte
+	total := 0
+	for total < size {
+		// Find the segment with the highest score using a sliding window over
+		// the sequences of each sample.
+		best, bestSample, bestPos, bestWidth := 0, 0, 0, 0
+		for si, s := range samples {
+			n := len(s) - gram + 1
+			if n <= 0 {
+				continue
+			}
+			w := segment - gram + 1
+			if w > n {
+				w = n
+			}
+			score := 0
+			for j := 0; j < w; j++ {
+				score += freq[string(s[j:j+gram])]
+			}
+			for i := 0; ; i++ {
+				if score > best {
+					best, bestSample, bestPos, bestWidth = score, si, i, w
+				}
+				if i+w >= n {
+					break
+				}
+				score -= freq[string(s[i:i+gram])]
+				score += freq[string(s[i+w:i+w+gram])]
+			}
+		}
+		if best == 0 {
+			break
+		}
+
+		// Trim sequences that no longer score from both ends.
+		s := samples[bestSample]
+		start, end := bestPos, bestPos+bestWidth-1
+		for start < end && freq[string(s[start:start+gram])] == 0 {
+			start++
+		}
+		for end > start && freq[string(s[end:end+gram])] == 0 {
+			end--
+		}
+		seg := s[start : end+gram]
+		if total+len(seg) > size {
+			seg = seg[:size-total]
+		}
+		for i := start; i <= end; i++ {
+			delete(freq, string(s[i:i+gram]))
+		}
+		picked = append(picked, seg)
+		total += len(seg)
+	}
+
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict
+}
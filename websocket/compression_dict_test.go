@@ -0,0 +1,220 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	stdflate "compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// dictSamples returns JSON messages that share a common skeleton.
+func dictSamples(n int) [][]byte {
+	samples := make([][]byte, n)
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"metadata":{"version":"1.0","timestamp":"2024-05-0%dT10:00:00Z"},"action":{"type":"send_message","data":{"channel_id":"channel-%d","message":{"type":"text","content":{"text":"hello %d"}}}}}`, i%10, i%3, i))
+	}
+	return samples
+}
+
+func newDictEchoServer(t *testing.T, dicts ...*CompressionDictionary) *httptest.Server {
+	upgrader := Upgrader{EnableCompression: true, CompressionDictionaries: dicts}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("Upgrade: %v", err)
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func TestDictionaryNegotiation(t *testing.T) {
+	dict := NewCompressionDictionary(BuildCompressionDictionary(dictSamples(50), 4096))
+	other := NewCompressionDictionary([]byte("another dictionary"))
+
+	tests := []struct {
+		name       string
+		server     []*CompressionDictionary
+		client     *CompressionDictionary
+		extensions string
+	}{
+		{"match", []*CompressionDictionary{other, dict}, dict, dict.extensionHeader()},
+		{"mismatch", []*CompressionDictionary{other}, dict, "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"no client dictionary", []*CompressionDictionary{dict}, nil, "permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newDictEchoServer(t, tt.server...)
+			defer s.Close()
+
+			d := Dialer{EnableCompression: true, CompressionDictionary: tt.client}
+			ws, resp, err := d.Dial(makeWsProto(s.URL), nil)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer ws.Close()
+
+			if got := resp.Header.Get("Sec-Websocket-Extensions"); got != tt.extensions {
+				t.Fatalf("extensions = %q, want %q", got, tt.extensions)
+			}
+			for _, m := range dictSamples(3) {
+				if err := ws.WriteMessage(TextMessage, m); err != nil {
+					t.Fatalf("WriteMessage: %v", err)
+				}
+				_, p, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage: %v", err)
+				}
+				if !bytes.Equal(p, m) {
+					t.Fatalf("message = %s, want %s", p, m)
+				}
+			}
+		})
+	}
+}
+
+func TestDictionaryFastHTTP(t *testing.T) {
+	dict := NewCompressionDictionary(BuildCompressionDictionary(dictSamples(50), 4096))
+	upgrader := FastHTTPUpgrader{EnableCompression: true, CompressionDictionaries: []*CompressionDictionary{dict}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	server := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		_ = upgrader.Upgrade(ctx, func(ws *Conn) {
+			mt, p, err := ws.ReadMessage()
+			if err == nil {
+				_ = ws.WriteMessage(mt, p)
+			}
+		})
+	}}
+	go func() { _ = server.Serve(ln) }()
+	defer func() { _ = server.Shutdown() }()
+
+	d := Dialer{EnableCompression: true, CompressionDictionary: dict, HandshakeTimeout: time.Second}
+	ws, resp, err := d.Dial("ws://"+ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	if got, want := resp.Header.Get("Sec-Websocket-Extensions"), dict.extensionHeader(); got != want {
+		t.Fatalf("extensions = %q, want %q", got, want)
+	}
+
+	message := dictSamples(1)[0]
+	if err := ws.WriteMessage(TextMessage, message); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	_, p, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if !bytes.Equal(p, message) {
+		t.Fatalf("message = %s, want %s", p, message)
+	}
+}
+
+func TestDialerRejectsUnknownDictionary(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-Websocket-Accept", computeAcceptKey(r.Header.Get("Sec-Websocket-Key")))
+		w.Header().Set("Sec-Websocket-Extensions", dictionaryExtension+"; dict_id=0000")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer s.Close()
+
+	d := Dialer{EnableCompression: true, CompressionDictionary: NewCompressionDictionary([]byte("dictionary"))}
+	if _, _, err := d.Dial(makeWsProto(s.URL), nil); err != errInvalidCompression {
+		t.Fatalf("Dial = %v, want %v", err, errInvalidCompression)
+	}
+}
+
+// compressedSize returns the size of message compressed with compress.
+func compressedSize(compress func(io.WriteCloser, int) io.WriteCloser, message []byte) int {
+	var b closerBuffer
+	w := compress(&b, defaultCompressionLevel)
+	_, _ = w.Write(message)
+	_ = w.Close()
+	return b.Len()
+}
+
+type closerBuffer struct{ bytes.Buffer }
+
+func (*closerBuffer) Close() error { return nil }
+
+func TestBuildCompressionDictionary(t *testing.T) {
+	samples := dictSamples(100)
+	data := BuildCompressionDictionary(samples, 1024)
+	if len(data) == 0 || len(data) > 1024 {
+		t.Fatalf("len(dictionary) = %d, want 1..1024", len(data))
+	}
+	if !bytes.Contains(data, []byte(`"action":{"type":"send_message"`)) {
+		t.Errorf("dictionary %q does not contain the common skeleton", data)
+	}
+
+	dict := NewCompressionDictionary(data)
+	message := []byte(`{"metadata":{"version":"1.0","timestamp":"2024-06-01T12:00:00Z"},"action":{"type":"send_message","data":{"channel_id":"channel-7","message":{"type":"text","content":{"text":"new"}}}}}`)
+	plain := compressedSize(compressNoContextTakeover, message)
+	withDict := compressedSize(dict.compress, message)
+	if withDict >= plain/2 {
+		t.Errorf("compressed size with dictionary = %d, without = %d", withDict, plain)
+	}
+
+	r := dict.decompress(bytes.NewReader(func() []byte {
+		var b closerBuffer
+		w := dict.compress(&b, defaultCompressionLevel)
+		_, _ = w.Write(message)
+		_ = w.Close()
+		return b.Bytes()
+	}()))
+	p, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(p, message) {
+		t.Fatalf("round trip = %s, %v", p, err)
+	}
+}
+
+func TestCompressionDictionaryCompress(t *testing.T) {
+	dict := NewCompressionDictionary([]byte(`{"metadata":{"version":"1.0"},"action":{"type":"send_message","data":{}}}`))
+	message := []byte(`{"metadata":{"version":"1.0"},"action":{"type":"send_message","data":{"text":"hello"}}}`)
+
+	for i := 0; i < 2; i++ { // the second round uses a pooled writer
+		p, err := dict.Compress(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The stream is complete, so a standard inflater reads it.
+		b, err := io.ReadAll(stdflate.NewReaderDict(bytes.NewReader(p), dict.Bytes()))
+		if err != nil || !bytes.Equal(b, message) {
+			t.Fatalf("standard inflater = %s, %v", b, err)
+		}
+		if b, err := dict.Decompress(p, int64(len(message))); err != nil || !bytes.Equal(b, message) {
+			t.Fatalf("Decompress = %s, %v", b, err)
+		}
+		if _, err := dict.Decompress(p, int64(len(message)-1)); err != ErrReadLimit {
+			t.Fatalf("Decompress over the limit = %v, want %v", err, ErrReadLimit)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// CompressionPolicy decides whether a data message is compressed. The data
+// argument is the complete message payload for WriteMessage and
+// WritePreparedMessage and nil for NextWriter, where the payload is not known
+// in advance. The policy is only consulted when compression was negotiated
+// with the peer and is enabled with EnableWriteCompression.
+type CompressionPolicy func(messageType int, data []byte) bool
+
+// MinSizeCompressionPolicy returns a policy that compresses messages of at
+// least minSize bytes. Messages written with NextWriter are compressed.
+func MinSizeCompressionPolicy(minSize int) CompressionPolicy {
+	return func(messageType int, data []byte) bool {
+		return data == nil || len(data) >= minSize
+	}
+}
+
+// DefaultCompressionPolicy returns a policy that skips messages smaller than
+// minSize bytes and binary messages that start with the signature of a
+// compressed format (see IsCompressedData).
+func DefaultCompressionPolicy(minSize int) CompressionPolicy {
+	return func(messageType int, data []byte) bool {
+		if data == nil {
+			return true
+		}
+		if len(data) < minSize {
+			return false
+		}
+		return messageType != BinaryMessage || !IsCompressedData(data)
+	}
+}
+
+// compressedSignatures are the leading bytes of common compressed file and
+// media formats.
+var compressedSignatures = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{'P', 'K', 0x03, 0x04},             // zip and zip based documents
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{0x89, 'P', 'N', 'G'},              // png
+	{'G', 'I', 'F', '8'},               // gif
+	{'O', 'g', 'g', 'S'},               // ogg
+	{'f', 'L', 'a', 'C'},               // flac
+	{'I', 'D', '3'},                    // mp3
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska and webm
+}
+
+// IsCompressedData returns true if data starts with the signature of a
+// compressed file or media format such as gzip, zip, jpeg, png, webp or mp4.
+// Compressing such data again costs CPU without reducing its size.
+func IsCompressedData(data []byte) bool {
+	for _, sig := range compressedSignatures {
+		if bytes.HasPrefix(data, sig) {
+			return true
+		}
+	}
+	if len(data) >= 12 {
+		// RIFF containers (webp) and ISO base media files (mp4, heic, avif).
+		if bytes.HasPrefix(data, []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")) {
+			return true
+		}
+		if bytes.Equal(data[4:8], []byte("ftyp")) {
+			return true
+		}
+	}
+	return false
+}
+
+// AdaptiveCompression configures a connection to measure the compression
+// ratio it achieves and to stop compressing when compression does not pay.
+//
+// The connection measures windows of SampleSize compressed messages. When the
+// compressed size of a window is more than MaxRatio times the uncompressed
+// size, the connection sends the next BackoffMessages messages uncompressed
+// and then measures again. The backoff doubles for every consecutive window
+// that does not pay, up to 16 times BackoffMessages.
+type AdaptiveCompression struct {
+	// MaxRatio is the highest compressed to uncompressed size ratio that is
+	// considered worth compressing. If zero, 0.9 is used.
+	MaxRatio float64
+
+	// SampleSize is the number of compressed messages measured per window. If
+	// zero, 16 is used.
+	SampleSize int
+
+	// BackoffMessages is the number of messages sent uncompressed after a
+	// window that did not pay. If zero, 64 is used.
+	BackoffMessages int
+}
+
+const maxCompressionBackoffShift = 4
+
+// CompressionStats reports the compression statistics of a connection.
+type CompressionStats struct {
+	// Messages is the number of data messages written while compression was
+	// negotiated.
+	Messages int64
+
+	// Compressed is the number of messages written compressed.
+	Compressed int64
+
+	// SkippedByPolicy is the number of messages the CompressionPolicy
+	// rejected.
+	SkippedByPolicy int64
+
+	// SkippedByBackoff is the number of messages the adaptive mode sent
+	// uncompressed.
+	SkippedByBackoff int64
+
+	// UncompressedBytes and CompressedBytes are the payload sizes of the
+	// compressed messages before and after compression. Prepared messages are
+	// not measured.
+	UncompressedBytes int64
+	CompressedBytes   int64
+
+	// BackedOff is true while the adaptive mode sends messages uncompressed.
+	BackedOff bool
+}
+
+// Ratio returns the achieved compressed to uncompressed size ratio, or 1 if
+// no message was measured.
+func (s CompressionStats) Ratio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+}
+
+// compressionState holds the compression policy, adaptive state and
+// statistics of a connection. The mutex protects stats for readers outside of
+// the writing goroutine.
+type compressionState struct {
+	policy   CompressionPolicy
+	adaptive *AdaptiveCompression
+
+	// adaptive state, only accessed by the writing goroutine.
+	windowIn, windowOut int64
+	windowMessages      int
+	backoffLeft         int
+	backoffShift        uint
+
+	mu    sync.Mutex
+	stats CompressionStats
+}
+
+// SetCompressionPolicy sets the policy that decides which data messages are
+// compressed. A nil policy compresses all messages. SetCompressionPolicy must
+// not be called concurrently with the write methods.
+func (c *Conn) SetCompressionPolicy(policy CompressionPolicy) {
+	if c == nil {
+		return
+	}
+	c.compression.policy = policy
+}
+
+// SetAdaptiveCompression enables adaptive compression with the given
+// configuration. A nil configuration disables adaptive compression.
+// SetAdaptiveCompression must not be called concurrently with the write
+// methods.
+func (c *Conn) SetAdaptiveCompression(adaptive *AdaptiveCompression) {
+	if c == nil {
+		return
+	}
+	s := &c.compression
+	s.adaptive = adaptive
+	s.windowIn, s.windowOut, s.windowMessages = 0, 0, 0
+	s.backoffLeft, s.backoffShift = 0, 0
+	s.mu.Lock()
+	s.stats.BackedOff = false
+	s.mu.Unlock()
+}
+
+// CompressionStats returns the compression statistics of the connection. It
+// is safe to call CompressionStats concurrently with the write methods.
+func (c *Conn) CompressionStats() CompressionStats {
+	if c == nil {
+		return CompressionStats{}
+	}
+	c.compression.mu.Lock()
+	defer c.compression.mu.Unlock()
+	return c.compression.stats
+}
+
+// shouldCompress decides whether the next data message is compressed.
+func (c *Conn) shouldCompress(messageType int, data []byte) bool {
+	if c.newCompressionWriter == nil || !c.enableWriteCompression || !isData(messageType) {
+		return false
+	}
+	s := &c.compression
+	allowed := s.policy == nil || s.policy(messageType, data)
+	compress := true
+	s.mu.Lock()
+	s.stats.Messages++
+	switch {
+	case !allowed:
+		s.stats.SkippedByPolicy++
+		compress = false
+	case s.adaptive != nil && s.backoffLeft > 0:
+		s.backoffLeft--
+		s.stats.SkippedByBackoff++
+		s.stats.BackedOff = s.backoffLeft > 0
+		compress = false
+	default:
+		s.stats.Compressed++
+	}
+	s.mu.Unlock()
+	return compress
+}
+
+// recordCompression records the size of a compressed message and updates the
+// adaptive state.
+func (c *Conn) recordCompression(in, out int64) {
+	s := &c.compression
+	s.mu.Lock()
+	s.stats.UncompressedBytes += in
+	s.stats.CompressedBytes += out
+	s.mu.Unlock()
+
+	a := s.adaptive
+	if a == nil {
+		return
+	}
+	s.windowIn += in
+	s.windowOut += out
+	s.windowMessages++
+
+	sampleSize := a.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = 16
+	}
+	if s.windowMessages < sampleSize {
+		return
+	}
+
+	maxRatio := a.MaxRatio
+	if maxRatio <= 0 {
+		maxRatio = 0.9
+	}
+	pays := s.windowIn > 0 && float64(s.windowOut) <= maxRatio*float64(s.windowIn)
+	s.windowIn, s.windowOut, s.windowMessages = 0, 0, 0
+	if pays {
+		s.backoffShift = 0
+		return
+	}
+
+	backoff := a.BackoffMessages
+	if backoff <= 0 {
+		backoff = 64
+	}
+	s.backoffLeft = backoff << s.backoffShift
+	if s.backoffShift < maxCompressionBackoffShift {
+		s.backoffShift++
+	}
+	s.mu.Lock()
+	s.stats.BackedOff = true
+	s.mu.Unlock()
+}
+
+// compressionStatsWriter counts the bytes written to a compression writer and
+// records the achieved size when the message is closed.
+type compressionStatsWriter struct {
+	w  io.WriteCloser
+	mw *messageWriter
+	n  int64
+}
+
+func (w *compressionStatsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *compressionStatsWriter) Close() error {
+	err := w.w.Close()
+	if err == nil {
+		w.mw.c.recordCompression(w.n, w.mw.length)
+	}
+	return err
+}
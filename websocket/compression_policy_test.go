@@ -0,0 +1,151 @@
+// Copyright 2017 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// newCompressionConns returns a server connection with compression enabled
+// writing to a client connection that decompresses messages.
+func newCompressionConns() (wc, rc *Conn) {
+	var b bytes.Buffer
+	wc = newTestConn(nil, &b, true)
+	wc.newCompressionWriter = compressNoContextTakeover
+	rc = newTestConn(&b, io.Discard, false)
+	rc.newDecompressionReader = decompressNoContextTakeover
+	return wc, rc
+}
+
+// readCompressed reads the next message and reports whether it was
+// compressed.
+func readCompressed(t *testing.T, rc *Conn, want []byte) bool {
+	t.Helper()
+	_, r, err := rc.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	compressed := rc.readDecompress
+	p, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(p, want) {
+		t.Fatalf("message = %q, want %q", p, want)
+	}
+	return compressed
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	wc, rc := newCompressionConns()
+	wc.SetCompressionPolicy(DefaultCompressionPolicy(64))
+
+	small := []byte("hello")
+	text := bytes.Repeat([]byte("hello world "), 20)
+	png := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 100)...)
+
+	tests := []struct {
+		messageType int
+		data        []byte
+		compressed  bool
+	}{
+		{TextMessage, small, false},
+		{TextMessage, text, true},
+		{BinaryMessage, png, false},
+		{BinaryMessage, text, true},
+	}
+	for _, tt := range tests {
+		if err := wc.WriteMessage(tt.messageType, tt.data); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	for i, tt := range tests {
+		if got := readCompressed(t, rc, tt.data); got != tt.compressed {
+			t.Errorf("%d: compressed = %v, want %v", i, got, tt.compressed)
+		}
+	}
+
+	stats := wc.CompressionStats()
+	if stats.Messages != 4 || stats.Compressed != 2 || stats.SkippedByPolicy != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.UncompressedBytes != int64(2*len(text)) || stats.Ratio() >= 0.5 {
+		t.Errorf("stats = %+v, ratio %f", stats, stats.Ratio())
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	wc, rc := newCompressionConns()
+	wc.SetAdaptiveCompression(&AdaptiveCompression{SampleSize: 2, BackoffMessages: 3})
+
+	random := make([]byte, 512)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("hello world "), 40)
+
+	// Two incompressible messages fill the window and trigger the backoff.
+	// The next three messages are not compressed even when they would
+	// compress well. Then the connection measures again.
+	messages := [][]byte{random, random, text, text, text, text}
+	want := []bool{true, true, false, false, false, true}
+	for i, m := range messages {
+		if err := wc.WriteMessage(BinaryMessage, m); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+		if i == 2 && !wc.CompressionStats().BackedOff {
+			t.Errorf("BackedOff = false during backoff")
+		}
+	}
+	for i, m := range messages {
+		if got := readCompressed(t, rc, m); got != want[i] {
+			t.Errorf("%d: compressed = %v, want %v", i, got, want[i])
+		}
+	}
+
+	stats := wc.CompressionStats()
+	if stats.SkippedByBackoff != 3 || stats.Compressed != 3 || stats.BackedOff {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestCompressionPolicyNextWriter(t *testing.T) {
+	wc, rc := newCompressionConns()
+	wc.SetCompressionPolicy(MinSizeCompressionPolicy(1 << 20))
+
+	// The size of a streamed message is not known in advance.
+	w, err := wc.NextWriter(TextMessage)
+	if err != nil {
+		t.Fatalf("NextWriter: %v", err)
+	}
+	_, _ = io.WriteString(w, "streamed")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !readCompressed(t, rc, []byte("streamed")) {
+		t.Error("streamed message was not compressed")
+	}
+}
+
+func TestIsCompressedData(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte("\x1f\x8b\x08\x00"), true},
+		{[]byte("\xff\xd8\xff\xe0\x00\x10JFIF"), true},
+		{[]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), true},
+		{[]byte("\x00\x00\x00\x18ftypmp42"), true},
+		{[]byte("RIFF\x00\x00\x00\x00WAVEfmt "), false},
+		{[]byte(`{"action":"send_message"}`), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsCompressedData(tt.data); got != tt.want {
+			t.Errorf("IsCompressedData(%q) = %v, want %v", tt.data, got, tt.want)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -112,31 +113,10 @@ type CloseError struct {
 func (e *CloseError) Error() string {
 	s := []byte("websocket: close ")
 	s = strconv.AppendInt(s, int64(e.Code), 10)
-	switch e.Code {
-	case CloseNormalClosure:
-		s = append(s, " (normal)"...)
-	case CloseGoingAway:
-		s = append(s, " (going away)"...)
-	case CloseProtocolError:
-		s = append(s, " (protocol error)"...)
-	case CloseUnsupportedData:
-		s = append(s, " (unsupported data)"...)
-	case CloseNoStatusReceived:
-		s = append(s, " (no status)"...)
-	case CloseAbnormalClosure:
-		s = append(s, " (abnormal closure)"...)
-	case CloseInvalidFramePayloadData:
-		s = append(s, " (invalid payload data)"...)
-	case ClosePolicyViolation:
-		s = append(s, " (policy violation)"...)
-	case CloseMessageTooBig:
-		s = append(s, " (message too big)"...)
-	case CloseMandatoryExtension:
-		s = append(s, " (mandatory extension missing)"...)
-	case CloseInternalServerErr:
-		s = append(s, " (internal server error)"...)
-	case CloseTLSHandshake:
-		s = append(s, " (TLS handshake error)"...)
+	if info, ok := LookupCloseCode(e.Code); ok && !unnamedCloseErrorCodes[e.Code] {
+		s = append(s, " ("...)
+		s = append(s, info.Name...)
+		s = append(s, ')')
 	}
 	if e.Text != "" {
 		s = append(s, ": "...)
@@ -216,6 +196,7 @@ var validReceivedCloseCodes = map[int]bool{
 	CloseInternalServerErr:       true,
 	CloseServiceRestart:          true,
 	CloseTryAgainLater:           true,
+	CloseBadGateway:              true,
 	CloseTLSHandshake:            false,
 }
 
@@ -237,6 +218,33 @@ type BufferPool interface {
 // added to the pool.
 type writePoolData struct{ buf []byte }
 
+// readPoolData is the type added to the read buffer pool. This wrapper is
+// used to prevent applications from peeking at and depending on the values
+// added to the pool.
+type readPoolData struct{ br *bufio.Reader }
+
+// lazyConnReader is the source of a pooled read buffer. The connection waits
+// for the first byte of the next frame with a one byte read so that no buffer
+// is held while the connection is idle. The byte is returned from the first
+// call to Read before data is read from the network connection.
+type lazyConnReader struct {
+	conn net.Conn
+	b    [1]byte
+	n    int
+}
+
+func (r *lazyConnReader) Read(p []byte) (int, error) {
+	if r.n > 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		p[0] = r.b[0]
+		r.n = 0
+		return 1, nil
+	}
+	return r.conn.Read(p)
+}
+
 // The Conn type represents a WebSocket connection.
 type Conn struct {
 	conn        net.Conn
@@ -258,11 +266,16 @@ type Conn struct {
 	enableWriteCompression bool
 	compressionLevel       int
 	newCompressionWriter   func(io.WriteCloser, int) io.WriteCloser
+	compression            compressionState // per-message policy, adaptive state and stats
 
 	// Read fields
-	reader  io.ReadCloser // the current reader returned to the application
-	readErr error
-	br      *bufio.Reader
+	reader      io.ReadCloser // the current reader returned to the application
+	readErr     error
+	br          *bufio.Reader
+	readPool    BufferPool     // when set, br is only held while a frame is read
+	polled      bool           // owned by a Poller, see enforceRateLimit
+	readBufSize int            // size of the buffers taken from readPool
+	readSrc     lazyConnReader // source of pooled read buffers
 	// bytes remaining in current frame.
 	// set setReadRemaining to safely update this value and prevent overflow
 	readRemaining int64
@@ -279,17 +292,22 @@ type Conn struct {
 
 	readDecompress         bool // whether last read frame had RSV1 set
 	newDecompressionReader func(io.Reader) io.ReadCloser
+
+	rateLimiter *rateLimiter // limits inbound data messages, nil if unlimited
+	readDrop    bool         // true if the current message is dropped by the rate limiter
+
+	capture atomic.Pointer[CaptureWriter] // records messages, nil if capture is disabled
 }
 
-func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int, writeBufferPool BufferPool, br *bufio.Reader, writeBuf []byte) *Conn {
+func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int, readBufferPool, writeBufferPool BufferPool, br *bufio.Reader, writeBuf []byte) *Conn {
 
-	if br == nil {
-		if readBufferSize == 0 {
-			readBufferSize = defaultReadBufferSize
-		} else if readBufferSize < maxControlFramePayloadSize {
-			// must be large enough for control frame
-			readBufferSize = maxControlFramePayloadSize
-		}
+	if readBufferSize == 0 {
+		readBufferSize = defaultReadBufferSize
+	} else if readBufferSize < maxControlFramePayloadSize {
+		// must be large enough for control frame
+		readBufferSize = maxControlFramePayloadSize
+	}
+	if br == nil && readBufferPool == nil {
 		br = bufio.NewReaderSize(conn, readBufferSize)
 	}
 
@@ -313,6 +331,9 @@ func newConn(conn net.Conn, isServer bool, readBufferSize, writeBufferSize int,
 		writeBuf:               writeBuf,
 		writePool:              writeBufferPool,
 		writeBufSize:           writeBufferSize,
+		readPool:               readBufferPool,
+		readBufSize:            readBufferSize,
+		readSrc:                lazyConnReader{conn: conn},
 		enableWriteCompression: true,
 		compressionLevel:       defaultCompressionLevel,
 	}
@@ -333,6 +354,60 @@ func (c *Conn) setReadRemaining(n int64) error {
 	return nil
 }
 
+// newPooledReader returns a read buffer from the read pool reading from r.
+func (c *Conn) newPooledReader(r io.Reader) *bufio.Reader {
+	if rpd, ok := c.readPool.Get().(readPoolData); ok {
+		rpd.br.Reset(r)
+		return rpd.br
+	}
+	return bufio.NewReaderSize(r, c.readBufSize)
+}
+
+// acquireReader makes sure that a read buffer is attached to the connection.
+// With a read pool, acquireReader blocks until the first byte of the next
+// frame arrives before taking a buffer from the pool.
+func (c *Conn) acquireReader() error {
+	if c.br != nil {
+		return nil
+	}
+	for {
+		n, err := c.conn.Read(c.readSrc.b[:])
+		if n > 0 {
+			c.readSrc.n = n
+			break
+		}
+		if err == io.EOF {
+			return errUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	c.br = c.newPooledReader(&c.readSrc)
+	return nil
+}
+
+// releaseReader returns the read buffer to the read pool when the buffer
+// does not hold unread data.
+func (c *Conn) releaseReader() {
+	if c.readPool == nil || c.br == nil || c.br.Buffered() > 0 {
+		return
+	}
+	br := c.br
+	c.br = nil
+	br.Reset(nil)
+	c.readPool.Put(readPoolData{br: br})
+}
+
+// buffered returns the number of bytes that have been read from the network
+// connection but not yet consumed.
+func (c *Conn) buffered() int {
+	if c.br == nil {
+		return 0
+	}
+	return c.br.Buffered()
+}
+
 // Subprotocol returns the negotiated protocol for the connection.
 func (c *Conn) Subprotocol() string {
 	if c == nil {
@@ -490,6 +565,7 @@ func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) er
 	if len(data) > maxControlFramePayloadSize {
 		return errInvalidControlFrame
 	}
+	c.captureMessage(CaptureOutbound, messageType, data)
 
 	b0 := byte(messageType) | finalBit
 	b1 := byte(len(data))
@@ -612,24 +688,36 @@ func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
 	if c == nil {
 		return nil, ErrNilConn
 	}
-	var mw messageWriter
-	if err := c.beginMessage(&mw, messageType); err != nil {
+	w, err := c.nextWriter(messageType, c.shouldCompress(messageType, nil))
+	if err != nil || c.capture.Load() == nil {
+		return w, err
+	}
+	c.writer = &captureWriter{w: w, c: c, messageType: messageType}
+	return c.writer, nil
+}
+
+// nextWriter returns a writer for the next message, compressing the message
+// if compress is true.
+func (c *Conn) nextWriter(messageType int, compress bool) (io.WriteCloser, error) {
+	mw := &messageWriter{}
+	if err := c.beginMessage(mw, messageType); err != nil {
 		return nil, err
 	}
-	c.writer = &mw
-	if c.newCompressionWriter != nil && c.enableWriteCompression && isData(messageType) {
+	c.writer = mw
+	if compress {
 		w := c.newCompressionWriter(c.writer, c.compressionLevel)
 		mw.compress = true
-		c.writer = w
+		c.writer = &compressionStatsWriter{w: w, mw: mw}
 	}
 	return c.writer, nil
 }
 
 type messageWriter struct {
 	c         *Conn
-	compress  bool // whether next call to flushFrame should set RSV1
-	pos       int  // end of data in writeBuf.
-	frameType int  // type of the current frame.
+	compress  bool  // whether next call to flushFrame should set RSV1
+	pos       int   // end of data in writeBuf.
+	frameType int   // type of the current frame.
+	length    int64 // payload bytes written in previous frames.
 	err       error
 }
 
@@ -727,6 +815,7 @@ func (w *messageWriter) flushFrame(final bool, extra []byte) error {
 	if err != nil {
 		return w.endMessage(err)
 	}
+	w.length += int64(length)
 
 	if final {
 		_ = w.endMessage(errWriteClosed)
@@ -835,9 +924,10 @@ func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
 	if c == nil {
 		return ErrNilConn
 	}
+	c.captureMessage(CaptureOutbound, pm.messageType, pm.data)
 	frameType, frameData, err := pm.frame(prepareKey{
 		isServer:         c.isServer,
-		compress:         c.newCompressionWriter != nil && c.enableWriteCompression && isData(pm.messageType),
+		compress:         c.shouldCompress(pm.messageType, pm.data),
 		compressionLevel: c.compressionLevel,
 	})
 	if err != nil {
@@ -861,7 +951,9 @@ func (c *Conn) WriteMessage(messageType int, data []byte) error {
 	if c == nil {
 		return ErrNilConn
 	}
-	if c.isServer && (c.newCompressionWriter == nil || !c.enableWriteCompression) {
+	c.captureMessage(CaptureOutbound, messageType, data)
+	compress := c.shouldCompress(messageType, data)
+	if c.isServer && !compress {
 		// Fast path with no allocations and single frame.
 
 		var mw messageWriter
@@ -874,7 +966,7 @@ func (c *Conn) WriteMessage(messageType int, data []byte) error {
 		return mw.flushFrame(true, data)
 	}
 
-	w, err := c.NextWriter(messageType)
+	w, err := c.nextWriter(messageType, compress)
 	if err != nil {
 		return err
 	}
@@ -1073,6 +1165,7 @@ func (c *Conn) readControlFramePayload() ([]byte, error) {
 // processControlFrame processes a control frame
 // 7. Process control frame payload.
 func (c *Conn) processControlFrame(frameType int, payload []byte) (int, error) {
+	c.captureMessage(CaptureInbound, frameType, payload)
 	switch frameType {
 	case PongMessage:
 		if err := c.handlePong(string(payload)); err != nil {
@@ -1109,6 +1202,13 @@ func (c *Conn) advanceFrame() (int, error) {
 		return noFrame, err
 	}
 
+	// The previous frame is consumed. Give the read buffer back while
+	// waiting for the next frame.
+	c.releaseReader()
+	if err := c.acquireReader(); err != nil {
+		return noFrame, err
+	}
+
 	// 2. Read and parse frame header.
 	frameType, _, mask, err := c.readFrameHeader()
 	if err != nil {
@@ -1131,6 +1231,9 @@ func (c *Conn) advanceFrame() (int, error) {
 		return noFrame, err
 	}
 	if isDataFrame {
+		if err := c.enforceRateLimit(frameType); err != nil {
+			return noFrame, err
+		}
 		return frameType, nil
 	}
 
@@ -1187,12 +1290,22 @@ func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
 			break
 		}
 
+		if c.readDrop {
+			if err := c.discardDroppedMessage(); err != nil {
+				c.readErr = err
+			}
+			continue
+		}
+
 		if frameType == TextMessage || frameType == BinaryMessage {
 			c.messageReader = &messageReader{c}
 			c.reader = c.messageReader
 			if c.readDecompress {
 				c.reader = c.newDecompressionReader(c.reader)
 			}
+			if c.capture.Load() != nil {
+				c.reader = &captureReader{r: c.reader, c: c, messageType: frameType}
+			}
 			return frameType, c.reader, nil
 		}
 	}
@@ -1241,6 +1354,7 @@ func (r *messageReader) Read(b []byte) (int, error) {
 
 		if c.readFinal {
 			c.messageReader = nil
+			c.releaseReader()
 			return 0, io.EOF
 		}
 
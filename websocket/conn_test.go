@@ -12,6 +12,7 @@ import (
 	"io"
 	"net"
 	"reflect"
+	"runtime"
 	"sync"
 	"testing"
 	"testing/iotest"
@@ -50,7 +51,7 @@ func (a fakeAddr) String() string {
 // newTestConn creates a connection backed by a fake network connection using
 // default values for buffering.
 func newTestConn(r io.Reader, w io.Writer, isServer bool) *Conn {
-	return newConn(fakeNetConn{Reader: r, Writer: w}, isServer, 1024, 1024, nil, nil, nil)
+	return newConn(fakeNetConn{Reader: r, Writer: w}, isServer, 1024, 1024, nil, nil, nil, nil)
 }
 
 func TestFraming(t *testing.T) {
@@ -249,7 +250,7 @@ func TestWriteBufferPool(t *testing.T) {
 
 	// Specify writeBufferSize smaller than message size to ensure that pooling
 	// works with fragmented messages.
-	wc := newConn(fakeNetConn{Writer: &buf}, true, 1024, len(message)-1, &pool, nil, nil)
+	wc := newConn(fakeNetConn{Writer: &buf}, true, 1024, len(message)-1, nil, &pool, nil, nil)
 
 	if wc.writeBuf != nil {
 		t.Fatal("writeBuf not nil after create")
@@ -321,7 +322,7 @@ func TestWriteBufferPool(t *testing.T) {
 func TestWriteBufferPoolSync(t *testing.T) {
 	var buf bytes.Buffer
 	var pool sync.Pool
-	wc := newConn(fakeNetConn{Writer: &buf}, true, 1024, 1024, &pool, nil, nil)
+	wc := newConn(fakeNetConn{Writer: &buf}, true, 1024, 1024, nil, &pool, nil, nil)
 	rc := newTestConn(&buf, nil, false)
 
 	const message = "Hello World!"
@@ -339,6 +340,100 @@ func TestWriteBufferPoolSync(t *testing.T) {
 	}
 }
 
+func TestReadBufferPool(t *testing.T) {
+	const message = "Now is the time for all good people to come to the aid of the party."
+
+	var buf bytes.Buffer
+	var pool simpleBufferPool
+	wc := newTestConn(nil, &buf, false)
+
+	// Specify readBufferSize smaller than message size to ensure that pooling
+	// works with frames that do not fit in the buffer.
+	rc := newConn(fakeNetConn{Reader: &buf, Writer: io.Discard}, true, maxControlFramePayloadSize, 1024, &pool, nil, nil, nil)
+
+	if rc.br != nil {
+		t.Fatal("br not nil after create")
+	}
+
+	var brAddr *bufio.Reader
+	for i := 0; i < 3; i++ {
+		if err := wc.WriteControl(PingMessage, []byte("ping"), time.Time{}); err != nil {
+			t.Fatalf("wc.WriteControl() returned %v", err)
+		}
+		if err := wc.WriteMessage(TextMessage, []byte(message)); err != nil {
+			t.Fatalf("wc.WriteMessage() returned %v", err)
+		}
+
+		opCode, p, err := rc.ReadMessage()
+		if opCode != TextMessage || err != nil {
+			t.Fatalf("ReadMessage() returned %d, p, %v", opCode, err)
+		}
+		if s := string(p); s != message {
+			t.Fatalf("message is %s, want %s", s, message)
+		}
+
+		if rc.br != nil {
+			t.Fatal("br not nil after ReadMessage")
+		}
+		rpd, ok := pool.v.(readPoolData)
+		if !ok {
+			t.Fatal("br not returned to pool")
+		}
+		if brAddr != nil && rpd.br != brAddr {
+			t.Fatal("br from pool not reused")
+		}
+		brAddr = rpd.br
+	}
+}
+
+// BenchmarkIdleConnMemory reports the heap held by a server connection that
+// has read one message and is waiting for the next one.
+func BenchmarkIdleConnMemory(b *testing.B) {
+	const numConns = 1000
+	message := bytes.Repeat([]byte("x"), 512)
+
+	var frame bytes.Buffer
+	wc := newTestConn(nil, &frame, false)
+	if err := wc.WriteMessage(TextMessage, message); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bm := range []struct {
+		name string
+		pool func() BufferPool
+	}{
+		{"unpooled", func() BufferPool { return nil }},
+		{"pooled", func() BufferPool { return &sync.Pool{} }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var perConn float64
+			for i := 0; i < b.N; i++ {
+				pool := bm.pool()
+				conns := make([]*Conn, numConns)
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				for j := range conns {
+					r := bytes.NewReader(frame.Bytes())
+					c := newConn(fakeNetConn{Reader: r}, true, 10240, 1024, pool, nil, nil, nil)
+					if _, _, err := c.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+					conns[j] = c
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				perConn = float64(after.HeapAlloc-before.HeapAlloc) / numConns
+				runtime.KeepAlive(conns)
+			}
+			b.ReportMetric(perConn, "B/conn")
+		})
+	}
+}
+
 // errorWriter is an io.Writer than returns an error on all writes.
 type errorWriter struct{}
 
@@ -351,7 +446,7 @@ func TestWriteBufferPoolError(t *testing.T) {
 	// Part 1: Test NextWriter/Write/Close
 
 	var pool simpleBufferPool
-	wc := newConn(fakeNetConn{Writer: errorWriter{}}, true, 1024, 1024, &pool, nil, nil)
+	wc := newConn(fakeNetConn{Writer: errorWriter{}}, true, 1024, 1024, nil, &pool, nil, nil)
 
 	w, err := wc.NextWriter(TextMessage)
 	if err != nil {
@@ -378,7 +473,7 @@ func TestWriteBufferPoolError(t *testing.T) {
 
 	// Part 2: Test WriteMessage
 
-	wc = newConn(fakeNetConn{Writer: errorWriter{}}, true, 1024, 1024, &pool, nil, nil)
+	wc = newConn(fakeNetConn{Writer: errorWriter{}}, true, 1024, 1024, nil, &pool, nil, nil)
 
 	if err := wc.WriteMessage(TextMessage, []byte("Hello")); err == nil {
 		t.Fatalf("wc.WriteMessage did not return error")
@@ -395,7 +490,7 @@ func TestCloseFrameBeforeFinalMessageFrame(t *testing.T) {
 	expectedErr := &CloseError{Code: CloseNormalClosure, Text: "hello"}
 
 	var b1, b2 bytes.Buffer
-	wc := newConn(&fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, bufSize, nil, nil, nil)
+	wc := newConn(&fakeNetConn{Reader: nil, Writer: &b1}, false, 1024, bufSize, nil, nil, nil, nil)
 	rc := newTestConn(&b1, &b2, true)
 
 	w, _ := wc.NextWriter(BinaryMessage)
@@ -456,7 +551,7 @@ func TestEOFBeforeFinalFrame(t *testing.T) {
 	const bufSize = 512
 
 	var b1, b2 bytes.Buffer
-	wc := newConn(&fakeNetConn{Writer: &b1}, false, 1024, bufSize, nil, nil, nil)
+	wc := newConn(&fakeNetConn{Writer: &b1}, false, 1024, bufSize, nil, nil, nil, nil)
 	rc := newTestConn(&b1, &b2, true)
 
 	w, _ := wc.NextWriter(BinaryMessage)
@@ -508,7 +603,7 @@ func TestReadLimit(t *testing.T) {
 		message := make([]byte, readLimit+1)
 
 		var b1, b2 bytes.Buffer
-		wc := newConn(&fakeNetConn{Writer: &b1}, false, 1024, readLimit-2, nil, nil, nil)
+		wc := newConn(&fakeNetConn{Writer: &b1}, false, 1024, readLimit-2, nil, nil, nil, nil)
 		rc := newTestConn(&b1, &b2, true)
 		rc.SetReadLimit(readLimit)
 
@@ -605,7 +700,7 @@ func TestAddrs(t *testing.T) {
 func TestDeprecatedUnderlyingConn(t *testing.T) {
 	var b1, b2 bytes.Buffer
 	fc := fakeNetConn{Reader: &b1, Writer: &b2}
-	c := newConn(fc, true, 1024, 1024, nil, nil, nil)
+	c := newConn(fc, true, 1024, 1024, nil, nil, nil, nil)
 	ul := c.UnderlyingConn()
 	if ul != fc {
 		t.Fatalf("Underlying conn is not what it should be.")
@@ -615,7 +710,7 @@ func TestDeprecatedUnderlyingConn(t *testing.T) {
 func TestNetConn(t *testing.T) {
 	var b1, b2 bytes.Buffer
 	fc := fakeNetConn{Reader: &b1, Writer: &b2}
-	c := newConn(fc, true, 1024, 1024, nil, nil, nil)
+	c := newConn(fc, true, 1024, 1024, nil, nil, nil, nil)
 	ul := c.NetConn()
 	if ul != fc {
 		t.Fatalf("Underlying conn is not what it should be.")
@@ -629,8 +724,8 @@ func TestBufioReadBytes(t *testing.T) {
 	m[len(m)-1] = '\n'
 
 	var b1, b2 bytes.Buffer
-	wc := newConn(fakeNetConn{Writer: &b1}, false, len(m)+64, len(m)+64, nil, nil, nil)
-	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, len(m)-64, len(m)-64, nil, nil, nil)
+	wc := newConn(fakeNetConn{Writer: &b1}, false, len(m)+64, len(m)+64, nil, nil, nil, nil)
+	rc := newConn(fakeNetConn{Reader: &b1, Writer: &b2}, true, len(m)-64, len(m)-64, nil, nil, nil, nil)
 
 	w, _ := wc.NextWriter(BinaryMessage)
 	_, _ = w.Write(m)
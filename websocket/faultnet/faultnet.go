@@ -0,0 +1,250 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package faultnet wraps network connections to inject faults for resilience
+// tests: latency, bandwidth limits, short reads and partial writes, stalls,
+// abrupt closes and data corruption.
+//
+// Wrap connections on the server side with Listen, for example by replacing
+// the listener of an httptest.Server before starting it, and on the client
+// side with DialContext as the websocket.Dialer NetDialContext function:
+//
+//	dialer := websocket.Dialer{
+//		NetDialContext: faultnet.DialContext(nil, faultnet.Faults{Latency: 50 * time.Millisecond}),
+//	}
+//
+// The faults of a connection can be changed while it is in use with
+// Conn.SetFaults.
+package faultnet
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInjectedClose is returned by Read and Write when the connection was
+// closed by an injected fault.
+var ErrInjectedClose = errors.New("faultnet: injected close")
+
+// Faults specifies the faults injected on a connection. Faults apply to the
+// data read from and written to the wrapped connection. The zero value
+// injects no faults.
+type Faults struct {
+	// Latency delays every read and write. Jitter adds a random delay of up
+	// to Jitter.
+	Latency, Jitter time.Duration
+
+	// Bandwidth limits the transfer rate in bytes per second in each
+	// direction. If zero, the rate is not limited.
+	Bandwidth int
+
+	// MaxReadChunk limits the number of bytes returned by a single Read.
+	// MaxWriteChunk splits writes in chunks of at most this size; faults are
+	// applied to each chunk, so the peer can observe a partial write. If
+	// zero, reads and writes are not split.
+	MaxReadChunk, MaxWriteChunk int
+
+	// StallProbability is the probability that a read or write stalls for
+	// StallDuration.
+	StallProbability float64
+	StallDuration    time.Duration
+
+	// CloseProbability is the probability that a read or write closes the
+	// connection abruptly. CloseAfterBytes closes the connection once the
+	// total number of bytes read and written reaches this value; zero
+	// disables the limit. TCP connections are reset instead of closed
+	// gracefully.
+	CloseProbability float64
+	CloseAfterBytes  int64
+
+	// CorruptProbability is the probability that a read or write flips a
+	// random bit of the data.
+	CorruptProbability float64
+
+	// Seed seeds the random source of the connection. If zero, the current
+	// time is used.
+	Seed int64
+}
+
+// Conn is a net.Conn that injects faults.
+type Conn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	faults Faults
+	rnd    *rand.Rand
+	bytes  int64
+	closed bool
+}
+
+// Wrap returns a connection that injects faults on c.
+func Wrap(c net.Conn, faults Faults) *Conn {
+	fc := &Conn{Conn: c}
+	fc.SetFaults(faults)
+	return fc
+}
+
+// SetFaults replaces the faults of the connection. SetFaults is safe to call
+// concurrently with Read and Write.
+func (c *Conn) SetFaults(faults Faults) {
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c.mu.Lock()
+	c.faults = faults
+	c.rnd = rand.New(rand.NewSource(seed))
+	c.mu.Unlock()
+}
+
+// Faults returns the faults of the connection.
+func (c *Conn) Faults() Faults {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.faults
+}
+
+// Reset closes the connection abruptly. TCP connections are closed with a
+// reset instead of the normal connection teardown.
+func (c *Conn) Reset() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	if tc, ok := c.Conn.(*net.TCPConn); ok {
+		_ = tc.SetLinger(0)
+	}
+	return c.Conn.Close()
+}
+
+// plan returns the delay and the injected faults of an operation on n bytes.
+func (c *Conn) plan(n int) (delay time.Duration, close, corrupt bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := &c.faults
+
+	delay = f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(c.rnd.Int63n(int64(f.Jitter)))
+	}
+	if f.Bandwidth > 0 {
+		delay += time.Duration(n) * time.Second / time.Duration(f.Bandwidth)
+	}
+	if f.StallProbability > 0 && c.rnd.Float64() < f.StallProbability {
+		delay += f.StallDuration
+	}
+
+	c.bytes += int64(n)
+	close = c.closed ||
+		(f.CloseProbability > 0 && c.rnd.Float64() < f.CloseProbability) ||
+		(f.CloseAfterBytes > 0 && c.bytes >= f.CloseAfterBytes)
+	corrupt = f.CorruptProbability > 0 && c.rnd.Float64() < f.CorruptProbability
+	return delay, close, corrupt
+}
+
+// corrupt flips a random bit of p.
+func (c *Conn) corrupt(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	c.mu.Lock()
+	i := c.rnd.Intn(len(p))
+	bit := byte(1) << uint(c.rnd.Intn(8))
+	c.mu.Unlock()
+	p[i] ^= bit
+}
+
+// Read reads data from the connection with the configured faults.
+func (c *Conn) Read(p []byte) (int, error) {
+	if max := c.Faults().MaxReadChunk; max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := c.Conn.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	delay, close, corrupt := c.plan(n)
+	time.Sleep(delay)
+	if close {
+		c.Reset()
+		return 0, ErrInjectedClose
+	}
+	if corrupt {
+		c.corrupt(p[:n])
+	}
+	return n, err
+}
+
+// Write writes data to the connection with the configured faults.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := c.Faults().MaxWriteChunk; max > 0 && len(chunk) > max {
+			chunk = chunk[:max]
+		}
+
+		delay, close, corrupt := c.plan(len(chunk))
+		time.Sleep(delay)
+		if close {
+			c.Reset()
+			return written, ErrInjectedClose
+		}
+		if corrupt {
+			// Do not modify the caller's buffer.
+			chunk = append([]byte(nil), chunk...)
+			c.corrupt(chunk)
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Listener is a net.Listener that injects faults on accepted connections.
+type Listener struct {
+	net.Listener
+	faults Faults
+}
+
+// Listen returns a listener that wraps the connections accepted by l with the
+// given faults.
+func Listen(l net.Listener, faults Faults) *Listener {
+	return &Listener{Listener: l, faults: faults}
+}
+
+// Accept waits for and returns the next connection wrapped in a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(c, l.faults), nil
+}
+
+// DialContext returns a dial function for websocket.Dialer NetDialContext
+// that wraps the connections created by dial with the given faults. If dial is
+// nil, a net.Dialer is used.
+func DialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), faults Faults) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return Wrap(c, faults), nil
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package faultnet
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"ws/websocket"
+)
+
+// newEchoServer starts a websocket echo server. Accepted connections inject
+// the server faults.
+func newEchoServer(t *testing.T, faults Faults) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			mt, p, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(mt, p); err != nil {
+				return
+			}
+		}
+	}))
+	s.Listener = Listen(s.Listener, faults)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// dial connects to s with a client that injects faults.
+func dial(t *testing.T, s *httptest.Server, faults Faults) (*websocket.Conn, error) {
+	d := websocket.Dialer{
+		NetDialContext:   DialContext(nil, faults),
+		HandshakeTimeout: 5 * time.Second,
+	}
+	ws, _, err := d.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil {
+		t.Cleanup(func() { ws.Close() })
+	}
+	return ws, err
+}
+
+func echo(ws *websocket.Conn, p []byte) ([]byte, error) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return nil, err
+	}
+	_, got, err := ws.ReadMessage()
+	return got, err
+}
+
+func TestLatency(t *testing.T) {
+	s := newEchoServer(t, Faults{Latency: 20 * time.Millisecond})
+	ws, err := dial(t, s, Faults{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	start := time.Now()
+	if _, err := echo(ws, []byte("hello")); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("round trip took %v, want at least 40ms", d)
+	}
+}
+
+func TestPartialReadsAndWrites(t *testing.T) {
+	s := newEchoServer(t, Faults{MaxReadChunk: 3, MaxWriteChunk: 5})
+	ws, err := dial(t, s, Faults{MaxReadChunk: 1, MaxWriteChunk: 2, Jitter: time.Millisecond, Seed: 1})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	want := bytes.Repeat([]byte("0123456789"), 50)
+	got, err := echo(ws, want)
+	if err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echo returned %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	s := newEchoServer(t, Faults{})
+	ws, err := dial(t, s, Faults{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ws.UnderlyingConn().(*Conn).SetFaults(Faults{Bandwidth: 100000})
+	start := time.Now()
+	if _, err := echo(ws, make([]byte, 5000)); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	// 5000 bytes are written and read at 100 kB/s.
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("echo took %v, want at least 100ms", d)
+	}
+}
+
+func TestInjectedClose(t *testing.T) {
+	s := newEchoServer(t, Faults{CloseAfterBytes: 1024})
+	ws, err := dial(t, s, Faults{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if _, err := echo(ws, []byte("small")); err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	// The server resets the connection without a close handshake.
+	_, err = echo(ws, make([]byte, 2048))
+	if _, ok := err.(*websocket.CloseError); err == nil || ok {
+		t.Errorf("echo after the limit returned %v, want a network error", err)
+	}
+
+	if _, err := dial(t, s, Faults{CloseProbability: 1}); err == nil {
+		t.Errorf("Dial with CloseProbability 1 succeeded")
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	s := newEchoServer(t, Faults{})
+	ws, err := dial(t, s, Faults{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	fc := ws.UnderlyingConn().(*Conn)
+	fc.SetFaults(Faults{CorruptProbability: 1, Seed: 1})
+
+	want := bytes.Repeat([]byte{'a'}, 100)
+	p := append([]byte(nil), want...)
+	got, err := echo(ws, p)
+	if !bytes.Equal(p, want) {
+		t.Fatalf("Write modified the caller's buffer")
+	}
+	if err == nil && bytes.Equal(got, want) {
+		t.Errorf("corrupted echo returned the original data")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import "net"
+
+// PipeOptions specifies the configuration of the connections returned by
+// Pipe.
+type PipeOptions struct {
+	// ReadBufferSize and WriteBufferSize specify I/O buffer sizes in bytes of
+	// both connections. If a buffer size is zero, then a default value of 4096
+	// is used.
+	ReadBufferSize, WriteBufferSize int
+
+	// Subprotocol is the subprotocol returned by Subprotocol on both
+	// connections.
+	Subprotocol string
+
+	// EnableCompression enables compression on both connections as if
+	// permessage-deflate was negotiated.
+	EnableCompression bool
+
+	// CompressionDictionary enables compression with the x-deflate-dictionary
+	// extension instead of permessage-deflate. EnableCompression must also be
+	// set.
+	CompressionDictionary *CompressionDictionary
+}
+
+// Pipe returns a connected pair of connections over an in-memory, synchronous
+// network connection created with net.Pipe. The server connection behaves
+// like a connection returned by Upgrader.Upgrade and the client connection
+// like a connection returned by Dialer.Dial, without an opening handshake.
+// If opts is nil, the default options are used.
+//
+// Pipe is intended for tests of application code. Because net.Pipe has no
+// internal buffering, a write on one connection blocks until the peer reads
+// the data, so tests must read from the peer concurrently with writes.
+func Pipe(opts *PipeOptions) (server, client *Conn) {
+	if opts == nil {
+		opts = &PipeOptions{}
+	}
+
+	sc, cc := net.Pipe()
+	server = newConn(sc, true, opts.ReadBufferSize, opts.WriteBufferSize, nil, nil, nil, nil)
+	client = newConn(cc, false, opts.ReadBufferSize, opts.WriteBufferSize, nil, nil, nil, nil)
+	for _, c := range []*Conn{server, client} {
+		c.subprotocol = opts.Subprotocol
+		if opts.EnableCompression {
+			c.setupCompression(opts.CompressionDictionary)
+		}
+	}
+	return server, client
+}
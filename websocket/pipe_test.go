@@ -0,0 +1,88 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// pipeEcho echoes messages on c until the connection fails.
+func pipeEcho(c *Conn) {
+	for {
+		mt, p, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.WriteMessage(mt, p); err != nil {
+			return
+		}
+	}
+}
+
+var pipeTests = []struct {
+	name string
+	opts *PipeOptions
+}{
+	{"default", nil},
+	{"small buffers", &PipeOptions{ReadBufferSize: 64, WriteBufferSize: 64}},
+	{"compression", &PipeOptions{EnableCompression: true}},
+	{"dictionary", &PipeOptions{EnableCompression: true, CompressionDictionary: NewCompressionDictionary([]byte("hello pipe"))}},
+}
+
+func TestPipe(t *testing.T) {
+	for _, tt := range pipeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := Pipe(tt.opts)
+			defer server.Close()
+			defer client.Close()
+			go pipeEcho(server)
+
+			for _, n := range []int{0, 10, 1000, 100000} {
+				want := bytes.Repeat([]byte("hello pipe "), n)
+				if err := client.WriteMessage(TextMessage, want); err != nil {
+					t.Fatalf("WriteMessage: %v", err)
+				}
+				mt, got, err := client.ReadMessage()
+				if err != nil {
+					t.Fatalf("ReadMessage: %v", err)
+				}
+				if mt != TextMessage || !bytes.Equal(got, want) {
+					t.Fatalf("echo of %d bytes: got type %d, %d bytes", len(want), mt, len(got))
+				}
+			}
+
+			compressed := client.CompressionStats().Compressed > 0
+			if enabled := tt.opts != nil && tt.opts.EnableCompression; compressed != enabled {
+				t.Errorf("compressed = %v, want %v", compressed, enabled)
+			}
+		})
+	}
+}
+
+func TestPipeSubprotocol(t *testing.T) {
+	server, client := Pipe(&PipeOptions{Subprotocol: "chat"})
+	defer server.Close()
+	defer client.Close()
+	if server.Subprotocol() != "chat" || client.Subprotocol() != "chat" {
+		t.Errorf("Subprotocol() = %q, %q, want %q", server.Subprotocol(), client.Subprotocol(), "chat")
+	}
+}
+
+func TestPipeClose(t *testing.T) {
+	server, client := Pipe(nil)
+	defer server.Close()
+	defer client.Close()
+	go pipeEcho(client)
+
+	if err := server.WriteControl(CloseMessage, FormatCloseMessage(CloseGoingAway, "bye"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteControl: %v", err)
+	}
+	_, _, err := server.ReadMessage()
+	if !IsCloseError(err, CloseGoingAway) {
+		t.Fatalf("ReadMessage returned %v, want close error %d", err, CloseGoingAway)
+	}
+}
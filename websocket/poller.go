@@ -0,0 +1,187 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrPollerUnsupported is returned by the Poller methods on platforms without
+// netpoll support.
+var ErrPollerUnsupported = errors.New("websocket: poller is not supported on this platform")
+
+// ErrPollerClosed is returned when a connection is added to a closed Poller.
+var ErrPollerClosed = errors.New("websocket: poller closed")
+
+// errPollerNotPollable is returned when the connection does not expose a file
+// descriptor that can be registered with the poller.
+var errPollerNotPollable = errors.New("websocket: connection does not support polling")
+
+const defaultPollerReadTimeout = 10 * time.Second
+
+// Poller dispatches messages from many mostly idle connections without a
+// dedicated reader goroutine per connection.
+//
+// Connections registered with Add are watched by a single event loop. When a
+// connection becomes readable, a worker reads the available bytes without
+// waiting for more, calls OnMessage for each complete data message and returns
+// the connection to the event loop. The bytes of a message that has not fully
+// arrived are kept with the connection until the rest arrives, so a slow peer
+// never holds a worker. Idle connections hold neither a goroutine nor a read
+// buffer.
+//
+// Workers never sleep: a connection with a RateLimitDelay rate limit drops the
+// messages over the limit as with RateLimitDrop while it is owned by the
+// poller.
+//
+// The application must not call the read methods (NextReader, ReadMessage,
+// ReadJSON) on a connection owned by the poller. Writes are not managed by the
+// poller; the application must still make sure that there is at most one
+// concurrent writer per connection. Call Remove before closing a connection
+// that is owned by the poller, except from OnMessage where closing the
+// connection is enough for the poller to drop it.
+//
+// Poller is only implemented on Linux. On other platforms Start returns
+// ErrPollerUnsupported.
+type Poller struct {
+	// Workers specifies the number of goroutines that read and dispatch
+	// messages. If zero, runtime.NumCPU() is used.
+	Workers int
+
+	// ReadBufferSize specifies the size of the read buffers borrowed while a
+	// connection has pending data. If zero, a useful default size is used.
+	ReadBufferSize int
+
+	// ReadTimeout bounds the time the first bytes of a message may wait for
+	// the rest of the message. A connection that exceeds it leaves the poller
+	// with os.ErrDeadlineExceeded. If zero, 10 seconds is used.
+	ReadTimeout time.Duration
+
+	// OnMessage is called from a worker goroutine for every data message
+	// received on a polled connection. The data slice is owned by the
+	// callback.
+	OnMessage func(c *Conn, messageType int, data []byte)
+
+	// OnClose is called once when a connection leaves the poller. The err
+	// argument is the read error that caused the removal, or nil when the
+	// connection was removed with Remove or Close.
+	OnClose func(c *Conn, err error)
+
+	mu      sync.Mutex
+	readers sync.Pool
+	conns   map[*Conn]*polledConn
+	fds     map[int]*polledConn
+	closed  bool
+	state   pollerState
+}
+
+// polledConn tracks a connection registered with a Poller.
+type polledConn struct {
+	c    *Conn
+	fd   int
+	mu   sync.Mutex // held while a worker dispatches messages from c
+	done chan struct{}
+	once sync.Once
+
+	// The bytes received after the last complete message, guarded by mu.
+	pending      []byte
+	pendingSince time.Time   // arrival of the first pending byte
+	timer        *time.Timer // expires the pending bytes after ReadTimeout
+}
+
+// Serve registers c with the poller and blocks until the connection leaves the
+// poller. Use Serve from a FastHTTPUpgrader handler when the fasthttp server
+// closes hijacked connections on handler return (KeepHijackedConns is false).
+// The blocked goroutine does not hold a read buffer.
+func (p *Poller) Serve(c *Conn) error {
+	pc, err := p.add(c)
+	if err != nil {
+		return err
+	}
+	<-pc.done
+	return nil
+}
+
+// Add registers c with the poller and returns immediately.
+func (p *Poller) Add(c *Conn) error {
+	_, err := p.add(c)
+	return err
+}
+
+// readTimeout returns the configured read timeout or the default.
+func (p *Poller) readTimeout() time.Duration {
+	if p.ReadTimeout > 0 {
+		return p.ReadTimeout
+	}
+	return defaultPollerReadTimeout
+}
+
+// finish removes pc from the connection table and reports the removal to the
+// application exactly once.
+func (p *Poller) finish(pc *polledConn, err error) {
+	pc.once.Do(func() {
+		p.mu.Lock()
+		delete(p.conns, pc.c)
+		if p.fds[pc.fd] == pc {
+			delete(p.fds, pc.fd)
+		}
+		p.mu.Unlock()
+
+		if p.OnClose != nil {
+			p.OnClose(pc.c, err)
+		}
+		close(pc.done)
+	})
+}
+
+// nextPolledMessage reads the next data message from the connection if one is
+// available. Control frames are processed as in NextReader. When only control
+// frames are buffered, nextPolledMessage returns noFrame and a nil error so
+// that the caller can return the connection to the event loop instead of
+// blocking for the next frame.
+func (c *Conn) nextPolledMessage() (messageType int, p []byte, err error) {
+	if c.reader != nil {
+		c.reader.Close()
+		c.reader = nil
+	}
+
+	c.messageReader = nil
+	c.readLength = 0
+
+	for c.readErr == nil {
+		frameType, err := c.advanceFrame()
+		if err != nil {
+			c.readErr = err
+			break
+		}
+
+		if c.readDrop {
+			if err := c.discardDroppedMessage(); err != nil {
+				c.readErr = err
+				break
+			}
+		} else if frameType == TextMessage || frameType == BinaryMessage {
+			c.messageReader = &messageReader{c}
+			c.reader = c.messageReader
+			if c.readDecompress {
+				c.reader = c.newDecompressionReader(c.reader)
+			}
+			if c.capture.Load() != nil {
+				c.reader = &captureReader{r: c.reader, c: c, messageType: frameType}
+			}
+			p, err = io.ReadAll(c.reader)
+			return frameType, p, err
+		}
+
+		if c.buffered() == 0 {
+			return noFrame, nil, nil
+		}
+	}
+
+	return noFrame, nil, c.readErr
+}
@@ -0,0 +1,502 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// pollerEvents is the set of epoll events requested for a polled connection.
+// EPOLLONESHOT guarantees that at most one worker handles a connection at a
+// time; the worker re-arms the descriptor when it is done.
+const pollerEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// pollerReadWait bounds the read of the bytes available on a ready connection.
+// The read only waits after a spurious wakeup.
+const pollerReadWait = time.Millisecond
+
+// pollerState holds the epoll resources of a Poller.
+type pollerState struct {
+	started bool
+	epfd    int
+	wakeR   int // read end of the pipe used to wake the event loop on Close
+	wakeW   int // write end of the pipe used to wake the event loop on Close
+	bufSize int // size of the pooled read buffers
+	work    chan *polledConn
+	wg      sync.WaitGroup
+}
+
+// Start creates the epoll instance and starts the event loop and the workers.
+// Start is called implicitly by Add and Serve. Calling Start on a started
+// poller is a no-op.
+func (p *Poller) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrPollerClosed
+	}
+	if p.state.started {
+		return nil
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(epfd)
+		return err
+	}
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, wake[0], &ev); err != nil {
+		_ = syscall.Close(wake[0])
+		_ = syscall.Close(wake[1])
+		_ = syscall.Close(epfd)
+		return err
+	}
+
+	workers := p.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	size := p.ReadBufferSize
+	if size == 0 {
+		size = defaultReadBufferSize
+	} else if size < maxControlFramePayloadSize {
+		// must be large enough for control frame
+		size = maxControlFramePayloadSize
+	}
+	p.readers.New = func() interface{} {
+		return bufio.NewReaderSize(nil, size)
+	}
+
+	p.conns = make(map[*Conn]*polledConn)
+	p.fds = make(map[int]*polledConn)
+	p.state = pollerState{
+		started: true,
+		epfd:    epfd,
+		wakeR:   wake[0],
+		wakeW:   wake[1],
+		bufSize: size,
+		work:    make(chan *polledConn, workers),
+	}
+
+	p.state.wg.Add(workers + 1)
+	go p.loop()
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+
+	return nil
+}
+
+// add registers c with the epoll instance. Messages that are already buffered
+// in the connection are dispatched from the calling goroutine before the
+// descriptor is armed.
+func (p *Poller) add(c *Conn) (*polledConn, error) {
+	if c == nil {
+		return nil, ErrNilConn
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+
+	fd, err := pollFD(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	pc := &polledConn{c: c, fd: fd, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, ErrPollerClosed
+	}
+	if _, ok := p.conns[c]; ok {
+		p.mu.Unlock()
+		return nil, errors.New("websocket: connection already added to poller")
+	}
+	stale := p.fds[fd]
+	p.conns[c] = pc
+	p.fds[fd] = pc
+	p.mu.Unlock()
+	c.polled = true
+
+	if stale != nil {
+		// The descriptor was reused after the previous owner was closed
+		// without calling Remove.
+		p.finish(stale, net.ErrClosed)
+	}
+
+	p.handle(pc, syscall.EPOLL_CTL_ADD)
+	return pc, nil
+}
+
+// Remove unregisters c from the poller and calls OnClose with a nil error.
+// Remove waits for a dispatch of messages from c that is in progress, so it
+// must not be called from OnMessage; close the connection there instead.
+func (p *Poller) Remove(c *Conn) error {
+	p.mu.Lock()
+	pc, ok := p.conns[c]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	// Hold pc.mu while the descriptor is deleted, so that a worker does not
+	// re-arm it in between and report the failed re-arm to OnClose.
+	pc.mu.Lock()
+	err := syscall.EpollCtl(p.state.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	p.finish(pc, nil)
+	pc.mu.Unlock()
+	if err == syscall.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+// Close stops the event loop and the workers and removes all connections from
+// the poller. The connections are not closed. Close must not be called from
+// OnMessage or OnClose.
+func (p *Poller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	started := p.state.started
+	pcs := make([]*polledConn, 0, len(p.conns))
+	for _, pc := range p.conns {
+		pcs = append(pcs, pc)
+	}
+	p.mu.Unlock()
+
+	if started {
+		_, _ = syscall.Write(p.state.wakeW, []byte{0})
+		p.state.wg.Wait()
+		_ = syscall.Close(p.state.epfd)
+		_ = syscall.Close(p.state.wakeR)
+		_ = syscall.Close(p.state.wakeW)
+	}
+
+	for _, pc := range pcs {
+		p.finish(pc, nil)
+	}
+	return nil
+}
+
+// loop waits for readiness events and hands ready connections to the workers.
+func (p *Poller) loop() {
+	defer p.state.wg.Done()
+	defer close(p.state.work)
+
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.state.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.state.wakeR {
+				return
+			}
+
+			p.mu.Lock()
+			pc := p.fds[fd]
+			p.mu.Unlock()
+
+			if pc != nil {
+				p.state.work <- pc
+			}
+		}
+	}
+}
+
+// worker dispatches messages from ready connections.
+func (p *Poller) worker() {
+	defer p.state.wg.Done()
+	for pc := range p.state.work {
+		p.handle(pc, syscall.EPOLL_CTL_MOD)
+	}
+}
+
+// handle reads the bytes available on pc without waiting for more,
+// dispatches the complete messages and re-arms the descriptor with the given
+// epoll operation.
+func (p *Poller) handle(pc *polledConn, op int) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	select {
+	case <-pc.done:
+		// Removed while the event was queued.
+		return
+	default:
+	}
+
+	c := pc.c
+	if c.br != nil {
+		p.takeBuffered(pc)
+	}
+	var readErr error
+	if op == syscall.EPOLL_CTL_MOD {
+		readErr = p.readAvailable(pc)
+	}
+	if err := p.dispatch(pc); err != nil {
+		p.drop(pc, err)
+		return
+	}
+	if readErr != nil {
+		p.drop(pc, readErr)
+		return
+	}
+
+	select {
+	case <-pc.done:
+		// Finished by OnMessage or by the reuse of the descriptor; the
+		// descriptor must not be re-armed.
+		return
+	default:
+	}
+
+	ev := syscall.EpollEvent{Events: pollerEvents, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.state.epfd, op, pc.fd, &ev); err != nil {
+		p.drop(pc, err)
+	}
+}
+
+// takeBuffered moves the bytes that the connection read before it was added
+// to the pending bytes and detaches its read buffer.
+func (p *Poller) takeBuffered(pc *polledConn) {
+	c := pc.c
+	if n := c.br.Buffered(); n > 0 {
+		b, _ := c.br.Peek(n)
+		pc.pending = append(pc.pending, b...)
+		_, _ = c.br.Discard(n)
+	}
+	if c.readPool != nil {
+		c.releaseReader()
+	}
+	c.br = nil
+}
+
+// readAvailable appends the bytes available on the connection to the pending
+// bytes. The descriptor is readable, so the read does not wait; a spurious
+// wakeup times out at once and the data is read on the next event.
+func (p *Poller) readAvailable(pc *polledConn) error {
+	c := pc.c
+	br := p.readers.Get().(*bufio.Reader)
+	br.Reset(c.conn)
+	defer func() {
+		br.Reset(nil)
+		p.readers.Put(br)
+	}()
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(pollerReadWait))
+	_, err := br.Peek(1)
+	_ = c.conn.SetReadDeadline(time.Time{})
+	if n := br.Buffered(); n > 0 {
+		b, _ := br.Peek(n)
+		pc.pending = append(pc.pending, b...)
+	}
+
+	if c.readLimit > 0 && int64(len(pc.pending)) > c.readLimit+int64(p.state.bufSize) {
+		_ = c.WriteControl(CloseMessage, FormatCloseMessage(CloseMessageTooBig, ""), time.Now().Add(writeWait))
+		return ErrReadLimit
+	}
+	var netErr net.Error
+	switch {
+	case err == nil, errors.As(err, &netErr) && netErr.Timeout():
+		return nil
+	case err == io.EOF:
+		return errUnexpectedEOF
+	default:
+		return err
+	}
+}
+
+// dispatch parses the complete messages of the pending bytes, calls OnMessage
+// for the data messages and keeps the rest. Pending bytes start the ReadTimeout
+// of the connection.
+func (p *Poller) dispatch(pc *polledConn) error {
+	c := pc.c
+	if n := messageBoundary(pc.pending); n > 0 {
+		src := bytes.NewReader(pc.pending[:n])
+		br := p.readers.Get().(*bufio.Reader)
+		br.Reset(src)
+		c.br = br
+		var err error
+		for err == nil && (c.buffered() > 0 || src.Len() > 0) {
+			var messageType int
+			var data []byte
+			messageType, data, err = c.nextPolledMessage()
+			if err == nil && messageType != noFrame && p.OnMessage != nil {
+				p.OnMessage(c, messageType, data)
+			}
+		}
+		c.br = nil
+		br.Reset(nil)
+		p.readers.Put(br)
+		if err != nil {
+			return err
+		}
+		pc.pending = append(pc.pending[:0], pc.pending[n:]...)
+		pc.pendingSince = time.Time{}
+	}
+
+	if len(pc.pending) == 0 {
+		pc.pending = nil
+		if pc.timer != nil {
+			pc.timer.Stop()
+			pc.timer = nil
+		}
+		return nil
+	}
+	if pc.pendingSince.IsZero() {
+		pc.pendingSince = time.Now()
+	}
+	if pc.timer == nil {
+		pc.timer = time.AfterFunc(p.readTimeout(), func() { p.expire(pc) })
+	}
+	return nil
+}
+
+// expire drops the connection if its pending bytes are older than ReadTimeout.
+func (p *Poller) expire(pc *polledConn) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	select {
+	case <-pc.done:
+		return
+	default:
+	}
+	if pc.timer == nil {
+		return
+	}
+	if wait := p.readTimeout() - time.Since(pc.pendingSince); wait > 0 {
+		pc.timer.Reset(wait)
+		return
+	}
+	pc.timer = nil
+	p.drop(pc, os.ErrDeadlineExceeded)
+}
+
+// drop unregisters pc after a read or poll error.
+func (p *Poller) drop(pc *polledConn, err error) {
+	_ = syscall.EpollCtl(p.state.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	p.finish(pc, err)
+}
+
+// messageBoundary returns the length of the longest prefix of p that holds
+// complete frames only and does not end inside a fragmented message.
+func messageBoundary(p []byte) int {
+	boundary, off := 0, 0
+	inMessage := false
+	for len(p)-off >= 2 {
+		b0, b1 := p[off], p[off+1]
+		header := 2
+		length := uint64(b1 & 0x7f)
+		switch length {
+		case 126:
+			if len(p)-off < 4 {
+				return boundary
+			}
+			length = uint64(binary.BigEndian.Uint16(p[off+2:]))
+			header = 4
+		case 127:
+			if len(p)-off < 10 {
+				return boundary
+			}
+			length = binary.BigEndian.Uint64(p[off+2:])
+			header = 10
+		}
+		if b1&maskBit != 0 {
+			header += 4
+		}
+		if len(p)-off < header || uint64(len(p)-off-header) < length {
+			return boundary
+		}
+		off += header + int(length)
+
+		if isControl(int(b0 & 0xf)) {
+			if !inMessage {
+				boundary = off
+			}
+		} else {
+			inMessage = b0&finalBit == 0
+			if !inMessage {
+				boundary = off
+			}
+		}
+	}
+	return boundary
+}
+
+// pollFD returns the file descriptor of the socket that backs nc.
+func pollFD(nc net.Conn) (int, error) {
+	nc, err := unwrapPollConn(nc)
+	if err != nil {
+		return -1, err
+	}
+
+	sc, ok := nc.(syscall.Conn)
+	if !ok {
+		return -1, errPollerNotPollable
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// unwrapPollConn strips the wrappers added by the upgraders so that the
+// socket can be reached. Reads still go through the wrappers.
+func unwrapPollConn(nc net.Conn) (net.Conn, error) {
+	for {
+		switch v := nc.(type) {
+		case *brNetConn:
+			if v.br != nil {
+				// Data buffered in the wrapper is invisible to epoll.
+				return nil, errPollerNotPollable
+			}
+			nc = v.Conn
+		case interface{ UnsafeConn() net.Conn }:
+			// Connection hijacked from a fasthttp server.
+			nc = v.UnsafeConn()
+		default:
+			return nc, nil
+		}
+	}
+}
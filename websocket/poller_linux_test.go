@@ -0,0 +1,340 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newPollerServer(t *testing.T, p *Poller) *httptest.Server {
+	upgrader := Upgrader{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Logf("Upgrade: %v", err)
+			return
+		}
+		if err := p.Serve(ws); err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+		ws.Close()
+	}))
+}
+
+func TestPollerEcho(t *testing.T) {
+	closed := make(chan error, 1)
+	p := &Poller{
+		Workers: 2,
+		OnMessage: func(c *Conn, messageType int, data []byte) {
+			if err := c.WriteMessage(messageType, data); err != nil {
+				t.Errorf("WriteMessage: %v", err)
+			}
+		},
+		OnClose: func(c *Conn, err error) {
+			closed <- err
+		},
+	}
+	defer p.Close()
+
+	s := newPollerServer(t, p)
+	defer s.Close()
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	for _, message := range []string{"one", "two", "three"} {
+		sendRecvMessage(t, ws, message)
+	}
+
+	// A ping without data messages must not stall the worker.
+	pong := make(chan string, 1)
+	ws.SetPongHandler(func(appData string) error {
+		pong <- appData
+		return nil
+	})
+	if err := ws.WriteControl(PingMessage, []byte("ping"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("WriteControl: %v", err)
+	}
+	sendRecvMessage(t, ws, "after ping")
+	select {
+	case appData := <-pong:
+		if appData != "ping" {
+			t.Errorf("pong = %q, want %q", appData, "ping")
+		}
+	default:
+		t.Error("pong not received")
+	}
+
+	if err := ws.WriteMessage(CloseMessage, FormatCloseMessage(CloseNormalClosure, "")); err != nil {
+		t.Fatalf("WriteMessage(CloseMessage): %v", err)
+	}
+
+	select {
+	case err := <-closed:
+		if !IsCloseError(err, CloseNormalClosure) {
+			t.Errorf("OnClose err = %v, want close 1000", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
+
+func TestPollerRemoveAdd(t *testing.T) {
+	added := make(chan *Conn, 1)
+	p := &Poller{
+		OnMessage: func(c *Conn, messageType int, data []byte) {
+			_ = c.WriteMessage(messageType, data)
+		},
+	}
+	defer p.Close()
+
+	upgrader := Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		if err := p.Add(ws); err != nil {
+			t.Errorf("Add: %v", err)
+			return
+		}
+		added <- ws
+	}))
+	defer s.Close()
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	sc := <-added
+	sendRecvMessage(t, ws, "hello")
+
+	if err := p.Remove(sc); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := p.Add(sc); err != nil {
+		t.Fatalf("Add after Remove: %v", err)
+	}
+	sendRecvMessage(t, ws, "again")
+}
+
+func TestPollerClosed(t *testing.T) {
+	p := &Poller{}
+	if err := p.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	c := newTestConn(nil, nil, true)
+	if err := p.Add(c); err != ErrPollerClosed {
+		t.Fatalf("Add = %v, want %v", err, ErrPollerClosed)
+	}
+}
+
+func TestPollerRemoveWhileReading(t *testing.T) {
+	closeErrs := make(chan error, 1)
+	added := make(chan *Conn, 1)
+	dispatching := make(chan struct{}, 1)
+	p := &Poller{
+		OnMessage: func(c *Conn, messageType int, data []byte) {
+			// Remove the connection while the worker dispatches from it.
+			select {
+			case dispatching <- struct{}{}:
+				time.Sleep(50 * time.Millisecond)
+			default:
+			}
+		},
+		OnClose: func(c *Conn, err error) {
+			closeErrs <- err
+		},
+	}
+	defer p.Close()
+
+	upgrader := Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		if err := p.Add(ws); err != nil {
+			t.Errorf("Add: %v", err)
+			return
+		}
+		added <- ws
+	}))
+	defer s.Close()
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+	sc := <-added
+
+	if err := ws.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	<-dispatching
+	if err := p.Remove(sc); err != nil {
+		t.Errorf("Remove: %v", err)
+	}
+	select {
+	case err := <-closeErrs:
+		if err != nil {
+			t.Errorf("OnClose error = %v, want nil after Remove", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
+
+func TestPollerPartialMessage(t *testing.T) {
+	closeErrs := make(chan error, 2)
+	p := &Poller{
+		Workers:     1,
+		ReadTimeout: 500 * time.Millisecond,
+		OnMessage: func(c *Conn, messageType int, data []byte) {
+			_ = c.WriteMessage(messageType, data)
+		},
+		OnClose: func(c *Conn, err error) {
+			closeErrs <- err
+		},
+	}
+	defer p.Close()
+
+	s := newPollerServer(t, p)
+	defer s.Close()
+
+	slow, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer slow.Close()
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	// A masked text frame with a zero key, sent in two parts.
+	frame := append([]byte{finalBit | TextMessage, maskBit | 5, 0, 0, 0, 0}, "hello"...)
+	if _, err := slow.UnderlyingConn().Write(frame[:4]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The only worker does not wait for the rest of the frame.
+	start := time.Now()
+	sendRecvMessage(t, ws, "not blocked")
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Errorf("message of another connection took %v", d)
+	}
+
+	if _, err := slow.UnderlyingConn().Write(frame[4:]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_ = slow.SetReadDeadline(time.Now().Add(time.Second))
+	if _, p, err := slow.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Fatalf("ReadMessage = %q, %v; want hello", p, err)
+	}
+
+	// A message that does not complete within ReadTimeout drops the connection.
+	if _, err := slow.UnderlyingConn().Write(frame[:4]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	select {
+	case err := <-closeErrs:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("OnClose err = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose was not called")
+	}
+}
+
+func TestPollerRateLimitDelay(t *testing.T) {
+	p := &Poller{
+		Workers: 1,
+		OnMessage: func(c *Conn, messageType int, data []byte) {
+			_ = c.WriteMessage(messageType, data)
+		},
+	}
+	defer p.Close()
+
+	upgrader := Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.SetRateLimit(&RateLimit{MessagesPerSecond: 0.1, MessageBurst: 1, Policy: RateLimitDelay})
+		_ = p.Serve(ws)
+		ws.Close()
+	}))
+	defer s.Close()
+
+	ws, _, err := DefaultDialer.Dial(makeWsProto(s.URL), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	// The messages over the limit are dropped instead of holding the worker
+	// for ten seconds.
+	for _, message := range []string{"one", "two", "three"} {
+		if err := ws.WriteMessage(TextMessage, []byte(message)); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, p, err := ws.ReadMessage(); err != nil || string(p) != "one" {
+		t.Fatalf("ReadMessage = %q, %v; want one", p, err)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := ws.ReadMessage(); err == nil {
+		t.Errorf("message %q over the limit was not dropped", p)
+	}
+}
+
+func TestMessageBoundary(t *testing.T) {
+	text := append([]byte{finalBit | TextMessage, maskBit | 2, 0, 0, 0, 0}, "hi"...)
+	first := append([]byte{TextMessage, maskBit | 2, 0, 0, 0, 0}, "hi"...)
+	last := append([]byte{finalBit | continuationFrame, maskBit | 2, 0, 0, 0, 0}, "hi"...)
+	ping := []byte{finalBit | PingMessage, maskBit, 0, 0, 0, 0}
+	long := append([]byte{finalBit | BinaryMessage, maskBit | 126, 0, 200, 0, 0, 0, 0}, make([]byte, 200)...)
+
+	join := func(frames ...[]byte) []byte { return bytes.Join(frames, nil) }
+	for _, tt := range []struct {
+		name string
+		p    []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"message", text, len(text)},
+		{"partial header", text[:1], 0},
+		{"partial payload", text[:7], 0},
+		{"message and partial", join(text, text[:3]), len(text)},
+		{"fragments", join(first, last), len(first) + len(last)},
+		{"first fragment", first, 0},
+		{"ping between fragments", join(first, ping), 0},
+		{"ping", ping, len(ping)},
+		{"extended length", long, len(long)},
+		{"partial extended length", long[:100], 0},
+	} {
+		if got := messageBoundary(tt.p); got != tt.want {
+			t.Errorf("%s: messageBoundary = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
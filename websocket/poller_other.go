@@ -0,0 +1,29 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package websocket
+
+// pollerState is empty on platforms without netpoll support.
+type pollerState struct{}
+
+// Start returns ErrPollerUnsupported.
+func (p *Poller) Start() error {
+	return ErrPollerUnsupported
+}
+
+func (p *Poller) add(c *Conn) (*polledConn, error) {
+	return nil, ErrPollerUnsupported
+}
+
+// Remove returns ErrPollerUnsupported.
+func (p *Poller) Remove(c *Conn) error {
+	return ErrPollerUnsupported
+}
+
+// Close is a no-op.
+func (p *Poller) Close() error {
+	return nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrRateLimited is returned when reading a message that exceeds the rate
+// limit of a connection using the RateLimitClose policy.
+var ErrRateLimited = errors.New("websocket: rate limit exceeded")
+
+// RateLimitPolicy specifies how a connection handles inbound messages that
+// exceed its rate limit.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDelay delays reading until the limit allows the message.
+	// Connections owned by a Poller drop the message instead.
+	RateLimitDelay RateLimitPolicy = iota
+
+	// RateLimitDrop discards messages that exceed the limit. Dropped messages
+	// are not returned to the application.
+	RateLimitDrop
+
+	// RateLimitClose sends a close message with ClosePolicyViolation to the
+	// peer and fails the read with ErrRateLimited.
+	RateLimitClose
+)
+
+// RateLimit specifies token bucket limits for inbound data messages. A zero
+// rate disables the corresponding limit.
+type RateLimit struct {
+	// MessagesPerSecond is the sustained number of messages allowed per
+	// second.
+	MessagesPerSecond float64
+
+	// MessageBurst is the number of messages allowed in a burst. If zero,
+	// one second worth of messages is allowed.
+	MessageBurst int
+
+	// BytesPerSecond is the sustained number of payload bytes allowed per
+	// second. Bytes are counted per frame before decompression.
+	BytesPerSecond float64
+
+	// ByteBurst is the number of payload bytes allowed in a burst. If zero,
+	// one second worth of bytes is allowed.
+	ByteBurst int
+
+	// Policy specifies how messages over the limit are handled.
+	Policy RateLimitPolicy
+}
+
+// rateLimiter enforces a RateLimit on the read side of a connection.
+type rateLimiter struct {
+	policy   RateLimitPolicy
+	messages *tokenBucket
+	bytes    *tokenBucket
+	dropped  int64
+}
+
+// tokenBucket is a token bucket that allows the balance to go negative. A
+// negative balance is paid back before further tokens are granted.
+type tokenBucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // capacity of the bucket
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// allowed reports whether n tokens can be taken now. A full bucket allows
+// amounts larger than the burst so that oversized messages are not rejected
+// forever.
+func (b *tokenBucket) allowed(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= n || b.tokens >= b.burst
+}
+
+// take removes n tokens and returns the time until the balance is no longer
+// negative.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// TokenBucket is the token bucket of the rate limits, for limits outside a
+// connection such as login attempts. A TokenBucket is not safe for concurrent
+// use.
+type TokenBucket struct {
+	b *tokenBucket
+}
+
+// NewTokenBucket returns a full bucket that refills at rate tokens per second
+// up to burst tokens. If burst is zero, one second worth of tokens is allowed.
+// NewTokenBucket returns nil if rate is not positive.
+func NewTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	b := newTokenBucket(rate, burst, now)
+	if b == nil {
+		return nil
+	}
+	return &TokenBucket{b: b}
+}
+
+// Take takes one token if the bucket has one and returns zero. Otherwise it
+// takes nothing and returns the time until a token is available.
+func (t *TokenBucket) Take(now time.Time) time.Duration {
+	if wait := t.Wait(now); wait > 0 {
+		return wait
+	}
+	t.b.tokens--
+	return 0
+}
+
+// Wait returns the time until a token is available, zero if the bucket has
+// one, without taking it.
+func (t *TokenBucket) Wait(now time.Time) time.Duration {
+	t.b.refill(now)
+	if t.b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - t.b.tokens) / t.b.rate * float64(time.Second))
+}
+
+// Full reports whether the bucket is full, that is whether it could be
+// replaced by a new bucket.
+func (t *TokenBucket) Full(now time.Time) bool {
+	t.b.refill(now)
+	return t.b.tokens >= t.b.burst
+}
+
+// SetRateLimit sets the rate limit for data messages read from the peer. A nil
+// limit removes the rate limit. SetRateLimit must be called from the goroutine
+// that reads from the connection.
+func (c *Conn) SetRateLimit(limit *RateLimit) {
+	if c == nil {
+		return
+	}
+	if limit == nil {
+		c.rateLimiter = nil
+		return
+	}
+	now := time.Now()
+	c.rateLimiter = &rateLimiter{
+		policy:   limit.Policy,
+		messages: newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst, now),
+		bytes:    newTokenBucket(limit.BytesPerSecond, limit.ByteBurst, now),
+	}
+}
+
+// DroppedMessages returns the number of messages discarded by the
+// RateLimitDrop policy.
+func (c *Conn) DroppedMessages() int64 {
+	if c == nil || c.rateLimiter == nil {
+		return 0
+	}
+	return c.rateLimiter.dropped
+}
+
+// enforceRateLimit charges the data frame that was just read against the rate
+// limit and applies the limit policy.
+func (c *Conn) enforceRateLimit(frameType int) error {
+	l := c.rateLimiter
+	if l == nil || c.readDrop {
+		return nil
+	}
+
+	now := time.Now()
+	messages := 0.0
+	if frameType != continuationFrame {
+		messages = 1
+	}
+	size := float64(c.readRemaining)
+
+	policy := l.policy
+	if policy == RateLimitDelay && c.polled {
+		// Poller workers serve many connections and must not sleep.
+		policy = RateLimitDrop
+	}
+	switch policy {
+	case RateLimitDrop:
+		// Only a message that has not been started can be dropped. Later
+		// frames of an accepted message are charged to the buckets.
+		if frameType != continuationFrame &&
+			(!l.messages.allowed(now, messages) || !l.bytes.allowed(now, size)) {
+			c.readDrop = true
+			l.dropped++
+			return nil
+		}
+		l.messages.take(now, messages)
+		l.bytes.take(now, size)
+	case RateLimitClose:
+		if !l.messages.allowed(now, messages) || !l.bytes.allowed(now, size) {
+			// Make a best effort to send a close message describing the problem.
+			_ = c.WriteCloseReason(ClosePolicyViolation, CloseReason{Reason: "rate_limited", Message: "rate limit exceeded"}, time.Now().Add(writeWait))
+			return ErrRateLimited
+		}
+		l.messages.take(now, messages)
+		l.bytes.take(now, size)
+	default:
+		wait := l.messages.take(now, messages)
+		if d := l.bytes.take(now, size); d > wait {
+			wait = d
+		}
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return nil
+}
+
+// discardDroppedMessage consumes the rest of a message dropped by the rate
+// limiter.
+func (c *Conn) discardDroppedMessage() error {
+	c.messageReader = &messageReader{c}
+	_, err := io.Copy(io.Discard, c.messageReader)
+	c.messageReader = nil
+	c.readDrop = false
+	c.readLength = 0
+	return err
+}
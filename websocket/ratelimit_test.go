@@ -0,0 +1,146 @@
+// Copyright 2013 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// newRateLimitConns returns a client connection that writes to a server
+// connection with the given rate limit.
+func newRateLimitConns(limit *RateLimit) (wc, rc *Conn, closeBuf *bytes.Buffer) {
+	var b1, b2 bytes.Buffer
+	wc = newConn(&fakeNetConn{Writer: &b1}, false, 1024, 1024, nil, nil, nil, nil)
+	rc = newTestConn(&b1, &b2, true)
+	rc.SetRateLimit(limit)
+	return wc, rc, &b2
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	wc, rc, _ := newRateLimitConns(&RateLimit{MessagesPerSecond: 0.001, MessageBurst: 2, Policy: RateLimitDrop})
+
+	for _, m := range []string{"one", "two", "three", "four"} {
+		if err := wc.WriteMessage(TextMessage, []byte(m)); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	// A fragmented message is dropped as a whole.
+	w, _ := wc.NextWriter(TextMessage)
+	_, _ = w.Write([]byte("fragmented"))
+	_ = wc.WriteControl(PingMessage, nil, time.Now().Add(time.Second))
+	_, _ = w.Write([]byte(" message"))
+	w.Close()
+
+	for _, want := range []string{"one", "two"} {
+		_, p, err := rc.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if string(p) != want {
+			t.Fatalf("message=%q, want %q", p, want)
+		}
+	}
+	if _, _, err := rc.ReadMessage(); err != errUnexpectedEOF {
+		t.Fatalf("ReadMessage after dropped messages = %v, want %v", err, errUnexpectedEOF)
+	}
+	if n := rc.DroppedMessages(); n != 3 {
+		t.Fatalf("DroppedMessages() = %d, want 3", n)
+	}
+}
+
+func TestRateLimitClose(t *testing.T) {
+	wc, rc, closeBuf := newRateLimitConns(&RateLimit{BytesPerSecond: 0.001, ByteBurst: 8, Policy: RateLimitClose})
+
+	_ = wc.WriteMessage(BinaryMessage, []byte("12345678"))
+	_ = wc.WriteMessage(BinaryMessage, []byte("9"))
+
+	if _, _, err := rc.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if _, _, err := rc.ReadMessage(); err != ErrRateLimited {
+		t.Fatalf("ReadMessage = %v, want %v", err, ErrRateLimited)
+	}
+
+	cc := newTestConn(closeBuf, io.Discard, false)
+	_, _, err := cc.ReadMessage()
+	if !IsCloseError(err, ClosePolicyViolation) {
+		t.Fatalf("peer received %v, want close %d", err, ClosePolicyViolation)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	const rate = 50
+	wc, rc, _ := newRateLimitConns(&RateLimit{MessagesPerSecond: rate, MessageBurst: 1, Policy: RateLimitDelay})
+
+	const n = 6
+	for i := 0; i < n; i++ {
+		_ = wc.WriteMessage(TextMessage, []byte("message"))
+	}
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, _, err := rc.ReadMessage(); err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+	}
+	// The first message uses the burst, the others wait for the bucket.
+	if d, want := time.Since(start), (n-1)*time.Second/rate; d < want*9/10 {
+		t.Fatalf("read %d messages in %v, want at least %v", n, d, want)
+	}
+	if n := rc.DroppedMessages(); n != 0 {
+		t.Fatalf("DroppedMessages() = %d, want 0", n)
+	}
+}
+
+func TestRateLimitOversizedMessage(t *testing.T) {
+	wc, rc, _ := newRateLimitConns(&RateLimit{BytesPerSecond: 1024, ByteBurst: 4, Policy: RateLimitDrop})
+
+	// A message larger than the burst is accepted when the bucket is full.
+	_ = wc.WriteMessage(BinaryMessage, make([]byte, 16))
+	_ = wc.WriteMessage(BinaryMessage, []byte("x"))
+
+	_, p, err := rc.ReadMessage()
+	if err != nil || len(p) != 16 {
+		t.Fatalf("ReadMessage = %d bytes, %v; want 16 bytes", len(p), err)
+	}
+	// The debt from the oversized message drops the next message.
+	if _, _, err := rc.ReadMessage(); err != errUnexpectedEOF {
+		t.Fatalf("ReadMessage = %v, want %v", err, errUnexpectedEOF)
+	}
+	if n := rc.DroppedMessages(); n != 1 {
+		t.Fatalf("DroppedMessages() = %d, want 1", n)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := NewTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if d := b.Take(now); d != 0 {
+			t.Fatalf("Take %d = %v, want 0", i, d)
+		}
+	}
+	if d := b.Wait(now); d != 500*time.Millisecond {
+		t.Fatalf("Wait on an empty bucket = %v, want 500ms", d)
+	}
+	if d := b.Take(now); d != 500*time.Millisecond {
+		t.Fatalf("Take from an empty bucket = %v, want 500ms", d)
+	}
+	if d := b.Wait(now.Add(500 * time.Millisecond)); d != 0 {
+		t.Fatalf("Wait after refill = %v, want 0", d)
+	}
+	if d := b.Take(now.Add(500 * time.Millisecond)); d != 0 {
+		t.Fatalf("Take after refill = %v, want 0", d)
+	}
+	if b.Full(now.Add(time.Second)) || !b.Full(now.Add(2*time.Second)) {
+		t.Fatalf("Full does not follow the refill")
+	}
+	if NewTokenBucket(0, 1, now) != nil {
+		t.Fatalf("NewTokenBucket with zero rate is not nil")
+	}
+}
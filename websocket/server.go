@@ -36,6 +36,17 @@ type Upgrader struct {
 	// or received.
 	ReadBufferSize, WriteBufferSize int
 
+	// ReadBufferPool is a pool of buffers for read operations. If the value
+	// is set, then a read buffer is taken from the pool when the first byte of
+	// a frame arrives and returned to the pool when the frame has been read,
+	// so idle connections do not hold a read buffer. If the value is not set,
+	// then read buffers are allocated to the connection for the lifetime of
+	// the connection.
+	//
+	// Applications should use a single pool for each unique value of
+	// ReadBufferSize.
+	ReadBufferPool BufferPool
+
 	// WriteBufferPool is a pool of buffers for write operations. If the value
 	// is not set, then write buffers are allocated to the connection for the
 	// lifetime of the connection.
@@ -73,6 +84,12 @@ type Upgrader struct {
 	// guarantee that compression will be supported. Currently only "no context
 	// takeover" modes are supported.
 	EnableCompression bool
+
+	// CompressionDictionaries specifies the preset dictionaries the server
+	// accepts for the x-deflate-dictionary extension when EnableCompression is
+	// true. A client offering one of the dictionaries gets the extension
+	// instead of permessage-deflate.
+	CompressionDictionaries []*CompressionDictionary
 }
 
 func (u *Upgrader) returnError(w http.ResponseWriter, r *http.Request, status int, reason string) (*Conn, error) {
@@ -115,25 +132,31 @@ func (u *Upgrader) selectSubprotocol(r *http.Request, responseHeader http.Header
 	return ""
 }
 
-// negotiateCompression checks if compression is supported and enabled.
-func (u *Upgrader) negotiateCompression(r *http.Request) bool {
+// negotiateCompression checks if compression is supported and enabled. The
+// returned dictionary is not nil when the x-deflate-dictionary extension was
+// negotiated.
+func (u *Upgrader) negotiateCompression(r *http.Request) (bool, *CompressionDictionary) {
 	if !u.EnableCompression {
-		return false
+		return false, nil
 	}
 
-	for _, ext := range parseExtensions(r.Header) {
+	extensions := parseExtensions(r.Header)
+	if dict := negotiateDictionary(u.CompressionDictionaries, extensions); dict != nil {
+		return true, dict
+	}
+	for _, ext := range extensions {
 		if ext[""] != "permessage-deflate" {
 			continue
 		}
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // setupBufferedReader sets up the buffered reader for the connection.
 func (u *Upgrader) setupBufferedReader(netConn net.Conn, brw *bufio.ReadWriter) (net.Conn, *bufio.Reader) {
 	var br *bufio.Reader
-	if u.ReadBufferSize == 0 && brw.Reader.Size() > 256 {
+	if u.ReadBufferPool == nil && u.ReadBufferSize == 0 && brw.Reader.Size() > 256 {
 		// Use hijacked buffered reader as the connection reader.
 		br = brw.Reader
 	} else if brw.Reader.Buffered() > 0 {
@@ -157,20 +180,19 @@ func (u *Upgrader) setupWriteBuffer(buf []byte) []byte {
 }
 
 // createWebSocketConnection creates a new WebSocket connection.
-func (u *Upgrader) createWebSocketConnection(netConn net.Conn, subprotocol string, compress bool, br *bufio.Reader, writeBuf []byte) *Conn {
-	c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.WriteBufferPool, br, writeBuf)
+func (u *Upgrader) createWebSocketConnection(netConn net.Conn, subprotocol string, compress bool, dict *CompressionDictionary, br *bufio.Reader, writeBuf []byte) *Conn {
+	c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.ReadBufferPool, u.WriteBufferPool, br, writeBuf)
 	c.subprotocol = subprotocol
 
 	if compress {
-		c.newCompressionWriter = compressNoContextTakeover
-		c.newDecompressionReader = decompressNoContextTakeover
+		c.setupCompression(dict)
 	}
 
 	return c
 }
 
 // generateUpgradeResponse generates the HTTP response for the WebSocket upgrade.
-func generateUpgradeResponse(c *Conn, challengeKey string, compress bool, responseHeader http.Header, buf []byte) []byte {
+func generateUpgradeResponse(c *Conn, challengeKey string, compress bool, dict *CompressionDictionary, responseHeader http.Header, buf []byte) []byte {
 	// Use larger of hijacked buffer and connection write buffer for header.
 	p := buf
 	if len(c.writeBuf) > len(p) {
@@ -186,7 +208,11 @@ func generateUpgradeResponse(c *Conn, challengeKey string, compress bool, respon
 		p = append(p, c.subprotocol...)
 		p = append(p, "\r\n"...)
 	}
-	if compress {
+	if compress && dict != nil {
+		p = append(p, "Sec-WebSocket-Extensions: "...)
+		p = append(p, dict.extensionHeader()...)
+		p = append(p, "\r\n"...)
+	} else if compress {
 		p = append(p, "Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover; client_no_context_takeover\r\n"...)
 	}
 	for k, vs := range responseHeader {
@@ -280,7 +306,7 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 	subprotocol := u.selectSubprotocol(r, responseHeader)
 
 	// Negotiate compression
-	compress := u.negotiateCompression(r)
+	compress, dict := u.negotiateCompression(r)
 
 	// Hijack the connection
 	netConn, brw, err := HijackResponse(r, w)
@@ -309,10 +335,10 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request, responseHeade
 	writeBuf := u.setupWriteBuffer(buf)
 
 	// Create WebSocket connection
-	c := u.createWebSocketConnection(netConn, subprotocol, compress, br, writeBuf)
+	c := u.createWebSocketConnection(netConn, subprotocol, compress, dict, br, writeBuf)
 
 	// Generate upgrade response
-	p := generateUpgradeResponse(c, challengeKey, compress, responseHeader, buf)
+	p := generateUpgradeResponse(c, challengeKey, compress, dict, responseHeader, buf)
 
 	// Set connection deadline
 	if err := u.setConnectionDeadline(netConn); err != nil {
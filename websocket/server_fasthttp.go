@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/gflydev/core/utils"
 	"net"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
@@ -40,6 +41,17 @@ type FastHTTPUpgrader struct {
 	// or received.
 	ReadBufferSize, WriteBufferSize int
 
+	// ReadBufferPool is a pool of buffers for read operations. If the value
+	// is set, then a read buffer is taken from the pool when the first byte of
+	// a frame arrives and returned to the pool when the frame has been read,
+	// so idle connections do not hold a read buffer. If the value is not set,
+	// then read buffers are allocated to the connection for the lifetime of
+	// the connection.
+	//
+	// Applications should use a single pool for each unique value of
+	// ReadBufferSize.
+	ReadBufferPool BufferPool
+
 	// WriteBufferPool is a pool of buffers for write operations. If the value
 	// is not set, then write buffers are allocated to the connection for the
 	// lifetime of the connection.
@@ -77,6 +89,12 @@ type FastHTTPUpgrader struct {
 	// guarantee that compression will be supported. Currently only "no context
 	// takeover" modes are supported.
 	EnableCompression bool
+
+	// CompressionDictionaries specifies the preset dictionaries the server
+	// accepts for the x-deflate-dictionary extension when EnableCompression is
+	// true. A client offering one of the dictionaries gets the extension
+	// instead of permessage-deflate.
+	CompressionDictionaries []*CompressionDictionary
 }
 
 func (u *FastHTTPUpgrader) responseError(ctx *fasthttp.RequestCtx, status int, reason string) error {
@@ -109,19 +127,29 @@ func (u *FastHTTPUpgrader) selectSubprotocol(ctx *fasthttp.RequestCtx) []byte {
 	return nil
 }
 
-func (u *FastHTTPUpgrader) isCompressionEnable(ctx *fasthttp.RequestCtx) bool {
-	extensions := parseDataHeader(ctx.Request.Header.Peek("Sec-WebSocket-Extensions"))
+func (u *FastHTTPUpgrader) isCompressionEnable(ctx *fasthttp.RequestCtx) (bool, *CompressionDictionary) {
+	if !u.EnableCompression {
+		return false, nil
+	}
+
+	header := ctx.Request.Header.Peek("Sec-WebSocket-Extensions")
+
+	// Negotiate the dictionary extension
+	if len(u.CompressionDictionaries) > 0 {
+		h := http.Header{"Sec-Websocket-Extensions": {string(header)}}
+		if dict := negotiateDictionary(u.CompressionDictionaries, parseExtensions(h)); dict != nil {
+			return true, dict
+		}
+	}
 
 	// Negotiate PMCE
-	if u.EnableCompression {
-		for _, ext := range extensions {
-			if bytes.HasPrefix(ext, strPermessageDeflate) {
-				return true
-			}
+	for _, ext := range parseDataHeader(header) {
+		if bytes.HasPrefix(ext, strPermessageDeflate) {
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
 
 // Upgrade upgrades the HTTP server connection to the WebSocket protocol.
@@ -167,13 +195,15 @@ func (u *FastHTTPUpgrader) Upgrade(ctx *fasthttp.RequestCtx, handler FastHTTPHan
 	}
 
 	subprotocol := u.selectSubprotocol(ctx)
-	compress := u.isCompressionEnable(ctx)
+	compress, dict := u.isCompressionEnable(ctx)
 
 	ctx.SetStatusCode(fasthttp.StatusSwitchingProtocols)
 	ctx.Response.Header.Set("Upgrade", "websocket")
 	ctx.Response.Header.Set("Connection", "Upgrade")
 	ctx.Response.Header.Set("Sec-WebSocket-Accept", computeAcceptKeyBytes(challengeKey))
-	if compress {
+	if compress && dict != nil {
+		ctx.Response.Header.Set("Sec-WebSocket-Extensions", dict.extensionHeader())
+	} else if compress {
 		ctx.Response.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate; server_no_context_takeover; client_no_context_takeover")
 	}
 	if subprotocol != nil {
@@ -184,14 +214,13 @@ func (u *FastHTTPUpgrader) Upgrade(ctx *fasthttp.RequestCtx, handler FastHTTPHan
 		// var br *bufio.Reader  // Always nil
 		writeBuf := poolWriteBuffer.Get().(*writePoolData)
 
-		c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.WriteBufferPool, nil, writeBuf.buf)
+		c := newConn(netConn, true, u.ReadBufferSize, u.WriteBufferSize, u.ReadBufferPool, u.WriteBufferPool, nil, writeBuf.buf)
 		if subprotocol != nil {
 			c.subprotocol = utils.UnsafeStr(subprotocol)
 		}
 
 		if compress {
-			c.newCompressionWriter = compressNoContextTakeover
-			c.newDecompressionReader = decompressNoContextTakeover
+			c.setupCompression(dict)
 		}
 
 		// Clear deadlines set by HTTP server.
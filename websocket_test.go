@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"ws/data"
+	"ws/websocket"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Users of the tests, kept in memory so that the tests do not write WS_USER_FILE.
+const testUsers = "admin:admin123:admin,user1:password1,user2:password2"
+
+func TestMain(m *testing.M) {
+	GlobalUserStore = NewInMemoryUserStore()
+	seedUsers(GlobalUserStore, testUsers)
+	// The tests connect guests unless they test authentication (see TestAuthRequired).
+	authRequired = false
+	os.Exit(m.Run())
+}
+
+// startTestServer serves the websocket and login endpoints on a local port and returns its
+// address.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fasthttp.Server{Handler: serveTLSWS}
+	go s.Serve(ln)
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return ln.Addr().String()
+}
+
+// dialTestServer opens a websocket to a test server with the Origin of the app.
+func dialTestServer(t *testing.T, url string, header http.Header, protocols ...string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Origin", os.Getenv("APP_URL"))
+	d := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: 5 * time.Second}
+	c, resp, err := d.Dial(url, header)
+	if err == nil {
+		t.Cleanup(func() { c.Close() })
+	}
+	return c, resp, err
+}
+
+func TestManagerGetOrCreateHub(t *testing.T) {
+	m := NewManager(NewInMemoryChannelStore())
+
+	hubs := make([]*Hub, 50)
+	var wg sync.WaitGroup
+	for i := range hubs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hubs[i] = m.GetOrCreateHub("room")
+		}()
+	}
+	wg.Wait()
+
+	for _, hub := range hubs {
+		if hub != hubs[0] {
+			t.Fatalf("GetOrCreateHub returned different hubs for the same channel")
+		}
+	}
+	if m.GetHub("room") != hubs[0] || hubs[0].persistent {
+		t.Errorf("pool holds %p (persistent=%v), want the unsaved hub %p", m.GetHub("room"), hubs[0].persistent, hubs[0])
+	}
+	m.DeleteHub("room")
+}
+
+func TestManagerReapIdleHubs(t *testing.T) {
+	m := NewManager(NewInMemoryChannelStore())
+	client := newTestClient(nil, "alice", data.RoleUser)
+
+	hub := m.Join("room", client)
+	if n := m.reapIdleHubs(0); n != 0 {
+		t.Fatalf("reaped %d hubs with a client", n)
+	}
+	store, err := NewFileMessageStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	hub.messages = newMessageLog(store, "room")
+	hub.messages.add(client.prepareMessage(hub, data.Message{ID: "m1"}))
+
+	hub.leave(client)
+	if n := m.reapIdleHubs(time.Hour); n != 0 {
+		t.Fatalf("reaped %d hubs before the idle timeout", n)
+	}
+	if n := m.reapIdleHubs(0); n != 1 {
+		t.Fatalf("reaped %d hubs, want 1", n)
+	}
+	select {
+	case <-hub.done:
+	case <-time.After(time.Second):
+		t.Fatal("reaped hub is still running")
+	}
+	if m.GetHub("room") != nil {
+		t.Errorf("reaped hub is still in the pool")
+	}
+	if len(store.files) != 0 || len(store.channels) != 0 {
+		t.Errorf("the messages of the reaped hub are still open")
+	}
+	hub.leave(client) // does not block on a stopped hub
+
+	// A channel cannot take over the running hub of an unsaved channel and its clients.
+	m.GetOrCreateHub("lobby")
+	if _, err := m.CreateChannel(data.Channel{ID: "lobby"}, 0); err != ErrChannelExists {
+		t.Errorf("CreateChannel over a running hub: %v, want %v", err, ErrChannelExists)
+	}
+	m.DeleteHub("lobby")
+
+	// Saved channels run persistent hubs, up to the quota of their owner.
+	if _, err := m.CreateChannel(data.Channel{ID: "team", OwnerID: "alice"}, 1); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	if _, err := m.CreateChannel(data.Channel{ID: "team"}, 0); err != ErrChannelExists {
+		t.Errorf("second CreateChannel: %v, want %v", err, ErrChannelExists)
+	}
+	if _, err := m.CreateChannel(data.Channel{ID: "other", OwnerID: "alice"}, 1); err != ErrChannelQuota {
+		t.Errorf("CreateChannel over the quota: %v, want %v", err, ErrChannelQuota)
+	}
+	if n := m.reapIdleHubs(0); n != 0 {
+		t.Errorf("reaped %d persistent hubs", n)
+	}
+	m.DeleteHub("team")
+}
+
+func TestPasswordOverWebsocketRefused(t *testing.T) {
+	c, _, err := dialTestServer(t, "ws://"+startTestServer(t)+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	// Passwords are refused, even valid ones: clients log in with POST /auth/login.
+	err = c.WriteJSON(data.ActionMessage{Action: data.Action{
+		Type: data.ActionUserAuth,
+		Data: data.UserAuthData{Username: "user1", Password: "password1"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, p, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("no error response: %v", err)
+		}
+		for _, line := range bytes.Split(p, newline) {
+			var errData data.ErrorData
+			switch decodeAction(t, line, &errData) {
+			case data.ActionUserAuth:
+				t.Fatalf("password authenticated the connection: %s", line)
+			case data.ActionError:
+				if errData.Action != data.ActionUserAuth || errData.Code != errCodeInvalidRequest {
+					t.Errorf("error response = %+v", errData)
+				}
+				return
+			}
+		}
+	}
+}
+
+func TestAuthRequired(t *testing.T) {
+	defer func(required bool) { authRequired = required }(authRequired)
+	authRequired = true
+
+	// Guests are rejected; a session token authenticates the upgrade.
+	var ctx fasthttp.RequestCtx
+	if _, _, ok := upgradeUser(&ctx); ok {
+		t.Error("guest upgrade allowed")
+	}
+	token, _, err := tokens.Issue("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Request.Header.Set("Sec-WebSocket-Protocol", bearerProtocol+", "+token)
+	if username, _, ok := upgradeUser(&ctx); !ok || username != "user1" {
+		t.Errorf("upgrade with a token = %q, %v", username, ok)
+	}
+}